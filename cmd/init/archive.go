@@ -0,0 +1,445 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	// siteDir is the web root the files of an archive are extracted to
+	siteDir = "site"
+
+	// extractDir holds the files while they are extracted, it becomes siteDir once the archive is complete
+	extractDir = "site.tmp"
+
+	notFoundPage = "404.html"
+
+	defaultMaxArchiveFiles = 10000
+	defaultMaxArchiveSize  = 512 << 20 // 512 MB once extracted
+)
+
+var (
+	errUnsupportedArchive = errors.New("unsupported archive, expected a .tar.gz or a .zip")
+	errUnsafeArchivePath  = errors.New("unsafe path in archive")
+	errArchiveTooLarge    = errors.New("archive too large")
+)
+
+// archiveLimits caps what an archive can extract, the sizes in the headers are not trusted
+type archiveLimits struct {
+	MaxFiles int
+	MaxSize  int64
+}
+
+// archiveResult describes an extracted archive
+type archiveResult struct {
+	Files   int
+	Size    int64
+	Skipped []string
+}
+
+// extractArchive extracts the .tar.gz or .zip archive at archivePath into siteDir. Only directories
+// and regular files are extracted, links and devices are skipped. When the archive holds a single
+// directory, such as dist/, its content becomes the web root.
+func extractArchive(archivePath string, limits archiveLimits) (*archiveResult, error) {
+	if err := os.RemoveAll(extractDir); err != nil {
+		return nil, fmt.Errorf("failed to clean %s: %w", extractDir, err)
+	}
+	if err := os.RemoveAll(siteDir); err != nil {
+		return nil, fmt.Errorf("failed to clean %s: %w", siteDir, err)
+	}
+	if err := os.Mkdir(extractDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", extractDir, err)
+	}
+
+	root, err := os.OpenRoot(extractDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", extractDir, err)
+	}
+	defer root.Close()
+
+	x := &extractor{root: root, limits: limits, result: &archiveResult{}}
+
+	format, err := archiveFormat(archivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case "zip":
+		err = x.extractZip(archivePath)
+	default:
+		err = x.extractTarGz(archivePath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := promoteSiteRoot(); err != nil {
+		return nil, err
+	}
+
+	return x.result, nil
+}
+
+// archiveFormat tells the format of an archive from its first bytes, the URL may not have an extension
+func archiveFormat(archivePath string) (string, error) {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer file.Close()
+
+	head := make([]byte, 4)
+	n, _ := io.ReadFull(file, head)
+	head = head[:n]
+
+	switch {
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return "tar.gz", nil
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return "zip", nil
+	default:
+		return "", errUnsupportedArchive
+	}
+}
+
+// promoteSiteRoot moves the extracted files to siteDir, unwrapping the single directory of the archive
+func promoteSiteRoot() error {
+	entries, err := os.ReadDir(extractDir)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", extractDir, err)
+	}
+
+	if len(entries) == 1 && entries[0].IsDir() {
+		if err := os.Rename(filepath.Join(extractDir, entries[0].Name()), siteDir); err != nil {
+			return fmt.Errorf("failed to move the site root: %w", err)
+		}
+		return os.RemoveAll(extractDir)
+	}
+
+	if err := os.Rename(extractDir, siteDir); err != nil {
+		return fmt.Errorf("failed to move the site root: %w", err)
+	}
+	return nil
+}
+
+// extractor writes the entries of an archive under its root, os.Root refuses the paths that escape it
+type extractor struct {
+	root   *os.Root
+	limits archiveLimits
+	result *archiveResult
+}
+
+func (x *extractor) extractTarGz(archivePath string) error {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return fmt.Errorf("failed to read gzip: %w", err)
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar: %w", err)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = x.dir(header.Name)
+		case tar.TypeReg:
+			err = x.file(header.Name, tr)
+		case tar.TypeXGlobalHeader:
+			continue
+		default:
+			x.result.Skipped = append(x.result.Skipped, header.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (x *extractor) extractZip(archivePath string) error {
+	reader, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return fmt.Errorf("failed to read zip: %w", err)
+	}
+	defer reader.Close()
+
+	if len(reader.File) > x.limits.MaxFiles {
+		return fmt.Errorf("%w: %d entries, at most %d", errArchiveTooLarge, len(reader.File), x.limits.MaxFiles)
+	}
+
+	for _, f := range reader.File {
+		switch mode := f.Mode(); {
+		case mode.IsDir():
+			err = x.dir(f.Name)
+		case mode.IsRegular():
+			err = x.zipFile(f)
+		default:
+			x.result.Skipped = append(x.result.Skipped, f.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (x *extractor) zipFile(f *zip.File) error {
+	rc, err := f.Open()
+	if err != nil {
+		return fmt.Errorf("failed to open %s in zip: %w", f.Name, err)
+	}
+	defer rc.Close()
+
+	return x.file(f.Name, rc)
+}
+
+// entryPath checks the name of an entry and returns it relative to the root, "." for the root itself
+func entryPath(name string) (string, error) {
+	if !filepath.IsLocal(name) || strings.Contains(name, `\`) {
+		return "", fmt.Errorf("%w: %s", errUnsafeArchivePath, name)
+	}
+	return filepath.Clean(name), nil
+}
+
+func (x *extractor) count() error {
+	x.result.Files++
+	if x.result.Files > x.limits.MaxFiles {
+		return fmt.Errorf("%w: more than %d entries", errArchiveTooLarge, x.limits.MaxFiles)
+	}
+	return nil
+}
+
+func (x *extractor) dir(name string) error {
+	name, err := entryPath(name)
+	if err != nil {
+		return err
+	}
+	if err := x.count(); err != nil {
+		return err
+	}
+
+	return x.mkdirAll(name)
+}
+
+// mkdirAll creates the directory and its parents under the root
+func (x *extractor) mkdirAll(name string) error {
+	if name == "." {
+		return nil
+	}
+
+	current := ""
+	for _, part := range strings.Split(name, string(filepath.Separator)) {
+		current = filepath.Join(current, part)
+		if err := x.root.Mkdir(current, 0755); err != nil && !errors.Is(err, fs.ErrExist) {
+			return fmt.Errorf("failed to create directory %s: %w", current, err)
+		}
+	}
+
+	return nil
+}
+
+func (x *extractor) file(name string, r io.Reader) error {
+	name, err := entryPath(name)
+	if err != nil {
+		return err
+	}
+	if name == "." {
+		return fmt.Errorf("%w: %s", errUnsafeArchivePath, name)
+	}
+	if err := x.count(); err != nil {
+		return err
+	}
+
+	if err := x.mkdirAll(filepath.Dir(name)); err != nil {
+		return err
+	}
+
+	f, err := x.root.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", name, err)
+	}
+	defer f.Close()
+
+	remaining := x.limits.MaxSize - x.result.Size
+	n, err := io.CopyN(f, r, remaining+1)
+	x.result.Size += n
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to extract %s: %w", name, err)
+	}
+	if x.result.Size > x.limits.MaxSize {
+		return fmt.Errorf("%w: more than %d bytes once extracted", errArchiveTooLarge, x.limits.MaxSize)
+	}
+
+	return f.Close()
+}
+
+// siteOptions are the settings of the generated configuration of a site
+type siteOptions struct {
+	// NotFoundPage serves the 404.html page of the site for the missing paths
+	NotFoundPage bool
+
+	// SPA serves index.html for the unknown paths so that the client side routes work
+	SPA bool
+}
+
+// hashedAssetExtensions are the types of assets that bundlers name after a hash of their content
+const hashedAssetExtensions = `\.(?:js|mjs|css|map|json|wasm|woff2?|ttf|otf|eot|svg|png|jpe?g|gif|webp|avif|ico)$`
+
+// hashedAssetPattern matches the names of the assets built with a hash of their content, such as
+// main.3f9a2c1b.js or index-DiwrgT4a.css. The hash must hold a digit, jquery-compiled.js is not hashed.
+const hashedAssetPattern = `[.-](?=[A-Za-z0-9_]*[0-9])[A-Za-z0-9_]{8,}` + hashedAssetExtensions
+
+// hashedAssetRegexp is hashedAssetPattern for Go, which does not support lookaheads: the digit is checked apart
+var hashedAssetRegexp = regexp.MustCompile(`[.-]([A-Za-z0-9_]{8,})` + hashedAssetExtensions)
+
+const (
+	immutableCacheControl = "public, max-age=31536000, immutable"
+	noCacheControl        = "no-cache"
+)
+
+// isHashedAsset reports whether the path is an asset whose name changes with its content
+func isHashedAsset(urlPath string) bool {
+	matches := hashedAssetRegexp.FindStringSubmatch(strings.ToLower(path.Base(urlPath)))
+	return len(matches) > 1 && strings.ContainsAny(matches[1], "0123456789")
+}
+
+// generateSiteNginxConfig generates an nginx configuration serving every file of siteDir, directories
+// through their index file. A single page application gets index.html for the unknown paths, its hashed
+// assets are cached for a year and the rest is revalidated. Other sites get their 404.html page if any.
+func generateSiteNginxConfig(options siteOptions, outConfig io.Writer) error {
+	config := `server {
+    listen 80;
+    server_name localhost;
+
+    root /app/{{site}};
+    index index.html;
+{{error_page}}
+    # Serve every file of the site
+    location / {
+        try_files $uri $uri/ {{fallback}};
+        add_header X-Content-Type-Options nosniff;{{cache_control}}
+    }
+{{assets}}
+    error_log /var/log/nginx/error.log;
+    access_log /var/log/nginx/access.log;
+}`
+
+	errorPage := ""
+	if options.NotFoundPage && !options.SPA {
+		errorPage = "    error_page 404 /" + notFoundPage + ";\n"
+	}
+
+	fallback, cacheControl, assets := "=404", "", ""
+	if options.SPA {
+		// The HTML shell is revalidated so that a new deployment is picked up right away
+		fallback = "/index.html"
+		cacheControl = "\n        add_header Cache-Control \"" + noCacheControl + "\";"
+		assets = `
+    # Hashed assets change name with their content, a missing one is not a route of the application
+    location ~* "` + hashedAssetPattern + `" {
+        try_files $uri =404;
+        add_header X-Content-Type-Options nosniff;
+        add_header Cache-Control "` + immutableCacheControl + `";
+    }
+`
+	}
+
+	config = strings.NewReplacer(
+		"{{site}}", siteDir,
+		"{{error_page}}", errorPage,
+		"{{fallback}}", fallback,
+		"{{cache_control}}", cacheControl,
+		"{{assets}}", assets,
+	).Replace(config)
+	if _, err := outConfig.Write([]byte(config)); err != nil {
+		return fmt.Errorf("failed to write nginx config: %w", err)
+	}
+
+	return nil
+}
+
+// hasNotFoundPage reports whether the site has its own 404 page
+func hasNotFoundPage(dir string) bool {
+	info, err := os.Stat(filepath.Join(dir, notFoundPage))
+	return err == nil && info.Mode().IsRegular()
+}
+
+// newSiteHandler serves the files of the site like the generated nginx configuration does, for environments
+// without nginx. Directories without an index file are not listed.
+func newSiteHandler(dir string, spa bool) http.Handler {
+	files := http.FileServer(http.Dir(dir))
+	notFound := hasNotFoundPage(dir)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+
+		hashed := spa && isHashedAsset(r.URL.Path)
+		exists := siteFileExists(dir, r.URL.Path)
+
+		if spa {
+			if hashed {
+				w.Header().Set("Cache-Control", immutableCacheControl)
+			} else {
+				w.Header().Set("Cache-Control", noCacheControl)
+			}
+		}
+
+		switch {
+		case exists:
+			files.ServeHTTP(w, r)
+		case spa && !hashed:
+			http.ServeFile(w, r, filepath.Join(dir, "index.html"))
+		case notFound && !spa:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusNotFound)
+			if content, err := os.ReadFile(filepath.Join(dir, notFoundPage)); err == nil {
+				w.Write(content)
+			}
+		default:
+			w.Header().Del("Cache-Control")
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// siteFileExists reports whether the path leads to a file of the site or to a directory with an index.html
+func siteFileExists(dir, urlPath string) bool {
+	name := filepath.Join(dir, filepath.FromSlash(path.Clean("/"+urlPath)))
+
+	info, err := os.Stat(name)
+	if err != nil {
+		return false
+	}
+	if info.IsDir() {
+		info, err = os.Stat(filepath.Join(name, "index.html"))
+		return err == nil && info.Mode().IsRegular()
+	}
+
+	return info.Mode().IsRegular()
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// archiveEntry is a file of a test archive, a name ending with / is a directory
+type archiveEntry struct {
+	name    string
+	content string
+	link    string
+}
+
+func writeTarGz(t *testing.T, filename string, entries []archiveEntry) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Mode: 0644, Size: int64(len(entry.content)), Typeflag: tar.TypeReg}
+		switch {
+		case entry.link != "":
+			header.Typeflag, header.Linkname, header.Size = tar.TypeSymlink, entry.link, 0
+		case strings.HasSuffix(entry.name, "/"):
+			header.Typeflag, header.Mode = tar.TypeDir, 0755
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatalf("failed to write tar header: %v", err)
+		}
+		io.WriteString(tw, entry.content)
+	}
+	tw.Close()
+	gz.Close()
+
+	if err := os.WriteFile(filename, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("failed to write archive: %v", err)
+	}
+}
+
+func writeZip(t *testing.T, filename string, entries []archiveEntry) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, entry := range entries {
+		w, err := zw.Create(entry.name)
+		if err != nil {
+			t.Fatalf("failed to write zip entry: %v", err)
+		}
+		io.WriteString(w, entry.content)
+	}
+	zw.Close()
+
+	if err := os.WriteFile(filename, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("failed to write archive: %v", err)
+	}
+}
+
+// Table-driven test for extractArchive
+func TestExtractArchive(t *testing.T) {
+	limits := archiveLimits{MaxFiles: 10, MaxSize: 1024}
+
+	tests := []struct {
+		name          string
+		zip           bool
+		entries       []archiveEntry
+		expectedFiles map[string]string
+		expectedErr   error
+	}{
+		{
+			name:    "Tar.gz site",
+			entries: []archiveEntry{{name: "index.html", content: "<h1>home</h1>"}, {name: "css/"}, {name: "css/site.css", content: "body{}"}},
+			expectedFiles: map[string]string{
+				"index.html":   "<h1>home</h1>",
+				"css/site.css": "body{}",
+			},
+		},
+		{
+			name:    "Zip site",
+			zip:     true,
+			entries: []archiveEntry{{name: "index.html", content: "<h1>home</h1>"}, {name: "js/app.js", content: "run()"}},
+			expectedFiles: map[string]string{
+				"index.html": "<h1>home</h1>",
+				"js/app.js":  "run()",
+			},
+		},
+		{
+			name:    "Single directory becomes the root",
+			entries: []archiveEntry{{name: "dist/"}, {name: "dist/index.html", content: "home"}, {name: "dist/404.html", content: "missing"}},
+			expectedFiles: map[string]string{
+				"index.html": "home",
+				"404.html":   "missing",
+			},
+		},
+		{
+			name:          "Symlinks are skipped",
+			entries:       []archiveEntry{{name: "index.html", content: "home"}, {name: "passwd", link: "/etc/passwd"}},
+			expectedFiles: map[string]string{"index.html": "home"},
+		},
+		{
+			name:        "Parent directory",
+			entries:     []archiveEntry{{name: "../evil.sh", content: "rm -rf /"}},
+			expectedErr: errUnsafeArchivePath,
+		},
+		{
+			name:        "Parent directory in zip",
+			zip:         true,
+			entries:     []archiveEntry{{name: "site/../../evil.sh", content: "rm -rf /"}},
+			expectedErr: errUnsafeArchivePath,
+		},
+		{
+			name:        "Absolute path",
+			entries:     []archiveEntry{{name: "/etc/cron.d/evil", content: "* * * * * root evil"}},
+			expectedErr: errUnsafeArchivePath,
+		},
+		{
+			name:        "Too many files",
+			entries:     []archiveEntry{{name: "1"}, {name: "2"}, {name: "3"}, {name: "4"}, {name: "5"}, {name: "6"}, {name: "7"}, {name: "8"}, {name: "9"}, {name: "10"}, {name: "11"}},
+			expectedErr: errArchiveTooLarge,
+		},
+		{
+			name:        "Too large once extracted",
+			zip:         true,
+			entries:     []archiveEntry{{name: "big.txt", content: strings.Repeat("a", 2048)}},
+			expectedErr: errArchiveTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+
+			if tt.zip {
+				writeZip(t, fileOutput, tt.entries)
+			} else {
+				writeTarGz(t, fileOutput, tt.entries)
+			}
+
+			_, err := extractArchive(fileOutput, limits)
+			if tt.expectedErr != nil {
+				if !errors.Is(err, tt.expectedErr) {
+					t.Fatalf("expected %v, got %v", tt.expectedErr, err)
+				}
+				if _, err := os.Stat(filepath.Join("..", "evil.sh")); err == nil {
+					t.Fatal("expected nothing written outside of the site")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			for name, content := range tt.expectedFiles {
+				data, err := os.ReadFile(filepath.Join(siteDir, name))
+				if err != nil {
+					t.Fatalf("expected %s in the site: %v", name, err)
+				}
+				if string(data) != content {
+					t.Errorf("unexpected content of %s: got %q, want %q", name, string(data), content)
+				}
+			}
+			if _, err := os.Lstat(filepath.Join(siteDir, "passwd")); err == nil {
+				t.Error("expected the symlink to be skipped")
+			}
+		})
+	}
+}
+
+func TestExtractArchiveUnsupported(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	if err := os.WriteFile(fileOutput, []byte("<html></html>"), 0644); err != nil {
+		t.Fatalf("failed to write output: %v", err)
+	}
+
+	if _, err := extractArchive(fileOutput, archiveLimits{MaxFiles: 10, MaxSize: 1024}); !errors.Is(err, errUnsupportedArchive) {
+		t.Fatalf("expected %v, got %v", errUnsupportedArchive, err)
+	}
+}
+
+// Table-driven test for generateSiteNginxConfig
+func TestGenerateSiteNginxConfig(t *testing.T) {
+	tests := []struct {
+		name          string
+		options       siteOptions
+		expectedSub   string
+		unexpectedSub string
+	}{
+		{name: "Root", expectedSub: "root /app/site;"},
+		{name: "All paths", expectedSub: "try_files $uri $uri/ =404;"},
+		{name: "Index files", expectedSub: "index index.html;"},
+		{name: "Not found page", options: siteOptions{NotFoundPage: true}, expectedSub: "error_page 404 /404.html;"},
+		{name: "Default not found page", unexpectedSub: "error_page"},
+		{name: "No cache headers", unexpectedSub: "Cache-Control"},
+		{name: "SPA fallback", options: siteOptions{SPA: true}, expectedSub: "try_files $uri $uri/ /index.html;"},
+		{name: "SPA shell revalidated", options: siteOptions{SPA: true}, expectedSub: `add_header Cache-Control "no-cache";`},
+		{name: "SPA hashed assets", options: siteOptions{SPA: true}, expectedSub: `add_header Cache-Control "public, max-age=31536000, immutable";`},
+		{name: "SPA without not found page", options: siteOptions{SPA: true, NotFoundPage: true}, unexpectedSub: "error_page"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := generateSiteNginxConfig(tt.options, &buf); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			content := buf.String()
+			if tt.expectedSub != "" && !strings.Contains(content, tt.expectedSub) {
+				t.Errorf("expected config to contain %q, got:\n%s", tt.expectedSub, content)
+			}
+			if tt.unexpectedSub != "" && strings.Contains(content, tt.unexpectedSub) {
+				t.Errorf("expected config not to contain %q, got:\n%s", tt.unexpectedSub, content)
+			}
+		})
+	}
+}
+
+// Table-driven test for newSiteHandler
+func TestSiteHandler(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"index.html":       "<h1>home</h1>",
+		"404.html":         "<h1>missing</h1>",
+		"css/site.css":     "body{}",
+		"docs/index.html":  "<h1>docs</h1>",
+		"assets/logo.json": `{"a":1}`,
+	}
+	for name, content := range files {
+		_ = os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755)
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+
+	ts := httptest.NewServer(newSiteHandler(dir, false))
+	defer ts.Close()
+
+	tests := []struct {
+		path           string
+		expectedStatus int
+		expectedBody   string
+		expectedType   string
+	}{
+		{path: "/", expectedStatus: http.StatusOK, expectedBody: "<h1>home</h1>", expectedType: "text/html; charset=utf-8"},
+		{path: "/css/site.css", expectedStatus: http.StatusOK, expectedBody: "body{}", expectedType: "text/css; charset=utf-8"},
+		{path: "/docs/", expectedStatus: http.StatusOK, expectedBody: "<h1>docs</h1>"},
+		{path: "/assets/", expectedStatus: http.StatusNotFound, expectedBody: "<h1>missing</h1>"},
+		{path: "/missing", expectedStatus: http.StatusNotFound, expectedBody: "<h1>missing</h1>"},
+		{path: "/../../etc/passwd", expectedStatus: http.StatusNotFound, expectedBody: "<h1>missing</h1>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			resp, err := http.Get(ts.URL + tt.path)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d", tt.expectedStatus, resp.StatusCode)
+			}
+
+			body, _ := io.ReadAll(resp.Body)
+			if string(body) != tt.expectedBody {
+				t.Errorf("unexpected body: got %q, want %q", string(body), tt.expectedBody)
+			}
+			if tt.expectedType != "" && resp.Header.Get("Content-Type") != tt.expectedType {
+				t.Errorf("unexpected content type: got %q, want %q", resp.Header.Get("Content-Type"), tt.expectedType)
+			}
+		})
+	}
+}
+
+func TestIsHashedAsset(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{path: "/static/js/main.3f9a2c1b.js", want: true},
+		{path: "/assets/index-DiwrgT4a.css", want: true},
+		{path: "/assets/logo.5d5d9eef.svg", want: true},
+		{path: "/fonts/inter.a1b2c3d4e5.woff2", want: true},
+		{path: "/js/jquery-compiled.js"},
+		{path: "/app.js"},
+		{path: "/index.html"},
+		{path: "/users/12345678"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := isHashedAsset(tt.path); got != tt.want {
+				t.Errorf("isHashedAsset(%s) = %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+// Table-driven test for newSiteHandler of a single page application
+func TestSiteHandlerSPA(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"index.html":               "<div id=app></div>",
+		"404.html":                 "<h1>missing</h1>",
+		"assets/index-4b9f2c1a.js": "app()",
+		"robots.txt":               "User-agent: *",
+	}
+	for name, content := range files {
+		_ = os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755)
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+
+	ts := httptest.NewServer(newSiteHandler(dir, true))
+	defer ts.Close()
+
+	tests := []struct {
+		path           string
+		expectedStatus int
+		expectedBody   string
+		expectedCache  string
+	}{
+		{path: "/", expectedStatus: http.StatusOK, expectedBody: "<div id=app></div>", expectedCache: "no-cache"},
+		{path: "/users/42/settings", expectedStatus: http.StatusOK, expectedBody: "<div id=app></div>", expectedCache: "no-cache"},
+		{path: "/assets/index-4b9f2c1a.js", expectedStatus: http.StatusOK, expectedBody: "app()", expectedCache: "public, max-age=31536000, immutable"},
+		{path: "/robots.txt", expectedStatus: http.StatusOK, expectedBody: "User-agent: *", expectedCache: "no-cache"},
+		{path: "/assets/index-00000000.js", expectedStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			resp, err := http.Get(ts.URL + tt.path)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d", tt.expectedStatus, resp.StatusCode)
+			}
+			if resp.Header.Get("Cache-Control") != tt.expectedCache {
+				t.Errorf("unexpected cache control: got %q, want %q", resp.Header.Get("Cache-Control"), tt.expectedCache)
+			}
+
+			body, _ := io.ReadAll(resp.Body)
+			if tt.expectedBody != "" && string(body) != tt.expectedBody {
+				t.Errorf("unexpected body: got %q, want %q", string(body), tt.expectedBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/alexisvisco/koyebtests/internal/initstatus"
+	"github.com/alexisvisco/koyebtests/internal/netguard"
+)
+
+const (
+	defaultMaxDownloadSize = 256 << 20
+	defaultRetries         = 3
+	defaultMaxRedirects    = netguard.DefaultMaxRedirects
+	defaultDownloadTimeout = 30 * time.Second
+
+	// The first retry waits retryBackoff, each next one twice longer up to maxRetryBackoff
+	retryBackoff    = time.Second
+	maxRetryBackoff = 30 * time.Second
+)
+
+var (
+	errTooLarge    = errors.New("content too large")
+	errWriteOutput = errors.New("failed to write output")
+)
+
+// statusError is a response of the source with another status than 200
+type statusError struct {
+	Code   int
+	Status string
+
+	// RetryAfter is the delay asked by the source with the Retry-After header
+	RetryAfter time.Duration
+}
+
+func (e *statusError) Error() string {
+	return "HTTP error: " + e.Status
+}
+
+// downloadOptions bounds the download of the content
+type downloadOptions struct {
+	// MaxSize is the maximum number of bytes of the content
+	MaxSize int64
+
+	// Retries is how many times a transient failure is retried
+	Retries int
+
+	// Backoff is the delay before the first retry, it doubles on each retry up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// downloadToFile downloads the content at the URL to the file, it retries the transient failures with an
+// exponential backoff and starts over from an empty file on each attempt. It returns the Content-Type of
+// the response and the number of attempts.
+func downloadToFile(ctx context.Context, client *http.Client, parsedURL *url.URL, filename string, opts downloadOptions, logger *slog.Logger) (string, int, error) {
+	delay := opts.Backoff
+
+	for attempt := 1; ; attempt++ {
+		contentType, err := downloadAttempt(ctx, client, parsedURL, filename, opts.MaxSize)
+		if err == nil {
+			return contentType, attempt, nil
+		}
+
+		_ = os.Remove(filename)
+		if attempt > opts.Retries || !retryable(err) {
+			return "", attempt, err
+		}
+
+		wait := delay
+		var statusErr *statusError
+		if errors.As(err, &statusErr) && statusErr.RetryAfter > wait {
+			wait = statusErr.RetryAfter
+		}
+		wait = min(wait, opts.MaxBackoff)
+
+		logger.Warn("download failed, retrying", "error", err, "attempt", attempt, "retry_in", wait)
+
+		select {
+		case <-ctx.Done():
+			return "", attempt, ctx.Err()
+		case <-time.After(wait):
+		}
+		delay = min(delay*2, opts.MaxBackoff)
+	}
+}
+
+func downloadAttempt(ctx context.Context, client *http.Client, parsedURL *url.URL, filename string, maxSize int64) (string, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errWriteOutput, err)
+	}
+	defer file.Close()
+
+	contentType, err := downloadFromURL(ctx, client, parsedURL, file, maxSize)
+	if err != nil {
+		return "", err
+	}
+
+	if err := file.Close(); err != nil {
+		return "", fmt.Errorf("%w: %v", errWriteOutput, err)
+	}
+
+	return contentType, nil
+}
+
+// downloadFromURL writes at most maxSize bytes of the content at the URL to the writer and returns the
+// Content-Type of the response
+func downloadFromURL(ctx context.Context, client *http.Client, parsedURL *url.URL, writer io.Writer, maxSize int64) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", parsedURL.String(), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("User-Agent", "Koyebtest")
+
+	// Execute the request
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to make request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", &statusError{Code: resp.StatusCode, Status: resp.Status, RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
+
+	if resp.ContentLength > maxSize {
+		return "", fmt.Errorf("%w: response of %d bytes exceeds %d bytes", errTooLarge, resp.ContentLength, maxSize)
+	}
+
+	// One more byte than allowed tells that the content goes over the limit
+	output := &outputWriter{writer: writer}
+	n, err := io.Copy(output, io.LimitReader(resp.Body, maxSize+1))
+	if output.err != nil {
+		return "", fmt.Errorf("%w: %v", errWriteOutput, output.err)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read response: %w", err)
+	}
+	if n > maxSize {
+		return "", fmt.Errorf("%w: response exceeds %d bytes", errTooLarge, maxSize)
+	}
+
+	return resp.Header.Get("Content-Type"), nil
+}
+
+// outputWriter remembers the error of the writer, so that a full disk is not taken for a network failure
+type outputWriter struct {
+	writer io.Writer
+	err    error
+}
+
+func (w *outputWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// parseRetryAfter reads a Retry-After header in seconds, the dates are ignored
+func parseRetryAfter(value string) time.Duration {
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// retryable reports whether a failure of the download may not happen on the next attempt
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		switch {
+		case statusErr.Code == http.StatusRequestTimeout, statusErr.Code == http.StatusTooManyRequests:
+			return true
+		case statusErr.Code >= 500:
+			return statusErr.Code != http.StatusNotImplemented
+		}
+		return false
+	}
+
+	return classifyDownloadError(err) == initstatus.ClassNetwork
+}
+
+// classifyDownloadError returns the class of a failure of the download
+func classifyDownloadError(err error) initstatus.Class {
+	var statusErr *statusError
+	switch {
+	case errors.Is(err, netguard.ErrForbiddenDestination):
+		return initstatus.ClassForbidden
+	case errors.Is(err, netguard.ErrTooManyRedirects):
+		return initstatus.ClassTooManyRedirects
+	case errors.Is(err, errTooLarge):
+		return initstatus.ClassTooLarge
+	case errors.Is(err, errWriteOutput):
+		return initstatus.ClassInternal
+	case errors.As(err, &statusErr), errors.Is(err, netguard.ErrInvalidURL):
+		// A redirect to an invalid URL is a mistake of the source as much as an error status
+		return initstatus.ClassUpstream
+	default:
+		return initstatus.ClassNetwork
+	}
+}
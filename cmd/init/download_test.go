@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alexisvisco/koyebtests/internal/initstatus"
+	"github.com/alexisvisco/koyebtests/internal/netguard"
+)
+
+func TestDownloadToFile(t *testing.T) {
+	tests := []struct {
+		name             string
+		failures         int
+		failureStatus    int
+		retries          int
+		expectedAttempts int
+		expectedClass    initstatus.Class
+	}{
+		{name: "first attempt", expectedAttempts: 1},
+		{name: "recovers from 503", failures: 2, failureStatus: http.StatusServiceUnavailable, retries: 3, expectedAttempts: 3},
+		{name: "recovers from 429", failures: 1, failureStatus: http.StatusTooManyRequests, retries: 1, expectedAttempts: 2},
+		{name: "gives up after the retries", failures: 5, failureStatus: http.StatusBadGateway, retries: 2, expectedAttempts: 3, expectedClass: initstatus.ClassUpstream},
+		{name: "404 is not retried", failures: 5, failureStatus: http.StatusNotFound, retries: 3, expectedAttempts: 1, expectedClass: initstatus.ClassUpstream},
+		{name: "501 is not retried", failures: 5, failureStatus: http.StatusNotImplemented, retries: 3, expectedAttempts: 1, expectedClass: initstatus.ClassUpstream},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if int(requests.Add(1)) <= tt.failures {
+					w.WriteHeader(tt.failureStatus)
+					io.WriteString(w, "failed attempt")
+					return
+				}
+				io.WriteString(w, "hello")
+			}))
+			defer ts.Close()
+
+			parsedURL, _ := url.Parse(ts.URL)
+			filename := filepath.Join(t.TempDir(), fileOutput)
+			opts := downloadOptions{MaxSize: 1024, Retries: tt.retries, Backoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond}
+
+			_, attempts, err := downloadToFile(context.Background(), ts.Client(), parsedURL, filename, opts, slog.Default())
+			if attempts != tt.expectedAttempts || int(requests.Load()) != tt.expectedAttempts {
+				t.Errorf("expected %d attempts, got %d (%d requests)", tt.expectedAttempts, attempts, requests.Load())
+			}
+
+			if tt.expectedClass != "" {
+				if err == nil || classifyDownloadError(err) != tt.expectedClass {
+					t.Fatalf("expected a %s error, got %v", tt.expectedClass, err)
+				}
+				if _, err := os.Stat(filename); !os.IsNotExist(err) {
+					t.Fatal("expected the output of the failed download to be removed")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// Nothing of the failed attempts is left in the output
+			content, _ := os.ReadFile(filename)
+			if string(content) != "hello" {
+				t.Fatalf("unexpected content: %q", content)
+			}
+		})
+	}
+}
+
+func TestDownloadToFileHonorsRetryAfter(t *testing.T) {
+	var first time.Time
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			first = time.Now()
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if elapsed := time.Since(first); elapsed < time.Second {
+			t.Errorf("expected the retry to wait for Retry-After, it came after %s", elapsed)
+		}
+		io.WriteString(w, "hello")
+	}))
+	defer ts.Close()
+
+	parsedURL, _ := url.Parse(ts.URL)
+	opts := downloadOptions{MaxSize: 1024, Retries: 1, Backoff: time.Millisecond, MaxBackoff: 2 * time.Second}
+
+	if _, _, err := downloadToFile(context.Background(), ts.Client(), parsedURL, filepath.Join(t.TempDir(), fileOutput), opts, slog.Default()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestDownloadFromURLLimits(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/big", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(1<<20))
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/chunked", func(w http.ResponseWriter, r *http.Request) {
+		// Flushing before writing everything sends the body without Content-Length
+		io.WriteString(w, "0123456789")
+		w.(http.Flusher).Flush()
+		io.WriteString(w, "0123456789")
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "0")
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-time.After(2 * time.Second):
+		}
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	client := &http.Client{Timeout: 200 * time.Millisecond, CheckRedirect: netguard.LimitRedirects(3)}
+
+	tests := []struct {
+		path          string
+		expectedClass initstatus.Class
+		retryable     bool
+	}{
+		{path: "/big", expectedClass: initstatus.ClassTooLarge},
+		{path: "/chunked", expectedClass: initstatus.ClassTooLarge},
+		{path: "/slow", expectedClass: initstatus.ClassNetwork, retryable: true},
+		{path: "/loop", expectedClass: initstatus.ClassTooManyRedirects},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			parsedURL, _ := url.Parse(ts.URL + tt.path)
+
+			_, err := downloadFromURL(context.Background(), client, parsedURL, io.Discard, 15)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if class := classifyDownloadError(err); class != tt.expectedClass {
+				t.Errorf("expected %s, got %s (%v)", tt.expectedClass, class, err)
+			}
+			if retryable(err) != tt.retryable {
+				t.Errorf("expected retryable %v for %v", tt.retryable, err)
+			}
+		})
+	}
+}
+
+func TestClassifyDownloadError(t *testing.T) {
+	tests := []struct {
+		name          string
+		err           error
+		expectedClass initstatus.Class
+		retryable     bool
+	}{
+		{name: "forbidden", err: &netguard.PolicyError{Rule: netguard.RulePrivateAddress}, expectedClass: initstatus.ClassForbidden},
+		{name: "refused redirect", err: &url.Error{Op: "Get", Err: netguard.ErrForbiddenDestination}, expectedClass: initstatus.ClassForbidden},
+		{name: "request timeout", err: &statusError{Code: http.StatusRequestTimeout}, expectedClass: initstatus.ClassUpstream, retryable: true},
+		{name: "bad gateway", err: &statusError{Code: http.StatusBadGateway}, expectedClass: initstatus.ClassUpstream, retryable: true},
+		{name: "forbidden status", err: &statusError{Code: http.StatusForbidden}, expectedClass: initstatus.ClassUpstream},
+		{name: "disk full", err: errWriteOutput, expectedClass: initstatus.ClassInternal},
+		{name: "connection refused", err: errors.New("connection refused"), expectedClass: initstatus.ClassNetwork, retryable: true},
+		{name: "canceled", err: context.Canceled, expectedClass: initstatus.ClassNetwork},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if class := classifyDownloadError(tt.err); class != tt.expectedClass {
+				t.Errorf("expected %s, got %s", tt.expectedClass, class)
+			}
+			if retryable(tt.err) != tt.retryable {
+				t.Errorf("expected retryable %v", tt.retryable)
+			}
+		})
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/alexisvisco/koyebtests/internal/netguard"
+)
+
+const (
+	// repoDir is where the repository is checked out, its path then becomes siteDir
+	repoDir = "repo"
+
+	cloneTimeout = 5 * time.Minute
+
+	// watchInterval is how often the size of the repository is checked while git writes it
+	watchInterval = 100 * time.Millisecond
+)
+
+var errCommitMismatch = errors.New("checked out commit does not match the pinned commit")
+
+// gitSource is a repository to check out, Commit pins it to the commit resolved by the API
+type gitSource struct {
+	URL    string
+	Ref    string
+	Commit string
+	Path   string
+
+	// AllowPrivate lets the repository be a file:// URL, for local development only. The private addresses
+	// are allowed by a Policy from netguard.Policy.AllowingPrivate.
+	AllowPrivate bool
+
+	// Policy restricts the hosts git connects to, the connections go through a local proxy that applies it
+	Policy *netguard.Policy
+}
+
+// cloneRepository shallow clones the commit of the repository and moves its path to siteDir. The
+// history is not kept and only the path is checked out. The files are counted against the limits of
+// the archives while git writes them, the objects of the commit count against the size limit too.
+// Symbolic links are checked out as plain files so that no file of the site can point outside of it.
+func cloneRepository(ctx context.Context, source gitSource, limits archiveLimits) (*archiveResult, string, error) {
+	if err := os.RemoveAll(repoDir); err != nil {
+		return nil, "", fmt.Errorf("failed to clean %s: %w", repoDir, err)
+	}
+	if err := os.RemoveAll(siteDir); err != nil {
+		return nil, "", fmt.Errorf("failed to clean %s: %w", siteDir, err)
+	}
+	// Nothing of a failed clone is left on disk, the checkout is already moved to siteDir otherwise
+	defer os.RemoveAll(repoDir)
+
+	ctx, cancel := context.WithTimeout(ctx, cloneTimeout)
+	defer cancel()
+
+	// A repository over the limits stops git instead of filling the disk first
+	ctx, stopWatch := watchRepository(ctx, limits)
+	defer stopWatch()
+
+	proxyURL, stop, err := startProxy(source.Policy)
+	if err != nil {
+		return nil, "", err
+	}
+	defer stop()
+	git := &gitCommand{allowPrivate: source.AllowPrivate, proxy: proxyURL}
+
+	if _, err := git.run(ctx, ".", "init", "-q", repoDir); err != nil {
+		return nil, "", err
+	}
+
+	// Fetching a commit by its hash needs a server that allows it, the ref is fetched otherwise
+	target := source.Commit
+	if target == "" {
+		target = source.Ref
+	}
+	if target == "" {
+		target = "HEAD"
+	}
+	_, err = git.run(ctx, repoDir, "fetch", "-q", "--depth", "1", "--no-tags", "--", source.URL, target)
+	if err != nil && source.Commit != "" {
+		fallback := source.Ref
+		if fallback == "" {
+			fallback = "HEAD"
+		}
+		_, err = git.run(ctx, repoDir, "fetch", "-q", "--depth", "1", "--no-tags", "--", source.URL, fallback)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	// The commit is checked before any file of it is written
+	commit, err := git.run(ctx, repoDir, "rev-parse", "FETCH_HEAD")
+	if err != nil {
+		return nil, "", err
+	}
+	if source.Commit != "" && commit != source.Commit {
+		return nil, "", fmt.Errorf("%w: got %s, want %s", errCommitMismatch, commit, source.Commit)
+	}
+
+	if err := sparseCheckout(source.Path); err != nil {
+		return nil, "", err
+	}
+
+	if _, err := git.run(ctx, repoDir, "checkout", "-q", "--detach", commit); err != nil {
+		return nil, "", err
+	}
+
+	// The last files may have been written after the last check of the watcher
+	if err := checkRepository(repoDir, limits); err != nil {
+		return nil, "", err
+	}
+
+	if err := os.RemoveAll(filepath.Join(repoDir, ".git")); err != nil {
+		return nil, "", fmt.Errorf("failed to remove the git directory: %w", err)
+	}
+
+	result, err := promoteRepoPath(source.Path, limits)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return result, commit, nil
+}
+
+// sparseCheckout restricts the checkout to the served path of the repository, the other files of the
+// commit are neither written nor counted against the limits
+func sparseCheckout(repoPath string) error {
+	repoPath = strings.Trim(repoPath, "/")
+	if repoPath == "" {
+		return nil
+	}
+
+	gitDir := filepath.Join(repoDir, ".git")
+	if err := os.MkdirAll(filepath.Join(gitDir, "info"), 0755); err != nil {
+		return fmt.Errorf("failed to configure the sparse checkout: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(gitDir, "info", "sparse-checkout"), []byte("/"+repoPath+"/\n"), 0644); err != nil {
+		return fmt.Errorf("failed to configure the sparse checkout: %w", err)
+	}
+
+	config, err := os.OpenFile(filepath.Join(gitDir, "config"), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("failed to configure the sparse checkout: %w", err)
+	}
+	defer config.Close()
+
+	if _, err := config.WriteString("[core]\n\tsparseCheckout = true\n"); err != nil {
+		return fmt.Errorf("failed to configure the sparse checkout: %w", err)
+	}
+	return config.Close()
+}
+
+// watchRepository checks the repository against the limits every watchInterval until stopped, the
+// returned context is canceled with the error of the check once the repository goes over them
+func watchRepository(ctx context.Context, limits archiveLimits) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(watchInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := checkRepository(repoDir, limits); err != nil {
+					cancel(err)
+					return
+				}
+			}
+		}
+	}()
+
+	return ctx, func() {
+		close(done)
+		cancel(nil)
+	}
+}
+
+// checkRepository counts the files checked out in dir against the limits, and the size of the git
+// objects against the size limit: a commit that weighs more than the site can hold is not fetched.
+// The files that disappear while git runs are not counted.
+func checkRepository(dir string, limits archiveLimits) error {
+	var files int
+	var size, objectsSize int64
+	err := filepath.WalkDir(dir, func(name string, entry fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		info, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if rel, _ := filepath.Rel(dir, name); strings.HasPrefix(rel, ".git"+string(filepath.Separator)) {
+			objectsSize += info.Size()
+			return nil
+		}
+		files++
+		size += info.Size()
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to check the repository: %w", err)
+	}
+
+	switch {
+	case objectsSize > limits.MaxSize:
+		return fmt.Errorf("%w: the commit weighs more than %d bytes", errArchiveTooLarge, limits.MaxSize)
+	case files > limits.MaxFiles:
+		return fmt.Errorf("%w: more than %d files", errArchiveTooLarge, limits.MaxFiles)
+	case size > limits.MaxSize:
+		return fmt.Errorf("%w: more than %d bytes", errArchiveTooLarge, limits.MaxSize)
+	}
+	return nil
+}
+
+// promoteRepoPath checks the served directory of the repository against the limits and moves it to siteDir,
+// a directory over the limits never becomes the site
+func promoteRepoPath(repoPath string, limits archiveLimits) (*archiveResult, error) {
+	if repoPath != "" && !filepath.IsLocal(repoPath) {
+		return nil, fmt.Errorf("%w: %s", errUnsafeArchivePath, repoPath)
+	}
+
+	dir := filepath.Join(repoDir, filepath.FromSlash(repoPath))
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("path %s is not in the repository: %w", repoPath, err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("path %s of the repository is not a directory", repoPath)
+	}
+
+	result := &archiveResult{}
+	err = filepath.WalkDir(dir, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			rel, _ := filepath.Rel(dir, name)
+			result.Skipped = append(result.Skipped, filepath.Join(siteDir, rel))
+			return os.Remove(name)
+		}
+
+		result.Files++
+		result.Size += info.Size()
+		if result.Files > limits.MaxFiles {
+			return fmt.Errorf("%w: more than %d files", errArchiveTooLarge, limits.MaxFiles)
+		}
+		if result.Size > limits.MaxSize {
+			return fmt.Errorf("%w: more than %d bytes", errArchiveTooLarge, limits.MaxSize)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(dir, siteDir); err != nil {
+		return nil, fmt.Errorf("failed to move the site root: %w", err)
+	}
+	if err := os.RemoveAll(repoDir); err != nil {
+		return nil, fmt.Errorf("failed to clean %s: %w", repoDir, err)
+	}
+
+	return result, nil
+}
+
+// gitCommand runs git without the configuration of the system and with only the http protocols
+type gitCommand struct {
+	allowPrivate bool
+	proxy        string
+}
+
+// run runs the git subcommand in the directory and returns its output
+func (g *gitCommand) run(ctx context.Context, dir string, args ...string) (string, error) {
+	config := []string{
+		"-c", "protocol.allow=never",
+		"-c", "protocol.https.allow=always",
+		"-c", "protocol.http.allow=always",
+		"-c", "core.symlinks=false",
+		"-c", "advice.detachedHead=false",
+	}
+	if g.allowPrivate {
+		config = append(config, "-c", "protocol.file.allow=always")
+	}
+	if g.proxy != "" {
+		config = append(config, "-c", "http.proxy="+g.proxy)
+	}
+
+	cmd := exec.CommandContext(ctx, "git", append(config, args...)...)
+	cmd.Dir = dir
+	cmd.Env = []string{
+		"PATH=" + os.Getenv("PATH"),
+		"HOME=" + os.TempDir(),
+		"GIT_TERMINAL_PROMPT=0",
+		"GIT_CONFIG_NOSYSTEM=1",
+		"GIT_CONFIG_GLOBAL=/dev/null",
+	}
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if cause := context.Cause(ctx); err != nil && cause != nil && cause != ctx.Err() {
+		// git was stopped by the watcher of the repository, its error only tells that it was killed
+		return "", fmt.Errorf("git %s: %w", args[0], cause)
+	}
+	if err != nil {
+		return "", fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// startProxy serves a proxy applying the policy on a local port, git connects through it so that the
+// addresses of the repository are checked like the downloads of the other sources
+func startProxy(policy *netguard.Policy) (string, func(), error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to start the git proxy: %w", err)
+	}
+
+	server := &http.Server{Handler: netguard.NewProxy(policy), ReadHeaderTimeout: 10 * time.Second}
+	go server.Serve(listener)
+
+	return "http://" + listener.Addr().String(), func() { server.Close() }, nil
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alexisvisco/koyebtests/internal/netguard"
+)
+
+// runGit runs a git command in the directory and returns its output
+func runGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_CONFIG_NOSYSTEM=1", "GIT_CONFIG_GLOBAL=/dev/null",
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// newBareRepo creates a bare repository with a site in public/ and a script, it returns the directory
+// holding repo.git and the commits of the first and the second version
+func newBareRepo(t *testing.T) (string, string, string) {
+	t.Helper()
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir := t.TempDir()
+	work := filepath.Join(dir, "work")
+	runGit(t, dir, "init", "-q", "-b", "main", work)
+
+	files := map[string]string{
+		"public/index.html":   "<h1>v1</h1>",
+		"public/css/site.css": "body {}",
+		"bin/hello.sh":        "printf \"%s from %s\" \"$(cat message.txt)\" \"$REQUEST_METHOD\"",
+		"message.txt":         "hello",
+	}
+	for name, content := range files {
+		os.MkdirAll(filepath.Join(work, filepath.Dir(name)), 0755)
+		os.WriteFile(filepath.Join(work, name), []byte(content), 0644)
+	}
+	os.Symlink("/etc/passwd", filepath.Join(work, "public", "passwd"))
+	runGit(t, work, "add", ".")
+	runGit(t, work, "commit", "-q", "-m", "v1")
+	first := runGit(t, work, "rev-parse", "HEAD")
+
+	os.WriteFile(filepath.Join(work, "public", "index.html"), []byte("<h1>v2</h1>"), 0644)
+	runGit(t, work, "commit", "-q", "-am", "v2")
+	second := runGit(t, work, "rev-parse", "HEAD")
+
+	runGit(t, dir, "clone", "-q", "--bare", work, filepath.Join(dir, "repo.git"))
+
+	return dir, first, second
+}
+
+func TestCloneRepository(t *testing.T) {
+	dir, first, second := newBareRepo(t)
+	repoURL := "file://" + filepath.Join(dir, "repo.git")
+
+	tests := []struct {
+		name          string
+		source        gitSource
+		expectedIndex string
+		expectedFiles int
+		expectedErr   error
+	}{
+		{
+			name:          "default branch",
+			source:        gitSource{URL: repoURL, Path: "public"},
+			expectedIndex: "<h1>v2</h1>",
+			expectedFiles: 3,
+		},
+		{
+			name:          "pinned commit",
+			source:        gitSource{URL: repoURL, Ref: "main", Commit: first, Path: "public/"},
+			expectedIndex: "<h1>v1</h1>",
+			expectedFiles: 3,
+		},
+		{
+			name:        "moved branch",
+			source:      gitSource{URL: repoURL, Ref: "main", Commit: strings.Repeat("0", 40)},
+			expectedErr: errCommitMismatch,
+		},
+		{
+			name:        "too many files",
+			source:      gitSource{URL: repoURL, Commit: second},
+			expectedErr: errArchiveTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+
+			tt.source.AllowPrivate = true
+			result, commit, err := cloneRepository(context.Background(), tt.source, archiveLimits{MaxFiles: 4, MaxSize: 1 << 20})
+			if tt.expectedErr != nil {
+				if !errors.Is(err, tt.expectedErr) {
+					t.Fatalf("expected error %v, got %v", tt.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if tt.source.Commit != "" && commit != tt.source.Commit {
+				t.Errorf("expected commit %s, got %s", tt.source.Commit, commit)
+			}
+			if tt.source.Commit == "" && commit != second {
+				t.Errorf("expected the commit of the default branch %s, got %s", second, commit)
+			}
+			if result.Files != tt.expectedFiles {
+				t.Errorf("expected %d files, got %d", tt.expectedFiles, result.Files)
+			}
+
+			index, err := os.ReadFile(filepath.Join(siteDir, "index.html"))
+			if err != nil || string(index) != tt.expectedIndex {
+				t.Fatalf("expected index %q, got %q (%v)", tt.expectedIndex, index, err)
+			}
+
+			// Links are checked out as plain files holding their target
+			if info, err := os.Lstat(filepath.Join(siteDir, "passwd")); err != nil || !info.Mode().IsRegular() {
+				t.Fatalf("expected the link to be a regular file, got %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(siteDir, ".git")); !os.IsNotExist(err) {
+				t.Fatal("expected the git directory not to be served")
+			}
+			if _, err := os.Stat(repoDir); !os.IsNotExist(err) {
+				t.Fatal("expected the checkout to be cleaned")
+			}
+		})
+	}
+}
+
+func TestCloneRepositoryOverLimits(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir := t.TempDir()
+	work := filepath.Join(dir, "work")
+	runGit(t, dir, "init", "-q", "-b", "main", work)
+
+	// Random content does not compress, the objects of the commit are as large as the files
+	content := make([]byte, 256<<10)
+	rand.Read(content)
+	os.MkdirAll(filepath.Join(work, "public"), 0755)
+	os.MkdirAll(filepath.Join(work, "assets"), 0755)
+	os.WriteFile(filepath.Join(work, "public", "index.html"), []byte("<h1>small</h1>"), 0644)
+	os.WriteFile(filepath.Join(work, "assets", "big.bin"), content, 0644)
+	runGit(t, work, "add", ".")
+	runGit(t, work, "commit", "-q", "-m", "v1")
+	repoURL := "file://" + work
+
+	tests := []struct {
+		name        string
+		path        string
+		limits      archiveLimits
+		expectedErr error
+	}{
+		// Only the path is checked out and counted
+		{name: "small path", path: "public", limits: archiveLimits{MaxFiles: 1, MaxSize: 1 << 20}},
+		{name: "too many files", limits: archiveLimits{MaxFiles: 1, MaxSize: 1 << 20}, expectedErr: errArchiveTooLarge},
+		{name: "commit too large", path: "public", limits: archiveLimits{MaxFiles: 1, MaxSize: 128 << 10}, expectedErr: errArchiveTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+
+			_, _, err := cloneRepository(context.Background(), gitSource{URL: repoURL, Path: tt.path, AllowPrivate: true}, tt.limits)
+			if !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("expected error %v, got %v", tt.expectedErr, err)
+			}
+			if _, err := os.Stat(repoDir); !os.IsNotExist(err) {
+				t.Fatal("expected the checkout to be cleaned")
+			}
+			if _, err := os.Stat(siteDir); (err == nil) != (tt.expectedErr == nil) {
+				t.Fatalf("expected the site to exist only when the clone succeeds, got %v", err)
+			}
+		})
+	}
+}
+
+// newSmartHTTPServer serves the repositories of dir with git http-backend
+func newSmartHTTPServer(t *testing.T, dir string) *httptest.Server {
+	t.Helper()
+
+	execPath, err := exec.Command("git", "--exec-path").Output()
+	if err != nil {
+		t.Skipf("failed to locate git-http-backend: %v", err)
+	}
+
+	server := httptest.NewServer(&cgi.Handler{
+		Path: filepath.Join(strings.TrimSpace(string(execPath)), "git-http-backend"),
+		Env:  []string{"GIT_PROJECT_ROOT=" + dir, "GIT_HTTP_EXPORT_ALL=1"},
+	})
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestCloneRepositorySmartHTTP(t *testing.T) {
+	dir, first, _ := newBareRepo(t)
+	server := newSmartHTTPServer(t, dir)
+
+	t.Chdir(t.TempDir())
+
+	// The proxy lets git reach the test server on the loopback address
+	source := gitSource{URL: server.URL + "/repo.git", Ref: "main", Commit: first, Policy: (*netguard.Policy)(nil).AllowingPrivate()}
+	_, commit, err := cloneRepository(context.Background(), source, archiveLimits{MaxFiles: 10, MaxSize: 1 << 20})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if commit != first {
+		t.Fatalf("expected commit %s, got %s", first, commit)
+	}
+
+	ts := httptest.NewServer(newScriptHandler(siteDir, "bin/hello.sh", scriptContentType))
+	defer ts.Close()
+
+	// The entrypoint runs in the site root, the relative paths of the repository work
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.Header.Get("Content-Type") != scriptContentType || string(body) != "hello from GET" {
+		t.Fatalf("expected the output of the entrypoint, got %q %q", resp.Header.Get("Content-Type"), body)
+	}
+}
+
+func TestCloneRepositoryRefusesPrivateAddresses(t *testing.T) {
+	dir, _, _ := newBareRepo(t)
+	server := newSmartHTTPServer(t, dir)
+
+	t.Chdir(t.TempDir())
+
+	// Without allow-private git connects through the proxy applying the policy
+	_, _, err := cloneRepository(context.Background(), gitSource{URL: server.URL + "/repo.git"}, archiveLimits{MaxFiles: 10, MaxSize: 1 << 20})
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("expected the proxy to refuse the loopback address, got %v", err)
+	}
+	if _, err := os.Stat(siteDir); !os.IsNotExist(err) {
+		t.Fatal("expected no site to be checked out")
+	}
+}
+
+func TestCheckGitFlags(t *testing.T) {
+	commit := strings.Repeat("a1", 20)
+
+	tests := []struct {
+		name        string
+		archive     bool
+		script      bool
+		spa         bool
+		contentType string
+		ref         string
+		commit      string
+		path        string
+		entrypoint  string
+		expectError bool
+	}{
+		{name: "site", ref: "main", commit: commit, path: "public", spa: true},
+		{name: "script", script: true, entrypoint: "bin/run.sh"},
+		{name: "archive", archive: true, expectError: true},
+		{name: "content type", contentType: "text/html", expectError: true},
+		{name: "script without entrypoint", script: true, expectError: true},
+		{name: "entrypoint without script", entrypoint: "run.sh", expectError: true},
+		{name: "option as ref", ref: "--upload-pack=touch /tmp/pwned", expectError: true},
+		{name: "short commit", commit: "abc123", expectError: true},
+		{name: "path outside of the repository", path: "../..", expectError: true},
+		{name: "entrypoint with shell", script: true, entrypoint: "run.sh;id", expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkGitFlags(tt.archive, tt.script, tt.spa, tt.contentType, tt.ref, tt.commit, tt.path, tt.entrypoint)
+			if (err != nil) != tt.expectError {
+				t.Fatalf("expected error %v, got %v", tt.expectError, err)
+			}
+		})
+	}
+}
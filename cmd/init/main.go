@@ -1,66 +1,275 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log/slog"
+	"mime"
 	"net/http"
+	"net/http/cgi"
 	"net/url"
 	"os"
+	"path"
+	"path/filepath"
 	"strings"
-	"time"
+
+	"github.com/alexisvisco/koyebtests/internal/gitsource"
+	"github.com/alexisvisco/koyebtests/internal/initstatus"
+	"github.com/alexisvisco/koyebtests/internal/integrity"
+	"github.com/alexisvisco/koyebtests/internal/netguard"
+	"github.com/alexisvisco/koyebtests/internal/types"
 )
 
 const (
-	fileOutput  = "output"
-	nginxConfig = "nginx.conf"
+	fileOutput   = "output"
+	nginxConfig  = "nginx.conf"
+	metadataFile = "metadata.json"
+
+	// scriptContentType is the type of the output of the scripts without an override
+	scriptContentType = "text/plain; charset=utf-8"
 )
 
+// envFlags are the flags that are not strings and default to an environment variable, the Nomad jobs
+// configure init through the environment of the task
+var envFlags = map[string]string{
+	"max-download-size":  "MAX_DOWNLOAD_SIZE",
+	"retries":            "DOWNLOAD_RETRIES",
+	"max-redirects":      "MAX_REDIRECTS",
+	"download-timeout":   "DOWNLOAD_TIMEOUT",
+	"max-files":          "MAX_ARCHIVE_FILES",
+	"max-extracted-size": "MAX_EXTRACTED_SIZE",
+}
+
+// flagsFromEnv sets the flags missing from the command line from their environment variable, so that
+// the values are parsed like the ones of the command line
+func flagsFromEnv(flags *flag.FlagSet, envs map[string]string) error {
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	for name, env := range envs {
+		value := os.Getenv(env)
+		if value == "" || set[name] {
+			continue
+		}
+		if err := flags.Set(name, value); err != nil {
+			return fmt.Errorf("%s: %w", env, err)
+		}
+	}
+
+	return nil
+}
+
 func main() {
 	logger := slog.With("component", "init")
 
 	flagIsScript := flag.Bool("script", false, "If set to true it will execute the script in the url")
+	flagArchive := flag.Bool("archive", false, "If set to true the url is a .tar.gz or .zip archive served as a static site")
+	flagSPA := flag.Bool("spa", false, "If set to true the site of the archive is a single page application, unknown paths get its index.html")
+	flagMaxFiles := flag.Int("max-files", defaultMaxArchiveFiles, "Maximum number of entries extracted from an archive, defaults to the MAX_ARCHIVE_FILES environment variable")
+	flagMaxExtractedSize := flag.Int64("max-extracted-size", defaultMaxArchiveSize, "Maximum number of bytes extracted from an archive, defaults to the MAX_EXTRACTED_SIZE environment variable")
 	flagUrl := flag.String("url", "", "Script to downloadFromURL")
+	flagListen := flag.String("listen", "", "If set, serve the content on this address with a built-in HTTP server instead of nginx")
+	flagAllowPrivate := flag.Bool("allow-private", false, "If set, the url can lead to private addresses and local host names, for local development only. The policy still applies")
+	flagPolicy := flag.String("policy", os.Getenv("SOURCE_POLICY"), "JSON policy restricting the url, defaults to the SOURCE_POLICY environment variable")
+	flagContentType := flag.String("content-type", os.Getenv("CONTENT_TYPE"), "Content type to serve instead of the detected one, defaults to the CONTENT_TYPE environment variable")
+	flagGit := flag.Bool("git", false, "If set to true the url is a git repository served as a static site, or whose entrypoint is run with script")
+	flagGitRef := flag.String("git-ref", os.Getenv("GIT_REF"), "Branch, tag or commit of the repository, defaults to the GIT_REF environment variable")
+	flagGitCommit := flag.String("git-commit", os.Getenv("GIT_COMMIT"), "Commit the ref must point to, defaults to the GIT_COMMIT environment variable")
+	flagGitPath := flag.String("git-path", os.Getenv("GIT_PATH"), "Directory of the repository to serve, defaults to the GIT_PATH environment variable")
+	flagEntrypoint := flag.String("entrypoint", os.Getenv("GIT_ENTRYPOINT"), "Script of the repository run with script, defaults to the GIT_ENTRYPOINT environment variable")
+	flagSHA256 := flag.String("sha256", os.Getenv("SHA256"), "Hex SHA-256 the downloaded content must match, defaults to the SHA256 environment variable")
+	flagSignature := flag.String("signature", os.Getenv("SIGNATURE"), "Base64 Ed25519 signature the downloaded content must match, defaults to the SIGNATURE environment variable")
+	flagPublicKey := flag.String("public-key", os.Getenv("SIGNATURE_PUBLIC_KEY"), "Ed25519 public key verifying the signature, defaults to the SIGNATURE_PUBLIC_KEY environment variable")
+	flagMaxDownloadSize := flag.Int64("max-download-size", defaultMaxDownloadSize, "Maximum number of bytes downloaded from the url, defaults to the MAX_DOWNLOAD_SIZE environment variable")
+	flagRetries := flag.Int("retries", defaultRetries, "How many times a download failing with a network error, a timeout, a 408, a 429 or a 5xx is retried, defaults to the DOWNLOAD_RETRIES environment variable")
+	flagMaxRedirects := flag.Int("max-redirects", defaultMaxRedirects, "Maximum number of redirects followed by the download, defaults to the MAX_REDIRECTS environment variable")
+	flagDownloadTimeout := flag.Duration("download-timeout", defaultDownloadTimeout, "Timeout of each download attempt, the body included, defaults to the DOWNLOAD_TIMEOUT environment variable")
 
 	flag.Parse()
 
+	// A status left by a previous run in the same directory would describe another content
+	_ = os.Remove(initstatus.File)
+	status := &statusReporter{logger: logger}
+
+	if err := flagsFromEnv(flag.CommandLine, envFlags); err != nil {
+		status.fail(initstatus.ClassInvalidArguments, "invalid environment variable", err)
+	}
+
 	if *flagUrl == "" {
-		logger.Error("url parameter is required")
-		os.Exit(1)
+		status.fail(initstatus.ClassInvalidArguments, "url parameter is required", nil)
 	}
 
-	parsedURL, err := url.Parse(*flagUrl)
-	if err != nil {
-		logger.Error("failed to parse url", "error", err, "url", *flagUrl)
-		os.Exit(1)
+	if *flagIsScript && *flagArchive {
+		status.fail(initstatus.ClassInvalidArguments, "script and archive cannot be set together", nil)
+	}
+
+	if *flagSPA && !*flagArchive && !*flagGit {
+		status.fail(initstatus.ClassInvalidArguments, "spa requires archive or git", nil)
 	}
 
-	var writer io.Writer
-	var file *os.File
+	if *flagGit {
+		if err := checkGitFlags(*flagArchive, *flagIsScript, *flagSPA, *flagContentType, *flagGitRef, *flagGitCommit, *flagGitPath, *flagEntrypoint); err != nil {
+			status.fail(initstatus.ClassInvalidArguments, "invalid git source", err)
+		}
+	}
 
-	file, err = os.Create(fileOutput)
+	expected, err := parseExpectation(*flagSHA256, *flagSignature, *flagPublicKey)
 	if err != nil {
-		logger.Error("failed to create output file", "error", err, "filename", fileOutput)
-		os.Exit(1)
+		status.fail(initstatus.ClassInvalidArguments, "invalid integrity check", err)
+	}
+	if *flagGit && (expected.SHA256 != "" || expected.Signature != nil) {
+		status.fail(initstatus.ClassInvalidArguments, "sha256 and signature cannot be set with git", nil)
+	}
+
+	override := *flagContentType
+	if override != "" {
+		var err error
+		override, err = types.NormalizeContentType(override)
+		if err != nil {
+			status.fail(initstatus.ClassInvalidArguments, "invalid content type", err)
+		}
+	}
+
+	var policy *netguard.Policy
+	if *flagPolicy != "" {
+		var err error
+		policy, err = netguard.ParsePolicy([]byte(*flagPolicy))
+		if err != nil {
+			status.fail(initstatus.ClassInvalidArguments, "invalid policy", err)
+		}
+	}
+
+	// Only the built-in private ranges are lifted for local development, the rules of the policy still apply
+	if *flagAllowPrivate {
+		policy = policy.AllowingPrivate()
 	}
-	defer file.Close()
-	writer = file
 
-	err = downloadFromURL(parsedURL, writer)
+	parsedURL, err := url.Parse(*flagUrl)
+	if err == nil && !(*flagAllowPrivate && *flagGit && parsedURL.Scheme == "file") {
+		parsedURL, err = policy.ParseURL(*flagUrl)
+	}
+	var policyErr *netguard.PolicyError
+	if errors.As(err, &policyErr) {
+		status.fail(initstatus.ClassForbidden, "url refused by policy", err, "rule", policyErr.Rule, "pattern", policyErr.Pattern, "value", policyErr.Value, "url", *flagUrl)
+	}
 	if err != nil {
-		logger.Error("failed to download content from url", "error", err, "url", parsedURL.String())
-		os.Exit(1)
+		status.fail(initstatus.ClassInvalidArguments, "failed to parse url", err, "url", *flagUrl)
 	}
 
-	_ = file.Close()
+	if *flagMaxDownloadSize <= 0 || *flagRetries < 0 || *flagMaxRedirects < 0 || *flagDownloadTimeout <= 0 {
+		status.fail(initstatus.ClassInvalidArguments, "max-download-size and download-timeout must be positive, retries and max-redirects cannot be negative", nil)
+	}
 
-	if *flagIsScript {
+	// The client refuses to connect to the addresses the policy refuses, on the first request and on every redirect
+	client := netguard.NewHTTPClient(*flagDownloadTimeout, policy)
+	client.CheckRedirect = netguard.RedirectPolicy(policy, *flagMaxRedirects)
+
+	download := downloadOptions{MaxSize: *flagMaxDownloadSize, Retries: *flagRetries, Backoff: retryBackoff, MaxBackoff: maxRetryBackoff}
+
+	limits := archiveLimits{MaxFiles: *flagMaxFiles, MaxSize: *flagMaxExtractedSize}
+
+	var meta metadata
+	if *flagGit {
+		source := gitSource{
+			URL:          parsedURL.String(),
+			Ref:          *flagGitRef,
+			Commit:       *flagGitCommit,
+			Path:         *flagGitPath,
+			AllowPrivate: *flagAllowPrivate,
+			Policy:       policy,
+		}
+		result, commit, err := cloneRepository(context.Background(), source, limits)
+		if err != nil {
+			status.fail(classifyContentError(err), "failed to clone repository", err, "url", parsedURL.String(), "ref", *flagGitRef)
+		}
+
+		if len(result.Skipped) > 0 {
+			logger.Warn("skipped repository entries that are not regular files", "count", len(result.Skipped), "entries", result.Skipped)
+		}
+
+		meta = metadata{Commit: commit, Files: result.Files, ExtractedSize: result.Size}
+		if *flagIsScript {
+			if info, err := os.Stat(filepath.Join(siteDir, *flagEntrypoint)); err != nil || !info.Mode().IsRegular() {
+				status.fail(initstatus.ClassInvalidContent, "entrypoint is not a file of the repository", nil, "entrypoint", *flagEntrypoint, "path", *flagGitPath)
+			}
+			meta.ContentType = scriptContentType
+			meta.ContentTypeSource = contentTypeDefault
+		}
+	} else {
+		upstreamContentType, attempts, err := downloadToFile(context.Background(), client, parsedURL, fileOutput, download, logger)
+		status.attempts = attempts
+		if err != nil {
+			status.fail(classifyDownloadError(err), "failed to download content from url", err, "url", parsedURL.String(), "attempts", attempts)
+		}
+
+		// Nothing of the content is used before it is verified
+		if err := expected.Verify(fileOutput); err != nil {
+			_ = os.Remove(fileOutput)
+			status.fail(initstatus.ClassIntegrity, "downloaded content does not match", err, "url", parsedURL.String())
+		}
+
+		meta = metadata{ContentType: override, ContentTypeSource: contentTypeOverride}
+		switch {
+		case *flagArchive:
+			result, err := extractArchive(fileOutput, limits)
+			if err != nil {
+				status.fail(classifyContentError(err), "failed to extract archive", err, "filename", fileOutput)
+			}
+			if len(result.Skipped) > 0 {
+				logger.Warn("skipped archive entries that are not regular files", "count", len(result.Skipped), "entries", result.Skipped)
+			}
+
+			// Each file of the site gets the type of its extension
+			meta = metadata{Files: result.Files, ExtractedSize: result.Size}
+			_ = os.Remove(fileOutput)
+		case *flagIsScript && override == "":
+			meta.ContentType = scriptContentType
+			meta.ContentTypeSource = contentTypeDefault
+		case !*flagIsScript:
+			meta.ContentType, meta.ContentTypeSource, err = detectContentType(override, upstreamContentType, parsedURL.Path, fileOutput)
+			if err != nil {
+				status.fail(initstatus.ClassInvalidContent, "failed to detect content type", err, "filename", fileOutput)
+			}
+		}
+		meta.Verified = expected.SHA256 != "" || expected.Signature != nil
+	}
+
+	if err := writeMetadata(meta); err != nil {
+		status.fail(initstatus.ClassInternal, "failed to write metadata", err, "filename", metadataFile)
+	}
+	logger.Info("content prepared", "content_type", meta.ContentType, "source", meta.ContentTypeSource, "files", meta.Files, "commit", meta.Commit)
+
+	if *flagIsScript && !*flagGit {
 		err = os.Chmod(fileOutput, 0755)
 		if err != nil {
-			logger.Error("failed to make file executable", "error", err, "filename", fileOutput)
-			os.Exit(1)
+			status.fail(initstatus.ClassInternal, "failed to make file executable", err, "filename", fileOutput)
+		}
+	}
+
+	// A repository without entrypoint is served like the files of an archive
+	site := *flagArchive || (*flagGit && !*flagIsScript)
+
+	if *flagListen != "" {
+		logger.Info("serving content", "address", *flagListen, "script", *flagIsScript, "archive", *flagArchive, "git", *flagGit)
+
+		handler := newServeHandler(*flagIsScript, meta.ContentType)
+		switch {
+		case site:
+			handler = newSiteHandler(siteDir, *flagSPA)
+		case *flagGit:
+			handler = newScriptHandler(siteDir, *flagEntrypoint, meta.ContentType)
 		}
+
+		status.ready()
+		err = http.ListenAndServe(*flagListen, handler)
+		logger.Error("built-in server stopped", "error", err)
+		os.Exit(1)
 	}
 
 	var configWriter io.Writer
@@ -68,31 +277,39 @@ func main() {
 
 	configFile, err = os.Create(nginxConfig)
 	if err != nil {
-		logger.Error("failed to create nginx config file", "error", err, "filename", nginxConfig)
-		os.Exit(1)
+		status.fail(initstatus.ClassInternal, "failed to create nginx config file", err, "filename", nginxConfig)
 	}
 	defer configFile.Close()
 	configWriter = configFile
 
-	err = generateNginxConfig(*flagIsScript, configWriter)
+	if site {
+		err = generateSiteNginxConfig(siteOptions{NotFoundPage: hasNotFoundPage(siteDir), SPA: *flagSPA}, configWriter)
+	} else {
+		err = generateNginxConfig(*flagIsScript, meta.ContentType, configWriter)
+	}
 	if err != nil {
-		logger.Error("failed to generate nginx configuration", "error", err)
-		os.Exit(1)
+		status.fail(initstatus.ClassInternal, "failed to generate nginx configuration", err)
 	}
 
 	if *flagIsScript {
-		err = createCGIWrapper()
+		// The entrypoint of a repository runs at the root of the site so that it finds the other files
+		dir, script := "", fileOutput
+		if *flagGit {
+			dir, script = siteDir, siteDir+"/"+*flagEntrypoint
+		}
+		err = createCGIWrapper(meta.ContentType, dir, script)
 		if err != nil {
-			logger.Error("failed to create cgi wrapper", "error", err)
-			os.Exit(1)
+			status.fail(initstatus.ClassInternal, "failed to create cgi wrapper", err)
 		}
 	}
+
+	status.ready()
 }
 
 // generateNginxConfig generates an nginx configuration based on whether the file is a script or not.
 // if isScript it will execute the script at the flagOutput using cgi at each request
-// if not it serve the static file at the flagOutput
-func generateNginxConfig(isScript bool, outConfig io.Writer) error {
+// if not it serve the static file at the flagOutput with the given content type
+func generateNginxConfig(isScript bool, contentType string, outConfig io.Writer) error {
 	var config string
 
 	if isScript {
@@ -126,7 +343,9 @@ func generateNginxConfig(isScript bool, outConfig io.Writer) error {
     location = / {
        root /app;
        try_files /{{output}} =404;
-       add_header Content-Type 'text/plain';
+       types { }
+       default_type '{{content_type}}';
+       add_header X-Content-Type-Options nosniff;
     }
     
     error_log /var/log/nginx/error.log;
@@ -135,7 +354,8 @@ func generateNginxConfig(isScript bool, outConfig io.Writer) error {
 	}
 
 	// Write the config to the provided writer
-	_, err := outConfig.Write([]byte(strings.ReplaceAll(config, "{{output}}", fileOutput)))
+	config = strings.NewReplacer("{{output}}", fileOutput, "{{content_type}}", contentType).Replace(config)
+	_, err := outConfig.Write([]byte(config))
 	if err != nil {
 		return fmt.Errorf("failed to write nginx config: %w", err)
 	}
@@ -143,13 +363,19 @@ func generateNginxConfig(isScript bool, outConfig io.Writer) error {
 	return nil
 }
 
-// createCGIWrapper creates a wrapper script that adds CGI headers and executes the downloaded script
+// createCGIWrapper creates a wrapper script that adds CGI headers and executes the script, both dir
+// and script are relative to /app, the script runs in dir when it is set
 // It is needed because otherwise nginx will not display the output of the script
-func createCGIWrapper() error {
+func createCGIWrapper(contentType, dir, script string) error {
 	wrapperContent := `#!/bin/sh
-echo "Content-Type: text/plain"
+echo "Content-Type: ` + contentType + `"
 echo ""
-/bin/sh /app/` + fileOutput + ` 2>&1
+`
+	if dir != "" {
+		wrapperContent += `cd /app/` + dir + ` || exit 1
+`
+	}
+	wrapperContent += `/bin/sh /app/` + script + ` 2>&1
 `
 
 	err := os.WriteFile("wrapper.sh", []byte(wrapperContent), 0755)
@@ -160,33 +386,178 @@ echo ""
 	return nil
 }
 
-func downloadFromURL(parsedURL *url.URL, writer io.Writer) error {
-	client := &http.Client{
-		Timeout: 30 * time.Second,
+// newServeHandler serves the content like the generated nginx configuration does, for environments without nginx.
+// Only the root endpoint is served: the static file with its content type, or the output of the script executed with CGI.
+func newServeHandler(isScript bool, contentType string) http.Handler {
+	var content http.Handler
+	if isScript {
+		content = newScriptHandler(".", fileOutput, contentType)
+	} else {
+		content = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			http.ServeFile(w, r, fileOutput)
+		})
 	}
 
-	req, err := http.NewRequest("GET", parsedURL.String(), nil)
-	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		content.ServeHTTP(w, r)
+	})
+}
+
+// newScriptHandler executes the script of dir with CGI for every request, in dir
+func newScriptHandler(dir, script, contentType string) http.Handler {
+	return &cgi.Handler{
+		Path: "/bin/sh",
+		Dir:  dir,
+		Args: []string{"-c", `echo "Content-Type: ` + contentType + `"; echo ""; /bin/sh ./` + script + ` 2>&1`},
+	}
+}
+
+// checkGitFlags rejects the flags that do not go with a git source
+func checkGitFlags(archive, script, spa bool, contentType, ref, commit, repoPath, entrypoint string) error {
+	switch {
+	case archive:
+		return errors.New("git and archive cannot be set together")
+	case contentType != "":
+		return errors.New("git and content-type cannot be set together")
+	case script && entrypoint == "":
+		return errors.New("script with git requires entrypoint")
+	case !script && entrypoint != "":
+		return errors.New("entrypoint requires script")
+	case script && spa:
+		return errors.New("script and spa cannot be set together")
+	case ref != "" && !gitsource.ValidRef(ref):
+		return fmt.Errorf("invalid ref %q", ref)
+	case commit != "" && !gitsource.IsCommit(commit):
+		return fmt.Errorf("invalid commit %q", commit)
+	case repoPath != "" && !gitsource.ValidPath(repoPath):
+		return fmt.Errorf("invalid path %q", repoPath)
+	case entrypoint != "" && !gitsource.ValidPath(entrypoint):
+		return fmt.Errorf("invalid entrypoint %q", entrypoint)
+	}
+	return nil
+}
+
+// parseExpectation reads the digest, the signature and the key the downloaded content is verified with
+func parseExpectation(digest, signature, publicKey string) (integrity.Expectation, error) {
+	var expected integrity.Expectation
+
+	if digest != "" {
+		var err error
+		expected.SHA256, err = integrity.ParseDigest(digest)
+		if err != nil {
+			return expected, err
+		}
 	}
 
-	req.Header.Set("User-Agent", "Koyebtest")
+	if signature == "" {
+		return expected, nil
+	}
 
-	// Execute the request
-	resp, err := client.Do(req)
+	var err error
+	expected.Signature, err = integrity.ParseSignature(signature)
 	if err != nil {
-		return fmt.Errorf("failed to make request: %w", err)
+		return expected, err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("HTTP error: %d %s", resp.StatusCode, resp.Status)
+	if publicKey == "" {
+		return expected, integrity.ErrMissingKey
+	}
+	expected.PublicKey, err = integrity.ParsePublicKey(publicKey)
+	if err != nil {
+		return expected, err
 	}
 
-	_, err = io.Copy(writer, resp.Body)
+	return expected, nil
+}
+
+// The sources of the content type of the metadata
+const (
+	contentTypeOverride  = "override"
+	contentTypeDefault   = "default"
+	contentTypeUpstream  = "upstream"
+	contentTypeExtension = "extension"
+	contentTypeSniffed   = "content"
+)
+
+// metadata describes the downloaded content, it is written next to it
+type metadata struct {
+	ContentType       string `json:"content_type,omitempty"`
+	ContentTypeSource string `json:"content_type_source,omitempty"`
+
+	// Files and ExtractedSize describe the site extracted from an archive or checked out from git
+	Files         int   `json:"files,omitempty"`
+	ExtractedSize int64 `json:"extracted_size,omitempty"`
+
+	// Commit is the commit of the repository that is served
+	Commit string `json:"commit,omitempty"`
+
+	// Verified tells that the downloaded content matched the expected sha256 and signature
+	Verified bool `json:"verified,omitempty"`
+}
+
+func writeMetadata(meta metadata) error {
+	data, err := json.MarshalIndent(meta, "", "  ")
 	if err != nil {
-		return fmt.Errorf("failed to copy response to output: %w", err)
+		return fmt.Errorf("failed to encode metadata: %w", err)
+	}
+
+	if err := os.WriteFile(metadataFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write metadata: %w", err)
 	}
 
 	return nil
 }
+
+// detectContentType picks the type of the downloaded file, in order: the override of the service, the type
+// sent by the source unless it is generic, the extension of the URL path, then the first bytes of the file
+func detectContentType(override, upstream, urlPath, filename string) (string, string, error) {
+	if override != "" {
+		return override, contentTypeOverride, nil
+	}
+
+	if contentType, err := types.NormalizeContentType(upstream); err == nil && !genericContentType(contentType) {
+		return contentType, contentTypeUpstream, nil
+	}
+
+	if ext := path.Ext(urlPath); ext != "" {
+		if contentType, err := types.NormalizeContentType(mime.TypeByExtension(ext)); err == nil {
+			return contentType, contentTypeExtension, nil
+		}
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to open %s: %w", filename, err)
+	}
+	defer file.Close()
+
+	// DetectContentType considers at most the first 512 bytes
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", "", fmt.Errorf("failed to read %s: %w", filename, err)
+	}
+
+	contentType, err := types.NormalizeContentType(http.DetectContentType(head[:n]))
+	if err != nil {
+		return "", "", err
+	}
+
+	return contentType, contentTypeSniffed, nil
+}
+
+// genericContentType reports whether a type sent by a source says nothing about the content
+func genericContentType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	switch mediaType {
+	case "application/octet-stream", "binary/octet-stream", "application/unknown", "application/x-unknown":
+		return true
+	}
+	return false
+}
@@ -2,6 +2,11 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"flag"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -9,6 +14,11 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/alexisvisco/koyebtests/internal/config"
+	"github.com/alexisvisco/koyebtests/internal/integrity"
+	"github.com/alexisvisco/koyebtests/internal/netguard"
 )
 
 // Table-driven test for generateNginxConfig
@@ -28,12 +38,17 @@ func TestGenerateNginxConfig(t *testing.T) {
 			isScript:    false,
 			expectedSub: "try_files /output =404;",
 		},
+		{
+			name:        "Static content type",
+			isScript:    false,
+			expectedSub: "default_type 'text/html; charset=utf-8';",
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			var buf bytes.Buffer
-			err := generateNginxConfig(tt.isScript, &buf)
+			err := generateNginxConfig(tt.isScript, "text/html; charset=utf-8", &buf)
 			if err != nil {
 				t.Fatalf("unexpected error: %v", err)
 			}
@@ -49,21 +64,40 @@ func TestGenerateNginxConfig(t *testing.T) {
 // Table-driven test for downloadFromURL
 func TestDownloadFromURL(t *testing.T) {
 	tests := []struct {
-		name           string
-		serverResponse string
-		statusCode     int
-		expectError    bool
+		name                string
+		serverResponse      string
+		statusCode          int
+		maxSize             int64
+		expectError         bool
+		expectedContentType string
 	}{
 		{
-			name:           "Valid response",
+			name:                "Valid response",
+			serverResponse:      "hello world",
+			statusCode:          http.StatusOK,
+			maxSize:             1024,
+			expectError:         false,
+			expectedContentType: "application/json",
+		},
+		{
+			name:                "Exactly the maximum size",
+			serverResponse:      "hello world",
+			statusCode:          http.StatusOK,
+			maxSize:             11,
+			expectedContentType: "application/json",
+		},
+		{
+			name:           "Too large",
 			serverResponse: "hello world",
 			statusCode:     http.StatusOK,
-			expectError:    false,
+			maxSize:        10,
+			expectError:    true,
 		},
 		{
 			name:           "404 response",
 			serverResponse: "not found",
 			statusCode:     http.StatusNotFound,
+			maxSize:        1024,
 			expectError:    true,
 		},
 	}
@@ -71,6 +105,7 @@ func TestDownloadFromURL(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
 				w.WriteHeader(tt.statusCode)
 				io.WriteString(w, tt.serverResponse)
 			}))
@@ -79,7 +114,7 @@ func TestDownloadFromURL(t *testing.T) {
 			parsedURL, _ := url.Parse(ts.URL)
 			var buf bytes.Buffer
 
-			err := downloadFromURL(parsedURL, &buf)
+			contentType, err := downloadFromURL(context.Background(), ts.Client(), parsedURL, &buf, tt.maxSize)
 
 			if tt.expectError && err == nil {
 				t.Errorf("expected error but got nil")
@@ -90,6 +125,9 @@ func TestDownloadFromURL(t *testing.T) {
 			if !tt.expectError && buf.String() != tt.serverResponse {
 				t.Errorf("unexpected response body: got %q, want %q", buf.String(), tt.serverResponse)
 			}
+			if contentType != tt.expectedContentType {
+				t.Errorf("unexpected content type: got %q, want %q", contentType, tt.expectedContentType)
+			}
 		})
 	}
 }
@@ -99,7 +137,7 @@ func TestCreateCGIWrapper(t *testing.T) {
 	// Cleanup
 	defer os.Remove("wrapper.sh")
 
-	err := createCGIWrapper()
+	err := createCGIWrapper("text/plain", "", fileOutput)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -114,3 +152,242 @@ func TestCreateCGIWrapper(t *testing.T) {
 		t.Errorf("wrapper.sh missing expected script call: got\n%s", string(data))
 	}
 }
+
+// Table-driven test for newServeHandler
+func TestServeHandler(t *testing.T) {
+	tests := []struct {
+		name           string
+		isScript       bool
+		content        string
+		path           string
+		expectedStatus int
+		expectedBody   string
+		expectedType   string
+	}{
+		{
+			name:           "Static root",
+			content:        "hello static",
+			path:           "/",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "hello static",
+			expectedType:   "text/html; charset=utf-8",
+		},
+		{
+			name:           "Static other path",
+			content:        "hello static",
+			path:           "/other",
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "Script root",
+			isScript:       true,
+			content:        "echo hello from $REQUEST_METHOD",
+			path:           "/",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "hello from GET\n",
+			expectedType:   "text/html; charset=utf-8",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+
+			if err := os.WriteFile(fileOutput, []byte(tt.content), 0755); err != nil {
+				t.Fatalf("failed to write output: %v", err)
+			}
+
+			ts := httptest.NewServer(newServeHandler(tt.isScript, "text/html; charset=utf-8"))
+			defer ts.Close()
+
+			resp, err := http.Get(ts.URL + tt.path)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d", tt.expectedStatus, resp.StatusCode)
+			}
+
+			body, _ := io.ReadAll(resp.Body)
+			if tt.expectedBody != "" && string(body) != tt.expectedBody {
+				t.Errorf("unexpected body: got %q, want %q", string(body), tt.expectedBody)
+			}
+			if tt.expectedType != "" && resp.Header.Get("Content-Type") != tt.expectedType {
+				t.Errorf("unexpected content type: got %q, want %q", resp.Header.Get("Content-Type"), tt.expectedType)
+			}
+		})
+	}
+}
+
+// Test downloadFromURL with the guarded client refuses private destinations
+func TestDownloadFromURLRefusesPrivateDestination(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "secret")
+	}))
+	defer ts.Close()
+
+	parsedURL, _ := url.Parse(ts.URL)
+	var buf bytes.Buffer
+
+	_, err := downloadFromURL(context.Background(), netguard.NewHTTPClient(time.Second, nil), parsedURL, &buf, defaultMaxDownloadSize)
+	if !errors.Is(err, netguard.ErrForbiddenDestination) {
+		t.Fatalf("expected %v, got %v", netguard.ErrForbiddenDestination, err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("expected nothing downloaded, got %q", buf.String())
+	}
+}
+
+// Table-driven test for detectContentType
+func TestDetectContentType(t *testing.T) {
+	tests := []struct {
+		name           string
+		override       string
+		upstream       string
+		urlPath        string
+		content        string
+		expectedType   string
+		expectedSource string
+	}{
+		{
+			name:           "Override",
+			override:       "text/css",
+			upstream:       "text/html",
+			content:        "<html></html>",
+			expectedType:   "text/css",
+			expectedSource: contentTypeOverride,
+		},
+		{
+			name:           "Upstream",
+			upstream:       "Application/JSON; Charset=UTF-8",
+			urlPath:        "/data.txt",
+			content:        `{"a":1}`,
+			expectedType:   "application/json; charset=utf-8",
+			expectedSource: contentTypeUpstream,
+		},
+		{
+			name:           "Generic upstream falls back to the extension",
+			upstream:       "application/octet-stream",
+			urlPath:        "/image.png",
+			content:        "not really a png",
+			expectedType:   "image/png",
+			expectedSource: contentTypeExtension,
+		},
+		{
+			name:           "Sniffed html",
+			urlPath:        "/raw/UCVAQpD4",
+			content:        "<!DOCTYPE html><html><body>hello</body></html>",
+			expectedType:   "text/html; charset=utf-8",
+			expectedSource: contentTypeSniffed,
+		},
+		{
+			name:           "Sniffed png",
+			upstream:       "application/octet-stream",
+			content:        "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR",
+			expectedType:   "image/png",
+			expectedSource: contentTypeSniffed,
+		},
+		{
+			name:           "Invalid upstream is ignored",
+			upstream:       "text/html'; evil",
+			content:        "hello",
+			expectedType:   "text/plain; charset=utf-8",
+			expectedSource: contentTypeSniffed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+
+			if err := os.WriteFile(fileOutput, []byte(tt.content), 0644); err != nil {
+				t.Fatalf("failed to write output: %v", err)
+			}
+
+			contentType, source, err := detectContentType(tt.override, tt.upstream, tt.urlPath, fileOutput)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if contentType != tt.expectedType || source != tt.expectedSource {
+				t.Errorf("got %q from %s, want %q from %s", contentType, source, tt.expectedType, tt.expectedSource)
+			}
+		})
+	}
+}
+
+func TestParseExpectation(t *testing.T) {
+	publicKey, privateKey, _ := ed25519.GenerateKey(nil)
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, []byte("content")))
+	digest := strings.Repeat("AB", 32)
+
+	tests := []struct {
+		name        string
+		digest      string
+		signature   string
+		publicKey   string
+		expectError bool
+	}{
+		{name: "nothing"},
+		{name: "digest", digest: digest},
+		{name: "signature", signature: signature, publicKey: integrity.EncodePublicKey(publicKey)},
+		{name: "invalid digest", digest: "abc", expectError: true},
+		{name: "invalid signature", signature: "c2lnbmF0dXJl", publicKey: integrity.EncodePublicKey(publicKey), expectError: true},
+		{name: "signature without key", signature: signature, expectError: true},
+		{name: "invalid key", signature: signature, publicKey: "a2V5", expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expected, err := parseExpectation(tt.digest, tt.signature, tt.publicKey)
+			if (err != nil) != tt.expectError {
+				t.Fatalf("expected error %v, got %v", tt.expectError, err)
+			}
+			if tt.digest != "" && !tt.expectError && expected.SHA256 != strings.ToLower(tt.digest) {
+				t.Errorf("expected the normalized digest, got %q", expected.SHA256)
+			}
+		})
+	}
+}
+
+func TestFlagsFromEnv(t *testing.T) {
+	t.Setenv("DOWNLOAD_RETRIES", "5")
+	t.Setenv("DOWNLOAD_TIMEOUT", "1m")
+
+	flags := flag.NewFlagSet("init", flag.ContinueOnError)
+	retries := flags.Int("retries", defaultRetries, "")
+	timeout := flags.Duration("download-timeout", defaultDownloadTimeout, "")
+	maxRedirects := flags.Int("max-redirects", defaultMaxRedirects, "")
+	if err := flags.Parse([]string{"-download-timeout=10s"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := flagsFromEnv(flags, envFlags); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The command line wins over the environment, which wins over the default
+	if *retries != 5 || *timeout != 10*time.Second || *maxRedirects != defaultMaxRedirects {
+		t.Fatalf("unexpected flags: retries %d, timeout %s, max redirects %d", *retries, *timeout, *maxRedirects)
+	}
+
+	t.Setenv("MAX_REDIRECTS", "many")
+	if err := flagsFromEnv(flags, envFlags); err == nil || !strings.Contains(err.Error(), "MAX_REDIRECTS") {
+		t.Fatalf("expected an error on MAX_REDIRECTS, got %v", err)
+	}
+}
+
+func TestDefaultsMatchJobConfig(t *testing.T) {
+	download := config.Default().Job.Download
+	archive := config.Default().Job.Archive
+
+	timeout, _ := time.ParseDuration(download.Timeout)
+	if download.MaxSize != defaultMaxDownloadSize || download.Retries != defaultRetries ||
+		download.MaxRedirects != defaultMaxRedirects || timeout != defaultDownloadTimeout {
+		t.Fatalf("the defaults of init differ from the job config: %+v", download)
+	}
+	if archive.MaxFiles != defaultMaxArchiveFiles || archive.MaxExtractedSize != defaultMaxArchiveSize {
+		t.Fatalf("the defaults of init differ from the job config: %+v", archive)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"os/exec"
+
+	"github.com/alexisvisco/koyebtests/internal/initstatus"
+)
+
+// statusReporter writes the status file of init, the local backend reads it to explain a failure
+type statusReporter struct {
+	logger *slog.Logger
+
+	// attempts is how many times the content was requested
+	attempts int
+}
+
+// fail logs the failure, records it in the status file and exits with the code of its class
+func (r *statusReporter) fail(class initstatus.Class, message string, err error, args ...any) {
+	reason := message
+	if err != nil {
+		reason += ": " + err.Error()
+		args = append([]any{"error", err}, args...)
+	}
+	r.logger.Error(message, append(args, "class", class)...)
+
+	r.write(initstatus.Status{State: initstatus.StateFailed, Class: class, Error: reason, Attempts: r.attempts})
+	os.Exit(class.ExitCode())
+}
+
+// ready records that the content is prepared
+func (r *statusReporter) ready() {
+	r.write(initstatus.Status{State: initstatus.StateReady, Attempts: r.attempts})
+}
+
+func (r *statusReporter) write(status initstatus.Status) {
+	if err := initstatus.Write(initstatus.File, status); err != nil {
+		r.logger.Warn("failed to write status", "error", err, "filename", initstatus.File)
+	}
+}
+
+// classifyContentError returns the class of a failure to extract an archive or to check out a repository
+func classifyContentError(err error) initstatus.Class {
+	var exitErr *exec.ExitError
+	switch {
+	case errors.Is(err, errArchiveTooLarge):
+		return initstatus.ClassTooLarge
+	case errors.Is(err, errCommitMismatch):
+		return initstatus.ClassIntegrity
+	case errors.As(err, &exitErr):
+		// git exits with an error when the repository or the ref cannot be fetched
+		return initstatus.ClassUpstream
+	default:
+		return initstatus.ClassInvalidContent
+	}
+}
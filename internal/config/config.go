@@ -0,0 +1,277 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/alexisvisco/koyebtests/internal/types"
+)
+
+// Config is the server configuration, loaded from a JSON file on top of the defaults
+type Config struct {
+	Job   JobConfig   `json:"job"`
+	Quota QuotaConfig `json:"quota"`
+
+	// ProjectQuota caps the resources of the services of each project
+	ProjectQuota QuotaConfig `json:"project_quota"`
+}
+
+// JobConfig is the template of the jobs created for the services
+type JobConfig struct {
+	Image         string                     `json:"image"`
+	Region        string                     `json:"region"`
+	Datacenters   []string                   `json:"datacenters"`
+	Resources     types.Resources            `json:"resources"`
+	Replicas      int                        `json:"replicas"`
+	InstanceTypes map[string]types.Resources `json:"instance_types"`
+	Limits        JobLimits                  `json:"limits"`
+	Download      DownloadConfig             `json:"download"`
+	Archive       ArchiveConfig              `json:"archive"`
+}
+
+// InitEnv returns the environment variables configuring init in every job
+func (c JobConfig) InitEnv() map[string]string {
+	env := c.Download.Env()
+	maps.Copy(env, c.Archive.Env())
+	return env
+}
+
+// DownloadConfig bounds the download of the sources by init, it is handed to init through its environment
+type DownloadConfig struct {
+	// MaxSize is the maximum number of bytes downloaded from the url
+	MaxSize int64 `json:"max_size"`
+
+	// Retries is how many times a transient failure of the download is retried
+	Retries int `json:"retries"`
+
+	MaxRedirects int `json:"max_redirects"`
+
+	// Timeout bounds each attempt of the download, body included, such as "30s"
+	Timeout string `json:"timeout"`
+}
+
+// Env returns the environment variables init reads the limits of the download from
+func (d DownloadConfig) Env() map[string]string {
+	return map[string]string{
+		"MAX_DOWNLOAD_SIZE": strconv.FormatInt(d.MaxSize, 10),
+		"DOWNLOAD_RETRIES":  strconv.Itoa(d.Retries),
+		"MAX_REDIRECTS":     strconv.Itoa(d.MaxRedirects),
+		"DOWNLOAD_TIMEOUT":  d.Timeout,
+	}
+}
+
+// ArchiveConfig bounds the extraction of the archives by init, it is handed to init through its environment
+type ArchiveConfig struct {
+	// MaxFiles is the maximum number of entries extracted from an archive
+	MaxFiles int `json:"max_files"`
+
+	// MaxExtractedSize is the maximum number of bytes extracted from an archive
+	MaxExtractedSize int64 `json:"max_extracted_size"`
+}
+
+// Env returns the environment variables init reads the limits of the extraction from
+func (a ArchiveConfig) Env() map[string]string {
+	return map[string]string{
+		"MAX_ARCHIVE_FILES":  strconv.Itoa(a.MaxFiles),
+		"MAX_EXTRACTED_SIZE": strconv.FormatInt(a.MaxExtractedSize, 10),
+	}
+}
+
+func (a ArchiveConfig) validate() error {
+	if a.MaxFiles <= 0 || a.MaxExtractedSize <= 0 {
+		return errors.New("archive.max_files and archive.max_extracted_size must be positive")
+	}
+	return nil
+}
+
+func (d DownloadConfig) validate() error {
+	if d.MaxSize <= 0 {
+		return errors.New("download.max_size must be positive")
+	}
+	if d.Retries < 0 || d.MaxRedirects < 0 {
+		return errors.New("download.retries and download.max_redirects cannot be negative")
+	}
+	if timeout, err := time.ParseDuration(d.Timeout); err != nil || timeout <= 0 {
+		return fmt.Errorf("download.timeout must be a positive duration, got %q", d.Timeout)
+	}
+	return nil
+}
+
+// JobLimits bounds what a request is allowed to override in the template.
+// An empty allowed list only allows the default value of the template.
+type JobLimits struct {
+	MinResources       types.Resources `json:"min_resources"`
+	MaxResources       types.Resources `json:"max_resources"`
+	MaxReplicas        int             `json:"max_replicas"`
+	AllowedImages      []string        `json:"allowed_images"`
+	AllowedRegions     []string        `json:"allowed_regions"`
+	AllowedDatacenters []string        `json:"allowed_datacenters"`
+}
+
+func Default() Config {
+	return Config{
+		Job: JobConfig{
+			Image:       "alexisvisco/koyeb-nginx",
+			Region:      "global",
+			Datacenters: []string{"dc1"},
+			Resources: types.Resources{
+				CPU:          100,
+				MemoryMB:     128,
+				NetworkMBits: 10,
+			},
+			Replicas: 1,
+			InstanceTypes: map[string]types.Resources{
+				"nano":   {CPU: 100, MemoryMB: 128, NetworkMBits: 10},
+				"small":  {CPU: 250, MemoryMB: 256, NetworkMBits: 20},
+				"medium": {CPU: 500, MemoryMB: 512, NetworkMBits: 50},
+			},
+			Limits: JobLimits{
+				MinResources: types.Resources{
+					CPU:          50,
+					MemoryMB:     32,
+					NetworkMBits: 1,
+				},
+				MaxResources: types.Resources{
+					CPU:          1000,
+					MemoryMB:     1024,
+					NetworkMBits: 100,
+				},
+				MaxReplicas: 5,
+			},
+			Download: DownloadConfig{
+				MaxSize:      256 << 20,
+				Retries:      3,
+				MaxRedirects: 10,
+				Timeout:      "30s",
+			},
+			Archive: ArchiveConfig{
+				MaxFiles:         10000,
+				MaxExtractedSize: 512 << 20,
+			},
+		},
+	}
+}
+
+// Load reads the configuration file, the keys missing from the file keep their default value
+func Load(path string) (Config, error) {
+	cfg := Default()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to read config file %s: %w", path, err)
+	}
+
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("failed to decode config file %s: %w", path, err)
+	}
+
+	if err := cfg.Job.Download.validate(); err != nil {
+		return cfg, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	if err := cfg.Job.Archive.validate(); err != nil {
+		return cfg, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+// Resolve applies the overrides of the input to the template and checks them against the limits
+func (c JobConfig) Resolve(input types.CreateJobInput) (types.JobSpec, error) {
+	spec := types.JobSpec{
+		Image:       c.Image,
+		Region:      c.Region,
+		Datacenters: c.Datacenters,
+		Resources:   c.Resources,
+		Replicas:    max(c.Replicas, 1),
+	}
+
+	if input.InstanceType != "" {
+		resources, ok := c.InstanceTypes[input.InstanceType]
+		if !ok {
+			return spec, &types.ValidationError{Field: "instance_type", Message: fmt.Sprintf("%q does not exist", input.InstanceType)}
+		}
+		spec.InstanceType = input.InstanceType
+		spec.Resources = resources
+	}
+
+	if input.Image != "" && input.Image != c.Image {
+		if !slices.Contains(c.Limits.AllowedImages, input.Image) {
+			return spec, &types.ValidationError{Field: "image", Message: "is not allowed"}
+		}
+		spec.Image = input.Image
+	}
+
+	if input.Region != "" && input.Region != c.Region {
+		if !slices.Contains(c.Limits.AllowedRegions, input.Region) {
+			return spec, &types.ValidationError{Field: "region", Message: "is not allowed"}
+		}
+		spec.Region = input.Region
+	}
+
+	if len(input.Datacenters) > 0 {
+		for _, dc := range input.Datacenters {
+			if !slices.Contains(c.Datacenters, dc) && !slices.Contains(c.Limits.AllowedDatacenters, dc) {
+				return spec, &types.ValidationError{Field: "datacenters", Message: fmt.Sprintf("%q is not allowed", dc)}
+			}
+		}
+		spec.Datacenters = input.Datacenters
+	}
+
+	if input.Replicas != 0 {
+		if input.Replicas < 1 || input.Replicas > c.Limits.MaxReplicas {
+			return spec, &types.ValidationError{Field: "replicas", Message: fmt.Sprintf("must be between 1 and %d", c.Limits.MaxReplicas)}
+		}
+		spec.Replicas = input.Replicas
+	}
+
+	resources := []struct {
+		field    string
+		value    int
+		target   *int
+		min, max int
+	}{
+		{"resources.cpu", input.Resources.CPU, &spec.Resources.CPU, c.Limits.MinResources.CPU, c.Limits.MaxResources.CPU},
+		{"resources.memory_mb", input.Resources.MemoryMB, &spec.Resources.MemoryMB, c.Limits.MinResources.MemoryMB, c.Limits.MaxResources.MemoryMB},
+		{"resources.network_mbits", input.Resources.NetworkMBits, &spec.Resources.NetworkMBits, c.Limits.MinResources.NetworkMBits, c.Limits.MaxResources.NetworkMBits},
+	}
+
+	for _, r := range resources {
+		if r.value == 0 {
+			continue
+		}
+		if r.value < r.min || r.value > r.max {
+			return spec, &types.ValidationError{Field: r.field, Message: fmt.Sprintf("must be between %d and %d", r.min, r.max)}
+		}
+		*r.target = r.value
+	}
+
+	return spec, nil
+}
+
+// QuotaConfig caps the resources used by all the services together, zero means unlimited
+type QuotaConfig struct {
+	MaxCPU      int `json:"max_cpu"`
+	MaxMemoryMB int `json:"max_memory_mb"`
+	MaxServices int `json:"max_services"`
+}
+
+// Check returns a *types.QuotaError when the usage is above the quota
+func (q QuotaConfig) Check(usage types.Resources, services int) error {
+	switch {
+	case q.MaxServices > 0 && services > q.MaxServices:
+		return &types.QuotaError{Resource: types.QuotaResourceServices, Usage: services, Limit: q.MaxServices}
+	case q.MaxCPU > 0 && usage.CPU > q.MaxCPU:
+		return &types.QuotaError{Resource: types.QuotaResourceCPU, Usage: usage.CPU, Limit: q.MaxCPU}
+	case q.MaxMemoryMB > 0 && usage.MemoryMB > q.MaxMemoryMB:
+		return &types.QuotaError{Resource: types.QuotaResourceMemory, Usage: usage.MemoryMB, Limit: q.MaxMemoryMB}
+	}
+
+	return nil
+}
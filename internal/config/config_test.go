@@ -0,0 +1,198 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/alexisvisco/koyebtests/internal/types"
+)
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	content := `{"job": {"image": "registry.example.com/nginx", "resources": {"cpu": 200}}}`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if cfg.Job.Image != "registry.example.com/nginx" {
+		t.Errorf("expected image from file, got %s", cfg.Job.Image)
+	}
+	if cfg.Job.Resources.CPU != 200 || cfg.Job.Resources.MemoryMB != 128 {
+		t.Errorf("expected cpu from file and default memory, got %+v", cfg.Job.Resources)
+	}
+	if cfg.Job.Region != "global" || !reflect.DeepEqual(cfg.Job.Datacenters, []string{"dc1"}) {
+		t.Errorf("expected default placement, got %s %v", cfg.Job.Region, cfg.Job.Datacenters)
+	}
+	if cfg.Job.Download != Default().Job.Download || cfg.Job.Archive != Default().Job.Archive {
+		t.Errorf("expected the default download and archive limits, got %+v %+v", cfg.Job.Download, cfg.Job.Archive)
+	}
+}
+
+func TestLoadRejectsInvalidInitLimits(t *testing.T) {
+	tests := map[string]string{
+		"zero size":        `{"job": {"download": {"max_size": 0}}}`,
+		"negative retries": `{"job": {"download": {"retries": -1}}}`,
+		"invalid timeout":  `{"job": {"download": {"timeout": "soon"}}}`,
+		"zero files":       `{"job": {"archive": {"max_files": 0}}}`,
+	}
+
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.json")
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatalf("failed to write config: %v", err)
+			}
+
+			if _, err := Load(path); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestJobConfigResolve(t *testing.T) {
+	cfg := Default().Job
+	cfg.Limits.AllowedRegions = []string{"europe"}
+	cfg.Limits.AllowedDatacenters = []string{"dc2"}
+
+	tests := []struct {
+		name          string
+		input         types.CreateJobInput
+		expected      types.JobSpec
+		expectedField string
+	}{
+		{
+			name:  "defaults",
+			input: types.CreateJobInput{},
+			expected: types.JobSpec{
+				Image:       "alexisvisco/koyeb-nginx",
+				Region:      "global",
+				Datacenters: []string{"dc1"},
+				Resources:   types.Resources{CPU: 100, MemoryMB: 128, NetworkMBits: 10},
+				Replicas:    1,
+			},
+		},
+		{
+			name:  "overrides within limits",
+			input: types.CreateJobInput{Region: "europe", Datacenters: []string{"dc2"}, Resources: types.Resources{CPU: 500, MemoryMB: 512}},
+			expected: types.JobSpec{
+				Image:       "alexisvisco/koyeb-nginx",
+				Region:      "europe",
+				Datacenters: []string{"dc2"},
+				Resources:   types.Resources{CPU: 500, MemoryMB: 512, NetworkMBits: 10},
+				Replicas:    1,
+			},
+		},
+		{
+			name:  "instance type with an override",
+			input: types.CreateJobInput{InstanceType: "small", Resources: types.Resources{MemoryMB: 384}},
+			expected: types.JobSpec{
+				InstanceType: "small",
+				Image:        "alexisvisco/koyeb-nginx",
+				Region:       "global",
+				Datacenters:  []string{"dc1"},
+				Resources:    types.Resources{CPU: 250, MemoryMB: 384, NetworkMBits: 20},
+				Replicas:     1,
+			},
+		},
+		{
+			name:  "replicas",
+			input: types.CreateJobInput{Replicas: 3},
+			expected: types.JobSpec{
+				Image:       "alexisvisco/koyeb-nginx",
+				Region:      "global",
+				Datacenters: []string{"dc1"},
+				Resources:   types.Resources{CPU: 100, MemoryMB: 128, NetworkMBits: 10},
+				Replicas:    3,
+			},
+		},
+		{
+			name:          "replicas above the maximum",
+			input:         types.CreateJobInput{Replicas: 6},
+			expectedField: "replicas",
+		},
+		{
+			name:          "unknown instance type",
+			input:         types.CreateJobInput{InstanceType: "huge"},
+			expectedField: "instance_type",
+		},
+		{
+			name:          "cpu above the maximum",
+			input:         types.CreateJobInput{Resources: types.Resources{CPU: 5000}},
+			expectedField: "resources.cpu",
+		},
+		{
+			name:          "memory below the minimum",
+			input:         types.CreateJobInput{Resources: types.Resources{MemoryMB: 1}},
+			expectedField: "resources.memory_mb",
+		},
+		{
+			name:          "image not allowed",
+			input:         types.CreateJobInput{Image: "evil/image"},
+			expectedField: "image",
+		},
+		{
+			name:          "datacenter not allowed",
+			input:         types.CreateJobInput{Datacenters: []string{"dc3"}},
+			expectedField: "datacenters",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec, err := cfg.Resolve(tt.input)
+
+			if tt.expectedField != "" {
+				var validationErr *types.ValidationError
+				if !errors.As(err, &validationErr) || validationErr.Field != tt.expectedField {
+					t.Fatalf("expected validation error on %s, got %v", tt.expectedField, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(spec, tt.expected) {
+				t.Errorf("expected %+v, got %+v", tt.expected, spec)
+			}
+		})
+	}
+}
+
+func TestQuotaConfigCheck(t *testing.T) {
+	quota := QuotaConfig{MaxCPU: 1000, MaxMemoryMB: 1024, MaxServices: 3}
+
+	tests := []struct {
+		name     string
+		usage    types.Resources
+		services int
+		exceeded bool
+	}{
+		{name: "within quota", usage: types.Resources{CPU: 1000, MemoryMB: 1024}, services: 3},
+		{name: "too many services", usage: types.Resources{CPU: 100, MemoryMB: 128}, services: 4, exceeded: true},
+		{name: "too much cpu", usage: types.Resources{CPU: 1001, MemoryMB: 128}, services: 1, exceeded: true},
+		{name: "too much memory", usage: types.Resources{CPU: 100, MemoryMB: 2048}, services: 1, exceeded: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := quota.Check(tt.usage, tt.services)
+			if errors.Is(err, types.ErrQuotaExceeded) != tt.exceeded {
+				t.Fatalf("expected exceeded=%v, got %v", tt.exceeded, err)
+			}
+		})
+	}
+
+	if err := (QuotaConfig{}).Check(types.Resources{CPU: 1 << 20}, 1000); err != nil {
+		t.Fatalf("expected an empty quota to be unlimited, got %v", err)
+	}
+}
@@ -0,0 +1,186 @@
+// Package gitsource resolves the refs of the git repositories used as sources. The API pins each
+// service to the commit of its ref when it is created, so that every replica and every restart
+// serves the same content even when the branch moves.
+package gitsource
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxAdvertisementSize caps the list of refs read from a repository
+const maxAdvertisementSize = 16 << 20
+
+var (
+	ErrRefNotFound       = errors.New("ref not found")
+	ErrInvalidRepository = errors.New("invalid repository")
+)
+
+var (
+	commitPattern = regexp.MustCompile(`^([0-9a-f]{40}|[0-9a-f]{64})$`)
+
+	// refPattern accepts branch and tag names, it refuses the options of git and the revision expressions
+	refPattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._/-]*$`)
+
+	// pathPattern accepts the paths that are safe in the nginx configuration and in a shell command
+	pathPattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._/-]*$`)
+)
+
+// IsCommit reports whether the ref is a full commit hash
+func IsCommit(ref string) bool {
+	return commitPattern.MatchString(ref)
+}
+
+// ValidRef reports whether the ref is a branch, a tag or a full commit hash that can be passed to git
+func ValidRef(ref string) bool {
+	return refPattern.MatchString(ref) && !strings.Contains(ref, "..") && !strings.HasSuffix(ref, "/") &&
+		!strings.HasSuffix(ref, ".lock")
+}
+
+// ValidPath reports whether the path stays inside of the repository
+func ValidPath(p string) bool {
+	return pathPattern.MatchString(p) && path.Clean(p) == strings.TrimSuffix(p, "/") &&
+		!strings.HasPrefix(path.Clean(p), "..") && p != ".git" && !strings.HasPrefix(p, ".git/")
+}
+
+// Resolver looks up the commit of a ref with the smart HTTP protocol of git, without cloning
+type Resolver struct {
+	// Client defaults to http.DefaultClient, it should refuse the private addresses
+	Client *http.Client
+}
+
+// Resolve returns the commit of the ref: a branch, a tag or HEAD when the ref is empty. A full
+// commit hash is returned as is, the init binary checks that it exists when it fetches it.
+func (r *Resolver) Resolve(ctx context.Context, repoURL, ref string) (string, error) {
+	if IsCommit(ref) {
+		return ref, nil
+	}
+
+	refs, err := r.listRefs(ctx, repoURL)
+	if err != nil {
+		return "", err
+	}
+
+	// The same order as git: a full name, the tags (peeled to their commit) then the branches
+	var candidates []string
+	switch {
+	case ref == "" || ref == "HEAD":
+		candidates = []string{"HEAD"}
+	case strings.HasPrefix(ref, "refs/"):
+		candidates = []string{ref + "^{}", ref}
+	default:
+		candidates = []string{"refs/tags/" + ref + "^{}", "refs/tags/" + ref, "refs/heads/" + ref}
+	}
+
+	for _, candidate := range candidates {
+		if commit, ok := refs[candidate]; ok {
+			return commit, nil
+		}
+	}
+
+	if ref == "" {
+		return "", fmt.Errorf("%w: the repository has no HEAD", ErrRefNotFound)
+	}
+	return "", fmt.Errorf("%w: %s", ErrRefNotFound, ref)
+}
+
+// listRefs reads the refs advertised by the git-upload-pack service of the repository
+func (r *Resolver) listRefs(ctx context.Context, repoURL string) (map[string]string, error) {
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(repoURL, "/")+"/info/refs?service=git-upload-pack", nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRepository, err)
+	}
+	req.Header.Set("User-Agent", "git/koyebtest")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRepository, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: HTTP error %d", ErrInvalidRepository, resp.StatusCode)
+	}
+	if resp.Header.Get("Content-Type") != "application/x-git-upload-pack-advertisement" {
+		return nil, fmt.Errorf("%w: the server does not speak the smart HTTP protocol", ErrInvalidRepository)
+	}
+
+	return parseAdvertisement(io.LimitReader(resp.Body, maxAdvertisementSize))
+}
+
+// parseAdvertisement reads the pkt-lines of a ref advertisement: the service announcement, a flush
+// packet, then one "<hash> <ref>" line per ref, the first one carrying the capabilities after a NUL
+func parseAdvertisement(r io.Reader) (map[string]string, error) {
+	reader := bufio.NewReader(r)
+	refs := make(map[string]string)
+
+	announced := false
+	for {
+		line, flush, err := readPktLine(reader)
+		if errors.Is(err, io.EOF) {
+			return refs, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidRepository, err)
+		}
+
+		if !announced {
+			if !flush && strings.HasPrefix(line, "# service=") {
+				continue
+			}
+			announced = true
+			if flush {
+				continue
+			}
+		}
+		if flush {
+			return refs, nil
+		}
+
+		line, _, _ = strings.Cut(strings.TrimSuffix(line, "\n"), "\x00")
+		hash, name, ok := strings.Cut(line, " ")
+		if !ok || !commitPattern.MatchString(hash) {
+			return nil, fmt.Errorf("%w: malformed ref line %q", ErrInvalidRepository, line)
+		}
+		refs[name] = hash
+	}
+}
+
+// readPktLine reads a line prefixed by its length in 4 hexadecimal digits, 0000 is a flush packet
+func readPktLine(r *bufio.Reader) (string, bool, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return "", false, err
+	}
+
+	n, err := strconv.ParseUint(string(size[:]), 16, 16)
+	if err != nil {
+		return "", false, fmt.Errorf("malformed pkt-line length %q", size)
+	}
+	if n == 0 {
+		return "", true, nil
+	}
+	if n < 4 {
+		return "", false, fmt.Errorf("malformed pkt-line length %d", n)
+	}
+
+	line := make([]byte, n-4)
+	if _, err := io.ReadFull(r, line); err != nil {
+		return "", false, err
+	}
+
+	return string(line), false, nil
+}
@@ -0,0 +1,180 @@
+package gitsource
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// git runs a git command in the directory and returns its output
+func git(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_CONFIG_NOSYSTEM=1", "GIT_CONFIG_GLOBAL=/dev/null",
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// newRepoServer serves a bare repository with two commits over the smart HTTP protocol
+func newRepoServer(t *testing.T) (*httptest.Server, map[string]string) {
+	t.Helper()
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	backend, err := exec.Command("git", "--exec-path").Output()
+	if err != nil {
+		t.Skipf("failed to locate git-http-backend: %v", err)
+	}
+
+	dir := t.TempDir()
+	work := filepath.Join(dir, "work")
+	git(t, dir, "init", "-q", "-b", "main", work)
+
+	commits := make(map[string]string)
+	os.WriteFile(filepath.Join(work, "index.html"), []byte("v1"), 0644)
+	git(t, work, "add", ".")
+	git(t, work, "commit", "-q", "-m", "v1")
+	git(t, work, "tag", "-a", "-m", "release", "v1.0.0")
+	commits["v1"] = git(t, work, "rev-parse", "HEAD")
+
+	os.WriteFile(filepath.Join(work, "index.html"), []byte("v2"), 0644)
+	git(t, work, "commit", "-q", "-am", "v2")
+	commits["v2"] = git(t, work, "rev-parse", "HEAD")
+
+	git(t, dir, "clone", "-q", "--bare", work, filepath.Join(dir, "repo.git"))
+
+	server := httptest.NewServer(&cgi.Handler{
+		Path: filepath.Join(strings.TrimSpace(string(backend)), "git-http-backend"),
+		Env:  []string{"GIT_PROJECT_ROOT=" + dir, "GIT_HTTP_EXPORT_ALL=1"},
+	})
+	t.Cleanup(server.Close)
+
+	return server, commits
+}
+
+func TestResolve(t *testing.T) {
+	server, commits := newRepoServer(t)
+	resolver := &Resolver{Client: server.Client()}
+
+	tests := []struct {
+		name    string
+		ref     string
+		want    string
+		wantErr error
+	}{
+		{name: "default branch", ref: "", want: commits["v2"]},
+		{name: "head", ref: "HEAD", want: commits["v2"]},
+		{name: "branch", ref: "main", want: commits["v2"]},
+		{name: "full branch name", ref: "refs/heads/main", want: commits["v2"]},
+		{name: "annotated tag", ref: "v1.0.0", want: commits["v1"]},
+		{name: "commit", ref: commits["v1"], want: commits["v1"]},
+		{name: "unknown ref", ref: "missing", wantErr: ErrRefNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolver.Resolve(context.Background(), server.URL+"/repo.git", tt.ref)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("expected commit %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestResolveInvalidRepository(t *testing.T) {
+	server, _ := newRepoServer(t)
+	resolver := &Resolver{Client: server.Client()}
+
+	_, err := resolver.Resolve(context.Background(), server.URL+"/missing.git", "main")
+	if !errors.Is(err, ErrInvalidRepository) {
+		t.Fatalf("expected ErrInvalidRepository, got %v", err)
+	}
+
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html></html>"))
+	}))
+	defer plain.Close()
+
+	_, err = resolver.Resolve(context.Background(), plain.URL, "main")
+	if !errors.Is(err, ErrInvalidRepository) {
+		t.Fatalf("expected ErrInvalidRepository for a web page, got %v", err)
+	}
+}
+
+func TestValidRef(t *testing.T) {
+	tests := []struct {
+		ref  string
+		want bool
+	}{
+		{ref: "main", want: true},
+		{ref: "feature/login", want: true},
+		{ref: "v1.2.3", want: true},
+		{ref: "refs/heads/main", want: true},
+		{ref: "-upload-pack=sh"},
+		{ref: "main..other"},
+		{ref: "HEAD~1"},
+		{ref: "main^{tree}"},
+		{ref: "with space"},
+		{ref: "branch.lock"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			if got := ValidRef(tt.ref); got != tt.want {
+				t.Errorf("ValidRef(%q) = %v, want %v", tt.ref, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{path: "docs", want: true},
+		{path: "site/public", want: true},
+		{path: "dist/", want: true},
+		{path: "../etc"},
+		{path: "docs/../../etc"},
+		{path: "/etc"},
+		{path: ".git"},
+		{path: ".git/config"},
+		{path: "a b"},
+		{path: "docs;rm"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := ValidPath(tt.path); got != tt.want {
+				t.Errorf("ValidPath(%q) = %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/alexisvisco/koyebtests/internal/types"
+	"github.com/google/uuid"
+)
+
+// apiKeyPrefix makes the keys easy to spot in logs and secret scanners
+const apiKeyPrefix = "kt_"
+
+type AuthParams struct {
+	Keys types.APIKeyStore
+
+	// AdminKey manages the API keys and can access every service, empty disables it
+	AdminKey string
+}
+
+type APIKeyResponse struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Project   string    `json:"project"`
+	Key       string    `json:"key,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type CreateAPIKeyRequest struct {
+	Name string `json:"name"`
+
+	// Project is the only project the key can access, the default one when empty
+	Project string `json:"project"`
+}
+
+type ListAPIKeysResponse struct {
+	APIKeys []APIKeyResponse `json:"api_keys"`
+}
+
+// caller is the authenticated key of a request
+type caller struct {
+	keyID   string
+	project string
+	admin   bool
+}
+
+type callerContextKey struct{}
+
+// Authenticate rejects the requests without a valid API key in the Authorization header
+// and records the key of the caller for the handlers
+func Authenticate(params AuthParams, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || key == "" {
+			unauthorized(w, r)
+			return
+		}
+
+		if params.AdminKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(params.AdminKey)) == 1 {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), callerContextKey{}, caller{admin: true})))
+			return
+		}
+
+		apiKey, err := params.Keys.GetAPIKeyByHash(hashAPIKey(key))
+		if errors.Is(err, types.ErrAPIKeyNotFound) {
+			unauthorized(w, r)
+			return
+		}
+		if err != nil {
+			internalProblem(w, r, "failed_authenticate", err)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), callerContextKey{}, caller{keyID: apiKey.ID, project: apiKey.Project})))
+	})
+}
+
+// RequireAdmin only lets the admin key through
+func RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, ok := r.Context().Value(callerContextKey{}).(caller)
+		if !ok || !c.admin {
+			problem(w, r, http.StatusForbidden, "forbidden", "Only the admin key can do this")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// CreateAPIKey generates a key, it is only returned once and the store keeps its hash
+func CreateAPIKey(keys types.APIKeyStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req CreateAPIKeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			problem(w, r, http.StatusBadRequest, "invalid_json", "The body is not a valid JSON request: "+err.Error())
+			return
+		}
+
+		if strings.TrimSpace(req.Name) == "" {
+			problem(w, r, http.StatusBadRequest, "invalid_name", "The name of the key is required")
+			return
+		}
+
+		if req.Project == "" {
+			req.Project = types.DefaultProject
+		}
+		if err := types.ValidateProject(req.Project); err != nil {
+			invalidProject(w, r, err)
+			return
+		}
+
+		key, err := generateAPIKey()
+		if err != nil {
+			internalProblem(w, r, "failed_create_api_key", err)
+			return
+		}
+
+		apiKey := &types.APIKey{
+			ID:        uuid.New().String(),
+			Name:      req.Name,
+			Project:   req.Project,
+			Hash:      hashAPIKey(key),
+			CreatedAt: time.Now().UTC(),
+		}
+		if err := keys.SaveAPIKey(apiKey); err != nil {
+			internalProblem(w, r, "failed_create_api_key", err)
+			return
+		}
+
+		response := newAPIKeyResponse(apiKey)
+		response.Key = key
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func ListAPIKeys(keys types.APIKeyStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		apiKeys, err := keys.ListAPIKeys()
+		if err != nil {
+			internalProblem(w, r, "failed_list_api_keys", err)
+			return
+		}
+
+		response := ListAPIKeysResponse{
+			APIKeys: make([]APIKeyResponse, 0, len(apiKeys)),
+		}
+		for _, k := range apiKeys {
+			response.APIKeys = append(response.APIKeys, newAPIKeyResponse(k))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// DeleteAPIKey revokes a key, the services it created keep running
+func DeleteAPIKey(keys types.APIKeyStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := keys.DeleteAPIKey(r.PathValue("id"))
+		if errors.Is(err, types.ErrAPIKeyNotFound) {
+			problem(w, r, http.StatusNotFound, "api_key_not_found", "API key "+r.PathValue("id")+" does not exist")
+			return
+		}
+		if err != nil {
+			internalProblem(w, r, "failed_delete_api_key", err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// canAccess reports whether the caller of the request can see a service or an operation of this project
+// and owner. API keys only see what they created in their project, the admin key sees everything and
+// every request can when authentication is disabled.
+func canAccess(r *http.Request, project, owner string) bool {
+	c, ok := r.Context().Value(callerContextKey{}).(caller)
+	return !ok || c.admin || c.project == project && c.keyID == owner
+}
+
+// requestProject returns the project of the request and writes the error response when it is invalid.
+// API keys are bound to their project, the admin key and unauthenticated requests pick it with the
+// project query parameter.
+func requestProject(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if c, ok := r.Context().Value(callerContextKey{}).(caller); ok && !c.admin {
+		return c.project, true
+	}
+
+	project := r.URL.Query().Get("project")
+	if project == "" {
+		return types.DefaultProject, true
+	}
+
+	if err := types.ValidateProject(project); err != nil {
+		invalidProject(w, r, err)
+		return "", false
+	}
+
+	return project, true
+}
+
+// requestOwner returns the owner of the services created by the request
+func requestOwner(r *http.Request) string {
+	c, _ := r.Context().Value(callerContextKey{}).(caller)
+	return c.keyID
+}
+
+func unauthorized(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	problem(w, r, http.StatusUnauthorized, "unauthorized", "A valid API key is required in the Authorization header")
+}
+
+func invalidProject(w http.ResponseWriter, r *http.Request, err error) {
+	writeProblem(w, r, Problem{
+		Status: http.StatusBadRequest,
+		Code:   "invalid_project",
+		Detail: err.Error(),
+		Errors: []FieldError{{Field: "project", Message: "must be lowercase letters, digits and dashes"}},
+	})
+}
+
+func generateAPIKey() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// hashAPIKey returns the hex SHA-256 of the key, the keys are random so a slow hash is not needed
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func newAPIKeyResponse(k *types.APIKey) APIKeyResponse {
+	return APIKeyResponse{
+		ID:        k.ID,
+		Name:      k.Name,
+		Project:   k.Project,
+		CreatedAt: k.CreatedAt,
+	}
+}
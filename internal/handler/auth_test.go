@@ -0,0 +1,368 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexisvisco/koyebtests/internal/config"
+	"github.com/alexisvisco/koyebtests/internal/service"
+	"github.com/alexisvisco/koyebtests/internal/store"
+	"github.com/alexisvisco/koyebtests/internal/types"
+	"github.com/alexisvisco/koyebtests/mocks"
+)
+
+const testAdminKey = "admin-secret"
+
+// newTestAuth returns a store holding one API key of the project team-a with the ID key-1 and its plain key
+func newTestAuth(t *testing.T) (AuthParams, string) {
+	t.Helper()
+
+	keys := store.NewMemoryStore()
+	key := "kt_test-key"
+	if err := keys.SaveAPIKey(&types.APIKey{ID: "key-1", Name: "test", Project: "team-a", Hash: hashAPIKey(key), CreatedAt: time.Now().UTC()}); err != nil {
+		t.Fatalf("failed to save api key: %v", err)
+	}
+
+	return AuthParams{Keys: keys, AdminKey: testAdminKey}, key
+}
+
+func TestAuthenticate(t *testing.T) {
+	params, key := newTestAuth(t)
+
+	tests := []struct {
+		name           string
+		authorization  string
+		expectedStatus int
+	}{
+		{name: "missing key", expectedStatus: http.StatusUnauthorized},
+		{name: "not a bearer", authorization: "Basic " + key, expectedStatus: http.StatusUnauthorized},
+		{name: "unknown key", authorization: "Bearer kt_unknown", expectedStatus: http.StatusUnauthorized},
+		{name: "valid key", authorization: "Bearer " + key, expectedStatus: http.StatusOK},
+		{name: "admin key", authorization: "Bearer " + testAdminKey, expectedStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/services", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+
+			Authenticate(params, next).ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Fatalf("expected a WWW-Authenticate header, got %q", w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestServicesScopedToProject(t *testing.T) {
+	params, key := newTestAuth(t)
+
+	owned := testServiceOutput()
+	owned.Project = "team-a"
+	owned.Owner = "key-1"
+	other := testServiceOutput()
+	other.Name = "other-service"
+	other.Project = "team-b"
+
+	jobService := mocks.NewJobService(t)
+	jobService.EXPECT().ListServices().Return([]*types.ServiceOutput{owned, other}, nil)
+	jobService.EXPECT().GetService("team-a", "other-service").Return(nil, types.ErrServiceNotFound)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /services", ListServices(jobService))
+	mux.HandleFunc("GET /services/{name}", GetService(jobService))
+	api := Authenticate(params, mux)
+
+	// The project of the key wins over the query parameter
+	req := httptest.NewRequest(http.MethodGet, "/services?project=team-b", nil)
+	req.Header.Set("Authorization", "Bearer "+key)
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+
+	var resp ListServicesResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(resp.Services) != 1 || resp.Services[0].Name != "test-service" {
+		t.Fatalf("expected only the service of the project, got %+v", resp.Services)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/services/other-service", nil)
+	req.Header.Set("Authorization", "Bearer "+key)
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected status 404 for the service of another project, got %d", w.Code)
+	}
+}
+
+func TestServicesScopedToAPIKey(t *testing.T) {
+	params, key := newTestAuth(t)
+
+	owned := testServiceOutput()
+	owned.Project = "team-a"
+	owned.Owner = "key-1"
+	other := testServiceOutput()
+	other.Name = "other-service"
+	other.Project = "team-a"
+	other.Owner = "key-2"
+
+	jobService := mocks.NewJobService(t)
+	jobService.EXPECT().ListServices().Return([]*types.ServiceOutput{owned, other}, nil)
+	jobService.EXPECT().GetService("team-a", "other-service").Return(other, nil)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /services", ListServices(jobService))
+	mux.HandleFunc("GET /services/{name}", GetService(jobService))
+	mux.HandleFunc("DELETE /services/{name}", DeleteService(jobService))
+	api := Authenticate(params, mux)
+
+	req := httptest.NewRequest(http.MethodGet, "/services", nil)
+	req.Header.Set("Authorization", "Bearer "+key)
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+
+	var resp ListServicesResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(resp.Services) != 1 || resp.Services[0].Name != "test-service" {
+		t.Fatalf("expected only the service of the key, got %+v", resp.Services)
+	}
+
+	// The service of another key of the same project can be neither read nor deleted
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		req = httptest.NewRequest(method, "/services/other-service", nil)
+		req.Header.Set("Authorization", "Bearer "+key)
+		w = httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("expected status 404 on %s for the service of another key, got %d", method, w.Code)
+		}
+	}
+}
+
+func TestAdminPicksProject(t *testing.T) {
+	params, _ := newTestAuth(t)
+
+	jobService := mocks.NewJobService(t)
+	jobService.EXPECT().GetService("team-b", "test-service").Return(testServiceOutput(), nil)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /services/{name}", GetService(jobService))
+	api := Authenticate(params, mux)
+
+	tests := []struct {
+		name           string
+		target         string
+		expectedStatus int
+	}{
+		{name: "project query", target: "/services/test-service?project=team-b", expectedStatus: http.StatusOK},
+		{name: "invalid project", target: "/services/test-service?project=Team_B", expectedStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			req.Header.Set("Authorization", "Bearer "+testAdminKey)
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+		})
+	}
+}
+
+func TestCreateJobRecordsOwnerAndProject(t *testing.T) {
+	params, key := newTestAuth(t)
+
+	jobService := mocks.NewJobService(t)
+	jobService.EXPECT().
+		CreateJob(types.CreateJobInput{Name: "test-service", TargetURL: "http://example.com", Project: "team-a", Owner: "key-1"}).
+		Return(nil, types.ErrServiceNameTaken)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /services/{name}", CreateJob(jobService, testSources, nil))
+
+	req := httptest.NewRequest(http.MethodPut, "/services/test-service", strings.NewReader(`{"url":"http://example.com"}`))
+	req.Header.Set("Authorization", "Bearer "+key)
+	w := httptest.NewRecorder()
+	Authenticate(params, mux).ServeHTTP(w, req)
+
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected status 409, got %d", w.Code)
+	}
+}
+
+func TestCreateJobScopedToAPIKey(t *testing.T) {
+	params, key := newTestAuth(t)
+
+	otherKey := "kt_other-key"
+	if err := params.Keys.SaveAPIKey(&types.APIKey{ID: "key-2", Name: "other", Project: "team-a", Hash: hashAPIKey(otherKey), CreatedAt: time.Now().UTC()}); err != nil {
+		t.Fatalf("failed to save api key: %v", err)
+	}
+
+	spec, err := config.Default().Job.Resolve(types.CreateJobInput{})
+	if err != nil {
+		t.Fatalf("failed to resolve spec: %v", err)
+	}
+
+	serviceStore := store.NewMemoryStore()
+	owned := &types.Service{
+		Name:      "test-service",
+		JobID:     "test-service-1",
+		SourceURL: "http://example.com",
+		Mode:      types.ServiceModeStatic,
+		Project:   "team-a",
+		Owner:     "key-1",
+		Spec:      spec,
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := serviceStore.SaveService(owned); err != nil {
+		t.Fatalf("failed to save service: %v", err)
+	}
+
+	jobService, err := service.NewLocalJobService(service.LocalJobServiceParams{Host: "example.test", Store: serviceStore, WorkDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("failed to create job service: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /services/{name}", CreateJob(jobService, testSources, nil))
+	api := Authenticate(params, mux)
+
+	tests := []struct {
+		name           string
+		authorization  string
+		body           string
+		expectedStatus int
+	}{
+		{name: "another key of the project", authorization: otherKey, body: `{"url":"http://example.org/other"}`, expectedStatus: http.StatusConflict},
+		{name: "owner", authorization: key, body: `{"url":"http://example.com"}`, expectedStatus: http.StatusOK},
+		{name: "admin", authorization: testAdminKey, body: `{"url":"http://example.com"}`, expectedStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPut, "/services/test-service?project=team-a", strings.NewReader(tt.body))
+			req.Header.Set("Authorization", "Bearer "+tt.authorization)
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	stored, err := serviceStore.GetService(owned.JobID)
+	if err != nil {
+		t.Fatalf("failed to get service: %v", err)
+	}
+	if stored.SourceURL != owned.SourceURL || stored.Owner != owned.Owner {
+		t.Fatalf("expected the service of key-1 to be unchanged, got %+v", stored)
+	}
+}
+
+func TestAPIKeyLifecycle(t *testing.T) {
+	params, key := newTestAuth(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api-keys", RequireAdmin(CreateAPIKey(params.Keys)))
+	mux.HandleFunc("GET /api-keys", RequireAdmin(ListAPIKeys(params.Keys)))
+	mux.HandleFunc("DELETE /api-keys/{id}", RequireAdmin(DeleteAPIKey(params.Keys)))
+	api := Authenticate(params, mux)
+
+	req := httptest.NewRequest(http.MethodPost, "/api-keys", strings.NewReader(`{"name":"ci"}`))
+	req.Header.Set("Authorization", "Bearer "+key)
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected status 403 for a non admin key, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api-keys", strings.NewReader(`{"name":"ci"}`))
+	req.Header.Set("Authorization", "Bearer "+testAdminKey)
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d", w.Code)
+	}
+
+	var created APIKeyResponse
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if created.Project != types.DefaultProject {
+		t.Fatalf("expected the key to belong to the default project, got %q", created.Project)
+	}
+	if !strings.HasPrefix(created.Key, apiKeyPrefix) {
+		t.Fatalf("expected a key starting with %s, got %q", apiKeyPrefix, created.Key)
+	}
+
+	stored, err := params.Keys.GetAPIKeyByHash(hashAPIKey(created.Key))
+	if err != nil {
+		t.Fatalf("expected the key to be stored by its hash: %v", err)
+	}
+	if stored.Hash == created.Key || stored.ID != created.ID {
+		t.Fatalf("unexpected stored key %+v", stored)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api-keys", strings.NewReader(`{"name":"ci","project":"Not A Project"}`))
+	req.Header.Set("Authorization", "Bearer "+testAdminKey)
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 for an invalid project, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api-keys", nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminKey)
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+
+	if strings.Contains(w.Body.String(), created.Key) || strings.Contains(w.Body.String(), stored.Hash) {
+		t.Fatalf("expected the list to hide the keys, got %s", w.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, "/api-keys/"+created.ID, nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminKey)
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api-keys", nil)
+	req.Header.Set("Authorization", "Bearer "+created.Key)
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a revoked key to be rejected, got %d", w.Code)
+	}
+}
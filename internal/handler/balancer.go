@@ -0,0 +1,192 @@
+package handler
+
+import (
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alexisvisco/koyebtests/internal/types"
+)
+
+// LoadBalancing is the strategy used to spread the requests of a service across its replicas
+type LoadBalancing string
+
+const (
+	LoadBalancingRoundRobin       LoadBalancing = "round_robin"
+	LoadBalancingLeastConnections LoadBalancing = "least_connections"
+)
+
+const (
+	defaultEjectionDuration = 10 * time.Second
+
+	// sweepInterval is how often the jobs without requests and the past ejections are forgotten
+	sweepInterval = time.Minute
+)
+
+// balancer picks the backend of each proxied request. Backends that fail are ejected for a while,
+// they only receive traffic again when every other backend of the service is ejected too.
+type balancer struct {
+	strategy         LoadBalancing
+	ejectionDuration time.Duration
+	now              func() time.Time
+
+	mutex    sync.Mutex
+	jobs     map[string]*jobBalance
+	inFlight map[string]int
+	ejected  map[string]time.Time
+	swept    time.Time
+}
+
+// jobBalance is the state of the balancing of a job
+type jobBalance struct {
+	next int
+
+	// addresses are the backends of the last pick, the ejections of the ones replaced since are dropped
+	addresses []string
+	picked    time.Time
+}
+
+func newBalancer(strategy LoadBalancing, ejectionDuration time.Duration) *balancer {
+	if strategy == "" {
+		strategy = LoadBalancingRoundRobin
+	}
+
+	if ejectionDuration <= 0 {
+		ejectionDuration = defaultEjectionDuration
+	}
+
+	return &balancer{
+		strategy:         strategy,
+		ejectionDuration: ejectionDuration,
+		now:              time.Now,
+		jobs:             make(map[string]*jobBalance),
+		inFlight:         make(map[string]int),
+		ejected:          make(map[string]time.Time),
+	}
+}
+
+// pick returns a backend of the job and the function to call once the request is done,
+// with failed set when the backend could not be reached
+func (b *balancer) pick(jobID string, backends []types.Backend) (types.Backend, func(failed bool)) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := b.now()
+	if b.swept.IsZero() {
+		b.swept = now
+	}
+	if now.Sub(b.swept) >= sweepInterval {
+		b.sweep(now)
+	}
+
+	job, ok := b.jobs[jobID]
+	if !ok {
+		job = &jobBalance{}
+		b.jobs[jobID] = job
+	}
+	job.picked = now
+
+	addresses := make([]string, len(backends))
+	for i, backend := range backends {
+		addresses[i] = backendAddress(backend)
+	}
+	if !slices.Equal(job.addresses, addresses) {
+		// The replicas of the job were replaced, the ones that are gone will not be picked again
+		for _, address := range job.addresses {
+			if !slices.Contains(addresses, address) {
+				delete(b.ejected, address)
+			}
+		}
+		job.addresses = addresses
+	}
+
+	candidates := make([]types.Backend, 0, len(backends))
+	for _, backend := range backends {
+		if until, ok := b.ejected[backendAddress(backend)]; ok {
+			if now.Before(until) {
+				continue
+			}
+			delete(b.ejected, backendAddress(backend))
+		}
+		candidates = append(candidates, backend)
+	}
+
+	if len(candidates) == 0 {
+		candidates = backends
+	}
+
+	// The rotation also breaks the ties of least connections so that idle backends share the load
+	start := job.next % len(candidates)
+	job.next = start + 1
+
+	chosen := candidates[start]
+	if b.strategy == LoadBalancingLeastConnections {
+		for i := 1; i < len(candidates); i++ {
+			candidate := candidates[(start+i)%len(candidates)]
+			if b.inFlight[backendAddress(candidate)] < b.inFlight[backendAddress(chosen)] {
+				chosen = candidate
+			}
+		}
+	}
+
+	address := backendAddress(chosen)
+	b.inFlight[address]++
+
+	return chosen, func(failed bool) {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+
+		b.inFlight[address]--
+		if b.inFlight[address] <= 0 {
+			delete(b.inFlight, address)
+		}
+
+		if failed {
+			b.ejected[address] = b.now().Add(b.ejectionDuration)
+		}
+	}
+}
+
+// forget drops the state of a job that is removed or whose replicas are stopped
+func (b *balancer) forget(jobID string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.forgetLocked(jobID)
+}
+
+func (b *balancer) forgetLocked(jobID string) {
+	job, ok := b.jobs[jobID]
+	if !ok {
+		return
+	}
+
+	for _, address := range job.addresses {
+		delete(b.ejected, address)
+	}
+	delete(b.jobs, jobID)
+}
+
+// sweep forgets the jobs without requests since the last sweep, such as the deleted ones, and the
+// ejections that are over
+func (b *balancer) sweep(now time.Time) {
+	for jobID, job := range b.jobs {
+		if now.Sub(job.picked) >= sweepInterval {
+			b.forgetLocked(jobID)
+		}
+	}
+
+	for address, until := range b.ejected {
+		if !now.Before(until) {
+			delete(b.ejected, address)
+		}
+	}
+
+	b.swept = now
+}
+
+func backendAddress(backend types.Backend) string {
+	return net.JoinHostPort(backend.IP, strconv.Itoa(backend.Port))
+}
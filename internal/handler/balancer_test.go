@@ -0,0 +1,149 @@
+package handler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alexisvisco/koyebtests/internal/types"
+)
+
+var testBackends = []types.Backend{
+	{AllocID: "alloc-1", IP: "10.0.0.1", Port: 20000},
+	{AllocID: "alloc-2", IP: "10.0.0.2", Port: 20000},
+	{AllocID: "alloc-3", IP: "10.0.0.3", Port: 20000},
+}
+
+func TestBalancerRoundRobin(t *testing.T) {
+	b := newBalancer(LoadBalancingRoundRobin, 0)
+
+	var picked []string
+	for range 4 {
+		backend, done := b.pick("job", testBackends)
+		done(false)
+		picked = append(picked, backend.AllocID)
+	}
+
+	expected := []string{"alloc-1", "alloc-2", "alloc-3", "alloc-1"}
+	for i := range expected {
+		if picked[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, picked)
+		}
+	}
+}
+
+func TestBalancerLeastConnections(t *testing.T) {
+	b := newBalancer(LoadBalancingLeastConnections, 0)
+
+	first, _ := b.pick("job", testBackends)
+	second, _ := b.pick("job", testBackends)
+	third, doneThird := b.pick("job", testBackends)
+
+	if first == second || second == third || first == third {
+		t.Fatalf("expected idle backends to be picked first, got %s, %s, %s", first.AllocID, second.AllocID, third.AllocID)
+	}
+
+	doneThird(false)
+
+	next, _ := b.pick("job", testBackends)
+	if next != third {
+		t.Fatalf("expected the backend without requests in flight %s, got %s", third.AllocID, next.AllocID)
+	}
+}
+
+func TestBalancerEjection(t *testing.T) {
+	now := time.Now()
+	b := newBalancer(LoadBalancingRoundRobin, 10*time.Second)
+	b.now = func() time.Time { return now }
+
+	backends := testBackends[:2]
+
+	failing, done := b.pick("job", backends)
+	done(true)
+
+	for range 3 {
+		backend, done := b.pick("job", backends)
+		done(false)
+		if backend == failing {
+			t.Fatalf("expected %s to be ejected", failing.AllocID)
+		}
+	}
+
+	now = now.Add(11 * time.Second)
+
+	seen := false
+	for range 2 {
+		backend, done := b.pick("job", backends)
+		done(false)
+		seen = seen || backend == failing
+	}
+	if !seen {
+		t.Fatalf("expected %s to receive requests after the ejection", failing.AllocID)
+	}
+}
+
+func TestBalancerAllEjected(t *testing.T) {
+	b := newBalancer(LoadBalancingRoundRobin, time.Minute)
+
+	backends := testBackends[:1]
+	_, done := b.pick("job", backends)
+	done(true)
+
+	backend, _ := b.pick("job", backends)
+	if backend != backends[0] {
+		t.Fatalf("expected the only backend to be used even when ejected, got %+v", backend)
+	}
+}
+
+func TestBalancerPrunesReplacedBackends(t *testing.T) {
+	b := newBalancer(LoadBalancingRoundRobin, time.Minute)
+
+	failing, done := b.pick("job", testBackends[:2])
+	done(true)
+
+	// The failing replica is replaced by a new one
+	b.pick("job", []types.Backend{testBackends[2], testBackends[1]})
+
+	if _, ok := b.ejected[backendAddress(failing)]; ok {
+		t.Fatalf("expected the ejection of the replaced %s to be dropped", failing.AllocID)
+	}
+	if len(b.jobs) != 1 {
+		t.Fatalf("expected a single job, got %d", len(b.jobs))
+	}
+}
+
+func TestBalancerForget(t *testing.T) {
+	b := newBalancer(LoadBalancingRoundRobin, time.Minute)
+
+	_, done := b.pick("job", testBackends)
+	done(true)
+
+	b.forget("job")
+
+	if len(b.jobs) != 0 || len(b.ejected) != 0 {
+		t.Fatalf("expected the job to be forgotten, got %d jobs and %d ejections", len(b.jobs), len(b.ejected))
+	}
+}
+
+func TestBalancerSweep(t *testing.T) {
+	now := time.Now()
+	b := newBalancer(LoadBalancingRoundRobin, 10*time.Second)
+	b.now = func() time.Time { return now }
+
+	_, done := b.pick("deleted", testBackends[:1])
+	done(false)
+	_, done = b.pick("failing", testBackends[1:2])
+	done(true)
+
+	now = now.Add(sweepInterval)
+	b.pick("active", testBackends[2:])
+
+	if _, ok := b.jobs["deleted"]; ok {
+		t.Fatal("expected the job without requests to be forgotten")
+	}
+	if len(b.ejected) != 0 {
+		t.Fatalf("expected the past ejections to be dropped, got %v", b.ejected)
+	}
+	if _, ok := b.jobs["active"]; !ok {
+		t.Fatal("expected the picked job to be kept")
+	}
+}
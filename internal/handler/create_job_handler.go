@@ -1,44 +1,235 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strings"
+	"time"
 
+	"github.com/alexisvisco/koyebtests/internal/gitsource"
+	"github.com/alexisvisco/koyebtests/internal/integrity"
+	"github.com/alexisvisco/koyebtests/internal/netguard"
 	"github.com/alexisvisco/koyebtests/internal/types"
 )
 
 type CreateJobRequest struct {
 	URL      string `json:"url"`
 	IsScript bool   `json:"is_script"`
+
+	// Archive serves the files of the .tar.gz or .zip archive at the URL as a static site
+	Archive bool `json:"archive"`
+
+	// SPA serves the index.html of the archive for the unknown paths, such as the routes of a single page application
+	SPA bool `json:"spa"`
+
+	// ContentType is served instead of the type detected from the downloaded content
+	ContentType string `json:"content_type"`
+
+	// Git serves a git repository instead of the file at URL
+	Git *GitRequest `json:"git"`
+
+	// SHA256 is the hex digest of the content at URL, Signature a base64 Ed25519 signature of it made
+	// with the key of the server. The service does not start when the content does not match.
+	SHA256    string `json:"sha256"`
+	Signature string `json:"signature"`
+
+	Async    bool `json:"async"`
+	Replicas int  `json:"replicas"`
+
+	// TTL (a duration such as "2h") or ExpiresAt sets when the service is purged
+	TTL       string     `json:"ttl"`
+	ExpiresAt *time.Time `json:"expires_at"`
+
+	InstanceType string            `json:"instance_type"`
+	Image        string            `json:"image"`
+	Region       string            `json:"region"`
+	Datacenters  []string          `json:"datacenters"`
+	Resources    *ResourcesRequest `json:"resources"`
 }
 
-type CreateJobResponse struct {
+// GitRequest is a git repository served over https, the ref is resolved to a commit when the service is created
+type GitRequest struct {
 	URL string `json:"url"`
+
+	// Ref is a branch, a tag or a commit, empty uses the default branch of the repository
+	Ref string `json:"ref"`
+
+	// Path is the directory of the repository to serve, empty serves the root
+	Path string `json:"path"`
+
+	// Entrypoint is a script of Path run for every request, empty serves the files as a static site
+	Entrypoint string `json:"entrypoint"`
 }
 
-func CreateJob(service types.JobService) http.HandlerFunc {
+type ResourcesRequest struct {
+	CPU          int `json:"cpu"`
+	MemoryMB     int `json:"memory_mb"`
+	NetworkMBits int `json:"network_mbits"`
+}
+
+type CreateJobResponse struct {
+	URL         string `json:"url"`
+	OperationID string `json:"operation_id,omitempty"`
+}
+
+// CreateJob creates or updates a service, sources checks that its URL does not lead to a private network
+// and repos resolves the refs of the git sources
+func CreateJob(service types.JobService, sources *netguard.Validator, repos *gitsource.Resolver) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req CreateJobRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "invalid_json", http.StatusBadRequest)
+			problem(w, r, http.StatusBadRequest, "invalid_json", "The body is not a valid JSON request: "+err.Error())
+			return
+		}
+
+		sourceURL, sourceField := req.URL, "url"
+		if req.Git != nil {
+			sourceURL, sourceField = req.Git.URL, "git.url"
+		}
+
+		if !isValidURL(sourceURL) {
+			writeProblem(w, r, Problem{
+				Status: http.StatusBadRequest,
+				Code:   "invalid_url",
+				Detail: sourceField + " must be an http or https URL to a public host",
+				Errors: []FieldError{{Field: sourceField, Message: "must be an http or https URL to a public host"}},
+			})
 			return
 		}
 
-		if !isValidURL(req.URL) {
-			http.Error(w, "invalid_url", http.StatusBadRequest)
+		// The host is resolved here to reject early the names that point to private addresses,
+		// the init binary checks the addresses again when it connects
+		err := sources.CheckURL(r.Context(), sourceURL)
+		var policyErr *netguard.PolicyError
+		if errors.As(err, &policyErr) {
+			writeProblem(w, r, Problem{
+				Status:  http.StatusBadRequest,
+				Code:    "forbidden_url",
+				Detail:  policyErr.Error(),
+				Rule:    policyErr.Rule,
+				Pattern: policyErr.Pattern,
+				Value:   policyErr.Value,
+			})
+			return
+		}
+		if err != nil {
+			writeProblem(w, r, Problem{
+				Status: http.StatusBadRequest,
+				Code:   "invalid_url",
+				Detail: err.Error(),
+				Errors: []FieldError{{Field: sourceField, Message: err.Error()}},
+			})
 			return
 		}
 
 		name := r.PathValue("name")
 		if strings.Trim(name, " ") == "" {
-			http.Error(w, "invalid_name", http.StatusBadRequest)
+			problem(w, r, http.StatusBadRequest, "invalid_name", "The service name is required")
 			return
 		}
 
-		job, err := service.CreateJob(name, req.URL, req.IsScript)
+		project, ok := requestProject(w, r)
+		if !ok {
+			return
+		}
+
+		lifetime, lifetimeErr := parseLifetime(req.TTL, req.ExpiresAt)
+		if lifetimeErr != nil {
+			validationProblem(w, r, lifetimeErr)
+			return
+		}
+
+		if sourceErr := checkSourceMode(req); sourceErr != nil {
+			validationProblem(w, r, sourceErr)
+			return
+		}
+
+		contentType, contentTypeErr := parseContentType(req.ContentType)
+		if contentTypeErr != nil {
+			validationProblem(w, r, contentTypeErr)
+			return
+		}
+
+		digest, integrityErr := parseIntegrity(req)
+		if integrityErr != nil {
+			validationProblem(w, r, integrityErr)
+			return
+		}
+
+		git, gitErr := resolveGit(r.Context(), repos, req.Git)
+		var gitValidationErr *types.ValidationError
+		if errors.As(gitErr, &gitValidationErr) {
+			validationProblem(w, r, gitValidationErr)
+			return
+		}
+		if gitErr != nil {
+			writeProblem(w, r, Problem{
+				Status: http.StatusBadRequest,
+				Code:   "invalid_git_repository",
+				Detail: "The git repository cannot be read: " + gitErr.Error(),
+				Errors: []FieldError{{Field: "git.url", Message: gitErr.Error()}},
+			})
+			return
+		}
+
+		input := types.CreateJobInput{
+			Name:         name,
+			TargetURL:    sourceURL,
+			IsScript:     req.IsScript,
+			Archive:      req.Archive,
+			SPA:          req.SPA,
+			ContentType:  contentType,
+			Git:          git,
+			SHA256:       digest,
+			Signature:    req.Signature,
+			Project:      project,
+			Owner:        requestOwner(r),
+			Async:        req.Async,
+			Replicas:     req.Replicas,
+			ExpiresAt:    lifetime.ExpiresAt,
+			InstanceType: req.InstanceType,
+			Image:        req.Image,
+			Region:       req.Region,
+			Datacenters:  req.Datacenters,
+		}
+		if lifetime.TTL > 0 {
+			input.ExpiresAt = time.Now().UTC().Add(lifetime.TTL)
+		}
+		if req.Resources != nil {
+			input.Resources = types.Resources{
+				CPU:          req.Resources.CPU,
+				MemoryMB:     req.Resources.MemoryMB,
+				NetworkMBits: req.Resources.NetworkMBits,
+			}
+		}
+
+		job, err := service.CreateJob(input)
+		var validationErr *types.ValidationError
+		if errors.As(err, &validationErr) {
+			validationProblem(w, r, validationErr)
+			return
+		}
+		var quotaErr *types.QuotaError
+		if errors.As(err, &quotaErr) {
+			problem(w, r, http.StatusForbidden, "quota_exceeded", "The service would exceed the quota: "+quotaErr.Detail())
+			return
+		}
+		if errors.Is(err, types.ErrServiceNameTaken) {
+			problem(w, r, http.StatusConflict, "service_name_taken", "Another service of the project is served on the subdomain of "+name)
+			return
+		}
+		if errors.Is(err, types.ErrOperationInProgress) {
+			problem(w, r, http.StatusConflict, "operation_in_progress", "Another operation is creating or updating "+name+", retry once it is done")
+			return
+		}
+		if errors.Is(err, types.ErrShuttingDown) {
+			problem(w, r, http.StatusServiceUnavailable, "shutting_down", "The API is shutting down, retry on another instance")
+			return
+		}
 		if err != nil {
-			http.Error(w, "failed_create_job", http.StatusInternalServerError)
+			internalProblem(w, r, "failed_create_job", err)
 			return
 		}
 
@@ -47,6 +238,155 @@ func CreateJob(service types.JobService) http.HandlerFunc {
 		}
 
 		w.Header().Set("Content-Type", "application/json")
+
+		// In async mode the client polls the operation to know when the service is running, a service
+		// already matching the request has nothing to wait for
+		if req.Async && job.OperationID != "" {
+			response.OperationID = job.OperationID
+			w.WriteHeader(http.StatusAccepted)
+		}
+
 		json.NewEncoder(w).Encode(response)
 	}
 }
+
+// parseLifetime reads the ttl or expires_at fields of a request, at most one of them can be set
+func parseLifetime(ttl string, expiresAt *time.Time) (types.ExtendServiceInput, *types.ValidationError) {
+	var lifetime types.ExtendServiceInput
+
+	if ttl != "" && expiresAt != nil {
+		return lifetime, &types.ValidationError{Field: "ttl", Message: "cannot be set with expires_at"}
+	}
+
+	if ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			return lifetime, &types.ValidationError{Field: "ttl", Message: "must be a positive duration such as 2h"}
+		}
+		lifetime.TTL = d
+	}
+
+	if expiresAt != nil {
+		if !expiresAt.After(time.Now()) {
+			return lifetime, &types.ValidationError{Field: "expires_at", Message: "must be in the future"}
+		}
+		lifetime.ExpiresAt = expiresAt.UTC()
+	}
+
+	return lifetime, nil
+}
+
+// checkSourceMode rejects the fields that do not go with the mode of the source
+func checkSourceMode(req CreateJobRequest) *types.ValidationError {
+	if req.Git != nil {
+		return checkGitSource(req)
+	}
+
+	if !req.Archive {
+		if req.SPA {
+			return &types.ValidationError{Field: "spa", Message: "requires archive"}
+		}
+		return nil
+	}
+
+	if req.IsScript {
+		return &types.ValidationError{Field: "archive", Message: "cannot be set with is_script"}
+	}
+	if req.ContentType != "" {
+		return &types.ValidationError{Field: "content_type", Message: "cannot be set with archive, the type of each file comes from its extension"}
+	}
+
+	return nil
+}
+
+// checkGitSource rejects the fields that do not go with a git source, a script is named by its entrypoint
+func checkGitSource(req CreateJobRequest) *types.ValidationError {
+	git := req.Git
+
+	switch {
+	case req.URL != "":
+		return &types.ValidationError{Field: "url", Message: "cannot be set with git"}
+	case req.Archive:
+		return &types.ValidationError{Field: "archive", Message: "cannot be set with git, the repository is served as a site"}
+	case req.ContentType != "":
+		return &types.ValidationError{Field: "content_type", Message: "cannot be set with git, the type of each file comes from its extension"}
+	case req.IsScript && git.Entrypoint == "":
+		return &types.ValidationError{Field: "git.entrypoint", Message: "is required with is_script"}
+	case !req.IsScript && git.Entrypoint != "":
+		return &types.ValidationError{Field: "git.entrypoint", Message: "requires is_script"}
+	case req.IsScript && req.SPA:
+		return &types.ValidationError{Field: "spa", Message: "cannot be set with is_script"}
+	case git.Ref != "" && !gitsource.ValidRef(git.Ref):
+		return &types.ValidationError{Field: "git.ref", Message: "must be a branch, a tag or a commit"}
+	case git.Path != "" && !gitsource.ValidPath(git.Path):
+		return &types.ValidationError{Field: "git.path", Message: "must be a relative path inside of the repository"}
+	case git.Entrypoint != "" && !gitsource.ValidPath(git.Entrypoint):
+		return &types.ValidationError{Field: "git.entrypoint", Message: "must be a relative path inside of the repository"}
+	}
+
+	return nil
+}
+
+// resolveGit pins the git source of a request to the commit of its ref, nil without git source
+func resolveGit(ctx context.Context, repos *gitsource.Resolver, git *GitRequest) (*types.GitSource, error) {
+	if git == nil {
+		return nil, nil
+	}
+
+	commit, err := repos.Resolve(ctx, git.URL, git.Ref)
+	if errors.Is(err, gitsource.ErrRefNotFound) {
+		return nil, &types.ValidationError{Field: "git.ref", Message: "is not a branch or a tag of the repository"}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.GitSource{
+		URL:        git.URL,
+		Ref:        git.Ref,
+		Commit:     commit,
+		Path:       strings.TrimSuffix(git.Path, "/"),
+		Entrypoint: git.Entrypoint,
+	}, nil
+}
+
+// parseIntegrity checks the sha256 and signature fields of a request and returns the normalized digest
+func parseIntegrity(req CreateJobRequest) (string, *types.ValidationError) {
+	if req.Git != nil && req.SHA256 != "" {
+		return "", &types.ValidationError{Field: "sha256", Message: "cannot be set with git, the commit pins the content"}
+	}
+	if req.Git != nil && req.Signature != "" {
+		return "", &types.ValidationError{Field: "signature", Message: "cannot be set with git, the commit pins the content"}
+	}
+
+	if req.Signature != "" {
+		if _, err := integrity.ParseSignature(req.Signature); err != nil {
+			return "", &types.ValidationError{Field: "signature", Message: "must be a base64 encoded Ed25519 signature"}
+		}
+	}
+
+	if req.SHA256 == "" {
+		return "", nil
+	}
+
+	digest, err := integrity.ParseDigest(req.SHA256)
+	if err != nil {
+		return "", &types.ValidationError{Field: "sha256", Message: "must be 64 hexadecimal characters"}
+	}
+
+	return digest, nil
+}
+
+// parseContentType normalizes the content_type field of a request, empty lets the init binary detect the type
+func parseContentType(contentType string) (string, *types.ValidationError) {
+	if contentType == "" {
+		return "", nil
+	}
+
+	normalized, err := types.NormalizeContentType(contentType)
+	if err != nil {
+		return "", &types.ValidationError{Field: "content_type", Message: "must be a media type such as text/html; charset=utf-8"}
+	}
+
+	return normalized, nil
+}
@@ -1,14 +1,22 @@
 package handler
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/alexisvisco/koyebtests/internal/gitsource"
+	"github.com/alexisvisco/koyebtests/internal/netguard"
 	"github.com/alexisvisco/koyebtests/internal/types"
 	"github.com/alexisvisco/koyebtests/mocks"
+	"github.com/stretchr/testify/mock"
 )
 
 func TestCreateJob(t *testing.T) {
@@ -16,10 +24,10 @@ func TestCreateJob(t *testing.T) {
 	expectedURL := "http://job.example.com"
 
 	jobService.EXPECT().
-		CreateJob("test-service", "http://example.com", true).
+		CreateJob(types.CreateJobInput{Name: "test-service", TargetURL: "http://example.com", Project: "default", IsScript: true}).
 		Return(&types.CreateJobOutput{URL: expectedURL}, nil)
 
-	handler := CreateJob(jobService)
+	handler := CreateJob(jobService, testSources, nil)
 
 	req := httptest.NewRequest(http.MethodPut, "/services/test-service", strings.NewReader(`{"url":"http://example.com","is_script":true}`))
 	req.SetPathValue("name", "test-service")
@@ -41,3 +49,496 @@ func TestCreateJob(t *testing.T) {
 		t.Fatalf("expected URL %s, got %s", expectedURL, resp.URL)
 	}
 }
+
+func TestCreateJobAsync(t *testing.T) {
+	jobService := mocks.NewJobService(t)
+
+	jobService.EXPECT().
+		CreateJob(types.CreateJobInput{Name: "test-service", TargetURL: "http://example.com", Project: "default", Async: true}).
+		Return(&types.CreateJobOutput{URL: "http://job.example.com", OperationID: "op-id"}, nil)
+
+	handler := CreateJob(jobService, testSources, nil)
+
+	req := httptest.NewRequest(http.MethodPut, "/services/test-service", strings.NewReader(`{"url":"http://example.com","async":true}`))
+	req.SetPathValue("name", "test-service")
+	w := httptest.NewRecorder()
+
+	handler(w, req)
+
+	res := w.Result()
+	if res.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d", res.StatusCode)
+	}
+
+	var resp CreateJobResponse
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+
+	if resp.OperationID != "op-id" || resp.URL != "http://job.example.com" {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+}
+
+func TestCreateJobAsyncExistingService(t *testing.T) {
+	tests := []struct {
+		name           string
+		output         *types.CreateJobOutput
+		err            error
+		expectedStatus int
+	}{
+		{name: "unchanged spec", output: &types.CreateJobOutput{URL: "http://job.example.com"}, expectedStatus: http.StatusOK},
+		{name: "operation in progress", err: types.ErrOperationInProgress, expectedStatus: http.StatusConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jobService := mocks.NewJobService(t)
+			jobService.EXPECT().
+				CreateJob(types.CreateJobInput{Name: "test-service", TargetURL: "http://example.com", Project: "default", Async: true}).
+				Return(tt.output, tt.err)
+
+			req := httptest.NewRequest(http.MethodPut, "/services/test-service", strings.NewReader(`{"url":"http://example.com","async":true}`))
+			req.SetPathValue("name", "test-service")
+			w := httptest.NewRecorder()
+
+			CreateJob(jobService, testSources, nil)(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+			if tt.err != nil {
+				if resp := decodeProblem(t, w); resp.Code != "operation_in_progress" {
+					t.Fatalf("expected operation_in_progress error, got %+v", resp)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateJobInvalidSpec(t *testing.T) {
+	jobService := mocks.NewJobService(t)
+
+	jobService.EXPECT().
+		CreateJob(types.CreateJobInput{Name: "test-service", TargetURL: "http://example.com", Project: "default", Resources: types.Resources{CPU: 99999}}).
+		Return(nil, &types.ValidationError{Field: "resources.cpu", Message: "must be between 50 and 1000"})
+
+	handler := CreateJob(jobService, testSources, nil)
+
+	req := httptest.NewRequest(http.MethodPut, "/services/test-service", strings.NewReader(`{"url":"http://example.com","resources":{"cpu":99999}}`))
+	req.SetPathValue("name", "test-service")
+	w := httptest.NewRecorder()
+
+	handler(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %d", w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), "resources.cpu must be between 50 and 1000") {
+		t.Fatalf("expected the validation message, got %q", w.Body.String())
+	}
+}
+
+func TestCreateJobQuotaExceeded(t *testing.T) {
+	jobService := mocks.NewJobService(t)
+
+	jobService.EXPECT().
+		CreateJob(types.CreateJobInput{Name: "test-service", TargetURL: "http://example.com", Project: "default", InstanceType: "medium", Replicas: 2}).
+		Return(nil, &types.QuotaError{Resource: types.QuotaResourceMemory, Usage: 1024, Limit: 768})
+
+	handler := CreateJob(jobService, testSources, nil)
+
+	req := httptest.NewRequest(http.MethodPut, "/services/test-service", strings.NewReader(`{"url":"http://example.com","instance_type":"medium","replicas":2}`))
+	req.SetPathValue("name", "test-service")
+	w := httptest.NewRecorder()
+
+	handler(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected status 403, got %d", w.Code)
+	}
+
+	resp := decodeProblem(t, w)
+	if resp.Code != "quota_exceeded" || resp.Detail != "The service would exceed the quota: 1024 MB of memory out of 768" {
+		t.Fatalf("expected quota_exceeded error, got %+v", resp)
+	}
+}
+
+func TestCreateJobShuttingDown(t *testing.T) {
+	jobService := mocks.NewJobService(t)
+
+	jobService.EXPECT().
+		CreateJob(types.CreateJobInput{Name: "test-service", TargetURL: "http://example.com", Project: "default"}).
+		Return(nil, types.ErrShuttingDown)
+
+	req := httptest.NewRequest(http.MethodPut, "/services/test-service", strings.NewReader(`{"url":"http://example.com"}`))
+	req.SetPathValue("name", "test-service")
+	w := httptest.NewRecorder()
+
+	CreateJob(jobService, testSources, nil)(w, req)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503, got %d", w.Code)
+	}
+
+	if resp := decodeProblem(t, w); resp.Code != "shutting_down" {
+		t.Fatalf("expected shutting_down error, got %+v", resp)
+	}
+}
+
+func TestCreateJobTTL(t *testing.T) {
+	jobService := mocks.NewJobService(t)
+
+	before := time.Now().Add(2 * time.Hour)
+	jobService.EXPECT().
+		CreateJob(mock.MatchedBy(func(input types.CreateJobInput) bool {
+			return input.ExpiresAt.Sub(before).Abs() < time.Minute
+		})).
+		Return(&types.CreateJobOutput{URL: "http://job.example.com"}, nil)
+
+	req := httptest.NewRequest(http.MethodPut, "/services/test-service", strings.NewReader(`{"url":"http://example.com","ttl":"2h"}`))
+	req.SetPathValue("name", "test-service")
+	w := httptest.NewRecorder()
+
+	CreateJob(jobService, testSources, nil)(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+}
+
+func TestCreateJobInvalidLifetime(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{name: "invalid ttl", body: `{"url":"http://example.com","ttl":"forever"}`},
+		{name: "negative ttl", body: `{"url":"http://example.com","ttl":"-1h"}`},
+		{name: "ttl and expires_at", body: `{"url":"http://example.com","ttl":"1h","expires_at":"2999-01-01T00:00:00Z"}`},
+		{name: "expires_at in the past", body: `{"url":"http://example.com","expires_at":"2000-01-01T00:00:00Z"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jobService := mocks.NewJobService(t)
+
+			req := httptest.NewRequest(http.MethodPut, "/services/test-service", strings.NewReader(tt.body))
+			req.SetPathValue("name", "test-service")
+			w := httptest.NewRecorder()
+
+			CreateJob(jobService, testSources, nil)(w, req)
+
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("expected status 400, got %d", w.Code)
+			}
+			if resp := decodeProblem(t, w); resp.Code != "invalid_spec" || len(resp.Errors) != 1 {
+				t.Fatalf("expected an invalid_spec error on one field, got %+v", resp)
+			}
+		})
+	}
+}
+
+func TestCreateJobRejectsForbiddenSource(t *testing.T) {
+	policy, err := netguard.ParsePolicy([]byte(`{"denied_domains":["*.nip.io"]}`))
+	if err != nil {
+		t.Fatalf("failed to parse policy: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		url          string
+		sources      *netguard.Validator
+		expectedRule string
+	}{
+		{
+			name:         "metadata address",
+			url:          "http://metadata.example.com",
+			sources:      &netguard.Validator{Resolver: staticResolver{netip.MustParseAddr("169.254.169.254")}},
+			expectedRule: netguard.RulePrivateAddress,
+		},
+		{
+			name:         "one private address among public ones",
+			url:          "http://mixed.example.com",
+			sources:      &netguard.Validator{Resolver: staticResolver{netip.MustParseAddr("93.184.215.14"), netip.MustParseAddr("10.0.0.1")}},
+			expectedRule: netguard.RulePrivateAddress,
+		},
+		{
+			name:         "denied domain",
+			url:          "http://10.0.0.1.nip.io",
+			sources:      &netguard.Validator{Resolver: testSources.Resolver, Policy: policy},
+			expectedRule: netguard.RuleDeniedDomains,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jobService := mocks.NewJobService(t)
+
+			req := httptest.NewRequest(http.MethodPut, "/services/test-service", strings.NewReader(`{"url":"`+tt.url+`"}`))
+			req.SetPathValue("name", "test-service")
+			w := httptest.NewRecorder()
+
+			CreateJob(jobService, tt.sources, nil)(w, req)
+
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("expected status 400, got %d", w.Code)
+			}
+
+			resp := decodeProblem(t, w)
+			if resp.Code != "forbidden_url" || resp.Rule != tt.expectedRule {
+				t.Fatalf("expected forbidden_url by %s, got %+v", tt.expectedRule, resp)
+			}
+		})
+	}
+}
+
+func TestCreateJobUnresolvableSource(t *testing.T) {
+	jobService := mocks.NewJobService(t)
+
+	req := httptest.NewRequest(http.MethodPut, "/services/test-service", strings.NewReader(`{"url":"http://unknown.example.com"}`))
+	req.SetPathValue("name", "test-service")
+	w := httptest.NewRecorder()
+
+	CreateJob(jobService, &netguard.Validator{Resolver: staticResolver{}}, nil)(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %d", w.Code)
+	}
+	if resp := decodeProblem(t, w); resp.Code != "invalid_url" {
+		t.Fatalf("expected an invalid_url error, got %+v", resp)
+	}
+}
+
+func TestCreateJobContentType(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		expected    string
+		wantErr     bool
+	}{
+		{name: "media type", contentType: "text/html", expected: "text/html"},
+		{name: "normalized charset", contentType: "Text/HTML; Charset=UTF-8; q=1", expected: "text/html; charset=utf-8"},
+		{name: "not a media type", contentType: "html", wantErr: true},
+		{name: "unsafe charset", contentType: `text/html; charset="utf-8';"`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jobService := mocks.NewJobService(t)
+			if !tt.wantErr {
+				jobService.EXPECT().
+					CreateJob(types.CreateJobInput{Name: "test-service", TargetURL: "http://example.com", Project: "default", ContentType: tt.expected}).
+					Return(&types.CreateJobOutput{URL: "http://job.example.com"}, nil)
+			}
+
+			body, _ := json.Marshal(CreateJobRequest{URL: "http://example.com", ContentType: tt.contentType})
+			req := httptest.NewRequest(http.MethodPut, "/services/test-service", strings.NewReader(string(body)))
+			req.SetPathValue("name", "test-service")
+			w := httptest.NewRecorder()
+
+			CreateJob(jobService, testSources, nil)(w, req)
+
+			if !tt.wantErr {
+				if w.Code != http.StatusOK {
+					t.Fatalf("expected status 200, got %d", w.Code)
+				}
+				return
+			}
+
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("expected status 400, got %d", w.Code)
+			}
+			if resp := decodeProblem(t, w); resp.Code != "invalid_spec" || len(resp.Errors) != 1 || resp.Errors[0].Field != "content_type" {
+				t.Fatalf("expected an invalid content_type, got %+v", resp)
+			}
+		})
+	}
+}
+
+func TestCreateJobArchive(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          string
+		expectedSPA   bool
+		expectedField string
+	}{
+		{name: "archive", body: `{"url":"http://example.com/site.tar.gz","archive":true}`},
+		{name: "single page application", body: `{"url":"http://example.com/site.tar.gz","archive":true,"spa":true}`, expectedSPA: true},
+		{name: "spa without archive", body: `{"url":"http://example.com/site.tar.gz","spa":true}`, expectedField: "spa"},
+		{name: "archive and script", body: `{"url":"http://example.com/site.tar.gz","archive":true,"is_script":true}`, expectedField: "archive"},
+		{name: "archive and content type", body: `{"url":"http://example.com/site.zip","archive":true,"content_type":"text/html"}`, expectedField: "content_type"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jobService := mocks.NewJobService(t)
+			if tt.expectedField == "" {
+				jobService.EXPECT().
+					CreateJob(types.CreateJobInput{Name: "test-service", TargetURL: "http://example.com/site.tar.gz", Project: "default", Archive: true, SPA: tt.expectedSPA}).
+					Return(&types.CreateJobOutput{URL: "http://job.example.com"}, nil)
+			}
+
+			req := httptest.NewRequest(http.MethodPut, "/services/test-service", strings.NewReader(tt.body))
+			req.SetPathValue("name", "test-service")
+			w := httptest.NewRecorder()
+
+			CreateJob(jobService, testSources, nil)(w, req)
+
+			if tt.expectedField == "" {
+				if w.Code != http.StatusOK {
+					t.Fatalf("expected status 200, got %d", w.Code)
+				}
+				return
+			}
+
+			if resp := decodeProblem(t, w); w.Code != http.StatusBadRequest || len(resp.Errors) != 1 || resp.Errors[0].Field != tt.expectedField {
+				t.Fatalf("expected an invalid %s, got %d %+v", tt.expectedField, w.Code, resp)
+			}
+		})
+	}
+}
+
+// advertiseRefs answers the ref advertisement of site.git, whose main branch is at the commit
+type advertiseRefs string
+
+func (commit advertiseRefs) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Path != "/site.git/info/refs" {
+		return &http.Response{StatusCode: http.StatusNotFound, Body: http.NoBody, Request: req}, nil
+	}
+
+	pkt := func(line string) string { return fmt.Sprintf("%04x%s", len(line)+4, line) }
+	body := pkt("# service=git-upload-pack\n") + "0000" +
+		pkt(string(commit)+" HEAD\x00symref=HEAD:refs/heads/main\n") +
+		pkt(string(commit)+" refs/heads/main\n") + "0000"
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/x-git-upload-pack-advertisement"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+func TestCreateJobGit(t *testing.T) {
+	commit := strings.Repeat("a1", 20)
+	repos := &gitsource.Resolver{Client: &http.Client{Transport: advertiseRefs(commit)}}
+
+	tests := []struct {
+		name          string
+		body          string
+		expected      *types.GitSource
+		expectedSPA   bool
+		expectedField string
+		expectedCode  string
+	}{
+		{
+			name:     "site of the default branch",
+			body:     `{"git":{"url":"https://example.com/site.git"}}`,
+			expected: &types.GitSource{URL: "https://example.com/site.git", Commit: commit},
+		},
+		{
+			name:        "single page application in a directory",
+			body:        `{"git":{"url":"https://example.com/site.git","ref":"main","path":"dist/"},"spa":true}`,
+			expected:    &types.GitSource{URL: "https://example.com/site.git", Ref: "main", Commit: commit, Path: "dist"},
+			expectedSPA: true,
+		},
+		{
+			name:     "script",
+			body:     `{"git":{"url":"https://example.com/site.git","ref":"main","entrypoint":"bin/run.sh"},"is_script":true}`,
+			expected: &types.GitSource{URL: "https://example.com/site.git", Ref: "main", Commit: commit, Entrypoint: "bin/run.sh"},
+		},
+		{name: "unknown ref", body: `{"git":{"url":"https://example.com/site.git","ref":"develop"}}`, expectedField: "git.ref"},
+		{name: "unsafe ref", body: `{"git":{"url":"https://example.com/site.git","ref":"--upload-pack=sh"}}`, expectedField: "git.ref"},
+		{name: "path outside of the repository", body: `{"git":{"url":"https://example.com/site.git","path":"../etc"}}`, expectedField: "git.path"},
+		{name: "script without entrypoint", body: `{"git":{"url":"https://example.com/site.git"},"is_script":true}`, expectedField: "git.entrypoint"},
+		{name: "entrypoint without script", body: `{"git":{"url":"https://example.com/site.git","entrypoint":"run.sh"}}`, expectedField: "git.entrypoint"},
+		{name: "url and git", body: `{"url":"http://example.com","git":{"url":"https://example.com/site.git"}}`, expectedField: "url"},
+		{name: "archive and git", body: `{"archive":true,"git":{"url":"https://example.com/site.git"}}`, expectedField: "archive"},
+		{name: "invalid repository url", body: `{"git":{"url":"ftp://example.com/site.git"}}`, expectedField: "git.url"},
+		{name: "not a repository", body: `{"git":{"url":"https://example.com/missing.git/x"}}`, expectedCode: "invalid_git_repository"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jobService := mocks.NewJobService(t)
+			if tt.expected != nil {
+				jobService.EXPECT().
+					CreateJob(types.CreateJobInput{Name: "test-service", TargetURL: "https://example.com/site.git", Project: "default", IsScript: tt.expected.Entrypoint != "", SPA: tt.expectedSPA, Git: tt.expected}).
+					Return(&types.CreateJobOutput{URL: "http://job.example.com"}, nil)
+			}
+
+			req := httptest.NewRequest(http.MethodPut, "/services/test-service", strings.NewReader(tt.body))
+			req.SetPathValue("name", "test-service")
+			w := httptest.NewRecorder()
+
+			CreateJob(jobService, testSources, repos)(w, req)
+
+			if tt.expected != nil {
+				if w.Code != http.StatusOK {
+					t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+				}
+				return
+			}
+
+			resp := decodeProblem(t, w)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("expected status 400, got %d", w.Code)
+			}
+			if tt.expectedCode != "" && resp.Code != tt.expectedCode {
+				t.Fatalf("expected code %s, got %+v", tt.expectedCode, resp)
+			}
+			if tt.expectedField != "" && (len(resp.Errors) != 1 || resp.Errors[0].Field != tt.expectedField) {
+				t.Fatalf("expected an invalid %s, got %+v", tt.expectedField, resp)
+			}
+		})
+	}
+}
+
+func TestCreateJobIntegrity(t *testing.T) {
+	digest := strings.Repeat("ab", 32)
+	signature := base64.StdEncoding.EncodeToString(make([]byte, 64))
+
+	tests := []struct {
+		name           string
+		body           string
+		expectedSHA256 string
+		expectedField  string
+	}{
+		{name: "digest", body: `{"url":"http://example.com","sha256":"` + strings.ToUpper(digest) + `"}`, expectedSHA256: digest},
+		{name: "digest and signature", body: `{"url":"http://example.com","sha256":"` + digest + `","signature":"` + signature + `"}`, expectedSHA256: digest},
+		{name: "invalid digest", body: `{"url":"http://example.com","sha256":"abc"}`, expectedField: "sha256"},
+		{name: "invalid signature", body: `{"url":"http://example.com","signature":"c2ln"}`, expectedField: "signature"},
+		{name: "git", body: `{"git":{"url":"https://example.com/site.git"},"sha256":"` + digest + `"}`, expectedField: "sha256"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jobService := mocks.NewJobService(t)
+			if tt.expectedField == "" {
+				jobService.EXPECT().
+					CreateJob(mock.MatchedBy(func(input types.CreateJobInput) bool {
+						return input.SHA256 == tt.expectedSHA256 && strings.Contains(tt.body, input.Signature)
+					})).
+					Return(&types.CreateJobOutput{URL: "http://job.example.com"}, nil)
+			}
+
+			req := httptest.NewRequest(http.MethodPut, "/services/test-service", strings.NewReader(tt.body))
+			req.SetPathValue("name", "test-service")
+			w := httptest.NewRecorder()
+
+			CreateJob(jobService, testSources, nil)(w, req)
+
+			if tt.expectedField == "" {
+				if w.Code != http.StatusOK {
+					t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+				}
+				return
+			}
+
+			if resp := decodeProblem(t, w); w.Code != http.StatusBadRequest || len(resp.Errors) != 1 || resp.Errors[0].Field != tt.expectedField {
+				t.Fatalf("expected an invalid %s, got %d %+v", tt.expectedField, w.Code, resp)
+			}
+		})
+	}
+}
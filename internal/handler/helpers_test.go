@@ -1,6 +1,12 @@
 package handler
 
-import "testing"
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/alexisvisco/koyebtests/internal/netguard"
+)
 
 func Test_isValidURL(t *testing.T) {
 	type args struct {
@@ -224,3 +230,13 @@ func Test_isValidURL(t *testing.T) {
 		})
 	}
 }
+
+// staticResolver resolves every host to the same addresses
+type staticResolver []netip.Addr
+
+func (r staticResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	return r, nil
+}
+
+// testSources accepts the source URLs of the tests without a DNS lookup
+var testSources = &netguard.Validator{Resolver: staticResolver{netip.MustParseAddr("93.184.215.14")}}
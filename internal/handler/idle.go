@@ -0,0 +1,127 @@
+package handler
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/alexisvisco/koyebtests/internal/types"
+)
+
+// IdleScaler scales to zero the services whose subdomain did not receive any request for a while
+type IdleScaler struct {
+	jobService  types.JobService
+	idleTimeout time.Duration
+	started     time.Time
+	now         func() time.Time
+	logger      *slog.Logger
+
+	mutex    sync.Mutex
+	lastSeen map[string]time.Time
+}
+
+type IdleScalerParams struct {
+	JobService types.JobService
+
+	// IdleTimeout is how long a service can go without requests before being scaled to zero
+	IdleTimeout time.Duration
+}
+
+func NewIdleScaler(params IdleScalerParams) *IdleScaler {
+	return &IdleScaler{
+		jobService:  params.JobService,
+		idleTimeout: params.IdleTimeout,
+		started:     time.Now(),
+		now:         time.Now,
+		logger:      slog.With("component", "idle_scaler"),
+		lastSeen:    make(map[string]time.Time),
+	}
+}
+
+// Touch records a request for the job, or its wake
+func (i *IdleScaler) Touch(jobID string) {
+	i.mutex.Lock()
+	i.lastSeen[jobID] = i.now()
+	i.mutex.Unlock()
+}
+
+// ScaleIdle scales down the running services idle for longer than the timeout. A service is idle since
+// its last request or wake, its last update or since the API started, whichever is last.
+func (i *IdleScaler) ScaleIdle() error {
+	services, err := i.jobService.ListServices()
+	if err != nil {
+		return err
+	}
+
+	// The requests of the deleted services are forgotten
+	listed := make(map[string]bool, len(services))
+	for _, service := range services {
+		listed[service.JobID] = true
+	}
+	i.mutex.Lock()
+	for jobID := range i.lastSeen {
+		if !listed[jobID] {
+			delete(i.lastSeen, jobID)
+		}
+	}
+	i.mutex.Unlock()
+
+	now := i.now()
+	for _, service := range services {
+		if service.Status != types.ServiceStatusRunning {
+			continue
+		}
+
+		i.mutex.Lock()
+		lastSeen := i.lastSeen[service.JobID]
+		i.mutex.Unlock()
+
+		lastSeen = latest(lastSeen, i.started, service.CreatedAt, service.UpdatedAt)
+
+		if now.Sub(lastSeen) < i.idleTimeout {
+			continue
+		}
+
+		if err := i.jobService.ScaleDown(service.JobID); err != nil {
+			i.logger.Error("unable to scale down idle service", "job_id", service.JobID, "error", err)
+			continue
+		}
+
+		i.mutex.Lock()
+		delete(i.lastSeen, service.JobID)
+		i.mutex.Unlock()
+
+		i.logger.Info("idle service scaled to zero", "job_id", service.JobID, "idle", now.Sub(lastSeen))
+	}
+
+	return nil
+}
+
+// latest returns the last of the times
+func latest(times ...time.Time) time.Time {
+	var last time.Time
+	for _, t := range times {
+		if t.After(last) {
+			last = t
+		}
+	}
+	return last
+}
+
+// Run checks the idle services every interval until the context is done
+func (i *IdleScaler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := i.ScaleIdle(); err != nil {
+				i.logger.Error("unable to scale idle services", "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package handler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alexisvisco/koyebtests/internal/types"
+	"github.com/alexisvisco/koyebtests/mocks"
+)
+
+func TestIdleScalerScaleIdle(t *testing.T) {
+	now := time.Now()
+
+	jobService := mocks.NewJobService(t)
+	jobService.EXPECT().
+		ListServices().
+		Return([]*types.ServiceOutput{
+			{Name: "idle", JobID: "idle-job", Status: types.ServiceStatusRunning, CreatedAt: now.Add(-time.Hour)},
+			{Name: "active", JobID: "active-job", Status: types.ServiceStatusRunning, CreatedAt: now.Add(-time.Hour)},
+			{Name: "new", JobID: "new-job", Status: types.ServiceStatusRunning, CreatedAt: now.Add(-time.Minute)},
+			{Name: "updated", JobID: "updated-job", Status: types.ServiceStatusRunning, CreatedAt: now.Add(-time.Hour), UpdatedAt: now.Add(-time.Minute)},
+			{Name: "sleeping", JobID: "sleeping-job", Status: types.ServiceStatusSleeping, CreatedAt: now.Add(-time.Hour)},
+		}, nil)
+	jobService.EXPECT().
+		ScaleDown("idle-job").
+		Return(nil)
+
+	idle := NewIdleScaler(IdleScalerParams{JobService: jobService, IdleTimeout: 10 * time.Minute})
+	idle.started = now.Add(-time.Hour)
+	idle.now = func() time.Time { return now.Add(-5 * time.Minute) }
+	idle.Touch("active-job")
+	idle.Touch("deleted-job")
+	idle.now = func() time.Time { return now }
+
+	if err := idle.ScaleIdle(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, ok := idle.lastSeen["deleted-job"]; ok {
+		t.Fatal("expected the requests of the deleted service to be forgotten")
+	}
+}
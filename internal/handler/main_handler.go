@@ -1,12 +1,17 @@
 package handler
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"regexp"
-	"strconv"
+	"sync"
+	"time"
 
 	"github.com/alexisvisco/koyebtests/internal/types"
 )
@@ -15,56 +20,192 @@ type MainParams struct {
 	Host       string
 	ApiHost    string
 	JobService types.JobService
+
+	// API serves the requests to the API host, defaults to http.DefaultServeMux
+	API http.Handler
+
+	// LoadBalancing spreads the requests across the replicas of a service, defaults to round robin
+	LoadBalancing LoadBalancing
+
+	// EjectionDuration is how long a backend that failed stops receiving requests, defaults to 10 seconds
+	EjectionDuration time.Duration
+
+	// Transport reaches the backends, defaults to http.DefaultTransport
+	Transport http.RoundTripper
+
+	// Idle records the requests of each service to scale the idle ones to zero, nil disables it
+	Idle *IdleScaler
+
+	// WakeTimeout is how long a request to a sleeping service is held while it wakes up, defaults to 1 minute
+	WakeTimeout time.Duration
+
+	// WakingPage answers requests to a sleeping service with a page that refreshes itself
+	// instead of holding them until the service is running
+	WakingPage bool
 }
 
+const defaultWakeTimeout = time.Minute
+
+// wakingPage is served while a sleeping service starts when MainParams.WakingPage is set
+const wakingPage = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><meta http-equiv="refresh" content="3"><title>Waking up</title></head>
+<body><p>This service is waking up, the page will reload in a few seconds.</p></body>
+</html>
+`
+
 func Main(params MainParams) http.HandlerFunc {
 	logger := slog.With("component", "main_handler")
+	balancer := newBalancer(params.LoadBalancing, params.EjectionDuration)
+
+	api := params.API
+	if api == nil {
+		api = http.DefaultServeMux
+	}
+
+	wakeTimeout := params.WakeTimeout
+	if wakeTimeout <= 0 {
+		wakeTimeout = defaultWakeTimeout
+	}
+
+	// waking holds the jobs woken up in the background, so that the refreshes of the waking page do not
+	// start a wake each
+	var waking sync.Map
+
+	// wake scales up a sleeping service, it returns false when the response was already written
+	wake := func(w http.ResponseWriter, r *http.Request, jobID string) ([]types.Backend, bool) {
+		if params.WakingPage {
+			if _, inFlight := waking.LoadOrStore(jobID, struct{}{}); !inFlight {
+				go func() {
+					defer waking.Delete(jobID)
+
+					ctx, cancel := context.WithTimeout(context.Background(), wakeTimeout)
+					defer cancel()
+					if _, err := params.JobService.WakeJob(ctx, jobID); err != nil {
+						logger.Error("unable to wake up service", "job_id", jobID, "error", err)
+						return
+					}
+					if params.Idle != nil {
+						params.Idle.Touch(jobID)
+					}
+				}()
+			}
+
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("Retry-After", "3")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, wakingPage)
+			return nil, false
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), wakeTimeout)
+		defer cancel()
+
+		logger.Info("waking up service", "job_id", jobID)
+		backends, err := params.JobService.WakeJob(ctx, jobID)
+		switch {
+		case errors.Is(err, context.DeadlineExceeded):
+			problem(w, r, http.StatusGatewayTimeout, "service_waking_up", "The service did not wake up in time, retry later")
+			return nil, false
+		case errors.Is(err, types.ErrServiceNotSleeping):
+			// The service is not sleeping, its replicas are restarting or being rescheduled
+			problem(w, r, http.StatusServiceUnavailable, "service_unavailable", "The service has no running replica")
+			return nil, false
+		case err != nil:
+			logger.Error("unable to wake up service", "job_id", jobID, "request_id", requestID(r), "error", err)
+			problem(w, r, http.StatusServiceUnavailable, "service_unavailable", "The service could not be woken up")
+			return nil, false
+		}
+
+		// The service is idle from its wake, not from the request that started it
+		if params.Idle != nil {
+			params.Idle.Touch(jobID)
+		}
+
+		return backends, true
+	}
+	// Services are served on <service>.<project>.<host>, <job id>.<host> is kept for the existing links
+	subdomainPattern := regexp.MustCompile(`^([^.]+)\.([^.]+)\.` + regexp.QuoteMeta(params.Host) + `$`)
 	jobIDPattern := regexp.MustCompile(`^([^.]+)\.` + regexp.QuoteMeta(params.Host) + `$`)
 	return func(w http.ResponseWriter, r *http.Request) {
+		r = withRequestID(w, r)
 		hostHeader := r.Host
-		logger.Info("incoming request", "host", hostHeader, "path", r.URL.Path, "method", r.Method)
+		logger.Info("incoming request", "host", hostHeader, "path", r.URL.Path, "method", r.Method, "request_id", requestID(r))
 
 		if hostHeader == params.ApiHost {
-			http.DefaultServeMux.ServeHTTP(w, r)
+			api.ServeHTTP(w, r)
 			return
 		}
 
-		matches := jobIDPattern.FindStringSubmatch(hostHeader)
-		if len(matches) > 1 {
-			mayJobID := matches[1]
-			jobPort, ok := params.JobService.GetJobPort(mayJobID)
+		var mayJobID string
+		if matches := subdomainPattern.FindStringSubmatch(hostHeader); len(matches) > 2 {
+			jobID, ok := params.JobService.ResolveSubdomain(matches[2], matches[1])
+			if !ok {
+				problem(w, r, http.StatusNotFound, "unable_to_find_job", "No service is served on "+hostHeader)
+				return
+			}
+			mayJobID = jobID
+		} else if matches := jobIDPattern.FindStringSubmatch(hostHeader); len(matches) > 1 {
+			mayJobID = matches[1]
+		}
+
+		if mayJobID != "" {
+			backends, ok := params.JobService.GetJobBackends(mayJobID)
 			if !ok {
-				http.Error(w, "unable_to_find_job", http.StatusNotFound)
+				balancer.forget(mayJobID)
+				problem(w, r, http.StatusNotFound, "unable_to_find_job", "No service is served on "+hostHeader)
 				return
 			}
 
-			target, err := url.Parse("http://localhost:" + strconv.Itoa(jobPort))
+			if params.Idle != nil {
+				params.Idle.Touch(mayJobID)
+			}
+
+			if len(backends) == 0 {
+				// The replicas are stopped, the woken service gets new ones
+				balancer.forget(mayJobID)
+				backends, ok = wake(w, r, mayJobID)
+				if !ok {
+					return
+				}
+			}
+
+			backend, done := balancer.pick(mayJobID, backends)
+
+			// Backends run on the Nomad client nodes, the API does not have to share a node with them
+			target, err := url.Parse("http://" + backendAddress(backend))
 			if err != nil {
-				logger.Error("error parsing target URL", "error", err)
-				http.Error(w, "internal_server_error", http.StatusInternalServerError)
+				done(false)
+				internalProblem(w, r, "internal_server_error", fmt.Errorf("unable to parse the backend address: %w", err))
 				return
 			}
 
 			proxy := httputil.NewSingleHostReverseProxy(target)
+			proxy.Transport = params.Transport
+			failed := false
 
 			originalDirector := proxy.Director
 			proxy.Director = func(req *http.Request) {
 				originalDirector(req)
 				req.Header.Set("X-Original-Subdomain", mayJobID)
 				req.Header.Set("X-Original-Host", hostHeader)
+				req.Header.Set(requestIDHeader, requestID(r))
 			}
 
 			proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-				logger.Error("reverse proxy error", "host", hostHeader, "job_id", mayJobID, "error", err)
-				http.Error(w, "service_unavailable", http.StatusServiceUnavailable)
+				logger.Error("reverse proxy error", "host", hostHeader, "job_id", mayJobID, "alloc_id", backend.AllocID, "request_id", requestID(r), "error", err)
+				// A request canceled by the client says nothing about the health of the backend
+				failed = r.Context().Err() == nil
+				problem(w, r, http.StatusServiceUnavailable, "service_unavailable", "The service did not answer")
 			}
 
-			logger.Info("proxying request", "host", hostHeader, "job_id", mayJobID, "target", "localhost:"+strconv.Itoa(jobPort))
+			logger.Info("proxying request", "host", hostHeader, "job_id", mayJobID, "target", target.Host)
 			proxy.ServeHTTP(w, r)
+			done(failed)
 			return
 		}
 
-		logger.Warn("unknown host", "host", hostHeader)
-		http.Error(w, "not_found", http.StatusNotFound)
+		logger.Warn("unknown host", "host", hostHeader, "request_id", requestID(r))
+		problem(w, r, http.StatusNotFound, "not_found", "Unknown host "+hostHeader)
 	}
 }
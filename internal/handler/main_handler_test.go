@@ -1,14 +1,20 @@
 package handler
 
 import (
+	"context"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/alexisvisco/koyebtests/internal/types"
 	"github.com/alexisvisco/koyebtests/mocks"
+	"github.com/stretchr/testify/mock"
 )
 
 func TestMainHandlerReverseProxy(t *testing.T) {
@@ -29,8 +35,8 @@ func TestMainHandlerReverseProxy(t *testing.T) {
 
 	jobService := mocks.NewJobService(t)
 	jobService.EXPECT().
-		GetJobPort(jobID).
-		Return(backendPort, true)
+		GetJobBackends(jobID).
+		Return([]types.Backend{{AllocID: "alloc-1", IP: "127.0.0.1", Port: backendPort}}, true)
 
 	mainHandler := Main(MainParams{Host: host, ApiHost: "api." + host, JobService: jobService})
 
@@ -42,6 +48,7 @@ func TestMainHandlerReverseProxy(t *testing.T) {
 		t.Fatalf("failed to create request: %v", err)
 	}
 	req.Host = jobID + "." + host
+	req.Header.Set("X-Request-ID", "lb-request-1")
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -52,6 +59,9 @@ func TestMainHandlerReverseProxy(t *testing.T) {
 	if resp.StatusCode != http.StatusOK {
 		t.Fatalf("expected status 200, got %d", resp.StatusCode)
 	}
+	if resp.Header.Get("X-Request-ID") != "lb-request-1" {
+		t.Fatalf("expected the request id in the response, got %q", resp.Header.Get("X-Request-ID"))
+	}
 	body, _ := io.ReadAll(resp.Body)
 	if string(body) != "ok" {
 		t.Fatalf("unexpected body: %s", string(body))
@@ -64,4 +74,276 @@ func TestMainHandlerReverseProxy(t *testing.T) {
 	if headers.Get("X-Original-Host") != jobID+"."+host {
 		t.Fatalf("expected X-Original-Host %s, got %s", jobID+"."+host, headers.Get("X-Original-Host"))
 	}
+	if headers.Get("X-Request-ID") != "lb-request-1" {
+		t.Fatalf("expected the request id to be forwarded, got %q", headers.Get("X-Request-ID"))
+	}
+}
+
+func TestMainHandlerEjectsFailingBackend(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	backendPort, err := strconv.Atoi(strings.Split(backend.Listener.Addr().String(), ":")[1])
+	if err != nil {
+		t.Fatalf("failed to parse backend port: %v", err)
+	}
+
+	// A closed server gives a port on which nothing listens anymore
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closedPort, _ := strconv.Atoi(strings.Split(closed.Listener.Addr().String(), ":")[1])
+	closed.Close()
+
+	jobID := "jobid"
+	host := "example.com"
+
+	jobService := mocks.NewJobService(t)
+	jobService.EXPECT().
+		GetJobBackends(jobID).
+		Return([]types.Backend{
+			{AllocID: "alloc-down", IP: "127.0.0.1", Port: closedPort},
+			{AllocID: "alloc-up", IP: "127.0.0.1", Port: backendPort},
+		}, true)
+
+	server := httptest.NewServer(Main(MainParams{Host: host, ApiHost: "api." + host, JobService: jobService}))
+	defer server.Close()
+
+	statuses := make([]int, 0, 4)
+	for range 4 {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/", nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		req.Host = jobID + "." + host
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to do request: %v", err)
+		}
+		resp.Body.Close()
+		statuses = append(statuses, resp.StatusCode)
+	}
+
+	expected := []int{http.StatusServiceUnavailable, http.StatusOK, http.StatusOK, http.StatusOK}
+	if !reflect.DeepEqual(statuses, expected) {
+		t.Fatalf("expected statuses %v, got %v", expected, statuses)
+	}
+}
+
+func TestMainHandlerProxiesToAllocationAddress(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	jobID := "jobid"
+	host := "example.com"
+
+	jobService := mocks.NewJobService(t)
+	jobService.EXPECT().
+		GetJobBackends(jobID).
+		Return([]types.Backend{{AllocID: "alloc-1", IP: "10.20.30.40", Port: 25000}}, true)
+
+	// The allocation runs on another node, the dial is recorded and sent to the local backend instead
+	dialed := make(chan string, 1)
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed <- addr
+			return (&net.Dialer{}).DialContext(ctx, network, backend.Listener.Addr().String())
+		},
+	}
+	defer transport.CloseIdleConnections()
+
+	server := httptest.NewServer(Main(MainParams{Host: host, ApiHost: "api." + host, JobService: jobService, Transport: transport}))
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/", nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	req.Host = jobID + "." + host
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to do request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+
+	if addr := <-dialed; addr != "10.20.30.40:25000" {
+		t.Fatalf("expected the allocation address 10.20.30.40:25000 to be dialed, got %s", addr)
+	}
+}
+
+func TestMainHandlerWakesSleepingService(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "awake")
+	}))
+	defer backend.Close()
+
+	backendPort, err := strconv.Atoi(strings.Split(backend.Listener.Addr().String(), ":")[1])
+	if err != nil {
+		t.Fatalf("failed to parse backend port: %v", err)
+	}
+
+	jobID := "jobid"
+	host := "example.com"
+
+	jobService := mocks.NewJobService(t)
+	jobService.EXPECT().
+		GetJobBackends(jobID).
+		Return(nil, true)
+	jobService.EXPECT().
+		WakeJob(mock.Anything, jobID).
+		Return([]types.Backend{{AllocID: "alloc-1", IP: "127.0.0.1", Port: backendPort}}, nil)
+
+	server := httptest.NewServer(Main(MainParams{Host: host, ApiHost: "api." + host, JobService: jobService}))
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/", nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	req.Host = jobID + "." + host
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to do request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "awake" {
+		t.Fatalf("expected the request to be held until the service woke up, got %d %q", resp.StatusCode, string(body))
+	}
+}
+
+func TestMainHandlerWakingPage(t *testing.T) {
+	jobID := "jobid"
+	host := "example.com"
+
+	woken := make(chan struct{})
+	release := make(chan struct{})
+	jobService := mocks.NewJobService(t)
+	jobService.EXPECT().
+		GetJobBackends(jobID).
+		Return(nil, true)
+	// The refreshes of the page while the service wakes up do not start other wakes
+	jobService.EXPECT().
+		WakeJob(mock.Anything, jobID).
+		RunAndReturn(func(ctx context.Context, jobID string) ([]types.Backend, error) {
+			close(woken)
+			<-release
+			return nil, nil
+		}).
+		Once()
+
+	server := httptest.NewServer(Main(MainParams{Host: host, ApiHost: "api." + host, JobService: jobService, WakingPage: true}))
+	defer server.Close()
+
+	for range 3 {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/", nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		req.Host = jobID + "." + host
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to do request: %v", err)
+		}
+
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(string(body), "waking up") {
+			t.Fatalf("expected the waking up page, got %d %q", resp.StatusCode, string(body))
+		}
+		if resp.Header.Get("Retry-After") == "" {
+			t.Fatal("expected a Retry-After header")
+		}
+	}
+
+	select {
+	case <-woken:
+	case <-time.After(time.Second):
+		t.Fatal("expected the service to be woken up in the background")
+	}
+	close(release)
+}
+
+func TestMainHandlerResolvesSubdomain(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	backendPort, err := strconv.Atoi(strings.Split(backend.Listener.Addr().String(), ":")[1])
+	if err != nil {
+		t.Fatalf("failed to parse backend port: %v", err)
+	}
+
+	host := "example.com"
+
+	jobService := mocks.NewJobService(t)
+	jobService.EXPECT().ResolveSubdomain("team-a", "my-app").Return("jobid", true)
+	jobService.EXPECT().ResolveSubdomain("team-b", "my-app").Return("", false)
+	jobService.EXPECT().
+		GetJobBackends("jobid").
+		Return([]types.Backend{{AllocID: "alloc-1", IP: "127.0.0.1", Port: backendPort}}, true)
+
+	server := httptest.NewServer(Main(MainParams{Host: host, ApiHost: "api." + host, JobService: jobService}))
+	defer server.Close()
+
+	tests := []struct {
+		name           string
+		host           string
+		expectedStatus int
+	}{
+		{name: "service of the project", host: "my-app.team-a." + host, expectedStatus: http.StatusOK},
+		{name: "unknown service", host: "my-app.team-b." + host, expectedStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, server.URL+"/", nil)
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+			req.Host = tt.host
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("failed to do request: %v", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d", tt.expectedStatus, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestMainHandlerUnknownHostProblem(t *testing.T) {
+	host := "example.com"
+	jobService := mocks.NewJobService(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = "unknown.org"
+	w := httptest.NewRecorder()
+
+	Main(MainParams{Host: host, ApiHost: "api." + host, JobService: jobService})(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected status 404, got %d", w.Code)
+	}
+
+	id := w.Header().Get("X-Request-ID")
+	if p := decodeProblem(t, w); p.Code != "not_found" || p.RequestID == "" || p.RequestID != id {
+		t.Fatalf("expected a not_found problem with the request id %q, got %+v", id, p)
+	}
 }
@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/alexisvisco/koyebtests/internal/types"
+)
+
+type OperationResponse struct {
+	ID        string    `json:"id"`
+	Service   string    `json:"service"`
+	Project   string    `json:"project"`
+	State     string    `json:"state"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func GetOperation(service types.JobService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		op, err := service.GetOperation(r.PathValue("id"))
+		if errors.Is(err, types.ErrOperationNotFound) || err == nil && !canAccess(r, op.Project, op.Owner) {
+			problem(w, r, http.StatusNotFound, "operation_not_found", "Operation "+r.PathValue("id")+" does not exist")
+			return
+		}
+		if err != nil {
+			internalProblem(w, r, "failed_get_operation", err)
+			return
+		}
+
+		response := OperationResponse{
+			ID:        op.ID,
+			Service:   op.ServiceName,
+			Project:   op.Project,
+			State:     string(op.State),
+			Reason:    op.Reason,
+			CreatedAt: op.CreatedAt,
+			UpdatedAt: op.UpdatedAt,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alexisvisco/koyebtests/internal/types"
+	"github.com/alexisvisco/koyebtests/mocks"
+)
+
+func TestGetOperation(t *testing.T) {
+	tests := []struct {
+		name           string
+		operation      *types.Operation
+		err            error
+		expectedStatus int
+	}{
+		{
+			name:           "failed operation",
+			operation:      &types.Operation{ID: "op-id", ServiceName: "test-service", State: types.OperationStateFailed, Reason: "image pull failed"},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "unknown operation",
+			err:            types.ErrOperationNotFound,
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jobService := mocks.NewJobService(t)
+			jobService.EXPECT().GetOperation("op-id").Return(tt.operation, tt.err)
+
+			req := httptest.NewRequest(http.MethodGet, "/operations/op-id", nil)
+			req.SetPathValue("id", "op-id")
+			w := httptest.NewRecorder()
+
+			GetOperation(jobService)(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+
+			if tt.operation == nil {
+				return
+			}
+
+			var resp OperationResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			if resp.State != "failed" || resp.Reason != "image pull failed" || resp.Service != "test-service" {
+				t.Fatalf("unexpected response: %+v", resp)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"regexp"
+
+	"github.com/alexisvisco/koyebtests/internal/types"
+	"github.com/google/uuid"
+)
+
+const (
+	// problemTypePrefix prefixes the code of a problem to make its type URI
+	problemTypePrefix = "urn:koyebtest:problem:"
+
+	requestIDHeader = "X-Request-ID"
+)
+
+// requestIDPattern accepts the request IDs set by a load balancer in front of the API
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// Problem is an RFC 7807 problem details response. Code is stable, clients should rely on it
+// rather than on Detail which is meant for humans.
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	Code      string       `json:"code"`
+	RequestID string       `json:"request_id,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+
+	// Rule, Pattern and Value tell which rule of the source policy refused a url
+	Rule    string `json:"rule,omitempty"`
+	Pattern string `json:"pattern,omitempty"`
+	Value   string `json:"value,omitempty"`
+}
+
+// FieldError is the validation error of a field of the request
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type requestIDContextKey struct{}
+
+// withRequestID returns the request with its ID in the context and sets the ID on the response.
+// The ID of the client or of a load balancer is kept when it looks like one.
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := r.Header.Get(requestIDHeader)
+	if !requestIDPattern.MatchString(id) {
+		id = uuid.New().String()
+	}
+
+	w.Header().Set(requestIDHeader, id)
+	return r.WithContext(context.WithValue(r.Context(), requestIDContextKey{}, id))
+}
+
+// requestID returns the ID of the request, empty when it did not go through Main
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// writeProblem completes the problem from the request and writes it
+func writeProblem(w http.ResponseWriter, r *http.Request, p Problem) {
+	p.Type = problemTypePrefix + p.Code
+	p.Title = http.StatusText(p.Status)
+	p.Instance = r.URL.Path
+	p.RequestID = requestID(r)
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// problem writes a problem without details
+func problem(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+	writeProblem(w, r, Problem{Status: status, Code: code, Detail: detail})
+}
+
+// validationProblem writes the error of a field of the request as an invalid_spec problem
+func validationProblem(w http.ResponseWriter, r *http.Request, err *types.ValidationError) {
+	writeProblem(w, r, Problem{
+		Status: http.StatusBadRequest,
+		Code:   "invalid_spec",
+		Detail: err.Error(),
+		Errors: []FieldError{{Field: err.Field, Message: err.Message}},
+	})
+}
+
+// internalProblem logs the cause of a failure with the ID of the request and writes it as a 500. The cause
+// stays in the logs, it may tell about the infrastructure behind the API.
+func internalProblem(w http.ResponseWriter, r *http.Request, code string, err error) {
+	id := requestID(r)
+	slog.Error("request failed", "component", "handler", "code", code, "request_id", id, "method", r.Method, "path", r.URL.Path, "error", err)
+
+	detail := "An internal error occurred"
+	if id != "" {
+		detail += ", report the request ID " + id + " to investigate it"
+	}
+	problem(w, r, http.StatusInternalServerError, code, detail)
+}
@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alexisvisco/koyebtests/internal/types"
+)
+
+// decodeProblem checks the content type of the response and decodes its problem
+func decodeProblem(t *testing.T, w *httptest.ResponseRecorder) Problem {
+	t.Helper()
+
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/problem+json" {
+		t.Fatalf("expected a problem+json response, got %q", contentType)
+	}
+
+	var p Problem
+	if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+		t.Fatalf("failed to decode problem: %v", err)
+	}
+	return p
+}
+
+func TestWithRequestID(t *testing.T) {
+	tests := []struct {
+		name     string
+		incoming string
+		keep     bool
+	}{
+		{name: "no request id"},
+		{name: "valid request id", incoming: "lb-1234.abcd_ef", keep: true},
+		{name: "invalid request id", incoming: "bad id\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/services", nil)
+			if tt.incoming != "" {
+				req.Header.Set(requestIDHeader, tt.incoming)
+			}
+			w := httptest.NewRecorder()
+
+			req = withRequestID(w, req)
+
+			id := requestID(req)
+			if id == "" || w.Header().Get(requestIDHeader) != id {
+				t.Fatalf("expected the response to carry the request id %q, got %q", id, w.Header().Get(requestIDHeader))
+			}
+			if (id == tt.incoming) != tt.keep {
+				t.Fatalf("expected keep %v, got id %q for %q", tt.keep, id, tt.incoming)
+			}
+		})
+	}
+}
+
+func TestValidationProblem(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPut, "/services/test-service", nil)
+	w := httptest.NewRecorder()
+	req = withRequestID(w, req)
+
+	validationProblem(w, req, &types.ValidationError{Field: "resources.cpu", Message: "must be between 50 and 1000"})
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %d", w.Code)
+	}
+
+	p := decodeProblem(t, w)
+	expected := Problem{
+		Type:      "urn:koyebtest:problem:invalid_spec",
+		Title:     "Bad Request",
+		Status:    http.StatusBadRequest,
+		Detail:    "resources.cpu must be between 50 and 1000",
+		Instance:  "/services/test-service",
+		Code:      "invalid_spec",
+		RequestID: requestID(req),
+		Errors:    []FieldError{{Field: "resources.cpu", Message: "must be between 50 and 1000"}},
+	}
+	if p.Type != expected.Type || p.Title != expected.Title || p.Status != expected.Status || p.Detail != expected.Detail ||
+		p.Instance != expected.Instance || p.Code != expected.Code || p.RequestID != expected.RequestID ||
+		len(p.Errors) != 1 || p.Errors[0] != expected.Errors[0] {
+		t.Fatalf("expected %+v, got %+v", expected, p)
+	}
+}
+
+func TestInternalProblemHidesCause(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPut, "/services/test-service", nil)
+	req.Header.Set(requestIDHeader, "req-123")
+	w := httptest.NewRecorder()
+
+	internalProblem(w, withRequestID(w, req), "failed_create_job", errors.New("failed to register job: Unexpected response code: 500"))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status 500, got %d", w.Code)
+	}
+
+	p := decodeProblem(t, w)
+	if p.Code != "failed_create_job" || p.RequestID != "req-123" {
+		t.Fatalf("expected the code and request ID in the problem, got %+v", p)
+	}
+	if p.Detail != "An internal error occurred, report the request ID req-123 to investigate it" {
+		t.Fatalf("expected a generic detail, got %q", p.Detail)
+	}
+}
@@ -0,0 +1,201 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/alexisvisco/koyebtests/internal/types"
+)
+
+type ServiceResponse struct {
+	Name        string           `json:"name"`
+	Project     string           `json:"project"`
+	Status      string           `json:"status"`
+	URL         string           `json:"url"`
+	Mode        string           `json:"mode"`
+	SourceURL   string           `json:"source_url"`
+	ContentType string           `json:"content_type,omitempty"`
+	SPA         bool             `json:"spa,omitempty"`
+	Git         *types.GitSource `json:"git,omitempty"`
+	SHA256      string           `json:"sha256,omitempty"`
+	Signed      bool             `json:"signed,omitempty"`
+	Replicas    int              `json:"replicas"`
+	CreatedAt   time.Time        `json:"created_at"`
+	ExpiresAt   time.Time        `json:"expires_at,omitzero"`
+}
+
+type ExtendServiceRequest struct {
+	TTL       string     `json:"ttl"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type ListServicesResponse struct {
+	Services []ServiceResponse `json:"services"`
+}
+
+// ListServices returns the services the API key created in its project. The admin key and unauthenticated
+// requests see every project unless they pick one with the project query parameter.
+func ListServices(service types.JobService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		project, ok := requestProject(w, r)
+		if !ok {
+			return
+		}
+		c, authenticated := r.Context().Value(callerContextKey{}).(caller)
+		allProjects := r.URL.Query().Get("project") == "" && (!authenticated || c.admin)
+
+		services, err := service.ListServices()
+		if err != nil {
+			internalProblem(w, r, "failed_list_services", err)
+			return
+		}
+
+		response := ListServicesResponse{
+			Services: make([]ServiceResponse, 0, len(services)),
+		}
+		for _, s := range services {
+			if (allProjects || s.Project == project) && canAccess(r, s.Project, s.Owner) {
+				response.Services = append(response.Services, newServiceResponse(s))
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func GetService(service types.JobService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, ok := findService(w, r, service)
+		if !ok {
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newServiceResponse(s))
+	}
+}
+
+func DeleteService(service types.JobService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, ok := findService(w, r, service)
+		if !ok {
+			return
+		}
+
+		if err := service.PurgeJob(s.JobID); err != nil {
+			internalProblem(w, r, "failed_delete_service", err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func RestartService(service types.JobService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, ok := findService(w, r, service)
+		if !ok {
+			return
+		}
+
+		if err := service.RestartJob(s.JobID); err != nil {
+			internalProblem(w, r, "failed_restart_service", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newServiceResponse(s))
+	}
+}
+
+// ExtendService pushes back the expiry of a service, a ttl is added to its current expiry
+func ExtendService(service types.JobService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		current, ok := findService(w, r, service)
+		if !ok {
+			return
+		}
+
+		var req ExtendServiceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			problem(w, r, http.StatusBadRequest, "invalid_json", "The body is not a valid JSON request: "+err.Error())
+			return
+		}
+
+		input, lifetimeErr := parseLifetime(req.TTL, req.ExpiresAt)
+		if lifetimeErr == nil && input.TTL == 0 && input.ExpiresAt.IsZero() {
+			lifetimeErr = &types.ValidationError{Field: "ttl", Message: "or expires_at is required"}
+		}
+		if lifetimeErr != nil {
+			validationProblem(w, r, lifetimeErr)
+			return
+		}
+
+		s, err := service.ExtendService(current.Project, current.Name, input)
+		var validationErr *types.ValidationError
+		switch {
+		case errors.Is(err, types.ErrServiceNotFound):
+			problem(w, r, http.StatusNotFound, "service_not_found", "Service "+current.Name+" does not exist")
+			return
+		case errors.As(err, &validationErr):
+			validationProblem(w, r, validationErr)
+			return
+		case err != nil:
+			internalProblem(w, r, "failed_extend_service", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newServiceResponse(s))
+	}
+}
+
+// findService resolves the service of the name path parameter and writes the error response when it fails.
+// The services are looked up in the project of the request, the services of other API keys are not found.
+func findService(w http.ResponseWriter, r *http.Request, service types.JobService) (*types.ServiceOutput, bool) {
+	name := r.PathValue("name")
+	if strings.Trim(name, " ") == "" {
+		problem(w, r, http.StatusBadRequest, "invalid_name", "The service name is required")
+		return nil, false
+	}
+
+	project, ok := requestProject(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	s, err := service.GetService(project, name)
+	if errors.Is(err, types.ErrServiceNotFound) || err == nil && !canAccess(r, s.Project, s.Owner) {
+		problem(w, r, http.StatusNotFound, "service_not_found", "Service "+name+" does not exist in project "+project)
+		return nil, false
+	}
+	if err != nil {
+		internalProblem(w, r, "failed_get_service", err)
+		return nil, false
+	}
+
+	return s, true
+}
+
+func newServiceResponse(s *types.ServiceOutput) ServiceResponse {
+	return ServiceResponse{
+		Name:        s.Name,
+		Project:     s.Project,
+		Status:      s.Status,
+		URL:         s.URL,
+		Mode:        string(s.Mode),
+		SourceURL:   s.SourceURL,
+		ContentType: s.ContentType,
+		SPA:         s.SPA,
+		Git:         s.Git,
+		SHA256:      s.SHA256,
+		Signed:      s.Signature != "",
+		Replicas:    s.Replicas,
+		CreatedAt:   s.CreatedAt,
+		ExpiresAt:   s.ExpiresAt,
+	}
+}
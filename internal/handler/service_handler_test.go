@@ -0,0 +1,209 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexisvisco/koyebtests/internal/types"
+	"github.com/alexisvisco/koyebtests/mocks"
+)
+
+func testServiceOutput() *types.ServiceOutput {
+	return &types.ServiceOutput{
+		Name:      "test-service",
+		Project:   "default",
+		JobID:     "test-service-job",
+		Status:    types.ServiceStatusRunning,
+		URL:       "http://test-service.default.example.com",
+		Mode:      types.ServiceModeScript,
+		SourceURL: "http://example.com",
+		CreatedAt: time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+}
+
+func TestListServices(t *testing.T) {
+	jobService := mocks.NewJobService(t)
+	jobService.EXPECT().ListServices().Return([]*types.ServiceOutput{testServiceOutput()}, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/services", nil)
+	w := httptest.NewRecorder()
+
+	ListServices(jobService)(w, req)
+
+	res := w.Result()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var resp ListServicesResponse
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+
+	if len(resp.Services) != 1 {
+		t.Fatalf("expected 1 service, got %d", len(resp.Services))
+	}
+
+	got := resp.Services[0]
+	if got.Name != "test-service" || got.Status != "running" || got.Mode != "script" || got.SourceURL != "http://example.com" {
+		t.Fatalf("unexpected service: %+v", got)
+	}
+	if !got.CreatedAt.Equal(testServiceOutput().CreatedAt) {
+		t.Fatalf("expected created_at %s, got %s", testServiceOutput().CreatedAt, got.CreatedAt)
+	}
+}
+
+func TestGetService(t *testing.T) {
+	tests := []struct {
+		name           string
+		output         *types.ServiceOutput
+		err            error
+		expectedStatus int
+	}{
+		{
+			name:           "found",
+			output:         testServiceOutput(),
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "not found",
+			err:            types.ErrServiceNotFound,
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jobService := mocks.NewJobService(t)
+			jobService.EXPECT().GetService("default", "test-service").Return(tt.output, tt.err)
+
+			req := httptest.NewRequest(http.MethodGet, "/services/test-service", nil)
+			req.SetPathValue("name", "test-service")
+			w := httptest.NewRecorder()
+
+			GetService(jobService)(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+		})
+	}
+}
+
+func TestDeleteService(t *testing.T) {
+	jobService := mocks.NewJobService(t)
+	jobService.EXPECT().GetService("default", "test-service").Return(testServiceOutput(), nil)
+	jobService.EXPECT().PurgeJob("test-service-job").Return(nil)
+
+	req := httptest.NewRequest(http.MethodDelete, "/services/test-service", nil)
+	req.SetPathValue("name", "test-service")
+	w := httptest.NewRecorder()
+
+	DeleteService(jobService)(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", w.Code)
+	}
+}
+
+func TestRestartService(t *testing.T) {
+	jobService := mocks.NewJobService(t)
+	jobService.EXPECT().GetService("default", "test-service").Return(testServiceOutput(), nil)
+	jobService.EXPECT().RestartJob("test-service-job").Return(nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/services/test-service/restart", nil)
+	req.SetPathValue("name", "test-service")
+	w := httptest.NewRecorder()
+
+	RestartService(jobService)(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	var resp ServiceResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if resp.URL != "http://test-service.default.example.com" {
+		t.Fatalf("unexpected url: %s", resp.URL)
+	}
+}
+
+func TestExtendService(t *testing.T) {
+	expiresAt := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	extended := testServiceOutput()
+	extended.ExpiresAt = expiresAt
+
+	tests := []struct {
+		name           string
+		body           string
+		input          *types.ExtendServiceInput
+		getErr         error
+		expectedStatus int
+	}{
+		{
+			name:           "ttl",
+			body:           `{"ttl":"1h"}`,
+			input:          &types.ExtendServiceInput{TTL: time.Hour},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "expires_at",
+			body:           `{"expires_at":"2030-01-02T03:04:05Z"}`,
+			input:          &types.ExtendServiceInput{ExpiresAt: expiresAt},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "not found",
+			body:           `{"ttl":"1h"}`,
+			getErr:         types.ErrServiceNotFound,
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "missing lifetime",
+			body:           `{}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jobService := mocks.NewJobService(t)
+			if tt.getErr != nil {
+				jobService.EXPECT().GetService("default", "test-service").Return(nil, tt.getErr)
+			} else {
+				jobService.EXPECT().GetService("default", "test-service").Return(testServiceOutput(), nil)
+			}
+			if tt.input != nil {
+				jobService.EXPECT().ExtendService("default", "test-service", *tt.input).Return(extended, nil)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/services/test-service/extend", strings.NewReader(tt.body))
+			req.SetPathValue("name", "test-service")
+			w := httptest.NewRecorder()
+
+			ExtendService(jobService)(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+
+			if tt.expectedStatus != http.StatusOK {
+				return
+			}
+
+			var resp ServiceResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			if !resp.ExpiresAt.Equal(expiresAt) {
+				t.Fatalf("expected expires_at %s, got %s", expiresAt, resp.ExpiresAt)
+			}
+		})
+	}
+}
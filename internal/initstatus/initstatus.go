@@ -0,0 +1,155 @@
+// Package initstatus describes how the init binary ended. Init writes a status file next to the
+// content and exits with the code of the class of its failure, the local backend reads the file
+// and the Nomad backend, which cannot reach the file of the allocation, reads the exit code of
+// the startup script of the image.
+package initstatus
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// File is the name of the status file in the working directory of init
+const File = "status.json"
+
+// Class groups the failures of init by what the owner of the service can do about them
+type Class string
+
+const (
+	ClassInternal         Class = "internal"
+	ClassInvalidArguments Class = "invalid_arguments"
+	ClassForbidden        Class = "forbidden_destination"
+	ClassUpstream         Class = "upstream_error"
+	ClassNetwork          Class = "network_error"
+	ClassTooLarge         Class = "too_large"
+	ClassIntegrity        Class = "integrity_mismatch"
+	ClassInvalidContent   Class = "invalid_content"
+	ClassTooManyRedirects Class = "too_many_redirects"
+)
+
+// exitCodes are the exit codes of the classes, 1 is left to the internal failures and to the crashes
+var exitCodes = map[Class]int{
+	ClassInternal:         1,
+	ClassInvalidArguments: 2,
+	ClassForbidden:        3,
+	ClassUpstream:         4,
+	ClassNetwork:          5,
+	ClassTooLarge:         6,
+	ClassIntegrity:        7,
+	ClassInvalidContent:   8,
+	ClassTooManyRedirects: 9,
+}
+
+var descriptions = map[Class]string{
+	ClassInternal:         "init failed",
+	ClassInvalidArguments: "invalid init arguments",
+	ClassForbidden:        "source refused by the policy",
+	ClassUpstream:         "source answered with an error",
+	ClassNetwork:          "source could not be reached",
+	ClassTooLarge:         "content exceeds the size limits",
+	ClassIntegrity:        "content does not match the expected digest, signature or commit",
+	ClassInvalidContent:   "content cannot be served",
+	ClassTooManyRedirects: "source redirected too many times",
+}
+
+// ExitCode returns the exit code of the class
+func (c Class) ExitCode() int {
+	if code, ok := exitCodes[c]; ok {
+		return code
+	}
+	return exitCodes[ClassInternal]
+}
+
+// Description returns a sentence explaining the class
+func (c Class) Description() string {
+	if description, ok := descriptions[c]; ok {
+		return description
+	}
+	return descriptions[ClassInternal]
+}
+
+// ClassOf returns the class of an exit code of init, false for the codes init does not use
+func ClassOf(exitCode int) (Class, bool) {
+	for class, code := range exitCodes {
+		if code == exitCode && class != ClassInternal {
+			return class, true
+		}
+	}
+	return "", false
+}
+
+// StartupExitOffset is added to the exit code of init by the startup script of the image. The task
+// only reports the exit code of the script, and bash or nginx also exit with small codes such as 1 or 2.
+const StartupExitOffset = 100
+
+// ClassOfStartup returns the class of a failure of init from the exit code of the startup script, false
+// for the codes of bash and nginx
+func ClassOfStartup(exitCode int) (Class, bool) {
+	code := exitCode - StartupExitOffset
+	if code == exitCodes[ClassInternal] {
+		return ClassInternal, true
+	}
+	return ClassOf(code)
+}
+
+// The states of the status file
+const (
+	StateReady  = "ready"
+	StateFailed = "failed"
+)
+
+// Status is the content of the status file
+type Status struct {
+	State string `json:"state"`
+	Class Class  `json:"class,omitempty"`
+	Error string `json:"error,omitempty"`
+
+	// Attempts is how many times the content was requested
+	Attempts int `json:"attempts,omitempty"`
+}
+
+// Err returns the failure of a failed status, nil otherwise
+func (s Status) Err() error {
+	if s.State != StateFailed {
+		return nil
+	}
+	if s.Error == "" {
+		return fmt.Errorf("%s: %s", s.Class, s.Class.Description())
+	}
+	return fmt.Errorf("%s: %s", s.Class, s.Error)
+}
+
+// Write writes the status to the file
+func Write(path string, status Status) error {
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode status: %w", err)
+	}
+
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write status: %w", err)
+	}
+
+	return nil
+}
+
+// Read reads the status file, it returns an error wrapping os.ErrNotExist when init did not write it
+func Read(path string) (Status, error) {
+	var status Status
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return status, err
+	}
+
+	if err := json.Unmarshal(data, &status); err != nil {
+		return status, fmt.Errorf("invalid status file: %w", err)
+	}
+	if status.State != StateReady && status.State != StateFailed {
+		return status, errors.New("invalid status file: unknown state " + status.State)
+	}
+
+	return status, nil
+}
@@ -0,0 +1,80 @@
+package initstatus
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestClassOf(t *testing.T) {
+	for class := range exitCodes {
+		if class == ClassInternal {
+			continue
+		}
+
+		got, ok := ClassOf(class.ExitCode())
+		if !ok || got != class {
+			t.Errorf("expected %s for exit code %d, got %q", class, class.ExitCode(), got)
+		}
+	}
+
+	for _, code := range []int{0, 1, 137} {
+		if class, ok := ClassOf(code); ok {
+			t.Errorf("expected no class for exit code %d, got %s", code, class)
+		}
+	}
+
+	if Class("unknown").ExitCode() != 1 {
+		t.Error("expected the unknown classes to exit with 1")
+	}
+}
+
+func TestClassOfStartup(t *testing.T) {
+	for class := range exitCodes {
+		got, ok := ClassOfStartup(StartupExitOffset + class.ExitCode())
+		if !ok || got != class {
+			t.Errorf("expected %s for exit code %d, got %q", class, StartupExitOffset+class.ExitCode(), got)
+		}
+	}
+
+	// The codes of bash and nginx are not failures of init
+	for _, code := range []int{0, 1, 2, 6, 127, 137} {
+		if class, ok := ClassOfStartup(code); ok {
+			t.Errorf("expected no class for exit code %d, got %s", code, class)
+		}
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), File)
+
+	if _, err := Read(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected a missing file, got %v", err)
+	}
+
+	status := Status{State: StateFailed, Class: ClassTooLarge, Error: "response exceeds 10 bytes", Attempts: 1}
+	if err := Write(path, status); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got, err := Read(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != status {
+		t.Fatalf("expected %+v, got %+v", status, got)
+	}
+	if err := got.Err(); err == nil || err.Error() != "too_large: response exceeds 10 bytes" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := (Status{State: StateReady}).Err(); err != nil {
+		t.Fatalf("expected no error for a ready status, got %v", err)
+	}
+
+	os.WriteFile(path, []byte(`{"state":"unknown"}`), 0644)
+	if _, err := Read(path); err == nil {
+		t.Fatal("expected an error for an unknown state")
+	}
+}
@@ -0,0 +1,138 @@
+// Package integrity checks that the content downloaded for a service is the one its owner
+// published. The API accepts the SHA-256 of the content and an Ed25519 signature made with the
+// key of the server, the init binary refuses to serve content that does not match them.
+package integrity
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+var (
+	ErrDigestMismatch   = errors.New("sha256 mismatch")
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrMissingKey       = errors.New("no public key to verify the signature")
+)
+
+// ParseDigest normalizes a hex encoded SHA-256 to lowercase
+func ParseDigest(value string) (string, error) {
+	digest, err := hex.DecodeString(value)
+	if err != nil || len(digest) != sha256.Size {
+		return "", errors.New("sha256 must be 64 hexadecimal characters")
+	}
+
+	return strings.ToLower(value), nil
+}
+
+// ParseSignature decodes a base64 encoded Ed25519 signature
+func ParseSignature(value string) ([]byte, error) {
+	signature, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("signature must be a base64 encoded Ed25519 signature of %d bytes", ed25519.SignatureSize)
+	}
+
+	return signature, nil
+}
+
+// LoadPublicKey reads the Ed25519 public key of the server from a PEM file
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key: %w", err)
+	}
+
+	return ParsePublicKey(string(data))
+}
+
+// ParsePublicKey reads an Ed25519 public key in PKIX form, either PEM or base64 encoded
+func ParsePublicKey(value string) (ed25519.PublicKey, error) {
+	var der []byte
+	if block, _ := pem.Decode([]byte(value)); block != nil {
+		der = block.Bytes
+	} else {
+		var err error
+		der, err = base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			return nil, errors.New("public key must be PEM or base64 encoded")
+		}
+	}
+
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key must be Ed25519, got %T", key)
+	}
+
+	return publicKey, nil
+}
+
+// EncodePublicKey returns the base64 PKIX form of the key, which fits on a command line or in an environment variable
+func EncodePublicKey(key ed25519.PublicKey) string {
+	der, _ := x509.MarshalPKIXPublicKey(key)
+	return base64.StdEncoding.EncodeToString(der)
+}
+
+// Expectation is what the downloaded content must match, the zero value accepts any content
+type Expectation struct {
+	// SHA256 is the hex encoded digest of the content
+	SHA256 string
+
+	// Signature is an Ed25519 signature of the content, it is verified with PublicKey
+	Signature []byte
+	PublicKey ed25519.PublicKey
+}
+
+// Verify checks the file against the digest and the signature
+func (e Expectation) Verify(path string) error {
+	if e.SHA256 == "" && e.Signature == nil {
+		return nil
+	}
+	if e.Signature != nil && e.PublicKey == nil {
+		return ErrMissingKey
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	if e.SHA256 != "" {
+		hash := sha256.New()
+		if _, err := io.Copy(hash, file); err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		if got := hex.EncodeToString(hash.Sum(nil)); got != e.SHA256 {
+			return fmt.Errorf("%w: got %s, want %s", ErrDigestMismatch, got, e.SHA256)
+		}
+	}
+
+	if e.Signature != nil {
+		// Ed25519 signs the whole message, not a digest of it
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		content, err := io.ReadAll(file)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		if !ed25519.Verify(e.PublicKey, content, e.Signature) {
+			return ErrInvalidSignature
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+package integrity
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseDigest(t *testing.T) {
+	digest := sha256.Sum256([]byte("hello"))
+	valid := hex.EncodeToString(digest[:])
+
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{value: valid, want: valid},
+		{value: strings.ToUpper(valid), want: valid},
+		{value: valid[:62], wantErr: true},
+		{value: "sha256:" + valid, wantErr: true},
+		{value: strings.Repeat("z", 64), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParseDigest(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParsePublicKey(t *testing.T) {
+	publicKey, _, _ := ed25519.GenerateKey(nil)
+	der, _ := x509.MarshalPKIXPublicKey(publicKey)
+	pemKey := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+
+	for name, value := range map[string]string{"pem": pemKey, "base64": EncodePublicKey(publicKey)} {
+		t.Run(name, func(t *testing.T) {
+			key, err := ParsePublicKey(value)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !key.Equal(publicKey) {
+				t.Fatal("expected the same key")
+			}
+		})
+	}
+
+	if _, err := ParsePublicKey("not a key"); err == nil {
+		t.Fatal("expected an error for an invalid key")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	publicKey, privateKey, _ := ed25519.GenerateKey(nil)
+	otherKey, _, _ := ed25519.GenerateKey(nil)
+
+	content := []byte("echo hello")
+	digest := sha256.Sum256(content)
+	signature := ed25519.Sign(privateKey, content)
+
+	path := filepath.Join(t.TempDir(), "output")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatalf("failed to write content: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		expectation Expectation
+		wantErr     error
+	}{
+		{name: "nothing expected"},
+		{name: "digest", expectation: Expectation{SHA256: hex.EncodeToString(digest[:])}},
+		{name: "signature", expectation: Expectation{Signature: signature, PublicKey: publicKey}},
+		{name: "digest and signature", expectation: Expectation{SHA256: hex.EncodeToString(digest[:]), Signature: signature, PublicKey: publicKey}},
+		{name: "other digest", expectation: Expectation{SHA256: strings.Repeat("0", 64)}, wantErr: ErrDigestMismatch},
+		{name: "other key", expectation: Expectation{Signature: signature, PublicKey: otherKey}, wantErr: ErrInvalidSignature},
+		{name: "no key", expectation: Expectation{Signature: signature}, wantErr: ErrMissingKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.expectation.Verify(path)
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+// Package netguard keeps the source URLs of the services away from the private networks of the
+// platform. The API checks the addresses a host resolves to before accepting it, and the init
+// binary checks the address of every connection it opens, so a host that resolves to a public
+// address at validation and to a private one at download time is still refused.
+package netguard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// DefaultMaxRedirects is how many redirects the clients of NewHTTPClient follow
+const DefaultMaxRedirects = 10
+
+var (
+	ErrInvalidURL           = errors.New("invalid url")
+	ErrForbiddenDestination = errors.New("forbidden destination")
+	ErrTooManyRedirects     = errors.New("too many redirects")
+)
+
+// Resolver looks up the addresses of a host, net.DefaultResolver implements it
+type Resolver interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+// Validator checks the source URLs before a service is created
+type Validator struct {
+	// Resolver defaults to net.DefaultResolver
+	Resolver Resolver
+
+	// Policy restricts the URLs beyond the built-in rules, nil only applies the built-in rules
+	Policy *Policy
+}
+
+// blockedPrefixes are the reserved ranges that are not covered by the netip.Addr predicates
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // Current network
+	netip.MustParsePrefix("100.64.0.0/10"),   // Carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // Documentation
+	netip.MustParsePrefix("198.18.0.0/15"),   // Benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // Documentation
+	netip.MustParsePrefix("203.0.113.0/24"),  // Documentation
+	netip.MustParsePrefix("240.0.0.0/4"),     // Reserved and broadcast
+	netip.MustParsePrefix("::/96"),           // IPv4-compatible
+	netip.MustParsePrefix("64:ff9b::/96"),    // NAT64, it embeds any IPv4 address
+	netip.MustParsePrefix("100::/64"),        // Discard
+	netip.MustParsePrefix("2001:db8::/32"),   // Documentation
+}
+
+// forbiddenSuffixes are the domains that only resolve inside private networks
+var forbiddenSuffixes = []string{".local", ".localhost", ".internal"}
+
+// IsPublic reports whether the address can be reached by the services downloads
+func IsPublic(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsValid() ||
+		addr.IsLoopback() ||
+		addr.IsPrivate() ||
+		addr.IsLinkLocalUnicast() ||
+		addr.IsMulticast() ||
+		addr.IsUnspecified() {
+		return false
+	}
+
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ParseURL parses an http or https URL and rejects the hosts that are private without resolving them:
+// private addresses and local host names
+func ParseURL(rawURL string) (*url.URL, error) {
+	return (*Policy)(nil).ParseURL(rawURL)
+}
+
+// CheckURL parses the URL and checks that every address its host resolves to is public and allowed
+// by the policy. A refused URL returns a *PolicyError.
+func (v *Validator) CheckURL(ctx context.Context, rawURL string) error {
+	u, err := v.Policy.ParseURL(rawURL)
+	if err != nil {
+		return err
+	}
+
+	hostname := u.Hostname()
+	if _, err := netip.ParseAddr(hostname); err == nil {
+		return nil
+	}
+
+	resolver := v.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	addrs, err := resolver.LookupNetIP(ctx, "ip", hostname)
+	if err != nil {
+		return fmt.Errorf("%w: unable to resolve %s: %v", ErrInvalidURL, hostname, err)
+	}
+	if len(addrs) == 0 {
+		return fmt.Errorf("%w: %s has no address", ErrInvalidURL, hostname)
+	}
+
+	for _, addr := range addrs {
+		if err := v.Policy.CheckAddr(addr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Control refuses the connections to addresses that are not public or not allowed by the policy,
+// it is meant for net.Dialer.Control. It runs once the host is resolved, right before connecting,
+// so DNS rebinding cannot get around it.
+func (p *Policy) Control(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: unable to parse address %s: %v", ErrForbiddenDestination, address, err)
+	}
+
+	return p.CheckAddr(addrPort.Addr())
+}
+
+// NewDialer returns a dialer that only connects to addresses allowed by the policy
+func NewDialer(policy *Policy) *net.Dialer {
+	return &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   policy.Control,
+	}
+}
+
+// NewHTTPClient returns a client that only connects to addresses allowed by the policy, on every
+// redirect too, and follows at most DefaultMaxRedirects redirects. It ignores the proxy environment
+// variables, a proxy would connect on its behalf.
+func NewHTTPClient(timeout time.Duration, policy *Policy) *http.Client {
+	transport := &http.Transport{
+		DialContext:           NewDialer(policy).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+
+	return &http.Client{
+		Timeout:       timeout,
+		Transport:     transport,
+		CheckRedirect: RedirectPolicy(policy, DefaultMaxRedirects),
+	}
+}
+
+// RedirectPolicy returns an http.Client CheckRedirect that stops after maxRedirects and refuses the
+// redirects to URLs the policy refuses, the addresses of the next hop are checked when connecting
+func RedirectPolicy(policy *Policy, maxRedirects int) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		return checkRedirect(policy, maxRedirects, req, via)
+	}
+}
+
+// LimitRedirects returns an http.Client CheckRedirect that only stops after maxRedirects, it is meant
+// for the clients allowed to reach private addresses
+func LimitRedirects(maxRedirects int) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		return limitRedirects(maxRedirects, via)
+	}
+}
+
+func limitRedirects(maxRedirects int, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("%w: stopped after %d redirects", ErrTooManyRedirects, maxRedirects)
+	}
+	return nil
+}
+
+func checkRedirect(policy *Policy, maxRedirects int, req *http.Request, via []*http.Request) error {
+	if err := limitRedirects(maxRedirects, via); err != nil {
+		return err
+	}
+
+	if _, err := policy.ParseURL(req.URL.String()); err != nil {
+		return fmt.Errorf("refused redirect to %s: %w", req.URL.Redacted(), err)
+	}
+
+	return nil
+}
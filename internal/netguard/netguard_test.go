@@ -0,0 +1,153 @@
+package netguard
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+	"time"
+)
+
+type staticResolver map[string][]netip.Addr
+
+func (r staticResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	addrs, ok := r[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return addrs, nil
+}
+
+func TestIsPublic(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{addr: "8.8.8.8", want: true},
+		{addr: "2606:4700:4700::1111", want: true},
+		{addr: "127.0.0.1"},
+		{addr: "10.1.2.3"},
+		{addr: "172.16.0.1"},
+		{addr: "192.168.1.1"},
+		{addr: "169.254.169.254"},
+		{addr: "100.64.0.1"},
+		{addr: "0.0.0.0"},
+		{addr: "224.0.0.1"},
+		{addr: "255.255.255.255"},
+		{addr: "::1"},
+		{addr: "::"},
+		{addr: "::ffff:169.254.169.254"},
+		{addr: "64:ff9b::a9fe:a9fe"},
+		{addr: "fd00::1"},
+		{addr: "fe80::1"},
+		{addr: "ff02::1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			if got := IsPublic(netip.MustParseAddr(tt.addr)); got != tt.want {
+				t.Errorf("IsPublic(%s) = %v, want %v", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckURL(t *testing.T) {
+	v := &Validator{Resolver: staticResolver{
+		"example.com":          {netip.MustParseAddr("93.184.215.14")},
+		"10.0.0.1.nip.io":      {netip.MustParseAddr("10.0.0.1")},
+		"metadata.example.com": {netip.MustParseAddr("169.254.169.254")},
+		"mixed.example.com":    {netip.MustParseAddr("93.184.215.14"), netip.MustParseAddr("::1")},
+	}}
+
+	tests := []struct {
+		name    string
+		url     string
+		wantErr error
+	}{
+		{name: "public host", url: "https://example.com/script.sh"},
+		{name: "public address", url: "http://8.8.8.8"},
+		{name: "host resolving to a private address", url: "http://10.0.0.1.nip.io", wantErr: ErrForbiddenDestination},
+		{name: "host resolving to the metadata address", url: "http://metadata.example.com/latest", wantErr: ErrForbiddenDestination},
+		{name: "one private address among public ones", url: "http://mixed.example.com", wantErr: ErrForbiddenDestination},
+		{name: "private address", url: "http://[::ffff:127.0.0.1]", wantErr: ErrForbiddenDestination},
+		{name: "local host name", url: "http://db.internal", wantErr: ErrForbiddenDestination},
+		{name: "unknown host", url: "http://unknown.example.com", wantErr: ErrInvalidURL},
+		{name: "scheme", url: "file:///etc/passwd", wantErr: ErrInvalidURL},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := v.CheckURL(context.Background(), tt.url)
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestControl(t *testing.T) {
+	tests := []struct {
+		address string
+		wantErr bool
+	}{
+		{address: "93.184.215.14:443"},
+		{address: "[2606:4700:4700::1111]:80"},
+		{address: "127.0.0.1:80", wantErr: true},
+		{address: "169.254.169.254:80", wantErr: true},
+		{address: "[::ffff:10.0.0.1]:80", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			err := (*Policy)(nil).Control("tcp", tt.address, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestHTTPClientRefusesPrivateAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secret"))
+	}))
+	defer server.Close()
+
+	_, err := NewHTTPClient(time.Second, nil).Get(server.URL)
+	if !errors.Is(err, ErrForbiddenDestination) {
+		t.Fatalf("expected %v, got %v", ErrForbiddenDestination, err)
+	}
+}
+
+func TestCheckRedirect(t *testing.T) {
+	redirect := func(rawURL string) *http.Request {
+		u, _ := url.Parse(rawURL)
+		return &http.Request{URL: u}
+	}
+
+	if err := checkRedirect(nil, DefaultMaxRedirects, redirect("https://example.com/next"), make([]*http.Request, 1)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := checkRedirect(nil, DefaultMaxRedirects, redirect("http://169.254.169.254/latest"), make([]*http.Request, 1)); !errors.Is(err, ErrForbiddenDestination) {
+		t.Fatalf("expected %v, got %v", ErrForbiddenDestination, err)
+	}
+	if err := checkRedirect(nil, DefaultMaxRedirects, redirect("http://localhost/"), make([]*http.Request, 1)); !errors.Is(err, ErrForbiddenDestination) {
+		t.Fatalf("expected %v, got %v", ErrForbiddenDestination, err)
+	}
+	if err := checkRedirect(nil, DefaultMaxRedirects, redirect("https://example.com/next"), make([]*http.Request, DefaultMaxRedirects)); !errors.Is(err, ErrTooManyRedirects) {
+		t.Fatalf("expected %v, got %v", ErrTooManyRedirects, err)
+	}
+	if err := checkRedirect(nil, 2, redirect("https://example.com/next"), make([]*http.Request, 2)); !errors.Is(err, ErrTooManyRedirects) {
+		t.Fatalf("expected %v with a lower limit, got %v", ErrTooManyRedirects, err)
+	}
+	if err := LimitRedirects(0)(redirect("http://localhost/"), nil); !errors.Is(err, ErrTooManyRedirects) {
+		t.Fatalf("expected %v without redirects allowed, got %v", ErrTooManyRedirects, err)
+	}
+}
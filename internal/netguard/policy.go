@@ -0,0 +1,287 @@
+package netguard
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Policy restricts the source URLs beyond the built-in private ranges, which are refused whatever
+// the policy says unless lifted by AllowingPrivate. Denied entries win over allowed ones, an empty allowed list allows everything.
+// Domains are exact names or wildcards such as *.example.com, which match the subdomains only.
+// The nil policy only applies the built-in rules.
+type Policy struct {
+	AllowedSchemes []string `json:"allowed_schemes,omitempty"`
+	AllowedPorts   []int    `json:"allowed_ports,omitempty"`
+	AllowedDomains []string `json:"allowed_domains,omitempty"`
+	DeniedDomains  []string `json:"denied_domains,omitempty"`
+	AllowedCIDRs   []string `json:"allowed_cidrs,omitempty"`
+	DeniedCIDRs    []string `json:"denied_cidrs,omitempty"`
+
+	allowedPrefixes []netip.Prefix
+	deniedPrefixes  []netip.Prefix
+
+	// allowPrivate lifts the built-in rules, it is never part of the JSON handed to init
+	allowPrivate bool
+}
+
+// The rules reported by PolicyError
+const (
+	RuleAllowedSchemes = "allowed_schemes"
+	RuleAllowedPorts   = "allowed_ports"
+	RuleAllowedDomains = "allowed_domains"
+	RuleDeniedDomains  = "denied_domains"
+	RuleAllowedCIDRs   = "allowed_cidrs"
+	RuleDeniedCIDRs    = "denied_cidrs"
+
+	// RulePrivateAddress and RuleLocalHost are the built-in rules
+	RulePrivateAddress = "private_address"
+	RuleLocalHost      = "local_host"
+)
+
+// PolicyError tells which rule refused a URL, it wraps ErrForbiddenDestination
+type PolicyError struct {
+	Rule string
+
+	// Pattern is the entry of the rule that matched, empty when an allowed list has no match
+	Pattern string
+
+	// Value is the part of the URL that was checked: a scheme, a port, a host or an address
+	Value string
+}
+
+func (e *PolicyError) Error() string {
+	if e.Pattern == "" {
+		return fmt.Sprintf("%s: %s is not in %s", ErrForbiddenDestination, e.Value, e.Rule)
+	}
+	return fmt.Sprintf("%s: %s matches %s %s", ErrForbiddenDestination, e.Value, e.Rule, e.Pattern)
+}
+
+func (e *PolicyError) Unwrap() error {
+	return ErrForbiddenDestination
+}
+
+// LoadPolicy reads a policy from a JSON file
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy file %s: %w", path, err)
+	}
+
+	policy, err := ParsePolicy(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %w", path, err)
+	}
+
+	return policy, nil
+}
+
+// ParsePolicy decodes and validates a JSON policy
+func ParsePolicy(data []byte) (*Policy, error) {
+	var policy Policy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("failed to decode policy: %w", err)
+	}
+
+	for i, scheme := range policy.AllowedSchemes {
+		policy.AllowedSchemes[i] = strings.ToLower(scheme)
+		if policy.AllowedSchemes[i] != "http" && policy.AllowedSchemes[i] != "https" {
+			return nil, fmt.Errorf("%s: scheme %s is not supported", RuleAllowedSchemes, scheme)
+		}
+	}
+
+	for _, port := range policy.AllowedPorts {
+		if port < 1 || port > 65535 {
+			return nil, fmt.Errorf("%s: port %d is out of range", RuleAllowedPorts, port)
+		}
+	}
+
+	for _, domains := range [][]string{policy.AllowedDomains, policy.DeniedDomains} {
+		for i, domain := range domains {
+			domains[i] = strings.TrimSuffix(strings.ToLower(domain), ".")
+			if name, _ := strings.CutPrefix(domains[i], "*."); name == "" || strings.Contains(name, "*") {
+				return nil, fmt.Errorf("domain %q must be a name or a wildcard such as *.example.com", domain)
+			}
+		}
+	}
+
+	var err error
+	if policy.allowedPrefixes, err = parsePrefixes(policy.AllowedCIDRs); err != nil {
+		return nil, fmt.Errorf("%s: %w", RuleAllowedCIDRs, err)
+	}
+	if policy.deniedPrefixes, err = parsePrefixes(policy.DeniedCIDRs); err != nil {
+		return nil, fmt.Errorf("%s: %w", RuleDeniedCIDRs, err)
+	}
+
+	return &policy, nil
+}
+
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// AllowingPrivate returns a copy of the policy that also allows the private and reserved ranges and the
+// local host names, for local development only. The allowed and denied entries still apply.
+func (p *Policy) AllowingPrivate() *Policy {
+	allowing := &Policy{}
+	if p != nil {
+		*allowing = *p
+	}
+	allowing.allowPrivate = true
+	return allowing
+}
+
+// String returns the policy as JSON, the form the init binary reads
+func (p *Policy) String() string {
+	if p == nil {
+		return ""
+	}
+
+	data, _ := json.Marshal(p)
+	return string(data)
+}
+
+// ParseURL parses an http or https URL and checks its scheme, port and host without resolving it
+func (p *Policy) ParseURL(rawURL string) (*url.URL, error) {
+	u, err := url.ParseRequestURI(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidURL, err)
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	if scheme != "http" && scheme != "https" {
+		return nil, fmt.Errorf("%w: scheme %s is not allowed", ErrInvalidURL, u.Scheme)
+	}
+
+	hostname := u.Hostname()
+	if hostname == "" {
+		return nil, fmt.Errorf("%w: missing host", ErrInvalidURL)
+	}
+
+	if p != nil {
+		if len(p.AllowedSchemes) > 0 && !slices.Contains(p.AllowedSchemes, scheme) {
+			return nil, &PolicyError{Rule: RuleAllowedSchemes, Value: scheme}
+		}
+
+		if len(p.AllowedPorts) > 0 {
+			port, err := urlPort(u)
+			if err != nil {
+				return nil, err
+			}
+			if !slices.Contains(p.AllowedPorts, port) {
+				return nil, &PolicyError{Rule: RuleAllowedPorts, Value: strconv.Itoa(port)}
+			}
+		}
+	}
+
+	if addr, err := netip.ParseAddr(hostname); err == nil {
+		return u, p.CheckAddr(addr)
+	}
+
+	return u, p.checkHostname(hostname)
+}
+
+func urlPort(u *url.URL) (int, error) {
+	if u.Port() == "" {
+		if strings.EqualFold(u.Scheme, "https") {
+			return 443, nil
+		}
+		return 80, nil
+	}
+
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid port %s", ErrInvalidURL, u.Port())
+	}
+	return port, nil
+}
+
+func (p *Policy) checkHostname(hostname string) error {
+	name := strings.TrimSuffix(strings.ToLower(hostname), ".")
+	if err := p.checkLocalHostname(name, hostname); err != nil {
+		return err
+	}
+
+	if p == nil {
+		return nil
+	}
+
+	if pattern, ok := matchDomain(p.DeniedDomains, name); ok {
+		return &PolicyError{Rule: RuleDeniedDomains, Pattern: pattern, Value: hostname}
+	}
+	if _, ok := matchDomain(p.AllowedDomains, name); len(p.AllowedDomains) > 0 && !ok {
+		return &PolicyError{Rule: RuleAllowedDomains, Value: hostname}
+	}
+
+	return nil
+}
+
+// checkLocalHostname refuses the names that only resolve inside private networks, unless they are allowed
+func (p *Policy) checkLocalHostname(name, hostname string) error {
+	if p != nil && p.allowPrivate {
+		return nil
+	}
+
+	if name == "localhost" || name == "local" || name == "broadcasthost" {
+		return &PolicyError{Rule: RuleLocalHost, Pattern: name, Value: hostname}
+	}
+	for _, suffix := range forbiddenSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return &PolicyError{Rule: RuleLocalHost, Pattern: "*" + suffix, Value: hostname}
+		}
+	}
+	return nil
+}
+
+// matchDomain returns the first pattern matching the name
+func matchDomain(patterns []string, name string) (string, bool) {
+	for _, pattern := range patterns {
+		if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+			if strings.HasSuffix(name, suffix) {
+				return pattern, true
+			}
+		} else if name == pattern {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+// CheckAddr checks an address the host of a URL resolves to
+func (p *Policy) CheckAddr(addr netip.Addr) error {
+	addr = addr.Unmap().WithZone("")
+	if !IsPublic(addr) && (p == nil || !p.allowPrivate) {
+		return &PolicyError{Rule: RulePrivateAddress, Value: addr.String()}
+	}
+
+	if p == nil {
+		return nil
+	}
+
+	for _, prefix := range p.deniedPrefixes {
+		if prefix.Contains(addr) {
+			return &PolicyError{Rule: RuleDeniedCIDRs, Pattern: prefix.String(), Value: addr.String()}
+		}
+	}
+
+	if len(p.allowedPrefixes) > 0 && !slices.ContainsFunc(p.allowedPrefixes, func(prefix netip.Prefix) bool {
+		return prefix.Contains(addr)
+	}) {
+		return &PolicyError{Rule: RuleAllowedCIDRs, Value: addr.String()}
+	}
+
+	return nil
+}
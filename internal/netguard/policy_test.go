@@ -0,0 +1,160 @@
+package netguard
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParsePolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		wantErr bool
+	}{
+		{name: "valid", policy: `{"allowed_schemes":["HTTPS"],"allowed_ports":[443],"allowed_domains":["*.example.com"],"denied_cidrs":["93.184.0.0/16"]}`},
+		{name: "unsupported scheme", policy: `{"allowed_schemes":["ftp"]}`, wantErr: true},
+		{name: "port out of range", policy: `{"allowed_ports":[70000]}`, wantErr: true},
+		{name: "wildcard in the middle", policy: `{"denied_domains":["api.*.example.com"]}`, wantErr: true},
+		{name: "invalid cidr", policy: `{"allowed_cidrs":["10.0.0.0/33"]}`, wantErr: true},
+		{name: "invalid json", policy: `{"allowed_schemes":`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParsePolicy([]byte(tt.policy))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestPolicyCheckURL(t *testing.T) {
+	policy, err := ParsePolicy([]byte(`{
+		"allowed_schemes": ["https"],
+		"allowed_ports": [443, 8443],
+		"allowed_domains": ["*.example.com", "example.org"],
+		"denied_domains": ["evil.example.com"],
+		"allowed_cidrs": ["93.184.0.0/16", "2606:2800::/32"],
+		"denied_cidrs": ["93.184.216.0/24"]
+	}`))
+	if err != nil {
+		t.Fatalf("failed to parse policy: %v", err)
+	}
+
+	v := &Validator{Policy: policy, Resolver: staticResolver{
+		"cdn.example.com":    {netip.MustParseAddr("93.184.215.14")},
+		"old.example.com":    {netip.MustParseAddr("93.184.216.34")},
+		"other.example.com":  {netip.MustParseAddr("8.8.8.8")},
+		"intra.example.com":  {netip.MustParseAddr("10.0.0.1")},
+		"example.org":        {netip.MustParseAddr("2606:2800:220:1::1")},
+		"evil.example.com":   {netip.MustParseAddr("93.184.215.14")},
+		"example.com":        {netip.MustParseAddr("93.184.215.14")},
+		"unknown.example.io": {netip.MustParseAddr("93.184.215.14")},
+	}}
+
+	tests := []struct {
+		name        string
+		url         string
+		wantRule    string
+		wantPattern string
+	}{
+		{name: "allowed", url: "https://cdn.example.com/script.sh"},
+		{name: "allowed exact domain", url: "https://example.org:8443/"},
+		{name: "scheme", url: "http://cdn.example.com", wantRule: RuleAllowedSchemes},
+		{name: "port", url: "https://cdn.example.com:8080", wantRule: RuleAllowedPorts},
+		{name: "denied domain", url: "https://evil.example.com", wantRule: RuleDeniedDomains, wantPattern: "evil.example.com"},
+		{name: "wildcard does not match the apex", url: "https://example.com", wantRule: RuleAllowedDomains},
+		{name: "domain not allowed", url: "https://unknown.example.io", wantRule: RuleAllowedDomains},
+		{name: "denied cidr", url: "https://old.example.com", wantRule: RuleDeniedCIDRs, wantPattern: "93.184.216.0/24"},
+		{name: "cidr not allowed", url: "https://other.example.com", wantRule: RuleAllowedCIDRs},
+		{name: "built-in private ranges", url: "https://intra.example.com", wantRule: RulePrivateAddress},
+		{name: "built-in local hosts", url: "https://db.internal", wantRule: RuleLocalHost, wantPattern: "*.internal"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := v.CheckURL(context.Background(), tt.url)
+			if tt.wantRule == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			var policyErr *PolicyError
+			if !errors.As(err, &policyErr) || !errors.Is(err, ErrForbiddenDestination) {
+				t.Fatalf("expected a policy error, got %v", err)
+			}
+			if policyErr.Rule != tt.wantRule || policyErr.Pattern != tt.wantPattern {
+				t.Fatalf("expected rule %s %q, got %s %q", tt.wantRule, tt.wantPattern, policyErr.Rule, policyErr.Pattern)
+			}
+		})
+	}
+}
+
+func TestPolicyRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte(`{"denied_cidrs":["93.184.216.0/24"]}`), 0o600); err != nil {
+		t.Fatalf("failed to write policy: %v", err)
+	}
+
+	policy, err := LoadPolicy(path)
+	if err != nil {
+		t.Fatalf("failed to load policy: %v", err)
+	}
+
+	// The init binary receives the policy as JSON
+	decoded, err := ParsePolicy([]byte(policy.String()))
+	if err != nil {
+		t.Fatalf("failed to parse policy: %v", err)
+	}
+
+	var policyErr *PolicyError
+	if err := decoded.Control("tcp", "93.184.216.34:443", nil); !errors.As(err, &policyErr) || policyErr.Rule != RuleDeniedCIDRs {
+		t.Fatalf("expected the decoded policy to deny the address, got %v", err)
+	}
+}
+
+func TestPolicyAllowingPrivate(t *testing.T) {
+	policy, err := ParsePolicy([]byte(`{"allowed_ports":[8080],"denied_domains":["db.internal"],"denied_cidrs":["10.1.0.0/16"]}`))
+	if err != nil {
+		t.Fatalf("failed to parse policy: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		policy   *Policy
+		url      string
+		wantRule string
+	}{
+		{name: "private address", policy: policy.AllowingPrivate(), url: "http://10.0.0.1:8080"},
+		{name: "local host", policy: policy.AllowingPrivate(), url: "http://localhost:8080"},
+		{name: "nil policy", policy: (*Policy)(nil).AllowingPrivate(), url: "http://127.0.0.1"},
+		{name: "denied cidr still applies", policy: policy.AllowingPrivate(), url: "http://10.1.0.1:8080", wantRule: RuleDeniedCIDRs},
+		{name: "denied domain still applies", policy: policy.AllowingPrivate(), url: "http://db.internal:8080", wantRule: RuleDeniedDomains},
+		{name: "port still applies", policy: policy.AllowingPrivate(), url: "http://10.0.0.1", wantRule: RuleAllowedPorts},
+		{name: "original policy unchanged", policy: policy, url: "http://10.0.0.1:8080", wantRule: RulePrivateAddress},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.policy.ParseURL(tt.url)
+			if tt.wantRule == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			var policyErr *PolicyError
+			if !errors.As(err, &policyErr) || policyErr.Rule != tt.wantRule {
+				t.Fatalf("expected rule %s, got %v", tt.wantRule, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package netguard
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+)
+
+// NewProxy returns a forward HTTP proxy that applies the policy to every request, for the tools such
+// as git that open their own connections. CONNECT tunnels carry https, other requests are plain http.
+func NewProxy(policy *Policy) http.Handler {
+	dialer := NewDialer(policy)
+	forward := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			// The request of a forward proxy already holds the absolute URL of the destination
+			r.Out.URL = r.In.URL
+			r.Out.Host = r.In.Host
+		},
+		Transport: NewHTTPClient(0, policy).Transport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			proxyError(w, err)
+		},
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			if !r.URL.IsAbs() {
+				http.Error(w, "proxy requests need an absolute url", http.StatusBadRequest)
+				return
+			}
+			if _, err := policy.ParseURL(r.URL.String()); err != nil {
+				proxyError(w, err)
+				return
+			}
+			forward.ServeHTTP(w, r)
+			return
+		}
+
+		if _, err := policy.ParseURL("https://" + r.Host); err != nil {
+			proxyError(w, err)
+			return
+		}
+
+		upstream, err := dialer.DialContext(r.Context(), "tcp", r.Host)
+		if err != nil {
+			proxyError(w, err)
+			return
+		}
+		defer upstream.Close()
+
+		client, buffered, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer client.Close()
+
+		if _, err := io.WriteString(client, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+			return
+		}
+
+		tunnel(client, buffered, upstream)
+	})
+}
+
+// tunnel copies the bytes both ways until one of the sides closes
+func tunnel(client net.Conn, clientReader io.Reader, upstream net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(upstream, clientReader)
+		if conn, ok := upstream.(*net.TCPConn); ok {
+			conn.CloseWrite()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(client, upstream)
+		if conn, ok := client.(*net.TCPConn); ok {
+			conn.CloseWrite()
+		}
+	}()
+	wg.Wait()
+}
+
+// proxyError answers 403 for the destinations the policy refuses and 502 for the other failures
+func proxyError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrForbiddenDestination) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadGateway)
+}
@@ -0,0 +1,83 @@
+package netguard
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestProxyRefusesPrivateDestinations(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "secret")
+	}))
+	defer backend.Close()
+
+	policy, err := ParsePolicy([]byte(`{"denied_domains":["*.example.com"]}`))
+	if err != nil {
+		t.Fatalf("failed to parse policy: %v", err)
+	}
+
+	proxy := httptest.NewServer(NewProxy(policy))
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	tests := []struct {
+		name string
+		url  string
+	}{
+		{name: "private address", url: backend.URL},
+		{name: "local host name", url: "http://localhost/"},
+		{name: "denied domain", url: "http://git.example.com/repo.git"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := client.Get(tt.url)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusForbidden {
+				t.Fatalf("expected status 403, got %d", resp.StatusCode)
+			}
+			if body, _ := io.ReadAll(resp.Body); strings.Contains(string(body), "secret") {
+				t.Fatal("expected the backend not to be reached")
+			}
+		})
+	}
+}
+
+func TestProxyRefusesPrivateTunnels(t *testing.T) {
+	proxy := httptest.NewServer(NewProxy(nil))
+	defer proxy.Close()
+
+	for _, target := range []string{"127.0.0.1:443", "169.254.169.254:443", "db.internal:443"} {
+		t.Run(target, func(t *testing.T) {
+			conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+			if err != nil {
+				t.Fatalf("failed to connect to the proxy: %v", err)
+			}
+			defer conn.Close()
+
+			io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n")
+
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatalf("failed to read the answer of the proxy: %v", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != http.StatusForbidden {
+				t.Fatalf("expected status 403, got %d", resp.StatusCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/alexisvisco/koyebtests/internal/types"
+)
+
+// reapExpired purges the services whose expiry is past. The expiry is checked again under the
+// name lock so that a service extended or updated in the meantime is kept.
+func reapExpired(store types.ServiceStore, locks *keyedMutex, purge func(jobID string) error, logger *slog.Logger) error {
+	services, err := store.ListServices()
+	if err != nil {
+		return fmt.Errorf("failed to list services: %w", err)
+	}
+
+	var errs error
+	for _, service := range services {
+		if !expired(service, time.Now()) {
+			continue
+		}
+
+		unlock := locks.Lock(subdomain(service.Project, service.Name))
+		current, err := store.GetService(service.JobID)
+		if err == nil && expired(current, time.Now()) {
+			logger.Info("service expired, purging it", "job_id", service.JobID, "expires_at", current.ExpiresAt)
+			err = purge(service.JobID)
+		}
+		unlock()
+
+		if err != nil && !errors.Is(err, types.ErrServiceNotFound) {
+			errs = errors.Join(errs, err)
+		}
+	}
+
+	return errs
+}
+
+// runReaper purges the expired services every interval until the context is done
+func runReaper(ctx context.Context, interval time.Duration, reap func() error, logger *slog.Logger) {
+	runEvery(ctx, interval, func() {
+		if err := reap(); err != nil {
+			logger.Error("unable to purge expired services", "error", err)
+		}
+	})
+}
+
+func expired(service *types.Service, now time.Time) bool {
+	return !service.ExpiresAt.IsZero() && !now.Before(service.ExpiresAt)
+}
+
+// extendService pushes back the expiry of the service with this name in the project
+func extendService(store types.ServiceStore, locks *keyedMutex, project, name string, input types.ExtendServiceInput) (*types.Service, error) {
+	unlock := locks.Lock(subdomain(project, name))
+	defer unlock()
+
+	service, err := findService(store, project, name)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	switch {
+	case !input.ExpiresAt.IsZero():
+		if !input.ExpiresAt.After(now) {
+			return nil, &types.ValidationError{Field: "expires_at", Message: "must be in the future"}
+		}
+		service.ExpiresAt = input.ExpiresAt.UTC()
+	case input.TTL > 0:
+		from := now
+		if service.ExpiresAt.After(now) {
+			from = service.ExpiresAt
+		}
+		service.ExpiresAt = from.Add(input.TTL)
+	default:
+		return nil, &types.ValidationError{Field: "ttl", Message: "must be positive"}
+	}
+
+	service.UpdatedAt = now
+	if err := store.SaveService(service); err != nil {
+		return nil, fmt.Errorf("failed to save service: %w", err)
+	}
+
+	return service, nil
+}
@@ -0,0 +1,99 @@
+package service
+
+import (
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/alexisvisco/koyebtests/internal/store"
+	"github.com/alexisvisco/koyebtests/internal/types"
+)
+
+func TestReapExpired(t *testing.T) {
+	serviceStore := store.NewMemoryStore()
+	now := time.Now().UTC()
+	_ = serviceStore.SaveService(&types.Service{Name: "expired", JobID: "expired-job", CreatedAt: now, ExpiresAt: now.Add(-time.Minute)})
+	_ = serviceStore.SaveService(&types.Service{Name: "alive", JobID: "alive-job", CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+	_ = serviceStore.SaveService(&types.Service{Name: "forever", JobID: "forever-job", CreatedAt: now})
+
+	var purged []string
+	purge := func(jobID string) error {
+		purged = append(purged, jobID)
+		return serviceStore.DeleteService(jobID)
+	}
+
+	if err := reapExpired(serviceStore, &keyedMutex{}, purge, slog.Default()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(purged) != 1 || purged[0] != "expired-job" {
+		t.Fatalf("expected only the expired service to be purged, got %v", purged)
+	}
+}
+
+func TestExtendService(t *testing.T) {
+	now := time.Now().UTC()
+
+	tests := []struct {
+		name          string
+		expiresAt     time.Time
+		input         types.ExtendServiceInput
+		expected      time.Time
+		expectedField string
+	}{
+		{
+			name:      "ttl added to the current expiry",
+			expiresAt: now.Add(time.Hour),
+			input:     types.ExtendServiceInput{TTL: time.Hour},
+			expected:  now.Add(2 * time.Hour),
+		},
+		{
+			name:     "ttl added to now without expiry",
+			input:    types.ExtendServiceInput{TTL: time.Hour},
+			expected: now.Add(time.Hour),
+		},
+		{
+			name:      "fixed date",
+			expiresAt: now.Add(time.Hour),
+			input:     types.ExtendServiceInput{ExpiresAt: now.Add(48 * time.Hour)},
+			expected:  now.Add(48 * time.Hour),
+		},
+		{
+			name:          "date in the past",
+			input:         types.ExtendServiceInput{ExpiresAt: now.Add(-time.Hour)},
+			expectedField: "expires_at",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serviceStore := store.NewMemoryStore()
+			_ = serviceStore.SaveService(&types.Service{Name: "svc", Project: "default", JobID: "job-1", CreatedAt: now, ExpiresAt: tt.expiresAt})
+
+			service, err := extendService(serviceStore, &keyedMutex{}, "default", "svc", tt.input)
+
+			if tt.expectedField != "" {
+				var validationErr *types.ValidationError
+				if !errors.As(err, &validationErr) || validationErr.Field != tt.expectedField {
+					t.Fatalf("expected validation error on %s, got %v", tt.expectedField, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// The ttl is added to the time of the call when the service does not expire yet
+			if service.ExpiresAt.Sub(tt.expected).Abs() > time.Second {
+				t.Fatalf("expected expiry %s, got %s", tt.expected, service.ExpiresAt)
+			}
+
+			stored, _ := serviceStore.GetService("job-1")
+			if !stored.ExpiresAt.Equal(service.ExpiresAt) {
+				t.Fatalf("expected the expiry to be stored, got %s", stored.ExpiresAt)
+			}
+		})
+	}
+}
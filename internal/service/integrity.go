@@ -0,0 +1,15 @@
+package service
+
+import (
+	"crypto/ed25519"
+
+	"github.com/alexisvisco/koyebtests/internal/types"
+)
+
+// validateSignature rejects the signed sources when the server has no key to verify them
+func validateSignature(input types.CreateJobInput, key ed25519.PublicKey) error {
+	if input.Signature != "" && key == nil {
+		return &types.ValidationError{Field: "signature", Message: "cannot be verified, the server has no public key configured"}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package service
+
+import (
+	"sync"
+
+	"github.com/alexisvisco/koyebtests/internal/types"
+)
+
+// keyedMutex serializes operations sharing the same key while letting other keys run concurrently
+type keyedMutex struct {
+	mutex sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	refs int
+}
+
+// Lock locks the key and returns the function releasing it
+func (m *keyedMutex) Lock(key string) func() {
+	m.mutex.Lock()
+	if m.locks == nil {
+		m.locks = make(map[string]*keyedLock)
+	}
+	lock, ok := m.locks[key]
+	if !ok {
+		lock = &keyedLock{}
+		m.locks[key] = lock
+	}
+	lock.refs++
+	m.mutex.Unlock()
+
+	lock.Lock()
+
+	return m.unlocker(key, lock)
+}
+
+// TryLock locks the key unless it is already locked, it reports whether it did
+func (m *keyedMutex) TryLock(key string) (func(), bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.locks == nil {
+		m.locks = make(map[string]*keyedLock)
+	}
+	lock, ok := m.locks[key]
+	if !ok {
+		lock = &keyedLock{}
+	}
+	if !lock.TryLock() {
+		return nil, false
+	}
+	lock.refs++
+	m.locks[key] = lock
+
+	return m.unlocker(key, lock), true
+}
+
+func (m *keyedMutex) unlocker(key string, lock *keyedLock) func() {
+	return func() {
+		lock.Unlock()
+
+		m.mutex.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(m.locks, key)
+		}
+		m.mutex.Unlock()
+	}
+}
+
+// lockCreation locks the name of a service for its creation. A synchronous creation waits for the one in
+// flight, an async one must not hold the request so it fails with types.ErrOperationInProgress instead.
+func lockCreation(locks *keyedMutex, input types.CreateJobInput) (func(), error) {
+	key := subdomain(input.Project, input.Name)
+	if !input.Async {
+		return locks.Lock(key), nil
+	}
+
+	unlock, ok := locks.TryLock(key)
+	if !ok {
+		return nil, types.ErrOperationInProgress
+	}
+
+	return unlock, nil
+}
@@ -0,0 +1,131 @@
+package service
+
+import (
+	"sync"
+	"time"
+
+	"github.com/alexisvisco/koyebtests/internal/types"
+	"github.com/google/uuid"
+)
+
+// operationRetention is how long finished operations stay queryable
+const operationRetention = time.Hour
+
+var operationStateRank = map[types.OperationState]int{
+	types.OperationStatePending:     0,
+	types.OperationStateScheduling:  1,
+	types.OperationStateDownloading: 2,
+	types.OperationStateRunning:     3,
+	types.OperationStateFailed:      3,
+}
+
+// operationTracker keeps the operations in memory, at most one is active per job
+type operationTracker struct {
+	mutex       sync.Mutex
+	operations  map[string]*types.Operation
+	activeByJob map[string]string
+}
+
+func newOperationTracker() *operationTracker {
+	return &operationTracker{
+		operations:  make(map[string]*types.Operation),
+		activeByJob: make(map[string]string),
+	}
+}
+
+func (t *operationTracker) start(jobID string, input types.CreateJobInput) *types.Operation {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.prune()
+
+	now := time.Now().UTC()
+	op := &types.Operation{
+		ID:          uuid.New().String(),
+		ServiceName: input.Name,
+		JobID:       jobID,
+		Project:     input.Project,
+		Owner:       input.Owner,
+		State:       types.OperationStatePending,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+
+	t.operations[op.ID] = op
+	t.activeByJob[jobID] = op.ID
+
+	copied := *op
+	return &copied
+}
+
+// progress moves the active operation of the job forward, it never goes back to a previous state
+func (t *operationTracker) progress(jobID string, state types.OperationState) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	id, ok := t.activeByJob[jobID]
+	if !ok {
+		return
+	}
+
+	op := t.operations[id]
+	if op.Done() || operationStateRank[state] <= operationStateRank[op.State] {
+		return
+	}
+
+	op.State = state
+	op.UpdatedAt = time.Now().UTC()
+}
+
+// finish marks the operation as running, or as failed with the reason of the error
+func (t *operationTracker) finish(id string, err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	op, ok := t.operations[id]
+	if !ok {
+		return
+	}
+
+	op.State = types.OperationStateRunning
+	if err != nil {
+		op.State = types.OperationStateFailed
+		op.Reason = err.Error()
+	}
+	op.UpdatedAt = time.Now().UTC()
+
+	if t.activeByJob[op.JobID] == id {
+		delete(t.activeByJob, op.JobID)
+	}
+}
+
+// active reports whether an operation is creating or updating the job
+func (t *operationTracker) active(jobID string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	_, ok := t.activeByJob[jobID]
+	return ok
+}
+
+func (t *operationTracker) get(id string) (*types.Operation, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	op, ok := t.operations[id]
+	if !ok {
+		return nil, types.ErrOperationNotFound
+	}
+
+	copied := *op
+	return &copied, nil
+}
+
+// prune forgets the finished operations older than the retention, the caller must hold the lock
+func (t *operationTracker) prune() {
+	for id, op := range t.operations {
+		if op.Done() && time.Since(op.UpdatedAt) > operationRetention {
+			delete(t.operations, id)
+		}
+	}
+}
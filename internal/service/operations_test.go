@@ -0,0 +1,40 @@
+package service
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/alexisvisco/koyebtests/internal/types"
+)
+
+func TestOperationTracker(t *testing.T) {
+	tracker := newOperationTracker()
+
+	op := tracker.start("job-1", types.CreateJobInput{Name: "svc"})
+	if op.State != types.OperationStatePending {
+		t.Fatalf("expected pending state, got %s", op.State)
+	}
+
+	tracker.progress("job-1", types.OperationStateDownloading)
+	tracker.progress("job-1", types.OperationStateScheduling)
+
+	got, err := tracker.get(op.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.State != types.OperationStateDownloading {
+		t.Fatalf("expected state to stay downloading, got %s", got.State)
+	}
+
+	tracker.finish(op.ID, errors.New("image pull failed"))
+	tracker.progress("job-1", types.OperationStateDownloading)
+
+	got, _ = tracker.get(op.ID)
+	if got.State != types.OperationStateFailed || got.Reason != "image pull failed" {
+		t.Fatalf("expected failed operation with reason, got %+v", got)
+	}
+
+	if _, err := tracker.get("unknown"); !errors.Is(err, types.ErrOperationNotFound) {
+		t.Fatalf("expected ErrOperationNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/alexisvisco/koyebtests/internal/config"
+	"github.com/alexisvisco/koyebtests/internal/types"
+)
+
+// quotaReservations enforces the quotas before jobs are submitted. Creations and updates in
+// flight are not in the store yet, they hold a reservation until they are saved or failed.
+type quotaReservations struct {
+	quota        config.QuotaConfig
+	projectQuota config.QuotaConfig
+
+	mutex    sync.Mutex
+	reserved map[string]reservation
+}
+
+type reservation struct {
+	project   string
+	resources types.Resources
+}
+
+func newQuotaReservations(quota, projectQuota config.QuotaConfig) *quotaReservations {
+	return &quotaReservations{
+		quota:        quota,
+		projectQuota: projectQuota,
+		reserved:     make(map[string]reservation),
+	}
+}
+
+// reserve checks that the job fits in the global quota and in the quota of its project
+// with the given resources and reserves them
+func (q *quotaReservations) reserve(store types.ServiceStore, jobID, project string, resources types.Resources) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	services, err := store.ListServices()
+	if err != nil {
+		return fmt.Errorf("failed to list services: %w", err)
+	}
+
+	byJob := make(map[string]reservation, len(services)+len(q.reserved))
+	for _, service := range services {
+		byJob[service.JobID] = reservation{project: service.Project, resources: service.Spec.TotalResources()}
+	}
+	for id, reserved := range q.reserved {
+		byJob[id] = reserved
+	}
+	byJob[jobID] = reservation{project: project, resources: resources}
+
+	var usage, projectUsage types.Resources
+	projectServices := 0
+	for _, r := range byJob {
+		usage = addResources(usage, r.resources)
+		if r.project == project {
+			projectUsage = addResources(projectUsage, r.resources)
+			projectServices++
+		}
+	}
+
+	if err := q.quota.Check(usage, len(byJob)); err != nil {
+		return err
+	}
+
+	if err := q.projectQuota.Check(projectUsage, projectServices); err != nil {
+		var quotaErr *types.QuotaError
+		if errors.As(err, &quotaErr) {
+			quotaErr.Project = project
+		}
+		return err
+	}
+
+	q.reserved[jobID] = reservation{project: project, resources: resources}
+	return nil
+}
+
+func addResources(a, b types.Resources) types.Resources {
+	return types.Resources{
+		CPU:          a.CPU + b.CPU,
+		MemoryMB:     a.MemoryMB + b.MemoryMB,
+		NetworkMBits: a.NetworkMBits + b.NetworkMBits,
+	}
+}
+
+func (q *quotaReservations) release(jobID string) {
+	q.mutex.Lock()
+	delete(q.reserved, jobID)
+	q.mutex.Unlock()
+}
@@ -0,0 +1,846 @@
+package service
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alexisvisco/koyebtests/internal/config"
+	"github.com/alexisvisco/koyebtests/internal/initstatus"
+	"github.com/alexisvisco/koyebtests/internal/integrity"
+	"github.com/alexisvisco/koyebtests/internal/netguard"
+	"github.com/alexisvisco/koyebtests/internal/types"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultInitBinary = "bin/init"
+	initLogFile       = "init.log"
+)
+
+// LocalJobService runs every service as a child process of the API using the built-in
+// server of cmd/init, it lets the full API run on a laptop without Nomad or Docker.
+type LocalJobService struct {
+	store               types.ServiceStore
+	host                string
+	initBinary          string
+	allowPrivateSources bool
+	sourcePolicy        *netguard.Policy
+	signatureKey        ed25519.PublicKey
+	workDir             string
+	readyTimeout        time.Duration
+	jobConfig           config.JobConfig
+	logger              *slog.Logger
+
+	rwMutex   sync.RWMutex
+	processes map[string]*localProcess
+	sleeping  map[string]bool
+
+	subdomains subdomainTable
+
+	nameLocks  keyedMutex
+	wakeLocks  keyedMutex
+	operations *operationTracker
+	quotas     *quotaReservations
+
+	creations      creationGate
+	shutdownPolicy ShutdownPolicy
+	drainTimeout   time.Duration
+}
+
+type LocalJobServiceParams struct {
+	Host  string
+	Store types.ServiceStore
+
+	// InitBinary is the path of the cmd/init binary, defaults to bin/init
+	InitBinary string
+
+	// AllowPrivateSources lets the processes download from private addresses, such as a file server
+	// on the laptop. The API still rejects these URLs, it is meant for tests.
+	AllowPrivateSources bool
+
+	// SourcePolicy is handed to the init processes, which apply it when downloading
+	SourcePolicy *netguard.Policy
+
+	// SignatureKey verifies the signatures of the sources, the signed services are refused without it
+	SignatureKey ed25519.PublicKey
+
+	// WorkDir is where each service gets its own directory, defaults to a directory in the temp dir
+	WorkDir string
+
+	// ReadyTimeout is the deadline for a process to accept connections, defaults to 2 minutes
+	ReadyTimeout time.Duration
+
+	// JobConfig validates the overrides of the requests like the Nomad orchestrator does, defaults to
+	// config.Default. The processes ignore the resolved resources but the services keep their spec.
+	JobConfig *config.JobConfig
+
+	// Quota caps the resources of all the services, the zero value is unlimited
+	Quota config.QuotaConfig
+
+	// ProjectQuota caps the resources of the services of each project, the zero value is unlimited
+	ProjectQuota config.QuotaConfig
+
+	// ShutdownPolicy decides what Close does with the services, defaults to detaching them.
+	// Processes never outlive the API: with detach and drain they are stopped but the services
+	// stay in the store for the next instance to start them again.
+	ShutdownPolicy ShutdownPolicy
+
+	// DrainTimeout bounds how long Close waits for the in-flight creations with the drain policy,
+	// defaults to 3 minutes
+	DrainTimeout time.Duration
+}
+
+type localProcess struct {
+	cmd    *exec.Cmd
+	port   int
+	dir    string
+	exited chan struct{}
+}
+
+func NewLocalJobService(params LocalJobServiceParams) (*LocalJobService, error) {
+	s := &LocalJobService{
+		store:               params.Store,
+		host:                params.Host,
+		initBinary:          params.InitBinary,
+		allowPrivateSources: params.AllowPrivateSources,
+		sourcePolicy:        params.SourcePolicy,
+		signatureKey:        params.SignatureKey,
+		workDir:             params.WorkDir,
+		readyTimeout:        params.ReadyTimeout,
+		logger:              slog.With("component", "local"),
+		processes:           make(map[string]*localProcess),
+		sleeping:            make(map[string]bool),
+		operations:          newOperationTracker(),
+		quotas:              newQuotaReservations(params.Quota, params.ProjectQuota),
+
+		shutdownPolicy: params.ShutdownPolicy,
+		drainTimeout:   params.DrainTimeout,
+	}
+
+	if s.shutdownPolicy == "" {
+		s.shutdownPolicy = ShutdownPolicyDetach
+	}
+
+	if s.drainTimeout <= 0 {
+		s.drainTimeout = defaultDrainTimeout
+	}
+
+	s.jobConfig = config.Default().Job
+	if params.JobConfig != nil {
+		s.jobConfig = *params.JobConfig
+	}
+
+	if s.initBinary == "" {
+		s.initBinary = defaultInitBinary
+	}
+
+	if s.workDir == "" {
+		s.workDir = filepath.Join(os.TempDir(), "koyebtests")
+	}
+
+	if s.readyTimeout <= 0 {
+		s.readyTimeout = defaultReadyTimeout
+	}
+
+	initBinary, err := filepath.Abs(s.initBinary)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve init binary %s: %w", s.initBinary, err)
+	}
+	s.initBinary = initBinary
+
+	if err := os.MkdirAll(s.workDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create work dir %s: %w", s.workDir, err)
+	}
+
+	return s, nil
+}
+
+// GetJobBackends returns the process of the service, local services always run a single replica
+func (s *LocalJobService) GetJobBackends(jobID string) ([]types.Backend, bool) {
+	s.rwMutex.RLock()
+	defer s.rwMutex.RUnlock()
+
+	process, exists := s.processes[jobID]
+	if !exists {
+		return nil, s.sleeping[jobID]
+	}
+	return []types.Backend{localBackend(jobID, process.port)}, true
+}
+
+// ResolveSubdomain returns the job of the service served on <label>.<project>
+func (s *LocalJobService) ResolveSubdomain(project, label string) (string, bool) {
+	return s.subdomains.resolve(project, label)
+}
+
+// CreateJob starts a process for the service, or replaces the process when the spec of an existing service changed
+func (s *LocalJobService) CreateJob(input types.CreateJobInput) (*types.CreateJobOutput, error) {
+	input.Project = projectOf(input)
+	if err := validateSubdomain(input.Name); err != nil {
+		return nil, err
+	}
+	if err := validateSignature(input, s.signatureKey); err != nil {
+		return nil, err
+	}
+
+	if err := s.creations.enter(); err != nil {
+		return nil, err
+	}
+
+	// The creation is in flight until the name is unlocked, including in async mode
+	unlockName, err := lockCreation(&s.nameLocks, input)
+	if err != nil {
+		s.creations.leave()
+		return nil, err
+	}
+	unlock := func() {
+		unlockName()
+		s.creations.leave()
+	}
+
+	spec, err := s.jobConfig.Resolve(input)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+
+	// A single process runs the service, it is stored and counted against the quotas as one replica
+	if input.Replicas > 1 {
+		unlock()
+		return nil, &types.ValidationError{Field: "replicas", Message: "must be 1 with the local orchestrator, which runs a single process"}
+	}
+	spec.Replicas = 1
+
+	existing, err := findService(s.store, input.Project, input.Name)
+	if err != nil && !errors.Is(err, types.ErrServiceNotFound) {
+		unlock()
+		return nil, err
+	}
+
+	if err := checkSubdomain(&s.subdomains, existing, input.Project, input.Name); err != nil {
+		unlock()
+		return nil, err
+	}
+
+	if err := checkOwner(existing, input.Owner); err != nil {
+		unlock()
+		return nil, err
+	}
+
+	if existing != nil && sameSpec(existing, input, spec) {
+		defer unlock()
+
+		if !input.ExpiresAt.IsZero() && !input.ExpiresAt.Equal(existing.ExpiresAt) {
+			existing.ExpiresAt = input.ExpiresAt
+			existing.UpdatedAt = time.Now().UTC()
+			if err := s.store.SaveService(existing); err != nil {
+				return nil, fmt.Errorf("failed to save service: %w", err)
+			}
+		}
+
+		return &types.CreateJobOutput{URL: s.serviceURL(existing.Project, existing.Name)}, nil
+	}
+
+	now := time.Now().UTC()
+	service := &types.Service{
+		Name:      input.Name,
+		JobID:     fmt.Sprintf(slugify(input.Name)+"%s", uuid.New().String()),
+		Project:   input.Project,
+		Owner:     input.Owner,
+		CreatedAt: now,
+	}
+	if existing != nil {
+		// The update is made on a copy, existing keeps the spec started again when the update fails
+		updated := *existing
+		service = &updated
+	}
+	service.SourceURL = input.TargetURL
+	service.Mode = input.Mode()
+	service.ContentType = input.ContentType
+	service.SPA = input.SPA
+	service.Git = input.Git
+	service.SHA256 = input.SHA256
+	service.Signature = input.Signature
+	service.Spec = spec
+	service.UpdatedAt = now
+	if !input.ExpiresAt.IsZero() {
+		service.ExpiresAt = input.ExpiresAt
+	}
+
+	if err := s.quotas.reserve(s.store, service.JobID, service.Project, spec.TotalResources()); err != nil {
+		unlock()
+		return nil, err
+	}
+
+	op := s.operations.start(service.JobID, input)
+
+	// An update replaces the running process, the service is down until the new one is ready
+	run := func() error {
+		defer unlock()
+		defer s.quotas.release(service.JobID)
+
+		err := s.startService(service)
+		if err == nil {
+			err = s.store.SaveService(service)
+		}
+		if err == nil {
+			s.subdomains.set(service)
+		}
+		if err != nil && existing == nil {
+			s.stopProcess(service.JobID)
+		}
+		if err != nil && existing != nil {
+			s.rollbackService(existing)
+		}
+
+		s.operations.finish(op.ID, err)
+		return err
+	}
+
+	output := &types.CreateJobOutput{
+		URL:         s.serviceURL(service.Project, service.Name),
+		OperationID: op.ID,
+	}
+
+	if input.Async {
+		go func() {
+			if err := run(); err != nil {
+				s.logger.Error("async operation failed", "operation_id", op.ID, "job_id", service.JobID, "error", err)
+			}
+		}()
+		return output, nil
+	}
+
+	if err := run(); err != nil {
+		return nil, err
+	}
+
+	return output, nil
+}
+
+// rollbackService starts the previous spec of a service whose update failed, so that the process runs
+// the spec that is still in the store. A sleeping service is left sleeping.
+func (s *LocalJobService) rollbackService(previous *types.Service) {
+	if previous.Sleeping {
+		s.stopProcess(previous.JobID)
+		s.rwMutex.Lock()
+		s.sleeping[previous.JobID] = true
+		s.rwMutex.Unlock()
+		return
+	}
+
+	if err := s.startService(previous); err != nil {
+		s.logger.Error("failed to roll back service update", "job_id", previous.JobID, "error", err)
+		return
+	}
+	if err := s.store.SaveService(previous); err != nil {
+		s.logger.Error("failed to save service", "job_id", previous.JobID, "error", err)
+	}
+
+	s.logger.Warn("service update failed, previous version started again", "job_id", previous.JobID)
+}
+
+func (s *LocalJobService) GetOperation(id string) (*types.Operation, error) {
+	return s.operations.get(id)
+}
+
+func (s *LocalJobService) GetService(project, name string) (*types.ServiceOutput, error) {
+	service, err := findService(s.store, project, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.serviceOutput(service), nil
+}
+
+func (s *LocalJobService) ListServices() ([]*types.ServiceOutput, error) {
+	services, err := s.store.ListServices()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list services: %w", err)
+	}
+
+	outputs := make([]*types.ServiceOutput, 0, len(services))
+	for _, service := range services {
+		outputs = append(outputs, s.serviceOutput(service))
+	}
+
+	return outputs, nil
+}
+
+// ExtendService pushes back the expiry of the service
+func (s *LocalJobService) ExtendService(project, name string, input types.ExtendServiceInput) (*types.ServiceOutput, error) {
+	service, err := extendService(s.store, &s.nameLocks, project, name, input)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.serviceOutput(service), nil
+}
+
+// ReapExpired purges the services whose expiry is past
+func (s *LocalJobService) ReapExpired() error {
+	return reapExpired(s.store, &s.nameLocks, s.PurgeJob, s.logger)
+}
+
+// RunReaper purges the expired services every interval until the context is done
+func (s *LocalJobService) RunReaper(ctx context.Context, interval time.Duration) {
+	runReaper(ctx, interval, s.ReapExpired, s.logger)
+}
+
+func (s *LocalJobService) RestartJob(jobID string) error {
+	service, err := s.store.GetService(jobID)
+	if err != nil {
+		return err
+	}
+
+	unlock := s.nameLocks.Lock(subdomain(service.Project, service.Name))
+	defer unlock()
+
+	if err := s.startService(service); err != nil {
+		return err
+	}
+
+	return s.store.SaveService(service)
+}
+
+// ScaleDown stops the process of an idle service until WakeJob starts it again
+func (s *LocalJobService) ScaleDown(jobID string) error {
+	service, err := s.store.GetService(jobID)
+	if err != nil {
+		return err
+	}
+
+	unlock := s.nameLocks.Lock(subdomain(service.Project, service.Name))
+	defer unlock()
+
+	unlockWake := s.wakeLocks.Lock(jobID)
+	defer unlockWake()
+
+	s.stopProcess(jobID)
+
+	s.rwMutex.Lock()
+	s.sleeping[jobID] = true
+	s.rwMutex.Unlock()
+
+	service.Sleeping = true
+	service.Backends = nil
+	service.UpdatedAt = time.Now().UTC()
+	if err := s.store.SaveService(service); err != nil {
+		return fmt.Errorf("failed to save service: %w", err)
+	}
+
+	s.logger.Info("process stopped while idle", "job_id", jobID)
+
+	return nil
+}
+
+// WakeJob starts the process of a sleeping service again
+func (s *LocalJobService) WakeJob(ctx context.Context, jobID string) ([]types.Backend, error) {
+	unlock := s.wakeLocks.Lock(jobID)
+	defer unlock()
+
+	if s.processRunning(jobID) {
+		backends, _ := s.GetJobBackends(jobID)
+		return backends, nil
+	}
+
+	service, err := s.store.GetService(jobID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !service.Sleeping {
+		return nil, types.ErrServiceNotSleeping
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := s.startService(service); err != nil {
+		return nil, err
+	}
+
+	if err := s.store.SaveService(service); err != nil {
+		return nil, fmt.Errorf("failed to save service: %w", err)
+	}
+
+	return service.Backends, nil
+}
+
+func (s *LocalJobService) PurgeJob(jobID string) error {
+	s.stopProcess(jobID)
+	s.subdomains.remove(jobID)
+	s.quotas.release(jobID)
+
+	s.rwMutex.Lock()
+	delete(s.sleeping, jobID)
+	s.rwMutex.Unlock()
+
+	if err := os.RemoveAll(filepath.Join(s.workDir, jobID)); err != nil {
+		return fmt.Errorf("failed to remove directory of job %s: %w", jobID, err)
+	}
+
+	if err := s.store.DeleteService(jobID); err != nil && !errors.Is(err, types.ErrServiceNotFound) {
+		return fmt.Errorf("failed to delete service %s from store: %w", jobID, err)
+	}
+
+	s.logger.Info("jobs purged", "job_id", jobID)
+
+	return nil
+}
+
+// Close rejects the new creations and applies the shutdown policy to the services
+func (s *LocalJobService) Close() error {
+	err := shutdown(s.shutdownPolicy, &s.creations, s.drainTimeout, s.jobIDs, s.PurgeJob)
+
+	if s.shutdownPolicy != ShutdownPolicyPurge {
+		// Listed after draining so that the processes of the drained creations are stopped too
+		for _, jobID := range s.jobIDs() {
+			s.stopProcess(jobID)
+		}
+		s.logger.Info("processes stopped, services kept in the store", "shutdown_policy", s.shutdownPolicy)
+	}
+
+	return err
+}
+
+// jobIDs returns the jobs with a process or sleeping
+func (s *LocalJobService) jobIDs() []string {
+	s.rwMutex.RLock()
+	defer s.rwMutex.RUnlock()
+
+	jobIDs := make([]string, 0, len(s.processes)+len(s.sleeping))
+	for j := range s.processes {
+		jobIDs = append(jobIDs, j)
+	}
+	for j := range s.sleeping {
+		jobIDs = append(jobIDs, j)
+	}
+
+	return jobIDs
+}
+
+// Reconcile starts the processes of the stored services that are not running,
+// which happens after a restart of the API or when a process crashed. Sleeping
+// services are left stopped until a request wakes them up.
+func (s *LocalJobService) Reconcile() error {
+	services, err := s.store.ListServices()
+	if err != nil {
+		return fmt.Errorf("failed to list services from store: %w", err)
+	}
+
+	for _, service := range services {
+		s.subdomains.set(service)
+
+		if service.Sleeping {
+			s.rwMutex.Lock()
+			s.sleeping[service.JobID] = true
+			s.rwMutex.Unlock()
+			continue
+		}
+
+		if s.processRunning(service.JobID) {
+			continue
+		}
+
+		unlock := s.nameLocks.Lock(subdomain(service.Project, service.Name))
+		err := s.startService(service)
+		if err == nil {
+			err = s.store.SaveService(service)
+		}
+		unlock()
+
+		if err != nil {
+			s.logger.Error("unable to start service", "job_id", service.JobID, "error", err)
+		}
+	}
+
+	return s.sweepOrphans(services)
+}
+
+// sweepOrphans stops the processes and removes the directories of the jobs missing from the store,
+// the local counterpart of the Nomad jobs left behind by a lost store or a failed creation
+func (s *LocalJobService) sweepOrphans(services []*types.Service) error {
+	known := make(map[string]bool, len(services))
+	for _, service := range services {
+		known[service.JobID] = true
+	}
+
+	entries, err := os.ReadDir(s.workDir)
+	if err != nil {
+		return fmt.Errorf("failed to list work dir: %w", err)
+	}
+
+	jobIDs := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			jobIDs[entry.Name()] = true
+		}
+	}
+
+	s.rwMutex.RLock()
+	for jobID := range s.processes {
+		jobIDs[jobID] = true
+	}
+	s.rwMutex.RUnlock()
+
+	for jobID := range jobIDs {
+		// Jobs being created are only saved once they are running
+		if known[jobID] || s.operations.active(jobID) {
+			continue
+		}
+
+		s.stopProcess(jobID)
+		if err := os.RemoveAll(filepath.Join(s.workDir, jobID)); err != nil {
+			s.logger.Error("unable to remove orphan directory", "job_id", jobID, "error", err)
+			continue
+		}
+
+		s.logger.Info("orphan job swept", "job_id", jobID)
+	}
+
+	return nil
+}
+
+// RunReconciler restarts the crashed processes every interval until the context is done
+func (s *LocalJobService) RunReconciler(ctx context.Context, interval time.Duration) {
+	runEvery(ctx, interval, func() {
+		if err := s.Reconcile(); err != nil {
+			s.logger.Error("reconciliation failed", "error", err)
+		}
+	})
+}
+
+// startService (re)starts the process of the service on a new ephemeral port and waits for it to accept connections
+func (s *LocalJobService) startService(service *types.Service) error {
+	s.stopProcess(service.JobID)
+
+	port, err := freePort()
+	if err != nil {
+		return fmt.Errorf("failed to find a free port: %w", err)
+	}
+
+	dir := filepath.Join(s.workDir, service.JobID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory of job %s: %w", service.JobID, err)
+	}
+
+	logFile, err := os.Create(filepath.Join(dir, initLogFile))
+	if err != nil {
+		return fmt.Errorf("failed to create log file of job %s: %w", service.JobID, err)
+	}
+	defer logFile.Close()
+
+	args := []string{"-url=" + service.SourceURL, "-listen=127.0.0.1:" + strconv.Itoa(port)}
+	switch service.Mode {
+	case types.ServiceModeScript:
+		args = append(args, "-script")
+	case types.ServiceModeArchive:
+		args = append(args, "-archive")
+		if service.SPA {
+			args = append(args, "-spa")
+		}
+	case types.ServiceModeGit:
+		args = append(args, "-git", "-git-ref="+service.Git.Ref, "-git-commit="+service.Git.Commit,
+			"-git-path="+service.Git.Path)
+		if service.Git.Entrypoint != "" {
+			args = append(args, "-script", "-entrypoint="+service.Git.Entrypoint)
+		} else if service.SPA {
+			args = append(args, "-spa")
+		}
+	}
+	if service.ContentType != "" {
+		args = append(args, "-content-type="+service.ContentType)
+	}
+	if service.SHA256 != "" {
+		args = append(args, "-sha256="+service.SHA256)
+	}
+	if service.Signature != "" {
+		args = append(args, "-signature="+service.Signature, "-public-key="+integrity.EncodePublicKey(s.signatureKey))
+	}
+	if s.allowPrivateSources {
+		args = append(args, "-allow-private")
+	}
+	if s.sourcePolicy != nil {
+		args = append(args, "-policy="+s.sourcePolicy.String())
+	}
+
+	cmd := exec.Command(s.initBinary, args...)
+	cmd.Dir = dir
+	cmd.Env = os.Environ()
+	for name, value := range s.jobConfig.InitEnv() {
+		cmd.Env = append(cmd.Env, name+"="+value)
+	}
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start process of job %s: %w", service.JobID, err)
+	}
+
+	process := &localProcess{cmd: cmd, port: port, dir: dir, exited: make(chan struct{})}
+	go func() {
+		_ = cmd.Wait()
+		close(process.exited)
+	}()
+
+	s.rwMutex.Lock()
+	s.processes[service.JobID] = process
+	s.rwMutex.Unlock()
+
+	s.operations.progress(service.JobID, types.OperationStateDownloading)
+
+	if err := s.waitReady(process); err != nil {
+		s.stopProcess(service.JobID)
+		return fmt.Errorf("process of job %s is not ready: %w", service.JobID, err)
+	}
+
+	service.Backends = []types.Backend{localBackend(service.JobID, port)}
+	service.Sleeping = false
+	service.UpdatedAt = time.Now().UTC()
+
+	s.rwMutex.Lock()
+	delete(s.sleeping, service.JobID)
+	s.rwMutex.Unlock()
+
+	s.logger.Info("process started", "job_id", service.JobID, "port", port, "pid", cmd.Process.Pid)
+
+	return nil
+}
+
+// waitReady waits for the process to accept connections, it fails as soon as the process exits
+func (s *LocalJobService) waitReady(process *localProcess) error {
+	deadline := time.Now().Add(s.readyTimeout)
+	address := "127.0.0.1:" + strconv.Itoa(process.port)
+
+	for time.Now().Before(deadline) {
+		select {
+		case <-process.exited:
+			return fmt.Errorf("process exited: %s", initFailure(process.dir))
+		default:
+		}
+
+		conn, err := net.DialTimeout("tcp", address, 100*time.Millisecond)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return fmt.Errorf("not accepting connections after %s", s.readyTimeout)
+}
+
+func (s *LocalJobService) stopProcess(jobID string) {
+	s.rwMutex.Lock()
+	process, ok := s.processes[jobID]
+	delete(s.processes, jobID)
+	s.rwMutex.Unlock()
+
+	if !ok {
+		return
+	}
+
+	_ = process.cmd.Process.Kill()
+	<-process.exited
+}
+
+func (s *LocalJobService) processRunning(jobID string) bool {
+	s.rwMutex.RLock()
+	process, ok := s.processes[jobID]
+	s.rwMutex.RUnlock()
+
+	if !ok {
+		return false
+	}
+
+	select {
+	case <-process.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+func (s *LocalJobService) serviceOutput(service *types.Service) *types.ServiceOutput {
+	status := types.ServiceStatusStopped
+	if service.Sleeping {
+		status = types.ServiceStatusSleeping
+	} else if s.processRunning(service.JobID) {
+		status = types.ServiceStatusRunning
+	} else if _, ok := s.GetJobBackends(service.JobID); ok {
+		status = types.ServiceStatusFailed
+	}
+
+	return &types.ServiceOutput{
+		Name:        service.Name,
+		JobID:       service.JobID,
+		Status:      status,
+		URL:         s.serviceURL(service.Project, service.Name),
+		Mode:        service.Mode,
+		SourceURL:   service.SourceURL,
+		ContentType: service.ContentType,
+		SPA:         service.SPA,
+		Git:         service.Git,
+		SHA256:      service.SHA256,
+		Signature:   service.Signature,
+		Project:     service.Project,
+		Owner:       service.Owner,
+		Replicas:    1,
+		CreatedAt:   service.CreatedAt,
+		UpdatedAt:   service.UpdatedAt,
+		ExpiresAt:   service.ExpiresAt,
+	}
+}
+
+func (s *LocalJobService) serviceURL(project, name string) string {
+	return fmt.Sprintf("http://%s.%s", subdomain(project, name), s.host)
+}
+
+func localBackend(jobID string, port int) types.Backend {
+	return types.Backend{AllocID: jobID, IP: "127.0.0.1", Port: port}
+}
+
+// freePort asks the kernel for an ephemeral port that is free at the time of the call
+func freePort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// initFailure explains why the init process exited, from its status file or else from its last log line
+func initFailure(dir string) string {
+	status, err := initstatus.Read(filepath.Join(dir, initstatus.File))
+	if err == nil && status.Err() != nil {
+		return status.Err().Error()
+	}
+
+	return lastLogLine(dir)
+}
+
+// lastLogLine returns the last line written by the init process, it usually holds the failure
+func lastLogLine(dir string) string {
+	data, err := os.ReadFile(filepath.Join(dir, initLogFile))
+	if err != nil {
+		return "no output"
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	return lines[len(lines)-1]
+}
@@ -0,0 +1,434 @@
+package service
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexisvisco/koyebtests/internal/config"
+	"github.com/alexisvisco/koyebtests/internal/store"
+	"github.com/alexisvisco/koyebtests/internal/types"
+)
+
+// buildInit compiles cmd/init so the local backend runs the same binary as in production
+func buildInit(t *testing.T) string {
+	t.Helper()
+
+	if testing.Short() {
+		t.Skip("building cmd/init is skipped in short mode")
+	}
+
+	binary := filepath.Join(t.TempDir(), "init")
+	out, err := exec.Command("go", "build", "-o", binary, "../../cmd/init").CombinedOutput()
+	if err != nil {
+		t.Fatalf("failed to build cmd/init: %v\n%s", err, out)
+	}
+
+	return binary
+}
+
+func TestLocalJobService(t *testing.T) {
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "echo hello from local")
+	}))
+	defer source.Close()
+
+	s, err := NewLocalJobService(LocalJobServiceParams{
+		Host:                "example.com",
+		Store:               store.NewMemoryStore(),
+		InitBinary:          buildInit(t),
+		AllowPrivateSources: true,
+		WorkDir:             t.TempDir(),
+		ReadyTimeout:        10 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+	defer s.Close()
+
+	out, err := s.CreateJob(types.CreateJobInput{Name: "local", TargetURL: source.URL, IsScript: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	op, err := s.GetOperation(out.OperationID)
+	if err != nil || op.State != types.OperationStateRunning {
+		t.Fatalf("expected running operation, got %+v (%v)", op, err)
+	}
+
+	service, err := s.GetService("default", "local")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if service.Status != types.ServiceStatusRunning || service.URL != out.URL {
+		t.Fatalf("unexpected service: %+v", service)
+	}
+
+	backends, ok := s.GetJobBackends(service.JobID)
+	if !ok || len(backends) != 1 {
+		t.Fatalf("expected a single backend for the service, got %+v", backends)
+	}
+
+	resp, err := http.Get("http://" + backends[0].IP + ":" + strconv.Itoa(backends[0].Port) + "/")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "hello from local\n" {
+		t.Fatalf("unexpected body: %q", string(body))
+	}
+
+	if err := s.PurgeJob(service.JobID); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := s.GetJobBackends(service.JobID); ok {
+		t.Fatal("expected the backend to be released after purge")
+	}
+}
+
+func TestLocalJobServiceArchive(t *testing.T) {
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	for name, content := range map[string]string{"dist/index.html": "<h1>home</h1>", "dist/css/site.css": "body{}"} {
+		w, _ := zw.Create(name)
+		io.WriteString(w, content)
+	}
+	zw.Close()
+
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/zip")
+		w.Write(archive.Bytes())
+	}))
+	defer source.Close()
+
+	s, err := NewLocalJobService(LocalJobServiceParams{
+		Host:                "example.com",
+		Store:               store.NewMemoryStore(),
+		InitBinary:          buildInit(t),
+		AllowPrivateSources: true,
+		WorkDir:             t.TempDir(),
+		ReadyTimeout:        10 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+	defer s.Close()
+
+	if _, err := s.CreateJob(types.CreateJobInput{Name: "site", TargetURL: source.URL + "/site.zip", Archive: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	service, err := s.GetService("default", "site")
+	if err != nil || service.Mode != types.ServiceModeArchive {
+		t.Fatalf("expected an archive service, got %+v (%v)", service, err)
+	}
+
+	backends, _ := s.GetJobBackends(service.JobID)
+	resp, err := http.Get("http://" + backends[0].IP + ":" + strconv.Itoa(backends[0].Port) + "/css/site.css")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "body{}" || resp.Header.Get("Content-Type") != "text/css; charset=utf-8" {
+		t.Fatalf("unexpected response: %d %q %q", resp.StatusCode, resp.Header.Get("Content-Type"), string(body))
+	}
+}
+
+func TestLocalJobServiceGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir := t.TempDir()
+	git := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GIT_CONFIG_NOSYSTEM=1", "GIT_CONFIG_GLOBAL=/dev/null",
+			"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com", "GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+
+	os.MkdirAll(filepath.Join(dir, "docs"), 0755)
+	os.WriteFile(filepath.Join(dir, "docs", "index.html"), []byte("<h1>docs</h1>"), 0644)
+	git("init", "-q", "-b", "main")
+	git("add", ".")
+	git("commit", "-q", "-m", "docs")
+	commit := git("rev-parse", "HEAD")
+
+	s, err := NewLocalJobService(LocalJobServiceParams{
+		Host:                "example.com",
+		Store:               store.NewMemoryStore(),
+		InitBinary:          buildInit(t),
+		AllowPrivateSources: true,
+		WorkDir:             t.TempDir(),
+		ReadyTimeout:        10 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+	defer s.Close()
+
+	repoURL := "file://" + dir
+	input := types.CreateJobInput{Name: "docs", TargetURL: repoURL, Git: &types.GitSource{URL: repoURL, Ref: "main", Commit: commit, Path: "docs"}}
+	if _, err := s.CreateJob(input); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	service, err := s.GetService("default", "docs")
+	if err != nil || service.Mode != types.ServiceModeGit || service.Git.Commit != commit {
+		t.Fatalf("expected a git service pinned to %s, got %+v (%v)", commit, service, err)
+	}
+
+	backends, _ := s.GetJobBackends(service.JobID)
+	resp, err := http.Get("http://" + backends[0].IP + ":" + strconv.Itoa(backends[0].Port) + "/")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "<h1>docs</h1>" {
+		t.Fatalf("unexpected response: %d %q", resp.StatusCode, string(body))
+	}
+}
+
+func TestLocalJobServiceIntegrity(t *testing.T) {
+	content := []byte("echo signed")
+	digest := sha256.Sum256(content)
+	publicKey, privateKey, _ := ed25519.GenerateKey(nil)
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, content))
+
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer source.Close()
+
+	s, err := NewLocalJobService(LocalJobServiceParams{
+		Host:                "example.com",
+		Store:               store.NewMemoryStore(),
+		InitBinary:          buildInit(t),
+		AllowPrivateSources: true,
+		SignatureKey:        publicKey,
+		WorkDir:             t.TempDir(),
+		ReadyTimeout:        10 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+	defer s.Close()
+
+	tests := []struct {
+		name        string
+		sha256      string
+		signature   string
+		expectError bool
+	}{
+		{name: "matching", sha256: hex.EncodeToString(digest[:]), signature: signature},
+		{name: "other digest", sha256: strings.Repeat("0", 64), expectError: true},
+		{name: "other signature", signature: base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, []byte("other"))), expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := strings.ReplaceAll(tt.name, " ", "-")
+			_, err := s.CreateJob(types.CreateJobInput{Name: name, TargetURL: source.URL, IsScript: true, SHA256: tt.sha256, Signature: tt.signature})
+			if (err != nil) != tt.expectError {
+				t.Fatalf("expected error %v, got %v", tt.expectError, err)
+			}
+		})
+	}
+}
+
+func TestLocalJobServiceSignatureWithoutKey(t *testing.T) {
+	s, err := NewLocalJobService(LocalJobServiceParams{Host: "example.com", Store: store.NewMemoryStore(), WorkDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+	defer s.Close()
+
+	_, err = s.CreateJob(types.CreateJobInput{Name: "signed", TargetURL: "http://example.com", Signature: "c2ln"})
+
+	var validationErr *types.ValidationError
+	if !errors.As(err, &validationErr) || validationErr.Field != "signature" {
+		t.Fatalf("expected a validation error on signature, got %v", err)
+	}
+}
+
+func TestLocalJobServiceValidatesOverrides(t *testing.T) {
+	s, err := NewLocalJobService(LocalJobServiceParams{Host: "example.com", Store: store.NewMemoryStore(), WorkDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+	defer s.Close()
+
+	tests := []struct {
+		name          string
+		input         types.CreateJobInput
+		expectedField string
+	}{
+		{name: "unknown instance type", input: types.CreateJobInput{Name: "custom", TargetURL: "http://example.com", InstanceType: "unknown"}, expectedField: "instance_type"},
+		{name: "several replicas", input: types.CreateJobInput{Name: "custom", TargetURL: "http://example.com", Replicas: 2}, expectedField: "replicas"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.CreateJob(tt.input)
+
+			var validationErr *types.ValidationError
+			if !errors.As(err, &validationErr) || validationErr.Field != tt.expectedField {
+				t.Fatalf("expected a validation error on %s, got %v", tt.expectedField, err)
+			}
+		})
+	}
+}
+
+func TestLocalJobServiceCountsSingleReplica(t *testing.T) {
+	jobConfig := config.Default().Job
+	jobConfig.Replicas = 3
+
+	// The quota holds a single process, the default replicas of the server would take three times more
+	s, err := NewLocalJobService(LocalJobServiceParams{
+		Host:       "example.com",
+		Store:      store.NewMemoryStore(),
+		InitBinary: filepath.Join(t.TempDir(), "missing-init"),
+		WorkDir:    t.TempDir(),
+		JobConfig:  &jobConfig,
+		Quota:      config.QuotaConfig{MaxMemoryMB: jobConfig.Resources.MemoryMB},
+	})
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+	defer s.Close()
+
+	// The process cannot start without the init binary, the quota was checked before
+	_, err = s.CreateJob(types.CreateJobInput{Name: "svc", TargetURL: "http://example.com"})
+	if err == nil || errors.Is(err, types.ErrQuotaExceeded) {
+		t.Fatalf("expected the service to count as a single replica, got %v", err)
+	}
+}
+
+func TestLocalJobServiceQuota(t *testing.T) {
+	serviceStore := store.NewMemoryStore()
+	now := time.Now().UTC()
+	_ = serviceStore.SaveService(&types.Service{Name: "existing", Project: "default", JobID: "existing-job", SourceURL: "http://example.com", Mode: types.ServiceModeStatic, CreatedAt: now, UpdatedAt: now})
+
+	s, err := NewLocalJobService(LocalJobServiceParams{Host: "example.com", Store: serviceStore, WorkDir: t.TempDir(), Quota: config.QuotaConfig{MaxServices: 1}})
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+	defer s.Close()
+
+	_, err = s.CreateJob(types.CreateJobInput{Name: "svc", TargetURL: "http://example.com"})
+
+	var quotaErr *types.QuotaError
+	if !errors.As(err, &quotaErr) || quotaErr.Resource != types.QuotaResourceServices || quotaErr.Usage != 2 {
+		t.Fatalf("expected the quota of services to be exceeded, got %v", err)
+	}
+}
+
+func TestLocalJobServiceFailure(t *testing.T) {
+	source := httptest.NewServer(http.NotFoundHandler())
+	defer source.Close()
+
+	s, err := NewLocalJobService(LocalJobServiceParams{
+		Host:                "example.com",
+		Store:               store.NewMemoryStore(),
+		InitBinary:          buildInit(t),
+		AllowPrivateSources: true,
+		WorkDir:             t.TempDir(),
+		ReadyTimeout:        10 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+	defer s.Close()
+
+	// The class written by init in its status file explains the failure
+	_, err = s.CreateJob(types.CreateJobInput{Name: "broken", TargetURL: source.URL})
+	if err == nil || !strings.Contains(err.Error(), "upstream_error: failed to download content from url: HTTP error: 404 Not Found") {
+		t.Fatalf("expected the download failure of init, got %v", err)
+	}
+
+	if _, err := s.GetService("default", "broken"); err == nil {
+		t.Fatal("expected the failed service not to be stored")
+	}
+}
+
+func TestLocalJobServiceUpdateFailureRestartsPreviousVersion(t *testing.T) {
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1.sh" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, "echo hello from v1")
+	}))
+	defer source.Close()
+
+	s, err := NewLocalJobService(LocalJobServiceParams{
+		Host:                "example.com",
+		Store:               store.NewMemoryStore(),
+		InitBinary:          buildInit(t),
+		AllowPrivateSources: true,
+		WorkDir:             t.TempDir(),
+		ReadyTimeout:        10 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+	defer s.Close()
+
+	if _, err := s.CreateJob(types.CreateJobInput{Name: "local", TargetURL: source.URL + "/v1.sh", IsScript: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The script of the update cannot be downloaded, its process never becomes ready
+	if _, err := s.CreateJob(types.CreateJobInput{Name: "local", TargetURL: source.URL + "/v2.sh", IsScript: true}); err == nil {
+		t.Fatal("expected the update to fail")
+	}
+
+	service, err := s.GetService("default", "local")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if service.SourceURL != source.URL+"/v1.sh" || service.Status != types.ServiceStatusRunning {
+		t.Fatalf("expected the previous version to be kept, got %+v", service)
+	}
+
+	backends, ok := s.GetJobBackends(service.JobID)
+	if !ok || len(backends) != 1 {
+		t.Fatalf("expected the previous process to run again, got %+v", backends)
+	}
+
+	resp, err := http.Get("http://" + backends[0].IP + ":" + strconv.Itoa(backends[0].Port) + "/")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "hello from v1\n" {
+		t.Fatalf("unexpected body: %q", string(body))
+	}
+}
@@ -0,0 +1,276 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/alexisvisco/koyebtests/internal/initstatus"
+	"github.com/alexisvisco/koyebtests/internal/types"
+	"github.com/hashicorp/nomad/api"
+)
+
+const (
+	portLabel = "http"
+
+	maxStreamBackoff = 30 * time.Second
+)
+
+// EventSource streams Nomad events, it is implemented by *api.EventStream
+type EventSource interface {
+	Stream(ctx context.Context, topics map[api.Topic][]string, index uint64, q *api.QueryOptions) (<-chan *api.Events, error)
+}
+
+// readiness is sent to the waiter of a job once one of its allocations is running or has failed
+type readiness struct {
+	backend types.Backend
+	err     error
+}
+
+type readinessWaiter struct {
+	ch chan readiness
+
+	// minIndex filters out the allocations created before the job version that is awaited
+	minIndex uint64
+}
+
+func (s *NomadJobService) watchReadiness(jobID string, minIndex uint64) <-chan readiness {
+	ch := make(chan readiness, 1)
+
+	s.waitersMutex.Lock()
+	s.waiters[jobID] = &readinessWaiter{ch: ch, minIndex: minIndex}
+	s.waitersMutex.Unlock()
+
+	return ch
+}
+
+func (s *NomadJobService) unwatchReadiness(jobID string) {
+	s.waitersMutex.Lock()
+	delete(s.waiters, jobID)
+	s.waitersMutex.Unlock()
+}
+
+// notifyReadiness sends the result to the waiter of the job if any, without blocking.
+// createIndex is the raft index at which the allocation or deployment was created.
+func (s *NomadJobService) notifyReadiness(jobID string, createIndex uint64, r readiness) {
+	s.waitersMutex.Lock()
+	waiter, ok := s.waiters[jobID]
+	s.waitersMutex.Unlock()
+
+	if !ok || createIndex < waiter.minIndex {
+		return
+	}
+
+	select {
+	case waiter.ch <- r:
+	default:
+	}
+}
+
+// RunEventLoop subscribes to the Nomad event stream and drives readiness, backend updates and
+// failure detection from allocation, job and deployment events. It reconnects with an
+// exponential backoff until the context is done.
+func (s *NomadJobService) RunEventLoop(ctx context.Context) {
+	topics := map[api.Topic][]string{
+		api.TopicAllocation: {"*"},
+		api.TopicJob:        {"*"},
+		api.TopicDeployment: {"*"},
+	}
+
+	var index uint64
+	backoff := time.Second
+
+	for {
+		stream, err := s.events.Stream(ctx, topics, index, &api.QueryOptions{Namespace: allNamespaces})
+		if err != nil {
+			s.logger.Error("unable to subscribe to the event stream", "error", err, "retry_in", backoff)
+		} else {
+			for events := range stream {
+				if events.Err != nil {
+					s.logger.Error("event stream error", "error", events.Err)
+					break
+				}
+
+				backoff = time.Second
+				if events.IsHeartbeat() {
+					continue
+				}
+
+				for i := range events.Events {
+					s.handleEvent(&events.Events[i])
+				}
+				index = events.Index
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff = min(backoff*2, maxStreamBackoff)
+	}
+}
+
+func (s *NomadJobService) handleEvent(event *api.Event) {
+	switch event.Topic {
+	case api.TopicAllocation:
+		alloc, err := event.Allocation()
+		if err != nil || alloc == nil {
+			s.logger.Warn("unable to decode allocation event", "key", event.Key, "error", err)
+			return
+		}
+		s.handleAllocation(alloc)
+	case api.TopicDeployment:
+		deployment, err := event.Deployment()
+		if err != nil || deployment == nil {
+			s.logger.Warn("unable to decode deployment event", "key", event.Key, "error", err)
+			return
+		}
+		if deployment.Status == "failed" {
+			s.notifyReadiness(deployment.JobID, deployment.CreateIndex, readiness{
+				err: fmt.Errorf("deployment failed: %s", deployment.StatusDescription),
+			})
+		}
+	case api.TopicJob:
+		if event.Type == "JobDeregistered" {
+			s.forgetJob(event.Key)
+		}
+	}
+}
+
+func (s *NomadJobService) handleAllocation(alloc *api.Allocation) {
+	switch alloc.ClientStatus {
+	case api.AllocClientStatusRunning:
+		if alloc.DesiredStatus != "" && alloc.DesiredStatus != api.AllocDesiredStatusRun {
+			// The allocation is being stopped or replaced, stop sending it traffic
+			s.removeBackend(alloc.JobID, alloc.ID)
+			return
+		}
+
+		backend, ok := allocationBackend(alloc)
+		if !ok {
+			return
+		}
+
+		s.notifyReadiness(alloc.JobID, alloc.CreateIndex, readiness{backend: backend})
+		s.upsertBackend(alloc.JobID, backend)
+	case api.AllocClientStatusPending:
+		s.operations.progress(alloc.JobID, allocationPendingState(alloc))
+	case api.AllocClientStatusFailed, api.AllocClientStatusLost:
+		s.notifyReadiness(alloc.JobID, alloc.CreateIndex, readiness{
+			err: fmt.Errorf("allocation %s %s: %s", alloc.ID, alloc.ClientStatus, allocationFailure(alloc)),
+		})
+		s.removeBackend(alloc.JobID, alloc.ID)
+	case api.AllocClientStatusComplete:
+		s.removeBackend(alloc.JobID, alloc.ID)
+	}
+}
+
+// forgetJob removes a job deregistered outside of the API from the routing table
+func (s *NomadJobService) forgetJob(jobID string) {
+	if !s.dropJob(jobID) {
+		return
+	}
+
+	s.logger.Info("job deregistered, forgetting it", "job_id", jobID)
+
+	if err := s.store.DeleteService(jobID); err != nil && !errors.Is(err, types.ErrServiceNotFound) {
+		s.logger.Error("unable to delete service from store", "job_id", jobID, "error", err)
+	}
+}
+
+// allocationAddress extracts the address of the http port of an allocation
+func allocationAddress(alloc *api.Allocation) (string, int, bool) {
+	if alloc.AllocatedResources != nil {
+		for _, port := range alloc.AllocatedResources.Shared.Ports {
+			if port.Label == portLabel {
+				return port.HostIP, port.Value, true
+			}
+		}
+
+		for _, network := range alloc.AllocatedResources.Shared.Networks {
+			for _, port := range network.DynamicPorts {
+				if port.Label == portLabel {
+					return network.IP, port.Value, true
+				}
+			}
+		}
+	}
+
+	// Ports declared at the task level are only reported in the legacy resources
+	if alloc.Resources != nil {
+		for _, network := range alloc.Resources.Networks {
+			for _, port := range network.DynamicPorts {
+				if port.Label == portLabel {
+					return network.IP, port.Value, true
+				}
+			}
+		}
+	}
+
+	return "", 0, false
+}
+
+// allocationPendingState tells whether a pending allocation is still being placed or already
+// preparing its task, pulling the image and downloading the content
+func allocationPendingState(alloc *api.Allocation) types.OperationState {
+	for _, state := range alloc.TaskStates {
+		if len(state.Events) > 0 {
+			return types.OperationStateDownloading
+		}
+	}
+
+	return types.OperationStateScheduling
+}
+
+// allocationFailure returns the most relevant message from the task events of a failed allocation,
+// the class of the failure of init when the task exited with one of its exit codes
+func allocationFailure(alloc *api.Allocation) string {
+	var reason, initReason string
+	for _, state := range alloc.TaskStates {
+		for _, event := range state.Events {
+			if class, ok := initFailureClass(event); ok {
+				initReason = fmt.Sprintf("%s: %s", class, class.Description())
+			}
+
+			switch {
+			case event.DriverError != "":
+				reason = event.DriverError
+			case event.DownloadError != "":
+				reason = event.DownloadError
+			case event.SetupError != "":
+				reason = event.SetupError
+			case event.FailsTask && event.DisplayMessage != "":
+				reason = event.DisplayMessage
+			}
+		}
+	}
+
+	if initReason != "" {
+		return initReason
+	}
+	if reason == "" {
+		reason = alloc.ClientDescription
+	}
+
+	return reason
+}
+
+// initFailureClass reads the class of the failure of init from the exit code of a terminated task, the
+// startup script of the image offsets the codes of init from the ones of bash and nginx
+func initFailureClass(event *api.TaskEvent) (initstatus.Class, bool) {
+	if event.Type != api.TaskTerminated {
+		return "", false
+	}
+
+	exitCode, err := strconv.Atoi(event.Details["exit_code"])
+	if err != nil {
+		return "", false
+	}
+
+	return initstatus.ClassOfStartup(exitCode)
+}
@@ -0,0 +1,302 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexisvisco/koyebtests/internal/store"
+	"github.com/alexisvisco/koyebtests/internal/types"
+	"github.com/hashicorp/nomad/api"
+)
+
+// fakeEventSource replays the events pushed in its channel as a Nomad event stream
+type fakeEventSource struct {
+	events chan *api.Events
+}
+
+func newFakeEventSource() *fakeEventSource {
+	return &fakeEventSource{events: make(chan *api.Events)}
+}
+
+func (f *fakeEventSource) Stream(ctx context.Context, _ map[api.Topic][]string, _ uint64, _ *api.QueryOptions) (<-chan *api.Events, error) {
+	out := make(chan *api.Events)
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case events := <-f.events:
+				select {
+				case out <- events:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (f *fakeEventSource) send(t *testing.T, events ...api.Event) {
+	t.Helper()
+	select {
+	case f.events <- &api.Events{Index: 1, Events: events}:
+	case <-time.After(time.Second):
+		t.Fatal("event loop did not consume the events")
+	}
+}
+
+// allocationEvent builds an event with a payload shaped like the one decoded from the Nomad HTTP API
+func allocationEvent(t *testing.T, alloc *api.Allocation) api.Event {
+	t.Helper()
+
+	data, err := json.Marshal(map[string]any{"Allocation": alloc})
+	if err != nil {
+		t.Fatalf("failed to encode allocation: %v", err)
+	}
+
+	var payload map[string]interface{}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		t.Fatalf("failed to decode allocation: %v", err)
+	}
+
+	return api.Event{Topic: api.TopicAllocation, Type: "AllocationUpdated", Key: alloc.ID, Payload: payload}
+}
+
+func runningAllocation(jobID string, port int) *api.Allocation {
+	return &api.Allocation{
+		ID:            "alloc-" + jobID,
+		JobID:         jobID,
+		DesiredStatus: api.AllocDesiredStatusRun,
+		ClientStatus:  api.AllocClientStatusRunning,
+		AllocatedResources: &api.AllocatedResources{
+			Shared: api.AllocatedSharedResources{
+				Ports: []api.PortMapping{{Label: "http", Value: port, HostIP: "10.0.0.12"}},
+			},
+		},
+	}
+}
+
+func newTestNomadJobService(t *testing.T, serviceStore types.ServiceStore) (*NomadJobService, *fakeEventSource) {
+	t.Helper()
+
+	events := newFakeEventSource()
+	s, err := NewNomadJobService(NomadJobServiceParams{
+		Host:   "example.com",
+		Store:  serviceStore,
+		Events: events,
+	})
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go s.RunEventLoop(ctx)
+
+	return s, events
+}
+
+func eventually(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("condition not met before deadline")
+}
+
+func TestEventLoopReadiness(t *testing.T) {
+	s, events := newTestNomadJobService(t, store.NewMemoryStore())
+
+	ready := s.watchReadiness("job-1", 0)
+	defer s.unwatchReadiness("job-1")
+
+	pending := runningAllocation("job-1", 0)
+	pending.ClientStatus = api.AllocClientStatusPending
+	events.send(t, allocationEvent(t, pending), allocationEvent(t, runningAllocation("job-1", 25000)))
+
+	select {
+	case r := <-ready:
+		if r.err != nil {
+			t.Fatalf("unexpected error: %v", r.err)
+		}
+		if r.backend.Port != 25000 || r.backend.IP != "10.0.0.12" {
+			t.Fatalf("expected 10.0.0.12:25000, got %+v", r.backend)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("job was never reported as ready")
+	}
+}
+
+func TestEventLoopFailure(t *testing.T) {
+	s, events := newTestNomadJobService(t, store.NewMemoryStore())
+
+	ready := s.watchReadiness("job-1", 0)
+	defer s.unwatchReadiness("job-1")
+
+	failed := runningAllocation("job-1", 0)
+	failed.ClientStatus = api.AllocClientStatusFailed
+	failed.TaskStates = map[string]*api.TaskState{
+		"koyeb-nginx": {
+			State:  "dead",
+			Failed: true,
+			Events: []*api.TaskEvent{{Type: "Driver Failure", DriverError: "image pull failed"}},
+		},
+	}
+	events.send(t, allocationEvent(t, failed))
+
+	select {
+	case r := <-ready:
+		if r.err == nil || !strings.Contains(r.err.Error(), "image pull failed") {
+			t.Fatalf("expected image pull failure, got %v", r.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("job failure was never reported")
+	}
+}
+
+func TestEventLoopBackendUpdates(t *testing.T) {
+	serviceStore := store.NewMemoryStore()
+	now := time.Now().UTC()
+	_ = serviceStore.SaveService(&types.Service{
+		Name:      "svc",
+		JobID:     "job-1",
+		Mode:      types.ServiceModeStatic,
+		Backends:  []types.Backend{{AllocID: "alloc-job-1", IP: "10.0.0.12", Port: 20000}},
+		CreatedAt: now,
+		UpdatedAt: now,
+	})
+
+	s, events := newTestNomadJobService(t, serviceStore)
+
+	second := runningAllocation("job-1", 22000)
+	second.ID = "alloc-second"
+	events.send(t, allocationEvent(t, runningAllocation("job-1", 21000)), allocationEvent(t, second))
+
+	expected := []types.Backend{
+		{AllocID: "alloc-job-1", IP: "10.0.0.12", Port: 21000},
+		{AllocID: "alloc-second", IP: "10.0.0.12", Port: 22000},
+	}
+	eventually(t, func() bool {
+		backends, ok := s.GetJobBackends("job-1")
+		return ok && reflect.DeepEqual(backends, expected)
+	})
+
+	service, err := serviceStore.GetService("job-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(service.Backends, expected) {
+		t.Fatalf("expected stored backends %+v, got %+v", expected, service.Backends)
+	}
+
+	stopped := runningAllocation("job-1", 21000)
+	stopped.DesiredStatus = api.AllocDesiredStatusStop
+	events.send(t, allocationEvent(t, stopped))
+
+	eventually(t, func() bool {
+		backends, _ := s.GetJobBackends("job-1")
+		return reflect.DeepEqual(backends, expected[1:])
+	})
+
+	events.send(t, api.Event{Topic: api.TopicJob, Type: "JobDeregistered", Key: "job-1"})
+
+	eventually(t, func() bool {
+		_, ok := s.GetJobBackends("job-1")
+		return !ok
+	})
+}
+
+func TestEventLoopReadinessIgnoresPreviousAllocations(t *testing.T) {
+	s, events := newTestNomadJobService(t, store.NewMemoryStore())
+
+	ready := s.watchReadiness("job-1", 10)
+	defer s.unwatchReadiness("job-1")
+
+	previous := runningAllocation("job-1", 20000)
+	previous.CreateIndex = 5
+	replacement := runningAllocation("job-1", 20001)
+	replacement.ID = "alloc-replacement"
+	replacement.CreateIndex = 12
+	events.send(t, allocationEvent(t, previous), allocationEvent(t, replacement))
+
+	select {
+	case r := <-ready:
+		if r.backend.Port != 20001 {
+			t.Fatalf("expected the replacing allocation port 20001, got %d", r.backend.Port)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("job was never reported as ready")
+	}
+}
+
+func TestAllocationFailure(t *testing.T) {
+	tests := []struct {
+		name     string
+		events   []*api.TaskEvent
+		expected string
+	}{
+		{
+			name:     "driver error",
+			events:   []*api.TaskEvent{{Type: "Driver Failure", DriverError: "image pull failed"}},
+			expected: "image pull failed",
+		},
+		{
+			name: "init failure",
+			events: []*api.TaskEvent{
+				{Type: api.TaskTerminated, Details: map[string]string{"exit_code": "106"}},
+				{Type: "Not Restarting", FailsTask: true, DisplayMessage: "Exceeded allowed attempts 2 in interval 30m0s"},
+			},
+			expected: "too_large: content exceeds the size limits",
+		},
+		{
+			name: "latest init failure",
+			events: []*api.TaskEvent{
+				{Type: api.TaskTerminated, Details: map[string]string{"exit_code": "105"}},
+				{Type: api.TaskTerminated, Details: map[string]string{"exit_code": "104"}},
+			},
+			expected: "upstream_error: source answered with an error",
+		},
+		{
+			name: "internal init failure",
+			events: []*api.TaskEvent{
+				{Type: api.TaskTerminated, Details: map[string]string{"exit_code": "101"}},
+			},
+			expected: "internal: init failed",
+		},
+		{
+			name: "nginx exit code",
+			events: []*api.TaskEvent{
+				{Type: api.TaskTerminated, Details: map[string]string{"exit_code": "1"}},
+				{Type: "Not Restarting", FailsTask: true, DisplayMessage: "Exceeded allowed attempts"},
+			},
+			expected: "Exceeded allowed attempts",
+		},
+		{
+			name: "other exit code",
+			events: []*api.TaskEvent{
+				{Type: api.TaskTerminated, Details: map[string]string{"exit_code": "137"}},
+				{Type: "Not Restarting", FailsTask: true, DisplayMessage: "Exceeded allowed attempts"},
+			},
+			expected: "Exceeded allowed attempts",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alloc := &api.Allocation{TaskStates: map[string]*api.TaskState{"koyeb-nginx": {State: "dead", Failed: true, Events: tt.events}}}
+			if got := allocationFailure(alloc); got != tt.expected {
+				t.Fatalf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
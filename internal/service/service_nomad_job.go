@@ -1,16 +1,23 @@
 package service
 
 import (
+	"context"
+	"crypto/ed25519"
 	"errors"
 	"fmt"
 	"log/slog"
+	"reflect"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 	"unicode"
 
+	"github.com/alexisvisco/koyebtests/internal/config"
+	"github.com/alexisvisco/koyebtests/internal/integrity"
+	"github.com/alexisvisco/koyebtests/internal/netguard"
 	"github.com/alexisvisco/koyebtests/internal/types"
 	"github.com/google/uuid"
 	"github.com/hashicorp/nomad/api"
@@ -19,84 +26,616 @@ import (
 	"golang.org/x/text/unicode/norm"
 )
 
+const defaultReadyTimeout = 2 * time.Minute
+
 type NomadJobService struct {
-	client *api.Client
-	host   string
-	logger *slog.Logger
+	client       *api.Client
+	store        types.ServiceStore
+	events       EventSource
+	host         string
+	readyTimeout time.Duration
+	jobConfig    config.JobConfig
+	logger       *slog.Logger
+
+	rwMutex       sync.RWMutex
+	jobBackends   map[string][]types.Backend
+	jobNamespaces map[string]string
+
+	subdomains subdomainTable
+
+	namespacesMutex sync.Mutex
+	knownNamespaces map[string]bool
+
+	waitersMutex sync.Mutex
+	waiters      map[string]*readinessWaiter
+
+	nameLocks    keyedMutex
+	wakeLocks    keyedMutex
+	operations   *operationTracker
+	quotas       *quotaReservations
+	orphanPolicy OrphanPolicy
+	sourcePolicy *netguard.Policy
+	signatureKey ed25519.PublicKey
+
+	creations      creationGate
+	shutdownPolicy ShutdownPolicy
+	drainTimeout   time.Duration
+}
+
+type NomadJobServiceParams struct {
+	Host   string
+	Client *api.Client
+	Store  types.ServiceStore
+
+	// Events defaults to the event stream of the client
+	Events EventSource
+
+	// ReadyTimeout is the deadline for a new job to have a running allocation, defaults to 2 minutes
+	ReadyTimeout time.Duration
+
+	// JobConfig is the template of the created jobs, defaults to config.Default
+	JobConfig *config.JobConfig
+
+	// Quota caps the resources of all the services, the zero value is unlimited
+	Quota config.QuotaConfig
 
-	rwMutex     sync.RWMutex
-	jobIdToPort map[string]int
+	// ProjectQuota caps the resources of the services of each project, the zero value is unlimited
+	ProjectQuota config.QuotaConfig
+
+	// OrphanPolicy decides what Reconcile does with the jobs owned by the API that are missing
+	// from the store, defaults to adopting them
+	OrphanPolicy OrphanPolicy
+
+	// SourcePolicy is handed to the init binary of the jobs, which applies it when downloading
+	SourcePolicy *netguard.Policy
+
+	// SignatureKey verifies the signatures of the sources, the signed services are refused without it
+	SignatureKey ed25519.PublicKey
+
+	// ShutdownPolicy decides what Close does with the running jobs, defaults to leaving them running
+	ShutdownPolicy ShutdownPolicy
+
+	// DrainTimeout bounds how long Close waits for the in-flight creations with the drain policy,
+	// defaults to 3 minutes
+	DrainTimeout time.Duration
 }
 
-func NewNomadJobService(host string, client *api.Client) *NomadJobService {
-	return &NomadJobService{
-		client:      client,
-		logger:      slog.With("component", "nomad"),
-		host:        host,
-		jobIdToPort: make(map[string]int),
+// NewNomadJobService creates the service and restores the routing table from the store
+func NewNomadJobService(params NomadJobServiceParams) (*NomadJobService, error) {
+	s := &NomadJobService{
+		client:          params.Client,
+		store:           params.Store,
+		events:          params.Events,
+		host:            params.Host,
+		readyTimeout:    params.ReadyTimeout,
+		logger:          slog.With("component", "nomad"),
+		jobBackends:     make(map[string][]types.Backend),
+		jobNamespaces:   make(map[string]string),
+		knownNamespaces: make(map[string]bool),
+		waiters:         make(map[string]*readinessWaiter),
+		operations:      newOperationTracker(),
+		quotas:          newQuotaReservations(params.Quota, params.ProjectQuota),
+		orphanPolicy:    params.OrphanPolicy,
+		sourcePolicy:    params.SourcePolicy,
+		signatureKey:    params.SignatureKey,
+
+		shutdownPolicy: params.ShutdownPolicy,
+		drainTimeout:   params.DrainTimeout,
+	}
+
+	if s.events == nil {
+		s.events = params.Client.EventStream()
 	}
+
+	if s.readyTimeout <= 0 {
+		s.readyTimeout = defaultReadyTimeout
+	}
+
+	if s.orphanPolicy == "" {
+		s.orphanPolicy = OrphanPolicyAdopt
+	}
+
+	if s.shutdownPolicy == "" {
+		s.shutdownPolicy = ShutdownPolicyDetach
+	}
+
+	if s.drainTimeout <= 0 {
+		s.drainTimeout = defaultDrainTimeout
+	}
+
+	s.jobConfig = config.Default().Job
+	if params.JobConfig != nil {
+		s.jobConfig = *params.JobConfig
+	}
+
+	services, err := s.store.ListServices()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load services from store: %w", err)
+	}
+
+	for _, service := range services {
+		s.addJob(service)
+	}
+
+	s.logger.Info("services restored from store", "count", len(services))
+
+	return s, nil
 }
 
-func (s *NomadJobService) GetJobPort(jobID string) (int, bool) {
-	s.rwMutex.RLock()
-	defer s.rwMutex.RUnlock()
+// CreateJob creates the service or makes it match the requested spec when it already exists.
+// The service name identifies the service: an identical spec returns the existing URL and a
+// different one updates the Nomad job in place, keeping the same job ID and subdomain.
+// In async mode the work continues in the background and is tracked by the returned operation.
+func (s *NomadJobService) CreateJob(input types.CreateJobInput) (*types.CreateJobOutput, error) {
+	input.Project = projectOf(input)
+	if err := validateSubdomain(input.Name); err != nil {
+		return nil, err
+	}
+	if err := validateSignature(input, s.signatureKey); err != nil {
+		return nil, err
+	}
+
+	if err := s.creations.enter(); err != nil {
+		return nil, err
+	}
+
+	// The creation is in flight until the name is unlocked, including in async mode
+	unlockName, err := lockCreation(&s.nameLocks, input)
+	if err != nil {
+		s.creations.leave()
+		return nil, err
+	}
+	unlock := func() {
+		unlockName()
+		s.creations.leave()
+	}
+
+	spec, err := s.jobConfig.Resolve(input)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+
+	existing, err := findService(s.store, input.Project, input.Name)
+	if err != nil && !errors.Is(err, types.ErrServiceNotFound) {
+		unlock()
+		return nil, err
+	}
+
+	if err := checkSubdomain(&s.subdomains, existing, input.Project, input.Name); err != nil {
+		unlock()
+		return nil, err
+	}
 
-	port, exists := s.jobIdToPort[jobID]
-	return port, exists
+	if err := checkOwner(existing, input.Owner); err != nil {
+		unlock()
+		return nil, err
+	}
+
+	if existing != nil && sameSpec(existing, input, spec) {
+		defer unlock()
+
+		if !input.ExpiresAt.IsZero() && !input.ExpiresAt.Equal(existing.ExpiresAt) {
+			existing.ExpiresAt = input.ExpiresAt
+			existing.UpdatedAt = time.Now().UTC()
+			if err := s.store.SaveService(existing); err != nil {
+				return nil, fmt.Errorf("failed to save service: %w", err)
+			}
+		}
+
+		return &types.CreateJobOutput{URL: s.serviceURL(existing.Project, existing.Name)}, nil
+	}
+
+	jobID := fmt.Sprintf(slugify(input.Name)+"%s", uuid.New().String())
+	if existing != nil {
+		jobID = existing.JobID
+	}
+
+	if err := s.quotas.reserve(s.store, jobID, input.Project, spec.TotalResources()); err != nil {
+		unlock()
+		return nil, err
+	}
+
+	op := s.operations.start(jobID, input)
+
+	run := func() error {
+		defer unlock()
+		defer s.quotas.release(jobID)
+
+		var err error
+		if existing != nil {
+			err = s.updateJob(existing, input, spec)
+		} else {
+			err = s.createJob(jobID, input, spec)
+		}
+
+		s.operations.finish(op.ID, err)
+		return err
+	}
+
+	output := &types.CreateJobOutput{
+		URL:         s.serviceURL(input.Project, input.Name),
+		OperationID: op.ID,
+	}
+
+	if input.Async {
+		go func() {
+			if err := run(); err != nil {
+				s.logger.Error("async operation failed", "operation_id", op.ID, "job_id", jobID, "error", err)
+			}
+		}()
+		return output, nil
+	}
+
+	if err := run(); err != nil {
+		return nil, err
+	}
+
+	return output, nil
+}
+
+func (s *NomadJobService) GetOperation(id string) (*types.Operation, error) {
+	return s.operations.get(id)
 }
 
-func (s *NomadJobService) CreateJob(name string, targetURL string, isScript bool) (*types.CreateJobOutput, error) {
-	jobID := fmt.Sprintf(slugify(name) + "%s", uuid.New().String())
+func (s *NomadJobService) createJob(jobID string, input types.CreateJobInput, spec types.JobSpec) error {
+	namespace := namespaceOf(input.Project)
+	if err := s.ensureNamespace(namespace); err != nil {
+		return err
+	}
+	s.setNamespace(jobID, namespace)
 
-	job := s.createNomadJobSpec(jobID, targetURL, isScript)
+	job := s.createNomadJobSpec(jobID, input, spec)
+
+	// Watch before submitting so that no allocation event can be missed
+	ready := s.watchReadiness(jobID, 0)
+	defer s.unwatchReadiness(jobID)
 
 	_, err := s.submitJob(job)
 	if err != nil {
-		return nil, fmt.Errorf("failed to submit job: %w", err)
+		return fmt.Errorf("failed to submit job: %w", err)
 	}
 
-	_, port, err := s.waitForServiceURL(jobID)
+	s.operations.progress(jobID, types.OperationStateScheduling)
+
+	backends, err := s.waitForBackends(context.Background(), jobID, 0, ready)
 	if err != nil {
 		_ = s.PurgeJob(jobID)
-		return nil, fmt.Errorf("job submitted but failed to get service URL: %w", err)
+		return fmt.Errorf("job submitted but failed to get service URL: %w", err)
+	}
+
+	now := time.Now().UTC()
+	service := &types.Service{
+		Name:        input.Name,
+		JobID:       jobID,
+		SourceURL:   input.TargetURL,
+		Mode:        input.Mode(),
+		ContentType: input.ContentType,
+		SPA:         input.SPA,
+		Git:         input.Git,
+		SHA256:      input.SHA256,
+		Signature:   input.Signature,
+		Project:     input.Project,
+		Owner:       input.Owner,
+		Spec:        spec,
+		Backends:    backends,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		ExpiresAt:   input.ExpiresAt,
+	}
+	if err := s.store.SaveService(service); err != nil {
+		_ = s.PurgeJob(jobID)
+		return fmt.Errorf("failed to save service: %w", err)
+	}
+
+	s.logger.Info("Job created successfully", "job_id", jobID, "backends", len(backends))
+
+	s.addJob(service)
+
+	return nil
+}
+
+// updateJob registers the new spec under the existing job ID and waits for the replacing allocations.
+// On failure the job is left to Nomad and the stored spec is unchanged so the update can be retried.
+func (s *NomadJobService) updateJob(service *types.Service, input types.CreateJobInput, spec types.JobSpec) error {
+	current, _, err := s.client.Jobs().Info(service.JobID, s.queryOptions(service.JobID))
+	if err != nil {
+		return fmt.Errorf("failed to get job %s: %w", service.JobID, err)
+	}
+
+	// Allocations of the new version are created after the current version of the job
+	var minIndex uint64
+	if current.ModifyIndex != nil {
+		minIndex = *current.ModifyIndex + 1
+	}
+
+	// The job meta keeps the current expiry when the update does not change it
+	if input.ExpiresAt.IsZero() {
+		input.ExpiresAt = service.ExpiresAt
+	}
+	job := s.createNomadJobSpec(service.JobID, input, spec)
+
+	ready := s.watchReadiness(service.JobID, minIndex)
+	defer s.unwatchReadiness(service.JobID)
+
+	_, err = s.submitJob(job)
+	if err != nil {
+		return fmt.Errorf("failed to submit job update: %w", err)
+	}
+
+	s.operations.progress(service.JobID, types.OperationStateScheduling)
+
+	backends, err := s.waitForBackends(context.Background(), service.JobID, minIndex, ready)
+	if err != nil {
+		s.rollbackJob(current)
+		return fmt.Errorf("job updated but failed to get service URL: %w", err)
+	}
+
+	previous := *service
+	service.SourceURL = input.TargetURL
+	service.Mode = input.Mode()
+	service.ContentType = input.ContentType
+	service.SPA = input.SPA
+	service.Git = input.Git
+	service.SHA256 = input.SHA256
+	service.Signature = input.Signature
+	service.Spec = spec
+	service.Backends = backends
+	service.Sleeping = false
+	service.UpdatedAt = time.Now().UTC()
+	if !input.ExpiresAt.IsZero() {
+		service.ExpiresAt = input.ExpiresAt
+	}
+	if err := s.store.SaveService(service); err != nil {
+		*service = previous
+		s.rollbackJob(current)
+		return fmt.Errorf("failed to save service: %w", err)
+	}
+
+	s.setBackends(service.JobID, backends)
+
+	s.logger.Info("Job updated successfully", "job_id", service.JobID, "backends", len(backends))
+
+	return nil
+}
+
+// rollbackJob registers the previous version of a job whose update failed, so that Nomad runs the spec
+// that is still in the store
+func (s *NomadJobService) rollbackJob(previous *api.Job) {
+	if _, err := s.submitJob(previous); err != nil {
+		s.logger.Error("failed to roll back job update", "job_id", *previous.ID, "error", err)
+		return
+	}
+
+	s.logger.Warn("job update failed, previous version registered again", "job_id", *previous.ID)
+}
+
+func (s *NomadJobService) GetService(project, name string) (*types.ServiceOutput, error) {
+	service, err := findService(s.store, project, name)
+	if err != nil {
+		return nil, err
 	}
 
-	s.logger.Info("Job created successfully", "job_id", jobID, "port", port)
+	return s.serviceOutput(service), nil
+}
+
+// ExtendService pushes back the expiry of the service
+func (s *NomadJobService) ExtendService(project, name string, input types.ExtendServiceInput) (*types.ServiceOutput, error) {
+	service, err := extendService(s.store, &s.nameLocks, project, name, input)
+	if err != nil {
+		return nil, err
+	}
 
-	s.rwMutex.Lock()
-	s.jobIdToPort[jobID] = port
-	s.rwMutex.Unlock()
+	s.logger.Info("service lifetime extended", "job_id", service.JobID, "expires_at", service.ExpiresAt)
 
-	return &types.CreateJobOutput{
-		URL: fmt.Sprintf("http://%s.%s", jobID, s.host),
-	}, nil
+	return s.serviceOutput(service), nil
 }
 
-func (s *NomadJobService) createNomadJobSpec(jobID, targetURL string, isScript bool) *api.Job {
-	job := api.NewServiceJob(jobID, jobID, "global", 1)
-	job.Datacenters = []string{"dc1"}
+// ReapExpired purges the services whose expiry is past
+func (s *NomadJobService) ReapExpired() error {
+	return reapExpired(s.store, &s.nameLocks, s.PurgeJob, s.logger)
+}
 
-	group := api.NewTaskGroup("web", 1)
+// RunReaper purges the expired services every interval until the context is done
+func (s *NomadJobService) RunReaper(ctx context.Context, interval time.Duration) {
+	runReaper(ctx, interval, s.ReapExpired, s.logger)
+}
+
+// findService returns the stored service with this name in the project, the most recent one wins
+// for services created before names were unique
+func findService(store types.ServiceStore, project, name string) (*types.Service, error) {
+	services, err := store.ListServices()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list services: %w", err)
+	}
+
+	for i := len(services) - 1; i >= 0; i-- {
+		if services[i].Project == project && services[i].Name == name {
+			return services[i], nil
+		}
+	}
+
+	return nil, types.ErrServiceNotFound
+}
+
+func (s *NomadJobService) ListServices() ([]*types.ServiceOutput, error) {
+	services, err := s.store.ListServices()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list services: %w", err)
+	}
+
+	outputs := make([]*types.ServiceOutput, 0, len(services))
+	for _, service := range services {
+		outputs = append(outputs, s.serviceOutput(service))
+	}
+
+	return outputs, nil
+}
+
+// RestartJob restarts the tasks of every running allocation of the job in place
+func (s *NomadJobService) RestartJob(jobID string) error {
+	allocs, _, err := s.client.Jobs().Allocations(jobID, false, s.queryOptions(jobID))
+	if err != nil {
+		return fmt.Errorf("failed to get allocations for job %s: %w", jobID, err)
+	}
+
+	restarted := 0
+	for _, stub := range allocs {
+		if stub.ClientStatus != api.AllocClientStatusRunning {
+			continue
+		}
+
+		alloc, _, err := s.client.Allocations().Info(stub.ID, s.queryOptions(jobID))
+		if err != nil {
+			return fmt.Errorf("failed to get allocation %s: %w", stub.ID, err)
+		}
+
+		if err := s.client.Allocations().Restart(alloc, "", s.queryOptions(jobID)); err != nil {
+			return fmt.Errorf("failed to restart allocation %s: %w", stub.ID, err)
+		}
+		restarted++
+	}
+
+	if restarted == 0 {
+		return fmt.Errorf("no running allocation found for job %s", jobID)
+	}
+
+	s.logger.Info("job restarted", "job_id", jobID, "allocations", restarted)
+
+	return nil
+}
+
+func (s *NomadJobService) serviceOutput(service *types.Service) *types.ServiceOutput {
+	status := types.ServiceStatusSleeping
+	if !service.Sleeping {
+		status = s.jobStatus(service.JobID)
+	}
+
+	return &types.ServiceOutput{
+		Name:        service.Name,
+		JobID:       service.JobID,
+		Status:      status,
+		URL:         s.serviceURL(service.Project, service.Name),
+		Mode:        service.Mode,
+		SourceURL:   service.SourceURL,
+		ContentType: service.ContentType,
+		SPA:         service.SPA,
+		Git:         service.Git,
+		SHA256:      service.SHA256,
+		Signature:   service.Signature,
+		Project:     service.Project,
+		Owner:       service.Owner,
+		Replicas:    max(service.Spec.Replicas, 1),
+		CreatedAt:   service.CreatedAt,
+		UpdatedAt:   service.UpdatedAt,
+		ExpiresAt:   service.ExpiresAt,
+	}
+}
+
+// jobStatus summarizes the client status of the allocations of a job
+func (s *NomadJobService) jobStatus(jobID string) string {
+	allocs, _, err := s.client.Jobs().Allocations(jobID, false, s.queryOptions(jobID))
+	if err != nil {
+		s.logger.Warn("unable to get allocations", "job_id", jobID, "error", err)
+		return types.ServiceStatusUnknown
+	}
+
+	status := types.ServiceStatusStopped
+	for _, alloc := range allocs {
+		switch alloc.ClientStatus {
+		case api.AllocClientStatusRunning:
+			return types.ServiceStatusRunning
+		case api.AllocClientStatusPending:
+			status = types.ServiceStatusPending
+		case api.AllocClientStatusFailed, api.AllocClientStatusLost:
+			if status == types.ServiceStatusStopped {
+				status = types.ServiceStatusFailed
+			}
+		}
+	}
+
+	return status
+}
+
+func (s *NomadJobService) serviceURL(project, name string) string {
+	return fmt.Sprintf("http://%s.%s", subdomain(project, name), s.host)
+}
+
+func (s *NomadJobService) createNomadJobSpec(jobID string, input types.CreateJobInput, spec types.JobSpec) *api.Job {
+	job := api.NewServiceJob(jobID, jobID, spec.Region, 1)
+	replicas := max(spec.Replicas, 1)
+	job.Datacenters = spec.Datacenters
+
+	// Each project has its own namespace so that its jobs are isolated from the other projects
+	job.Namespace = toPtr(namespaceOf(input.Project))
+
+	// Meta allows to find back the jobs owned by the API when the local state is lost
+	job.SetMeta(metaManagedBy, metaManagedByValue)
+	job.SetMeta(metaServiceName, input.Name)
+	job.SetMeta(metaSourceURL, input.TargetURL)
+	job.SetMeta(metaServiceMode, string(input.Mode()))
+	job.SetMeta(metaContentType, input.ContentType)
+	job.SetMeta(metaSPA, strconv.FormatBool(input.SPA))
+	job.SetMeta(metaSHA256, input.SHA256)
+	job.SetMeta(metaSignature, input.Signature)
+	if input.Git != nil {
+		job.SetMeta(metaGitRef, input.Git.Ref)
+		job.SetMeta(metaGitCommit, input.Git.Commit)
+		job.SetMeta(metaGitPath, input.Git.Path)
+		job.SetMeta(metaGitEntrypoint, input.Git.Entrypoint)
+	}
+	job.SetMeta(metaProject, input.Project)
+	job.SetMeta(metaOwner, input.Owner)
+	if !input.ExpiresAt.IsZero() {
+		job.SetMeta(metaExpiresAt, input.ExpiresAt.UTC().Format(time.RFC3339))
+	}
+
+	group := api.NewTaskGroup(taskGroupName, replicas)
 
 	task := api.NewTask("koyeb-nginx", "docker")
 	task.Config = map[string]interface{}{
-		"image": "alexisvisco/koyeb-nginx",
+		"image": spec.Image,
 		"port_map": []map[string]int{
 			{"http": 80},
 		},
 	}
 
 	task.Env = map[string]string{
-		"URL":       targetURL,
-		"IS_SCRIPT": strconv.FormatBool(isScript),
+		"URL":       input.TargetURL,
+		"IS_SCRIPT": strconv.FormatBool(input.IsScript),
+		"ARCHIVE":   strconv.FormatBool(input.Archive),
+		"SPA":       strconv.FormatBool(input.SPA),
+	}
+	if input.ContentType != "" {
+		task.Env["CONTENT_TYPE"] = input.ContentType
+	}
+	if input.Git != nil {
+		task.Env["GIT"] = "true"
+		task.Env["GIT_REF"] = input.Git.Ref
+		task.Env["GIT_COMMIT"] = input.Git.Commit
+		task.Env["GIT_PATH"] = input.Git.Path
+		task.Env["GIT_ENTRYPOINT"] = input.Git.Entrypoint
+	}
+	if input.SHA256 != "" {
+		task.Env["SHA256"] = input.SHA256
+	}
+	if input.Signature != "" {
+		task.Env["SIGNATURE"] = input.Signature
+		task.Env["SIGNATURE_PUBLIC_KEY"] = integrity.EncodePublicKey(s.signatureKey)
+	}
+	if s.sourcePolicy != nil {
+		task.Env["SOURCE_POLICY"] = s.sourcePolicy.String()
+	}
+	for name, value := range s.jobConfig.InitEnv() {
+		task.Env[name] = value
 	}
 
 	task.Resources = &api.Resources{
-		CPU:      toPtr[int](100), // 100 MHz
-		MemoryMB: toPtr[int](128), // 128 MB
+		CPU:      toPtr[int](spec.Resources.CPU),      // MHz
+		MemoryMB: toPtr[int](spec.Resources.MemoryMB), // MB
 		Networks: []*api.NetworkResource{
 			{
-				MBits: toPtr[int](10), // 10 Mbits
+				MBits: toPtr[int](spec.Resources.NetworkMBits), // Mbits
 				DynamicPorts: []api.Port{
 					{Label: "http"},
 				},
@@ -113,7 +652,7 @@ func (s *NomadJobService) createNomadJobSpec(jobID, targetURL string, isScript b
 func (s *NomadJobService) submitJob(job *api.Job) (*api.JobRegisterResponse, error) {
 	jobs := s.client.Jobs()
 
-	resp, _, err := jobs.Register(job, nil)
+	resp, _, err := jobs.Register(job, &api.WriteOptions{Namespace: *job.Namespace})
 	if err != nil {
 		return nil, err
 	}
@@ -121,87 +660,93 @@ func (s *NomadJobService) submitJob(job *api.Job) (*api.JobRegisterResponse, err
 	return resp, nil
 }
 
-func (s *NomadJobService) waitForServiceURL(jobID string) (string, int, error) {
-	for i := 0; i < 30; i++ {
-		netIp, port, err := s.getServiceURL(jobID)
-		if err == nil {
-			return netIp, port, nil
+// waitForBackends waits for the event loop to report the job as running or failed, then returns
+// the replicas already running. When the deadline is reached the allocations are checked one
+// last time in case the stream missed the event.
+func (s *NomadJobService) waitForBackends(ctx context.Context, jobID string, minIndex uint64, ready <-chan readiness) ([]types.Backend, error) {
+	timer := time.NewTimer(s.readyTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-ready:
+		if r.err != nil {
+			return nil, r.err
 		}
 
-		time.Sleep(250 * time.Millisecond)
+		// The other replicas are added by the event loop as they start
+		backends, err := s.runningBackends(jobID, minIndex)
+		if err != nil || !slices.Contains(backends, r.backend) {
+			backends = append(backends, r.backend)
+		}
+		return backends, nil
+	case <-timer.C:
 	}
 
-	return "", 0, fmt.Errorf("failed to get service URL for job %s after retries", jobID)
-}
-
-func (s *NomadJobService) getServiceURL(jobID string) (string, int, error) {
-	jobs := s.client.Jobs()
-
-	allocs, _, err := jobs.Allocations(jobID, false, nil)
-	if err != nil {
-		return "", 0, fmt.Errorf("failed to get allocations for job %s: %w", jobID, err)
+	backends, err := s.runningBackends(jobID, minIndex)
+	if err == nil {
+		return backends, nil
 	}
 
-	for _, alloc := range allocs {
-		if alloc.ClientStatus == "running" {
-			// Get allocation details
-			allocsAPI := s.client.Allocations()
-			allocDetail, _, err := allocsAPI.Info(alloc.ID, nil)
-			if err != nil {
-				continue
-			}
-
-			// Extract the reserved port
-			if allocDetail.Resources != nil && allocDetail.Resources.Networks != nil {
-				for _, network := range allocDetail.Resources.Networks {
-					for _, port := range network.DynamicPorts {
-						if port.Label == "http" {
-							return network.IP, port.Value, nil
-						}
-					}
-				}
-			}
-		}
-	}
-
-	return "", 0, fmt.Errorf("no running allocation found for job %s", jobID)
+	return nil, fmt.Errorf("job %s is not running after %s: %w", jobID, s.readyTimeout, err)
 }
 
 func (s *NomadJobService) PurgeJob(jobID string) error {
 	jobs := s.client.Jobs()
 
 	// Stop and purge the job
-	_, _, err := jobs.Deregister(jobID, true, nil)
+	_, _, err := jobs.Deregister(jobID, true, s.writeOptions(jobID))
 	if err != nil {
 		return fmt.Errorf("failed to deregister job %s: %w", jobID, err)
 	}
 
-	// Clean up the internal port mapping
-	s.rwMutex.Lock()
-	delete(s.jobIdToPort, jobID)
-	s.rwMutex.Unlock()
+	// Clean up the routing table
+	s.dropJob(jobID)
+
+	if err := s.store.DeleteService(jobID); err != nil && !errors.Is(err, types.ErrServiceNotFound) {
+		return fmt.Errorf("failed to delete service %s from store: %w", jobID, err)
+	}
 
 	s.logger.Info("jobs purged", "job_id", jobID)
 
 	return nil
 }
 
+// Close rejects the new creations and applies the shutdown policy to the jobs
 func (s *NomadJobService) Close() error {
+	err := shutdown(s.shutdownPolicy, &s.creations, s.drainTimeout, s.jobIDs, s.PurgeJob)
+
+	if s.shutdownPolicy != ShutdownPolicyPurge {
+		s.logger.Info("leaving jobs running", "shutdown_policy", s.shutdownPolicy, "count", len(s.jobIDs()))
+	}
+
+	return err
+}
+
+// jobIDs lists the jobs of the routing table
+func (s *NomadJobService) jobIDs() []string {
 	s.rwMutex.RLock()
-	jobIDs := make([]string, 0, len(s.jobIdToPort))
-	for j := range s.jobIdToPort {
+	defer s.rwMutex.RUnlock()
+
+	jobIDs := make([]string, 0, len(s.jobBackends))
+	for j := range s.jobBackends {
 		jobIDs = append(jobIDs, j)
 	}
-	s.rwMutex.RUnlock()
 
-	var errs error
-	for _, jid := range jobIDs {
-		if err := s.PurgeJob(jid); err != nil {
-			errs = errors.Join(errs, err)
-		}
-	}
+	return jobIDs
+}
 
-	return errs
+// sameSpec reports whether the stored service already matches the requested one
+func sameSpec(service *types.Service, input types.CreateJobInput, spec types.JobSpec) bool {
+	return service.SourceURL == input.TargetURL &&
+		service.Mode == input.Mode() &&
+		service.ContentType == input.ContentType &&
+		service.SPA == input.SPA &&
+		reflect.DeepEqual(service.Git, input.Git) &&
+		service.SHA256 == input.SHA256 &&
+		service.Signature == input.Signature &&
+		reflect.DeepEqual(service.Spec, spec)
 }
 
 func toPtr[T any](v T) *T {
@@ -0,0 +1,403 @@
+package service
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexisvisco/koyebtests/internal/config"
+	"github.com/alexisvisco/koyebtests/internal/integrity"
+	"github.com/alexisvisco/koyebtests/internal/netguard"
+	"github.com/alexisvisco/koyebtests/internal/store"
+	"github.com/alexisvisco/koyebtests/internal/types"
+	"github.com/hashicorp/nomad/api"
+)
+
+func TestCreateJobSameSpecReturnsExistingService(t *testing.T) {
+	spec, _ := config.Default().Job.Resolve(types.CreateJobInput{})
+
+	serviceStore := store.NewMemoryStore()
+	now := time.Now().UTC()
+	_ = serviceStore.SaveService(&types.Service{Name: "svc", Project: "default", JobID: "svc-job", SourceURL: "http://example.com", Mode: types.ServiceModeScript, Spec: spec, Backends: []types.Backend{{AllocID: "alloc-1", IP: "10.0.0.12", Port: 20000}}, CreatedAt: now, UpdatedAt: now})
+
+	s, _ := newTestNomadJobService(t, serviceStore)
+
+	out, err := s.CreateJob(types.CreateJobInput{Name: "svc", TargetURL: "http://example.com", IsScript: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if out.URL != "http://svc.default.example.com" {
+		t.Fatalf("expected the existing service URL, got %s", out.URL)
+	}
+
+	services, _ := serviceStore.ListServices()
+	if len(services) != 1 {
+		t.Fatalf("expected no new service, got %d services", len(services))
+	}
+}
+
+func TestCreateJobAsyncDoesNotWaitForOperationInFlight(t *testing.T) {
+	spec, _ := config.Default().Job.Resolve(types.CreateJobInput{})
+
+	serviceStore := store.NewMemoryStore()
+	now := time.Now().UTC()
+	_ = serviceStore.SaveService(&types.Service{Name: "svc", Project: "default", JobID: "svc-job", SourceURL: "http://example.com", Mode: types.ServiceModeScript, Spec: spec, CreatedAt: now, UpdatedAt: now})
+
+	s, _ := newTestNomadJobService(t, serviceStore)
+
+	// A creation of the service is in flight
+	unlock := s.nameLocks.Lock(subdomain("default", "svc"))
+	defer unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.CreateJob(types.CreateJobInput{Name: "svc", TargetURL: "http://example.com/other", Async: true})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, types.ErrOperationInProgress) {
+			t.Fatalf("expected %v, got %v", types.ErrOperationInProgress, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the async creation not to wait for the operation in flight")
+	}
+}
+
+func TestCreateJobAsyncSameSpecHasNoOperation(t *testing.T) {
+	spec, _ := config.Default().Job.Resolve(types.CreateJobInput{})
+
+	serviceStore := store.NewMemoryStore()
+	now := time.Now().UTC()
+	_ = serviceStore.SaveService(&types.Service{Name: "svc", Project: "default", JobID: "svc-job", SourceURL: "http://example.com", Mode: types.ServiceModeScript, Spec: spec, CreatedAt: now, UpdatedAt: now})
+
+	s, _ := newTestNomadJobService(t, serviceStore)
+
+	out, err := s.CreateJob(types.CreateJobInput{Name: "svc", TargetURL: "http://example.com", IsScript: true, Async: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.OperationID != "" || out.URL != "http://svc.default.example.com" {
+		t.Fatalf("expected the existing URL without operation, got %+v", out)
+	}
+}
+
+// newUpdateTest stores a static service on job-1 and returns a service whose fake Nomad knows its job
+func newUpdateTest(t *testing.T, serviceStore types.ServiceStore) (*NomadJobService, *fakeNomad, *fakeEventSource) {
+	t.Helper()
+
+	spec, _ := config.Default().Job.Resolve(types.CreateJobInput{})
+	now := time.Now().UTC()
+	_ = serviceStore.SaveService(&types.Service{Name: "svc", Project: "default", JobID: "job-1", SourceURL: "http://example.com/old", Mode: types.ServiceModeStatic, Spec: spec, CreatedAt: now, UpdatedAt: now})
+
+	nomad := newFakeNomad(t, map[string]any{
+		"/v1/job/job-1": &api.Job{ID: toPtr("job-1"), Namespace: toPtr("default"), ModifyIndex: toPtr[uint64](10)},
+		"/v1/jobs":      &api.JobRegisterResponse{},
+	})
+
+	events := newFakeEventSource()
+	s, err := NewNomadJobService(NomadJobServiceParams{Host: "example.com", Client: nomad.client, Store: serviceStore, Events: events})
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go s.RunEventLoop(ctx)
+
+	return s, nomad, events
+}
+
+func TestCreateJobUpdatesChangedSpec(t *testing.T) {
+	serviceStore := store.NewMemoryStore()
+	s, nomad, events := newUpdateTest(t, serviceStore)
+
+	type result struct {
+		out *types.CreateJobOutput
+		err error
+	}
+	done := make(chan result)
+	go func() {
+		out, err := s.CreateJob(types.CreateJobInput{Name: "svc", TargetURL: "http://example.com/new", IsScript: true})
+		done <- result{out, err}
+	}()
+
+	eventually(t, func() bool { return len(nomad.registeredJobs()) == 1 })
+	alloc := runningAllocation("job-1", 25000)
+	alloc.CreateIndex = 11
+	events.send(t, allocationEvent(t, alloc))
+
+	r := <-done
+	if r.err != nil {
+		t.Fatalf("unexpected error: %v", r.err)
+	}
+	if r.out.URL != "http://svc.default.example.com" {
+		t.Fatalf("expected the same subdomain, got %s", r.out.URL)
+	}
+
+	// The job is updated in place
+	if registered := nomad.registeredJobs(); *registered[0].ID != "job-1" {
+		t.Fatalf("expected job-1 to be registered again, got %s", *registered[0].ID)
+	}
+
+	service, err := serviceStore.GetService("job-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if service.SourceURL != "http://example.com/new" || service.Mode != types.ServiceModeScript {
+		t.Fatalf("expected the new spec to be stored, got %s in %s mode", service.SourceURL, service.Mode)
+	}
+	if len(service.Backends) != 1 || service.Backends[0].Port != 25000 {
+		t.Fatalf("expected the new allocation as backend, got %+v", service.Backends)
+	}
+}
+
+func TestCreateJobUpdateFailureRegistersPreviousVersion(t *testing.T) {
+	serviceStore := store.NewMemoryStore()
+	s, nomad, events := newUpdateTest(t, serviceStore)
+
+	done := make(chan error)
+	go func() {
+		_, err := s.CreateJob(types.CreateJobInput{Name: "svc", TargetURL: "http://example.com/new", IsScript: true})
+		done <- err
+	}()
+
+	eventually(t, func() bool { return len(nomad.registeredJobs()) == 1 })
+	failed := runningAllocation("job-1", 0)
+	failed.CreateIndex = 11
+	failed.ClientStatus = api.AllocClientStatusFailed
+	failed.TaskStates = map[string]*api.TaskState{
+		"koyeb-init": {State: "dead", Failed: true, Events: []*api.TaskEvent{{Type: "Driver Failure", DriverError: "download failed"}}},
+	}
+	events.send(t, allocationEvent(t, failed))
+
+	if err := <-done; err == nil {
+		t.Fatal("expected the update to fail")
+	}
+
+	// Nomad runs the version of the job that matches the stored service again
+	registered := nomad.registeredJobs()
+	if len(registered) != 2 || registered[1].ModifyIndex == nil || *registered[1].ModifyIndex != 10 {
+		t.Fatalf("expected the previous version to be registered again, got %d registrations", len(registered))
+	}
+
+	service, _ := serviceStore.GetService("job-1")
+	if service.SourceURL != "http://example.com/old" || service.Mode != types.ServiceModeStatic {
+		t.Fatalf("expected the previous spec to stay stored, got %s in %s mode", service.SourceURL, service.Mode)
+	}
+}
+
+func TestCreateJobRejectsNameSharingSubdomain(t *testing.T) {
+	spec, _ := config.Default().Job.Resolve(types.CreateJobInput{})
+
+	serviceStore := store.NewMemoryStore()
+	now := time.Now().UTC()
+	_ = serviceStore.SaveService(&types.Service{Name: "My App", Project: "default", JobID: "my-app-job", SourceURL: "http://example.com", Mode: types.ServiceModeScript, Spec: spec, CreatedAt: now, UpdatedAt: now})
+
+	s, _ := newTestNomadJobService(t, serviceStore)
+
+	_, err := s.CreateJob(types.CreateJobInput{Name: "my-app", TargetURL: "http://example.com", IsScript: true})
+	if !errors.Is(err, types.ErrServiceNameTaken) {
+		t.Fatalf("expected %v, got %v", types.ErrServiceNameTaken, err)
+	}
+
+	out, err := s.CreateJob(types.CreateJobInput{Name: "My App", TargetURL: "http://example.com", IsScript: true})
+	if err != nil {
+		t.Fatalf("unexpected error for the same name: %v", err)
+	}
+	if out.URL != "http://my-app.default.example.com" {
+		t.Fatalf("expected the existing service URL, got %s", out.URL)
+	}
+
+	if jobID, ok := s.ResolveSubdomain("default", "my-app"); !ok || jobID != "my-app-job" {
+		t.Fatalf("expected the subdomain to resolve to my-app-job, got %q", jobID)
+	}
+}
+
+func TestCreateJobRejectsResourcesAboveLimits(t *testing.T) {
+	s, _ := newTestNomadJobService(t, store.NewMemoryStore())
+
+	_, err := s.CreateJob(types.CreateJobInput{Name: "svc", TargetURL: "http://example.com", Resources: types.Resources{MemoryMB: 1 << 20}})
+
+	var validationErr *types.ValidationError
+	if !errors.As(err, &validationErr) || validationErr.Field != "resources.memory_mb" {
+		t.Fatalf("expected a validation error on memory, got %v", err)
+	}
+}
+
+func TestCreateJobRejectsWhenQuotaExceeded(t *testing.T) {
+	spec, _ := config.Default().Job.Resolve(types.CreateJobInput{InstanceType: "medium"})
+
+	serviceStore := store.NewMemoryStore()
+	now := time.Now().UTC()
+	_ = serviceStore.SaveService(&types.Service{Name: "existing", JobID: "existing-job", SourceURL: "http://example.com", Mode: types.ServiceModeStatic, Spec: spec, CreatedAt: now, UpdatedAt: now})
+
+	events := newFakeEventSource()
+	s, err := NewNomadJobService(NomadJobServiceParams{
+		Host:   "example.com",
+		Store:  serviceStore,
+		Events: events,
+		Quota:  config.QuotaConfig{MaxMemoryMB: 700},
+	})
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	_, err = s.CreateJob(types.CreateJobInput{Name: "svc", TargetURL: "http://example.com", InstanceType: "small"})
+	if !errors.Is(err, types.ErrQuotaExceeded) {
+		t.Fatalf("expected quota exceeded, got %v", err)
+	}
+}
+
+func TestCreateJobRejectsWhenProjectQuotaExceeded(t *testing.T) {
+	spec, _ := config.Default().Job.Resolve(types.CreateJobInput{})
+
+	serviceStore := store.NewMemoryStore()
+	now := time.Now().UTC()
+	_ = serviceStore.SaveService(&types.Service{Name: "existing", Project: "team-a", JobID: "existing-job", SourceURL: "http://example.com", Mode: types.ServiceModeStatic, Spec: spec, CreatedAt: now, UpdatedAt: now})
+	_ = serviceStore.SaveService(&types.Service{Name: "existing", Project: "team-b", JobID: "other-job", SourceURL: "http://example.com", Mode: types.ServiceModeStatic, Spec: spec, CreatedAt: now, UpdatedAt: now})
+
+	s, err := NewNomadJobService(NomadJobServiceParams{
+		Host:         "example.com",
+		Store:        serviceStore,
+		Events:       newFakeEventSource(),
+		Quota:        config.QuotaConfig{MaxServices: 3},
+		ProjectQuota: config.QuotaConfig{MaxServices: 1},
+	})
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	_, err = s.CreateJob(types.CreateJobInput{Name: "svc", Project: "team-a", TargetURL: "http://example.com"})
+	if !errors.Is(err, types.ErrQuotaExceeded) || !strings.HasSuffix(err.Error(), "in project team-a") {
+		t.Fatalf("expected the quota of the project to be exceeded, got %v", err)
+	}
+}
+
+func TestCreateNomadJobSpecSourcePolicy(t *testing.T) {
+	policy, err := netguard.ParsePolicy([]byte(`{"allowed_domains":["*.example.com"]}`))
+	if err != nil {
+		t.Fatalf("failed to parse policy: %v", err)
+	}
+
+	s := &NomadJobService{sourcePolicy: policy}
+	spec, _ := config.Default().Job.Resolve(types.CreateJobInput{})
+
+	job := s.createNomadJobSpec("job-1", types.CreateJobInput{Name: "svc", TargetURL: "https://cdn.example.com"}, spec)
+
+	env := job.TaskGroups[0].Tasks[0].Env
+	if env["SOURCE_POLICY"] != `{"allowed_domains":["*.example.com"]}` {
+		t.Fatalf("expected the policy in the task environment, got %q", env["SOURCE_POLICY"])
+	}
+}
+
+func TestCreateNomadJobSpecInitLimits(t *testing.T) {
+	jobConfig := config.Default().Job
+	jobConfig.Download.MaxSize = 1 << 20
+	jobConfig.Download.Timeout = "5s"
+	jobConfig.Archive.MaxFiles = 100
+
+	s := &NomadJobService{jobConfig: jobConfig}
+	spec, _ := jobConfig.Resolve(types.CreateJobInput{})
+
+	job := s.createNomadJobSpec("job-1", types.CreateJobInput{Name: "svc", TargetURL: "https://example.com"}, spec)
+
+	env := job.TaskGroups[0].Tasks[0].Env
+	if env["MAX_DOWNLOAD_SIZE"] != "1048576" || env["DOWNLOAD_TIMEOUT"] != "5s" || env["DOWNLOAD_RETRIES"] != "3" || env["MAX_REDIRECTS"] != "10" ||
+		env["MAX_ARCHIVE_FILES"] != "100" || env["MAX_EXTRACTED_SIZE"] != "536870912" {
+		t.Fatalf("expected the download and archive limits in the task environment, got %v", env)
+	}
+}
+
+func TestCreateNomadJobSpecContentType(t *testing.T) {
+	s := &NomadJobService{}
+	spec, _ := config.Default().Job.Resolve(types.CreateJobInput{})
+
+	job := s.createNomadJobSpec("job-1", types.CreateJobInput{Name: "svc", TargetURL: "https://example.com", ContentType: "text/html; charset=utf-8"}, spec)
+
+	if env := job.TaskGroups[0].Tasks[0].Env; env["CONTENT_TYPE"] != "text/html; charset=utf-8" {
+		t.Fatalf("expected the content type in the task environment, got %q", env["CONTENT_TYPE"])
+	}
+	if job.Meta[metaContentType] != "text/html; charset=utf-8" {
+		t.Fatalf("expected the content type in the job meta, got %q", job.Meta[metaContentType])
+	}
+
+	job = s.createNomadJobSpec("job-1", types.CreateJobInput{Name: "svc", TargetURL: "https://example.com"}, spec)
+	if _, ok := job.TaskGroups[0].Tasks[0].Env["CONTENT_TYPE"]; ok {
+		t.Fatal("expected no content type when it is detected")
+	}
+}
+
+func TestCreateNomadJobSpecArchive(t *testing.T) {
+	s := &NomadJobService{}
+	spec, _ := config.Default().Job.Resolve(types.CreateJobInput{})
+
+	job := s.createNomadJobSpec("job-1", types.CreateJobInput{Name: "svc", TargetURL: "https://example.com/site.tar.gz", Archive: true, SPA: true}, spec)
+
+	if env := job.TaskGroups[0].Tasks[0].Env; env["ARCHIVE"] != "true" || env["SPA"] != "true" || env["IS_SCRIPT"] != "false" {
+		t.Fatalf("expected a single page application archive in the task environment, got %v", env)
+	}
+	if job.Meta[metaSPA] != "true" {
+		t.Fatalf("expected spa in the job meta, got %q", job.Meta[metaSPA])
+	}
+	if job.Meta[metaServiceMode] != string(types.ServiceModeArchive) {
+		t.Fatalf("expected the archive mode in the job meta, got %q", job.Meta[metaServiceMode])
+	}
+}
+
+func TestCreateNomadJobSpecGit(t *testing.T) {
+	s := &NomadJobService{}
+	spec, _ := config.Default().Job.Resolve(types.CreateJobInput{})
+
+	git := &types.GitSource{URL: "https://example.com/site.git", Ref: "main", Commit: strings.Repeat("a1", 20), Path: "app", Entrypoint: "run.sh"}
+	job := s.createNomadJobSpec("job-1", types.CreateJobInput{Name: "svc", TargetURL: git.URL, IsScript: true, Git: git}, spec)
+
+	env := job.TaskGroups[0].Tasks[0].Env
+	if env["GIT"] != "true" || env["IS_SCRIPT"] != "true" || env["URL"] != git.URL {
+		t.Fatalf("expected a git script in the task environment, got %v", env)
+	}
+	if env["GIT_REF"] != "main" || env["GIT_COMMIT"] != git.Commit || env["GIT_PATH"] != "app" || env["GIT_ENTRYPOINT"] != "run.sh" {
+		t.Fatalf("expected the git source in the task environment, got %v", env)
+	}
+	if job.Meta[metaServiceMode] != string(types.ServiceModeGit) || job.Meta[metaGitCommit] != git.Commit {
+		t.Fatalf("expected the git mode and commit in the job meta, got %v", job.Meta)
+	}
+}
+
+func TestCreateNomadJobSpecIntegrity(t *testing.T) {
+	publicKey, _, _ := ed25519.GenerateKey(nil)
+	s := &NomadJobService{signatureKey: publicKey}
+	spec, _ := config.Default().Job.Resolve(types.CreateJobInput{})
+
+	digest := strings.Repeat("ab", 32)
+	job := s.createNomadJobSpec("job-1", types.CreateJobInput{Name: "svc", TargetURL: "https://example.com", SHA256: digest, Signature: "c2ln"}, spec)
+
+	env := job.TaskGroups[0].Tasks[0].Env
+	if env["SHA256"] != digest || env["SIGNATURE"] != "c2ln" || env["SIGNATURE_PUBLIC_KEY"] != integrity.EncodePublicKey(publicKey) {
+		t.Fatalf("expected the digest, the signature and the key in the task environment, got %v", env)
+	}
+	if job.Meta[metaSHA256] != digest || job.Meta[metaSignature] != "c2ln" {
+		t.Fatalf("expected the digest and the signature in the job meta, got %v", job.Meta)
+	}
+
+	job = s.createNomadJobSpec("job-1", types.CreateJobInput{Name: "svc", TargetURL: "https://example.com"}, spec)
+	if _, ok := job.TaskGroups[0].Tasks[0].Env["SIGNATURE_PUBLIC_KEY"]; ok {
+		t.Fatal("expected no key when the source is not signed")
+	}
+}
+
+func TestCreateJobRejectsSignatureWithoutKey(t *testing.T) {
+	s, _ := newTestNomadJobService(t, store.NewMemoryStore())
+
+	_, err := s.CreateJob(types.CreateJobInput{Name: "svc", TargetURL: "http://example.com", Signature: "c2ln"})
+
+	var validationErr *types.ValidationError
+	if !errors.As(err, &validationErr) || validationErr.Field != "signature" {
+		t.Fatalf("expected a validation error on signature, got %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/alexisvisco/koyebtests/internal/types"
+	"github.com/hashicorp/nomad/api"
+)
+
+// allNamespaces lists and streams the jobs of every project
+const allNamespaces = "*"
+
+// namespaceOf returns the Nomad namespace isolating the jobs of a project
+func namespaceOf(project string) string {
+	if project == "" {
+		return types.DefaultProject
+	}
+	return project
+}
+
+// setNamespace records the namespace of a job, every Nomad call on the job must name it
+func (s *NomadJobService) setNamespace(jobID, namespace string) {
+	s.rwMutex.Lock()
+	s.jobNamespaces[jobID] = namespace
+	s.rwMutex.Unlock()
+}
+
+// namespace returns the namespace of the job, the default one for unknown jobs
+func (s *NomadJobService) namespace(jobID string) string {
+	s.rwMutex.RLock()
+	defer s.rwMutex.RUnlock()
+
+	if namespace, ok := s.jobNamespaces[jobID]; ok {
+		return namespace
+	}
+	return types.DefaultProject
+}
+
+func (s *NomadJobService) queryOptions(jobID string) *api.QueryOptions {
+	return &api.QueryOptions{Namespace: s.namespace(jobID)}
+}
+
+func (s *NomadJobService) writeOptions(jobID string) *api.WriteOptions {
+	return &api.WriteOptions{Namespace: s.namespace(jobID)}
+}
+
+// ensureNamespace creates the namespace of a project the first time a job is submitted to it.
+// Existing namespaces are left untouched so that the quotas set by the operators are kept.
+func (s *NomadJobService) ensureNamespace(namespace string) error {
+	if namespace == types.DefaultProject {
+		return nil
+	}
+
+	s.namespacesMutex.Lock()
+	defer s.namespacesMutex.Unlock()
+
+	if s.knownNamespaces[namespace] {
+		return nil
+	}
+
+	if _, _, err := s.client.Namespaces().Info(namespace, nil); err != nil {
+		_, err := s.client.Namespaces().Register(&api.Namespace{
+			Name:        namespace,
+			Description: "Services of the project " + namespace,
+		}, nil)
+		if err != nil {
+			return fmt.Errorf("failed to create namespace %s: %w", namespace, err)
+		}
+
+		s.logger.Info("namespace created", "namespace", namespace)
+	}
+
+	s.knownNamespaces[namespace] = true
+	return nil
+}
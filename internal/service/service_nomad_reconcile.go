@@ -0,0 +1,331 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/alexisvisco/koyebtests/internal/types"
+	"github.com/hashicorp/nomad/api"
+)
+
+// OrphanPolicy is what Reconcile does with the jobs owned by the API that are missing from the store
+type OrphanPolicy string
+
+const (
+	// OrphanPolicyAdopt saves the orphan jobs back in the store, it recovers from a lost store.
+	// Jobs that cannot be adopted because their name is taken are swept anyway.
+	OrphanPolicyAdopt OrphanPolicy = "adopt"
+
+	// OrphanPolicySweep deregisters the orphan jobs
+	OrphanPolicySweep OrphanPolicy = "sweep"
+)
+
+const (
+	metaManagedBy      = "managed_by"
+	metaManagedByValue = "koyebtests"
+	metaServiceName    = "service_name"
+	metaSourceURL      = "source_url"
+	metaServiceMode    = "service_mode"
+	metaContentType    = "content_type"
+	metaSPA            = "spa"
+	metaGitRef         = "git_ref"
+	metaGitCommit      = "git_commit"
+	metaGitPath        = "git_path"
+	metaGitEntrypoint  = "git_entrypoint"
+	metaSHA256         = "sha256"
+	metaSignature      = "signature"
+	metaProject        = "project"
+	metaOwner          = "owner"
+	metaExpiresAt      = "expires_at"
+)
+
+// RunReconciler reconciles the routing table with Nomad every interval until the context is done
+func (s *NomadJobService) RunReconciler(ctx context.Context, interval time.Duration) {
+	runEvery(ctx, interval, func() {
+		if err := s.Reconcile(); err != nil {
+			s.logger.Error("reconciliation failed", "error", err)
+		}
+	})
+}
+
+// runEvery calls fn every interval until the context is done
+func runEvery(ctx context.Context, interval time.Duration, fn func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fn()
+		}
+	}
+}
+
+// Reconcile rebuilds the routing table from the jobs owned by the API that are live in Nomad.
+// Jobs tagged with our meta but missing from the store are adopted or swept depending on the
+// orphan policy, services whose job disappeared are forgotten and backends are refreshed from
+// the running allocations.
+func (s *NomadJobService) Reconcile() error {
+	// The store is read first: a service is saved once its job is registered, so every service read
+	// has its job in the listing, while a service saved after the listing is not forgotten
+	services, err := s.store.ListServices()
+	if err != nil {
+		return fmt.Errorf("failed to list services from store: %w", err)
+	}
+
+	stubs, _, err := s.client.Jobs().List(&api.QueryOptions{Namespace: allNamespaces})
+	if err != nil {
+		return fmt.Errorf("failed to list jobs: %w", err)
+	}
+
+	known := make(map[string]*types.Service, len(services))
+	for _, service := range services {
+		known[service.JobID] = service
+	}
+
+	live := make(map[string]bool, len(stubs))
+	for _, stub := range stubs {
+		if stub.Stop {
+			continue
+		}
+
+		service, ok := known[stub.ID]
+		if !ok {
+			service, err = s.handleOrphan(stub)
+			if err != nil {
+				s.logger.Warn("unable to inspect job", "job_id", stub.ID, "error", err)
+				continue
+			}
+			if service == nil {
+				continue
+			}
+		}
+
+		live[stub.ID] = true
+		s.refreshBackends(service)
+	}
+
+	for jobID := range known {
+		if live[jobID] {
+			continue
+		}
+
+		s.logger.Info("job no longer exists in nomad, forgetting it", "job_id", jobID)
+
+		s.dropJob(jobID)
+
+		if err := s.store.DeleteService(jobID); err != nil && !errors.Is(err, types.ErrServiceNotFound) {
+			s.logger.Error("unable to delete service from store", "job_id", jobID, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// handleOrphan adopts or deregisters a job missing from the store. It returns the adopted
+// service, or nil when the job is not owned by the API or was swept.
+func (s *NomadJobService) handleOrphan(stub *api.JobListStub) (*types.Service, error) {
+	jobID := stub.ID
+
+	// Jobs being created are only saved once they are running
+	if s.operations.active(jobID) {
+		return nil, nil
+	}
+
+	// The creation of the job finished after the store was read
+	if service, err := s.store.GetService(jobID); err == nil {
+		return service, nil
+	}
+
+	job, _, err := s.client.Jobs().Info(jobID, &api.QueryOptions{Namespace: stub.Namespace})
+	if err != nil {
+		return nil, err
+	}
+
+	if job.Meta[metaManagedBy] != metaManagedByValue {
+		return nil, nil
+	}
+
+	reason, err := s.orphanSweepReason(job)
+	if err != nil {
+		return nil, err
+	}
+
+	if reason == "" {
+		return s.adoptJob(jobID, job)
+	}
+
+	if _, _, err := s.client.Jobs().Deregister(jobID, true, &api.WriteOptions{Namespace: stub.Namespace}); err != nil {
+		return nil, fmt.Errorf("failed to deregister orphan job: %w", err)
+	}
+
+	s.logger.Info("orphan job swept", "job_id", jobID, "reason", reason)
+
+	return nil, nil
+}
+
+// orphanSweepReason tells why an orphan job cannot be adopted, an empty reason means it can
+func (s *NomadJobService) orphanSweepReason(job *api.Job) (string, error) {
+	if s.orphanPolicy == OrphanPolicySweep {
+		return "orphans are swept", nil
+	}
+
+	name := job.Meta[metaServiceName]
+	if name == "" {
+		return "no service name in the job meta", nil
+	}
+
+	// A job left behind by a failed creation or update lost its name to the stored service
+	project := jobProject(job)
+	owner, err := findService(s.store, project, name)
+	switch {
+	case errors.Is(err, types.ErrServiceNotFound):
+		if jobID, ok := s.subdomains.resolve(project, slugify(name)); ok {
+			return fmt.Sprintf("subdomain of service %s belongs to job %s", name, jobID), nil
+		}
+		return "", nil
+	case err != nil:
+		return "", err
+	default:
+		return fmt.Sprintf("service %s belongs to job %s", name, owner.JobID), nil
+	}
+}
+
+// adoptJob saves a service built from the meta of a job owned by the API
+func (s *NomadJobService) adoptJob(jobID string, job *api.Job) (*types.Service, error) {
+	// A job scaled to zero by an idle API instance is adopted as sleeping
+	spec := jobSpecFromJob(job)
+
+	// A service with a TTL keeps its expiry, the reaper purges it once past
+	var expiresAt time.Time
+	if value := job.Meta[metaExpiresAt]; value != "" {
+		var err error
+		if expiresAt, err = time.Parse(time.RFC3339, value); err != nil {
+			return nil, fmt.Errorf("invalid expiry in the job meta: %w", err)
+		}
+	}
+
+	now := time.Now().UTC()
+	service := &types.Service{
+		Name:        job.Meta[metaServiceName],
+		JobID:       jobID,
+		SourceURL:   job.Meta[metaSourceURL],
+		Mode:        types.ServiceMode(job.Meta[metaServiceMode]),
+		ContentType: job.Meta[metaContentType],
+		SPA:         job.Meta[metaSPA] == "true",
+		SHA256:      job.Meta[metaSHA256],
+		Signature:   job.Meta[metaSignature],
+		Project:     jobProject(job),
+		Owner:       job.Meta[metaOwner],
+		Spec:        spec,
+		Sleeping:    spec.Replicas == 0,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		ExpiresAt:   expiresAt,
+	}
+	if service.Mode == types.ServiceModeGit {
+		service.Git = &types.GitSource{
+			URL:        service.SourceURL,
+			Ref:        job.Meta[metaGitRef],
+			Commit:     job.Meta[metaGitCommit],
+			Path:       job.Meta[metaGitPath],
+			Entrypoint: job.Meta[metaGitEntrypoint],
+		}
+	}
+
+	if err := s.store.SaveService(service); err != nil {
+		return nil, fmt.Errorf("failed to save adopted service: %w", err)
+	}
+
+	s.addJob(service)
+
+	s.logger.Info("adopted job from nomad", "job_id", jobID, "name", service.Name, "project", service.Project)
+
+	return service, nil
+}
+
+// refreshBackends updates the routing table with the allocations of the service that are running
+func (s *NomadJobService) refreshBackends(service *types.Service) {
+	backends, err := s.runningBackends(service.JobID, 0)
+	if err != nil {
+		// The allocations may be restarting, keep the previous backends until new ones are running
+		s.logger.Debug("no running allocation", "job_id", service.JobID, "error", err)
+		return
+	}
+
+	s.rwMutex.Lock()
+	previous, ok := s.jobBackends[service.JobID]
+	s.jobBackends[service.JobID] = backends
+	s.rwMutex.Unlock()
+
+	if ok && slices.Equal(previous, backends) && slices.Equal(service.Backends, backends) {
+		return
+	}
+
+	s.logger.Info("service backends updated", "job_id", service.JobID, "previous", len(previous), "backends", len(backends))
+
+	service.Backends = backends
+	service.UpdatedAt = time.Now().UTC()
+	if err := s.store.SaveService(service); err != nil {
+		s.logger.Error("unable to save service", "job_id", service.JobID, "error", err)
+	}
+}
+
+// jobProject returns the project of a job owned by the API, jobs created before projects
+// existed have no project meta and run in the default namespace
+func jobProject(job *api.Job) string {
+	if project := job.Meta[metaProject]; project != "" {
+		return project
+	}
+	if job.Namespace != nil && *job.Namespace != "" {
+		return *job.Namespace
+	}
+	return types.DefaultProject
+}
+
+// jobSpecFromJob reads back the placement and sizing of a job created by createNomadJobSpec
+func jobSpecFromJob(job *api.Job) types.JobSpec {
+	spec := types.JobSpec{
+		Datacenters: job.Datacenters,
+	}
+
+	if job.Region != nil {
+		spec.Region = *job.Region
+	}
+
+	if len(job.TaskGroups) == 0 || len(job.TaskGroups[0].Tasks) == 0 {
+		return spec
+	}
+
+	if count := job.TaskGroups[0].Count; count != nil {
+		spec.Replicas = *count
+	}
+
+	task := job.TaskGroups[0].Tasks[0]
+	if image, ok := task.Config["image"].(string); ok {
+		spec.Image = image
+	}
+
+	if task.Resources != nil {
+		spec.Resources.CPU = derefOrZero(task.Resources.CPU)
+		spec.Resources.MemoryMB = derefOrZero(task.Resources.MemoryMB)
+		if len(task.Resources.Networks) > 0 {
+			spec.Resources.NetworkMBits = derefOrZero(task.Resources.Networks[0].MBits)
+		}
+	}
+
+	return spec
+}
+
+func derefOrZero[T any](v *T) T {
+	var zero T
+	if v == nil {
+		return zero
+	}
+	return *v
+}
@@ -0,0 +1,281 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alexisvisco/koyebtests/internal/config"
+	"github.com/alexisvisco/koyebtests/internal/store"
+	"github.com/alexisvisco/koyebtests/internal/types"
+	"github.com/hashicorp/nomad/api"
+)
+
+// fakeNomad serves the responses of the Nomad HTTP API by path and records the requests
+type fakeNomad struct {
+	client *api.Client
+
+	mutex      sync.Mutex
+	requests   []string
+	registered []*api.Job
+}
+
+func newFakeNomad(t *testing.T, responses map[string]any) *fakeNomad {
+	t.Helper()
+
+	f := &fakeNomad{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mutex.Lock()
+		f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+		if r.Method == http.MethodPut && r.URL.Path == "/v1/jobs" {
+			var register api.JobRegisterRequest
+			_ = json.NewDecoder(r.Body).Decode(&register)
+			f.registered = append(f.registered, register.Job)
+		}
+		f.mutex.Unlock()
+
+		response, ok := responses[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("X-Nomad-Index", "1")
+		w.Header().Set("X-Nomad-KnownLeader", "true")
+		w.Header().Set("X-Nomad-LastContact", "0")
+		_ = json.NewEncoder(w).Encode(response)
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := api.NewClient(&api.Config{Address: server.URL})
+	if err != nil {
+		t.Fatalf("failed to create nomad client: %v", err)
+	}
+	f.client = client
+
+	return f
+}
+
+func (f *fakeNomad) requested(request string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return slices.Contains(f.requests, request)
+}
+
+// registeredJobs returns the jobs submitted to the fake, in order
+func (f *fakeNomad) registeredJobs() []*api.Job {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return slices.Clone(f.registered)
+}
+
+func TestReconcileRoutesToAllocationAddress(t *testing.T) {
+	nomad := newFakeNomad(t, map[string]any{
+		"/v1/jobs": []*api.JobListStub{{ID: "job-1", Status: "running"}},
+		"/v1/job/job-1/allocations": []*api.AllocationListStub{
+			{ID: "alloc-1", JobID: "job-1", ClientStatus: api.AllocClientStatusRunning, CreateIndex: 5},
+		},
+		"/v1/allocation/alloc-1": &api.Allocation{
+			ID:           "alloc-1",
+			JobID:        "job-1",
+			ClientStatus: api.AllocClientStatusRunning,
+			AllocatedResources: &api.AllocatedResources{
+				Shared: api.AllocatedSharedResources{
+					Ports: []api.PortMapping{{Label: "http", Value: 25000, HostIP: "10.20.30.40"}},
+				},
+			},
+		},
+	})
+
+	serviceStore := store.NewMemoryStore()
+	now := time.Now().UTC()
+	_ = serviceStore.SaveService(&types.Service{Name: "svc", Project: "default", JobID: "job-1", Mode: types.ServiceModeStatic, CreatedAt: now, UpdatedAt: now})
+
+	s, err := NewNomadJobService(NomadJobServiceParams{
+		Host:   "example.com",
+		Client: nomad.client,
+		Store:  serviceStore,
+		Events: newFakeEventSource(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	if err := s.Reconcile(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []types.Backend{{AllocID: "alloc-1", IP: "10.20.30.40", Port: 25000}}
+
+	backends, ok := s.GetJobBackends("job-1")
+	if !ok || !reflect.DeepEqual(backends, expected) {
+		t.Fatalf("expected backends %+v, got %+v", expected, backends)
+	}
+
+	service, err := serviceStore.GetService("job-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(service.Backends, expected) {
+		t.Fatalf("expected stored backends %+v, got %+v", expected, service.Backends)
+	}
+}
+
+func TestReconcileOrphans(t *testing.T) {
+	managed := func(id, name string) *api.Job {
+		job := api.NewServiceJob(id, id, "global", 50)
+		job.SetMeta(metaManagedBy, metaManagedByValue)
+		job.SetMeta(metaServiceName, name)
+		job.SetMeta(metaSourceURL, "http://example.com")
+		job.SetMeta(metaServiceMode, string(types.ServiceModeStatic))
+		return job
+	}
+
+	nomad := newFakeNomad(t, map[string]any{
+		"/v1/jobs": []*api.JobListStub{
+			{ID: "job-1", Status: "running"},
+			{ID: "job-duplicate", Status: "running"},
+			{ID: "job-lost", Status: "running"},
+		},
+		"/v1/job/job-duplicate": managed("job-duplicate", "svc"),
+		"/v1/job/job-lost":      managed("job-lost", "lost"),
+	})
+
+	serviceStore := store.NewMemoryStore()
+	now := time.Now().UTC()
+	_ = serviceStore.SaveService(&types.Service{Name: "svc", Project: "default", JobID: "job-1", Mode: types.ServiceModeStatic, CreatedAt: now, UpdatedAt: now})
+
+	s, err := NewNomadJobService(NomadJobServiceParams{
+		Host:   "example.com",
+		Client: nomad.client,
+		Store:  serviceStore,
+		Events: newFakeEventSource(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	if err := s.Reconcile(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !nomad.requested("DELETE /v1/job/job-duplicate") {
+		t.Fatal("expected the job whose name is taken to be swept")
+	}
+	if nomad.requested("DELETE /v1/job/job-lost") {
+		t.Fatal("expected the job missing from the store to be adopted, not swept")
+	}
+
+	if _, err := serviceStore.GetService("job-lost"); err != nil {
+		t.Fatalf("expected the lost job to be adopted, got %v", err)
+	}
+	if _, err := serviceStore.GetService("job-duplicate"); err == nil {
+		t.Fatal("expected the swept job to stay out of the store")
+	}
+}
+
+// staleStore lists the services without the ones saved since it became stale, like a store read by
+// Reconcile just before a creation saves its service
+type staleStore struct {
+	*store.MemoryStore
+
+	mutex sync.Mutex
+	stale bool
+}
+
+func (s *staleStore) ListServices() ([]*types.Service, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.stale {
+		s.stale = false
+		return nil, nil
+	}
+	return s.MemoryStore.ListServices()
+}
+
+func TestReconcileKeepsServiceSavedDuringListing(t *testing.T) {
+	job := api.NewServiceJob("job-1", "job-1", "global", 50)
+	job.SetMeta(metaManagedBy, metaManagedByValue)
+	job.SetMeta(metaServiceName, "svc")
+
+	nomad := newFakeNomad(t, map[string]any{
+		"/v1/jobs":      []*api.JobListStub{{ID: "job-1", Status: "running"}},
+		"/v1/job/job-1": job,
+	})
+
+	serviceStore := &staleStore{MemoryStore: store.NewMemoryStore()}
+
+	s, err := NewNomadJobService(NomadJobServiceParams{
+		Host:   "example.com",
+		Client: nomad.client,
+		Store:  serviceStore,
+		Events: newFakeEventSource(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	// The creation saves its service once Reconcile read the store
+	serviceStore.stale = true
+	now := time.Now().UTC()
+	_ = serviceStore.SaveService(&types.Service{Name: "svc", Project: "default", JobID: "job-1", SourceURL: "http://example.com", Mode: types.ServiceModeStatic, CreatedAt: now, UpdatedAt: now})
+
+	if err := s.Reconcile(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if nomad.requested("DELETE /v1/job/job-1") {
+		t.Fatal("expected the job of the saved service not to be swept")
+	}
+
+	service, err := serviceStore.GetService("job-1")
+	if err != nil {
+		t.Fatalf("expected the service to stay in the store, got %v", err)
+	}
+	if service.SourceURL != "http://example.com" {
+		t.Fatalf("expected the saved service to be kept as is, got %+v", service)
+	}
+}
+
+func TestReconcileAdoptsExpiry(t *testing.T) {
+	expiresAt := time.Now().UTC().Add(2 * time.Hour).Truncate(time.Second)
+
+	spec, _ := config.Default().Job.Resolve(types.CreateJobInput{})
+	job := (&NomadJobService{}).createNomadJobSpec("job-ttl", types.CreateJobInput{Name: "ttl", TargetURL: "https://example.com", Project: "default", ExpiresAt: expiresAt}, spec)
+
+	nomad := newFakeNomad(t, map[string]any{
+		"/v1/jobs":        []*api.JobListStub{{ID: "job-ttl", Status: "running"}},
+		"/v1/job/job-ttl": job,
+	})
+
+	serviceStore := store.NewMemoryStore()
+	s, err := NewNomadJobService(NomadJobServiceParams{
+		Host:   "example.com",
+		Client: nomad.client,
+		Store:  serviceStore,
+		Events: newFakeEventSource(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	if err := s.Reconcile(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	service, err := serviceStore.GetService("job-ttl")
+	if err != nil {
+		t.Fatalf("expected the job to be adopted, got %v", err)
+	}
+	if !service.ExpiresAt.Equal(expiresAt) {
+		t.Fatalf("expected the adopted service to expire at %s, got %s", expiresAt, service.ExpiresAt)
+	}
+}
@@ -0,0 +1,155 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/alexisvisco/koyebtests/internal/types"
+	"github.com/hashicorp/nomad/api"
+)
+
+// GetJobBackends returns the running allocations of the job the proxy can balance across
+func (s *NomadJobService) GetJobBackends(jobID string) ([]types.Backend, bool) {
+	s.rwMutex.RLock()
+	defer s.rwMutex.RUnlock()
+
+	backends, exists := s.jobBackends[jobID]
+	return slices.Clone(backends), exists
+}
+
+// ResolveSubdomain returns the job of the service served on <label>.<project>
+func (s *NomadJobService) ResolveSubdomain(project, label string) (string, bool) {
+	return s.subdomains.resolve(project, label)
+}
+
+// addJob registers a stored service in the routing tables
+func (s *NomadJobService) addJob(service *types.Service) {
+	s.rwMutex.Lock()
+	s.jobBackends[service.JobID] = slices.Clone(service.Backends)
+	s.jobNamespaces[service.JobID] = namespaceOf(service.Project)
+	s.rwMutex.Unlock()
+
+	s.subdomains.set(service)
+}
+
+// dropJob removes a job from the routing tables, it reports whether the job was known
+func (s *NomadJobService) dropJob(jobID string) bool {
+	s.rwMutex.Lock()
+	_, ok := s.jobBackends[jobID]
+	delete(s.jobBackends, jobID)
+	delete(s.jobNamespaces, jobID)
+	s.rwMutex.Unlock()
+
+	s.subdomains.remove(jobID)
+
+	return ok
+}
+
+// setBackends replaces the backends of a job and registers it in the routing table
+func (s *NomadJobService) setBackends(jobID string, backends []types.Backend) {
+	s.rwMutex.Lock()
+	s.jobBackends[jobID] = slices.Clone(backends)
+	s.rwMutex.Unlock()
+}
+
+// upsertBackend adds or moves the backend of an allocation of a known service
+func (s *NomadJobService) upsertBackend(jobID string, backend types.Backend) {
+	s.updateBackends(jobID, func(backends []types.Backend) []types.Backend {
+		i := slices.IndexFunc(backends, func(b types.Backend) bool { return b.AllocID == backend.AllocID })
+		if i < 0 {
+			return append(backends, backend)
+		}
+		if backends[i] == backend {
+			return backends
+		}
+		backends[i] = backend
+		return backends
+	})
+}
+
+// removeBackend removes the backend of an allocation that is no longer running
+func (s *NomadJobService) removeBackend(jobID string, allocID string) {
+	s.updateBackends(jobID, func(backends []types.Backend) []types.Backend {
+		return slices.DeleteFunc(backends, func(b types.Backend) bool { return b.AllocID == allocID })
+	})
+}
+
+// updateBackends applies fn to the backends of a known service and persists them when they changed.
+// Unknown jobs are either not ours or still being created, CreateJob will register them.
+func (s *NomadJobService) updateBackends(jobID string, fn func([]types.Backend) []types.Backend) {
+	s.rwMutex.Lock()
+	previous, ok := s.jobBackends[jobID]
+	if !ok {
+		s.rwMutex.Unlock()
+		return
+	}
+	backends := fn(slices.Clone(previous))
+	s.jobBackends[jobID] = backends
+	s.rwMutex.Unlock()
+
+	if slices.Equal(previous, backends) {
+		return
+	}
+
+	s.logger.Info("service backends updated", "job_id", jobID, "previous", len(previous), "backends", len(backends))
+
+	s.saveBackends(jobID, backends)
+}
+
+func (s *NomadJobService) saveBackends(jobID string, backends []types.Backend) {
+	service, err := s.store.GetService(jobID)
+	if err != nil {
+		if !errors.Is(err, types.ErrServiceNotFound) {
+			s.logger.Error("unable to get service", "job_id", jobID, "error", err)
+		}
+		return
+	}
+
+	service.Backends = backends
+	service.UpdatedAt = time.Now().UTC()
+	if err := s.store.SaveService(service); err != nil {
+		s.logger.Error("unable to save service", "job_id", jobID, "error", err)
+	}
+}
+
+// runningBackends returns the address of every running allocation of the job created at or after minIndex
+func (s *NomadJobService) runningBackends(jobID string, minIndex uint64) ([]types.Backend, error) {
+	allocs, _, err := s.client.Jobs().Allocations(jobID, false, s.queryOptions(jobID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get allocations for job %s: %w", jobID, err)
+	}
+
+	var backends []types.Backend
+	for _, stub := range allocs {
+		if stub.ClientStatus != api.AllocClientStatusRunning || stub.CreateIndex < minIndex {
+			continue
+		}
+
+		alloc, _, err := s.client.Allocations().Info(stub.ID, s.queryOptions(jobID))
+		if err != nil {
+			continue
+		}
+
+		if backend, ok := allocationBackend(alloc); ok {
+			backends = append(backends, backend)
+		}
+	}
+
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("no running allocation found for job %s", jobID)
+	}
+
+	return backends, nil
+}
+
+// allocationBackend returns the backend serving the http port of an allocation
+func allocationBackend(alloc *api.Allocation) (types.Backend, bool) {
+	ip, port, ok := allocationAddress(alloc)
+	if !ok {
+		return types.Backend{}, false
+	}
+
+	return types.Backend{AllocID: alloc.ID, IP: ip, Port: port}, true
+}
@@ -0,0 +1,135 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/alexisvisco/koyebtests/internal/types"
+)
+
+const taskGroupName = "web"
+
+// ScaleDown stops every allocation of an idle service by setting its count to 0. The job
+// stays registered so that WakeJob only has to scale it back up.
+func (s *NomadJobService) ScaleDown(jobID string) error {
+	service, err := s.store.GetService(jobID)
+	if err != nil {
+		return err
+	}
+
+	unlock := s.nameLocks.Lock(subdomain(service.Project, service.Name))
+	defer unlock()
+
+	// A wake in flight must not see the service scaled down under it
+	unlockWake := s.wakeLocks.Lock(jobID)
+	defer unlockWake()
+
+	service, err = s.store.GetService(jobID)
+	if err != nil {
+		return err
+	}
+
+	if service.Sleeping {
+		return nil
+	}
+
+	_, _, err = s.client.Jobs().Scale(jobID, taskGroupName, toPtr(0), "scaled to zero after being idle", false, nil, s.writeOptions(jobID))
+	if err != nil {
+		return fmt.Errorf("failed to scale down job %s: %w", jobID, err)
+	}
+
+	s.setBackends(jobID, nil)
+
+	service.Sleeping = true
+	service.Backends = nil
+	service.UpdatedAt = time.Now().UTC()
+	if err := s.store.SaveService(service); err != nil {
+		return fmt.Errorf("failed to save service: %w", err)
+	}
+
+	s.logger.Info("job scaled to zero", "job_id", jobID)
+
+	return nil
+}
+
+// WakeJob scales a sleeping service back to its replicas and waits for one of them to be running.
+// Concurrent calls for the same service wait for the first one and return its backends. It does not
+// wait for the creations of the service, only for the other wakes and scale downs.
+func (s *NomadJobService) WakeJob(ctx context.Context, jobID string) ([]types.Backend, error) {
+	unlock := s.wakeLocks.Lock(jobID)
+	defer unlock()
+
+	if backends, _ := s.GetJobBackends(jobID); len(backends) > 0 {
+		return backends, nil
+	}
+
+	service, err := s.store.GetService(jobID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !service.Sleeping {
+		return nil, types.ErrServiceNotSleeping
+	}
+
+	current, _, err := s.client.Jobs().Info(jobID, s.queryOptions(jobID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get job %s: %w", jobID, err)
+	}
+
+	// Allocations started by the scale up are created after the current version of the job
+	var minIndex uint64
+	if current.ModifyIndex != nil {
+		minIndex = *current.ModifyIndex + 1
+	}
+
+	ready := s.watchReadiness(jobID, minIndex)
+	defer s.unwatchReadiness(jobID)
+
+	replicas := max(service.Spec.Replicas, 1)
+	_, _, err = s.client.Jobs().Scale(jobID, taskGroupName, &replicas, "woken up by a request", false, nil, s.writeOptions(jobID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to scale up job %s: %w", jobID, err)
+	}
+
+	// The job runs from now on even when the caller stops waiting, the event loop routes its allocations
+	// and the idle scaler considers it again
+	if err := s.saveAwake(jobID, nil); err != nil {
+		return nil, err
+	}
+
+	backends, err := s.waitForBackends(ctx, jobID, minIndex, ready)
+	if err != nil {
+		return nil, fmt.Errorf("job %s did not wake up: %w", jobID, err)
+	}
+
+	s.setBackends(jobID, backends)
+	if err := s.saveAwake(jobID, backends); err != nil {
+		return nil, err
+	}
+
+	s.logger.Info("job woken up", "job_id", jobID, "backends", len(backends))
+
+	return backends, nil
+}
+
+// saveAwake stores the service as awake, with its backends once they are known. The service is read
+// again so that an update saved while waking up is kept.
+func (s *NomadJobService) saveAwake(jobID string, backends []types.Backend) error {
+	service, err := s.store.GetService(jobID)
+	if err != nil {
+		return err
+	}
+
+	service.Sleeping = false
+	if backends != nil {
+		service.Backends = backends
+	}
+	service.UpdatedAt = time.Now().UTC()
+	if err := s.store.SaveService(service); err != nil {
+		return fmt.Errorf("failed to save service: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,138 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alexisvisco/koyebtests/internal/store"
+	"github.com/alexisvisco/koyebtests/internal/types"
+	"github.com/hashicorp/nomad/api"
+)
+
+func TestScaleDownAndWakeJob(t *testing.T) {
+	nomad := newFakeNomad(t, map[string]any{
+		"/v1/job/job-1":       &api.Job{ID: toPtr("job-1"), ModifyIndex: toPtr[uint64](10)},
+		"/v1/job/job-1/scale": &api.JobRegisterResponse{},
+	})
+
+	serviceStore := store.NewMemoryStore()
+	now := time.Now().UTC()
+	_ = serviceStore.SaveService(&types.Service{
+		Name:      "svc",
+		JobID:     "job-1",
+		Mode:      types.ServiceModeStatic,
+		Spec:      types.JobSpec{Replicas: 1},
+		Backends:  []types.Backend{{AllocID: "alloc-old", IP: "10.0.0.12", Port: 20000}},
+		CreatedAt: now,
+		UpdatedAt: now,
+	})
+
+	events := newFakeEventSource()
+	s, err := NewNomadJobService(NomadJobServiceParams{Host: "example.com", Client: nomad.client, Store: serviceStore, Events: events})
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go s.RunEventLoop(ctx)
+
+	if err := s.ScaleDown("job-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	backends, ok := s.GetJobBackends("job-1")
+	if !ok || len(backends) != 0 {
+		t.Fatalf("expected a known job without backends, got %+v", backends)
+	}
+
+	service, _ := serviceStore.GetService("job-1")
+	if !service.Sleeping {
+		t.Fatal("expected the service to be stored as sleeping")
+	}
+
+	woken := make(chan []types.Backend, 1)
+	go func() {
+		backends, err := s.WakeJob(context.Background(), "job-1")
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		woken <- backends
+	}()
+
+	// Only the allocation created by the scale up wakes the service
+	eventually(t, func() bool {
+		s.waitersMutex.Lock()
+		defer s.waitersMutex.Unlock()
+		return s.waiters["job-1"] != nil
+	})
+	alloc := runningAllocation("job-1", 21000)
+	alloc.CreateIndex = 12
+	events.send(t, allocationEvent(t, alloc))
+
+	expected := []types.Backend{{AllocID: "alloc-job-1", IP: "10.0.0.12", Port: 21000}}
+	select {
+	case backends := <-woken:
+		if !reflect.DeepEqual(backends, expected) {
+			t.Fatalf("expected backends %+v, got %+v", expected, backends)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("service never woke up")
+	}
+
+	service, _ = serviceStore.GetService("job-1")
+	if service.Sleeping || !reflect.DeepEqual(service.Backends, expected) {
+		t.Fatalf("expected an awake service with the new backends, got %+v", service)
+	}
+}
+
+func TestWakeJobNotSleeping(t *testing.T) {
+	serviceStore := store.NewMemoryStore()
+	now := time.Now().UTC()
+	_ = serviceStore.SaveService(&types.Service{Name: "svc", JobID: "job-1", Mode: types.ServiceModeStatic, CreatedAt: now, UpdatedAt: now})
+
+	s, _ := newTestNomadJobService(t, serviceStore)
+
+	if _, err := s.WakeJob(context.Background(), "job-1"); err != types.ErrServiceNotSleeping {
+		t.Fatalf("expected ErrServiceNotSleeping, got %v", err)
+	}
+}
+
+func TestWakeJobCanceledAfterScale(t *testing.T) {
+	nomad := newFakeNomad(t, map[string]any{
+		"/v1/job/job-1":       &api.Job{ID: toPtr("job-1"), ModifyIndex: toPtr[uint64](10)},
+		"/v1/job/job-1/scale": &api.JobRegisterResponse{},
+	})
+
+	serviceStore := store.NewMemoryStore()
+	now := time.Now().UTC()
+	_ = serviceStore.SaveService(&types.Service{Name: "svc", Project: "default", JobID: "job-1", Mode: types.ServiceModeStatic, Spec: types.JobSpec{Replicas: 1}, Sleeping: true, CreatedAt: now, UpdatedAt: now})
+
+	s, err := NewNomadJobService(NomadJobServiceParams{Host: "example.com", Client: nomad.client, Store: serviceStore, Events: newFakeEventSource()})
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	// A creation of the service in flight does not hold the wake
+	unlock := s.nameLocks.Lock(subdomain("default", "svc"))
+	defer unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := s.WakeJob(ctx, "job-1"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the wake to time out, got %v", err)
+	}
+	if !nomad.requested("POST /v1/job/job-1/scale") {
+		t.Fatal("expected the job to be scaled up")
+	}
+
+	// The job was scaled up, it is no longer sleeping even though no replica was seen running yet
+	service, _ := serviceStore.GetService("job-1")
+	if service.Sleeping {
+		t.Fatal("expected the service to be stored as awake")
+	}
+}
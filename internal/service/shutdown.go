@@ -0,0 +1,96 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/alexisvisco/koyebtests/internal/types"
+)
+
+// ShutdownPolicy is what Close does with the running services
+type ShutdownPolicy string
+
+const (
+	// ShutdownPolicyPurge deregisters every job, the services are gone with the API
+	ShutdownPolicyPurge ShutdownPolicy = "purge"
+
+	// ShutdownPolicyDetach leaves the jobs running for the next instance of the API to adopt, it is the default
+	ShutdownPolicyDetach ShutdownPolicy = "detach"
+
+	// ShutdownPolicyDrain waits for the in-flight creations to finish, then detaches
+	ShutdownPolicyDrain ShutdownPolicy = "drain"
+)
+
+const defaultDrainTimeout = 3 * time.Minute
+
+// creationGate counts the in-flight creations and rejects new ones once closed
+type creationGate struct {
+	mutex    sync.Mutex
+	closed   bool
+	inFlight sync.WaitGroup
+}
+
+// enter registers a creation, it fails with types.ErrShuttingDown once the gate is closed
+func (g *creationGate) enter() error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.closed {
+		return types.ErrShuttingDown
+	}
+
+	g.inFlight.Add(1)
+	return nil
+}
+
+// leave marks a creation registered by enter as done
+func (g *creationGate) leave() {
+	g.inFlight.Done()
+}
+
+// close rejects the creations that did not enter yet
+func (g *creationGate) close() {
+	g.mutex.Lock()
+	g.closed = true
+	g.mutex.Unlock()
+}
+
+// wait waits for the in-flight creations to finish, at most for the timeout
+func (g *creationGate) wait(timeout time.Duration) error {
+	done := make(chan struct{})
+	go func() {
+		g.inFlight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("creations still in flight after %s", timeout)
+	}
+}
+
+// shutdown closes the gate and applies the policy, purge is only called for the purge policy
+func shutdown(policy ShutdownPolicy, gate *creationGate, drainTimeout time.Duration, jobIDs func() []string, purge func(jobID string) error) error {
+	gate.close()
+
+	switch policy {
+	case ShutdownPolicyDetach:
+		return nil
+	case ShutdownPolicyDrain:
+		return gate.wait(drainTimeout)
+	}
+
+	// The jobs are listed once the creations in flight are done, so that the jobs they register are purged too
+	errs := gate.wait(drainTimeout)
+	for _, jobID := range jobIDs() {
+		if err := purge(jobID); err != nil {
+			errs = errors.Join(errs, err)
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,142 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alexisvisco/koyebtests/internal/store"
+	"github.com/alexisvisco/koyebtests/internal/types"
+)
+
+func TestCloseShutdownPolicy(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     ShutdownPolicy
+		wantPurged bool
+	}{
+		{name: "default detaches"},
+		{name: "purge", policy: ShutdownPolicyPurge, wantPurged: true},
+		{name: "detach", policy: ShutdownPolicyDetach},
+		{name: "drain", policy: ShutdownPolicyDrain},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nomad := newFakeNomad(t, map[string]any{
+				"/v1/job/job-1": map[string]string{"EvalID": "eval-1"},
+			})
+
+			serviceStore := store.NewMemoryStore()
+			now := time.Now().UTC()
+			_ = serviceStore.SaveService(&types.Service{
+				Name:      "svc",
+				JobID:     "job-1",
+				Mode:      types.ServiceModeStatic,
+				Backends:  []types.Backend{{AllocID: "alloc-1", IP: "10.0.0.12", Port: 20000}},
+				CreatedAt: now,
+				UpdatedAt: now,
+			})
+
+			s, err := NewNomadJobService(NomadJobServiceParams{
+				Host:           "example.com",
+				Client:         nomad.client,
+				Store:          serviceStore,
+				Events:         newFakeEventSource(),
+				ShutdownPolicy: tt.policy,
+			})
+			if err != nil {
+				t.Fatalf("failed to create service: %v", err)
+			}
+
+			if err := s.Close(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if purged := nomad.requested("DELETE /v1/job/job-1"); purged != tt.wantPurged {
+				t.Fatalf("expected job purged to be %v, got %v", tt.wantPurged, purged)
+			}
+
+			_, err = serviceStore.GetService("job-1")
+			if stored := err == nil; stored == tt.wantPurged {
+				t.Fatalf("expected service stored to be %v, got %v", !tt.wantPurged, stored)
+			}
+
+			_, err = s.CreateJob(types.CreateJobInput{Name: "other", TargetURL: "http://example.com"})
+			if !errors.Is(err, types.ErrShuttingDown) {
+				t.Fatalf("expected %v after close, got %v", types.ErrShuttingDown, err)
+			}
+		})
+	}
+}
+
+func TestCreationGateDrain(t *testing.T) {
+	var gate creationGate
+	if err := gate.enter(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	drained := make(chan error, 1)
+	go func() {
+		drained <- shutdown(ShutdownPolicyDrain, &gate, time.Second, nil, nil)
+	}()
+
+	select {
+	case err := <-drained:
+		t.Fatalf("expected drain to wait for the creation in flight, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := gate.enter(); !errors.Is(err, types.ErrShuttingDown) {
+		t.Fatalf("expected %v while draining, got %v", types.ErrShuttingDown, err)
+	}
+
+	gate.leave()
+
+	select {
+	case err := <-drained:
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("drain did not return after the creation finished")
+	}
+}
+
+func TestCreationGateDrainTimeout(t *testing.T) {
+	var gate creationGate
+	if err := gate.enter(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := shutdown(ShutdownPolicyDrain, &gate, 20*time.Millisecond, nil, nil); err == nil {
+		t.Fatal("expected an error when creations are still in flight")
+	}
+}
+
+func TestShutdownPurgeWaitsForCreations(t *testing.T) {
+	var gate creationGate
+	if err := gate.enter(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The creation in flight registers its job after the shutdown started
+	var registered []string
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		registered = append(registered, "job-late")
+		gate.leave()
+	}()
+
+	var purged []string
+	err := shutdown(ShutdownPolicyPurge, &gate, time.Second, func() []string { return registered }, func(jobID string) error {
+		purged = append(purged, jobID)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(purged) != 1 || purged[0] != "job-late" {
+		t.Fatalf("expected the job of the creation in flight to be purged, got %v", purged)
+	}
+}
@@ -0,0 +1,102 @@
+package service
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/alexisvisco/koyebtests/internal/types"
+)
+
+// maxLabelLength is the longest DNS label
+const maxLabelLength = 63
+
+// subdomainTable maps the <service>.<project> subdomains to the job IDs of the services
+type subdomainTable struct {
+	mutex  sync.RWMutex
+	jobIDs map[string]string
+	byJob  map[string]string
+}
+
+func (t *subdomainTable) set(service *types.Service) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.jobIDs == nil {
+		t.jobIDs = make(map[string]string)
+		t.byJob = make(map[string]string)
+	}
+
+	key := subdomain(service.Project, service.Name)
+	t.jobIDs[key] = service.JobID
+	t.byJob[service.JobID] = key
+}
+
+func (t *subdomainTable) remove(jobID string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	key, ok := t.byJob[jobID]
+	if !ok {
+		return
+	}
+
+	delete(t.byJob, jobID)
+	if t.jobIDs[key] == jobID {
+		delete(t.jobIDs, key)
+	}
+}
+
+// resolve returns the job ID of the service served on the label of the project
+func (t *subdomainTable) resolve(project, label string) (string, bool) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	jobID, ok := t.jobIDs[label+"."+project]
+	return jobID, ok
+}
+
+// subdomain returns the <service>.<project> part of the host of a service. It also keys the
+// name locks so that two names sharing a subdomain cannot be created at the same time.
+func subdomain(project, name string) string {
+	return slugify(name) + "." + project
+}
+
+// validateSubdomain checks that the name of a service makes a valid DNS label
+func validateSubdomain(name string) error {
+	label := slugify(name)
+	switch {
+	case label == "":
+		return &types.ValidationError{Field: "name", Message: "must contain letters or digits"}
+	case len(label) > maxLabelLength:
+		return &types.ValidationError{Field: "name", Message: "must be at most 63 characters once made a subdomain"}
+	}
+	return nil
+}
+
+// projectOf returns the project of the input, DefaultProject when it is empty
+func projectOf(input types.CreateJobInput) string {
+	if input.Project == "" {
+		return types.DefaultProject
+	}
+	return input.Project
+}
+
+// checkSubdomain returns types.ErrServiceNameTaken when the subdomain of the name is served by
+// another service of the project, existing is the service with this exact name if any
+func checkSubdomain(table *subdomainTable, existing *types.Service, project, name string) error {
+	jobID, ok := table.resolve(project, slugify(name))
+	if ok && (existing == nil || existing.JobID != jobID) {
+		return types.ErrServiceNameTaken
+	}
+	return nil
+}
+
+// checkOwner returns types.ErrServiceNameTaken when the existing service was created by another API key,
+// the service is only updated by its owner. The empty owner is the admin key or disabled authentication,
+// which update any service.
+func checkOwner(existing *types.Service, owner string) error {
+	if existing != nil && owner != "" && existing.Owner != owner {
+		return fmt.Errorf("%w: the service belongs to another API key", types.ErrServiceNameTaken)
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/alexisvisco/koyebtests/internal/types"
+)
+
+// FileStore is an embedded store that keeps its state in a single JSON file.
+// Every write rewrites the file atomically so a crash never leaves a partial state behind.
+type FileStore struct {
+	path string
+
+	rwMutex sync.RWMutex
+	state   fileState
+}
+
+type fileState struct {
+	Services map[string]*types.Service `json:"services"`
+	APIKeys  map[string]*types.APIKey  `json:"api_keys"`
+}
+
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{
+		path: path,
+		state: fileState{
+			Services: make(map[string]*types.Service),
+			APIKeys:  make(map[string]*types.APIKey),
+		},
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file %s: %w", path, err)
+	}
+
+	if err := json.Unmarshal(data, &s.state); err != nil {
+		return nil, fmt.Errorf("failed to decode state file %s: %w", path, err)
+	}
+
+	if s.state.Services == nil {
+		s.state.Services = make(map[string]*types.Service)
+	}
+
+	if s.state.APIKeys == nil {
+		s.state.APIKeys = make(map[string]*types.APIKey)
+	}
+
+	// State written before projects existed belongs to the default project
+	for _, service := range s.state.Services {
+		if service.Project == "" {
+			service.Project = types.DefaultProject
+		}
+	}
+	for _, key := range s.state.APIKeys {
+		if key.Project == "" {
+			key.Project = types.DefaultProject
+		}
+	}
+
+	return s, nil
+}
+
+func (s *FileStore) GetService(jobID string) (*types.Service, error) {
+	s.rwMutex.RLock()
+	defer s.rwMutex.RUnlock()
+
+	service, ok := s.state.Services[jobID]
+	if !ok {
+		return nil, types.ErrServiceNotFound
+	}
+
+	return cloneService(service), nil
+}
+
+func (s *FileStore) ListServices() ([]*types.Service, error) {
+	s.rwMutex.RLock()
+	defer s.rwMutex.RUnlock()
+
+	return sortedServices(s.state.Services), nil
+}
+
+func (s *FileStore) SaveService(service *types.Service) error {
+	s.rwMutex.Lock()
+	defer s.rwMutex.Unlock()
+
+	previous, existed := s.state.Services[service.JobID]
+
+	s.state.Services[service.JobID] = cloneService(service)
+
+	if err := s.flush(); err != nil {
+		if existed {
+			s.state.Services[service.JobID] = previous
+		} else {
+			delete(s.state.Services, service.JobID)
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (s *FileStore) DeleteService(jobID string) error {
+	s.rwMutex.Lock()
+	defer s.rwMutex.Unlock()
+
+	previous, ok := s.state.Services[jobID]
+	if !ok {
+		return types.ErrServiceNotFound
+	}
+
+	delete(s.state.Services, jobID)
+
+	if err := s.flush(); err != nil {
+		s.state.Services[jobID] = previous
+		return err
+	}
+
+	return nil
+}
+
+func (s *FileStore) GetAPIKeyByHash(hash string) (*types.APIKey, error) {
+	s.rwMutex.RLock()
+	defer s.rwMutex.RUnlock()
+
+	return findAPIKey(s.state.APIKeys, hash)
+}
+
+func (s *FileStore) ListAPIKeys() ([]*types.APIKey, error) {
+	s.rwMutex.RLock()
+	defer s.rwMutex.RUnlock()
+
+	return sortedAPIKeys(s.state.APIKeys), nil
+}
+
+func (s *FileStore) SaveAPIKey(key *types.APIKey) error {
+	s.rwMutex.Lock()
+	defer s.rwMutex.Unlock()
+
+	previous, existed := s.state.APIKeys[key.ID]
+
+	copied := *key
+	s.state.APIKeys[key.ID] = &copied
+
+	if err := s.flush(); err != nil {
+		if existed {
+			s.state.APIKeys[key.ID] = previous
+		} else {
+			delete(s.state.APIKeys, key.ID)
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (s *FileStore) DeleteAPIKey(id string) error {
+	s.rwMutex.Lock()
+	defer s.rwMutex.Unlock()
+
+	previous, ok := s.state.APIKeys[id]
+	if !ok {
+		return types.ErrAPIKeyNotFound
+	}
+
+	delete(s.state.APIKeys, id)
+
+	if err := s.flush(); err != nil {
+		s.state.APIKeys[id] = previous
+		return err
+	}
+
+	return nil
+}
+
+func (s *FileStore) Close() error {
+	return nil
+}
+
+// flush writes the state to a temporary file and renames it over the previous one.
+// The caller must hold the write lock.
+func (s *FileStore) flush() error {
+	data, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temporary state file: %w", err)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync temporary state file: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary state file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to replace state file %s: %w", s.path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,156 @@
+package store
+
+import (
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/alexisvisco/koyebtests/internal/types"
+)
+
+// MemoryStore keeps everything in memory, it is meant for tests and ephemeral setups
+type MemoryStore struct {
+	rwMutex  sync.RWMutex
+	services map[string]*types.Service
+	apiKeys  map[string]*types.APIKey
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		services: make(map[string]*types.Service),
+		apiKeys:  make(map[string]*types.APIKey),
+	}
+}
+
+func (s *MemoryStore) GetService(jobID string) (*types.Service, error) {
+	s.rwMutex.RLock()
+	defer s.rwMutex.RUnlock()
+
+	service, ok := s.services[jobID]
+	if !ok {
+		return nil, types.ErrServiceNotFound
+	}
+
+	return cloneService(service), nil
+}
+
+func (s *MemoryStore) ListServices() ([]*types.Service, error) {
+	s.rwMutex.RLock()
+	defer s.rwMutex.RUnlock()
+
+	return sortedServices(s.services), nil
+}
+
+func (s *MemoryStore) SaveService(service *types.Service) error {
+	s.rwMutex.Lock()
+	defer s.rwMutex.Unlock()
+
+	s.services[service.JobID] = cloneService(service)
+	return nil
+}
+
+func (s *MemoryStore) DeleteService(jobID string) error {
+	s.rwMutex.Lock()
+	defer s.rwMutex.Unlock()
+
+	if _, ok := s.services[jobID]; !ok {
+		return types.ErrServiceNotFound
+	}
+
+	delete(s.services, jobID)
+	return nil
+}
+
+func (s *MemoryStore) GetAPIKeyByHash(hash string) (*types.APIKey, error) {
+	s.rwMutex.RLock()
+	defer s.rwMutex.RUnlock()
+
+	return findAPIKey(s.apiKeys, hash)
+}
+
+func (s *MemoryStore) ListAPIKeys() ([]*types.APIKey, error) {
+	s.rwMutex.RLock()
+	defer s.rwMutex.RUnlock()
+
+	return sortedAPIKeys(s.apiKeys), nil
+}
+
+func (s *MemoryStore) SaveAPIKey(key *types.APIKey) error {
+	s.rwMutex.Lock()
+	defer s.rwMutex.Unlock()
+
+	copied := *key
+	s.apiKeys[key.ID] = &copied
+	return nil
+}
+
+func (s *MemoryStore) DeleteAPIKey(id string) error {
+	s.rwMutex.Lock()
+	defer s.rwMutex.Unlock()
+
+	if _, ok := s.apiKeys[id]; !ok {
+		return types.ErrAPIKeyNotFound
+	}
+
+	delete(s.apiKeys, id)
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// sortedServices returns copies of the services ordered by creation date
+func sortedServices(services map[string]*types.Service) []*types.Service {
+	list := make([]*types.Service, 0, len(services))
+	for _, service := range services {
+		list = append(list, cloneService(service))
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].CreatedAt.Equal(list[j].CreatedAt) {
+			return list[i].JobID < list[j].JobID
+		}
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+
+	return list
+}
+
+// cloneService copies the service so that callers never share the slices of the stored record
+func cloneService(service *types.Service) *types.Service {
+	copied := *service
+	copied.Spec.Datacenters = slices.Clone(service.Spec.Datacenters)
+	copied.Backends = slices.Clone(service.Backends)
+	return &copied
+}
+
+// findAPIKey returns a copy of the key with this hash
+func findAPIKey(keys map[string]*types.APIKey, hash string) (*types.APIKey, error) {
+	for _, key := range keys {
+		if key.Hash == hash {
+			copied := *key
+			return &copied, nil
+		}
+	}
+
+	return nil, types.ErrAPIKeyNotFound
+}
+
+// sortedAPIKeys returns copies of the keys ordered by creation date
+func sortedAPIKeys(keys map[string]*types.APIKey) []*types.APIKey {
+	list := make([]*types.APIKey, 0, len(keys))
+	for _, key := range keys {
+		copied := *key
+		list = append(list, &copied)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].CreatedAt.Equal(list[j].CreatedAt) {
+			return list[i].ID < list[j].ID
+		}
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+
+	return list
+}
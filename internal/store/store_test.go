@@ -0,0 +1,218 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alexisvisco/koyebtests/internal/types"
+)
+
+func TestServiceStores(t *testing.T) {
+	tests := []struct {
+		name     string
+		newStore func(t *testing.T) types.ServiceStore
+	}{
+		{
+			name: "memory",
+			newStore: func(t *testing.T) types.ServiceStore {
+				return NewMemoryStore()
+			},
+		},
+		{
+			name: "file",
+			newStore: func(t *testing.T) types.ServiceStore {
+				s, err := NewFileStore(filepath.Join(t.TempDir(), "state.json"))
+				if err != nil {
+					t.Fatalf("failed to create file store: %v", err)
+				}
+				return s
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.newStore(t)
+			defer s.Close()
+
+			now := time.Now().UTC()
+			first := &types.Service{Name: "first", JobID: "job-1", SourceURL: "http://example.com", Mode: types.ServiceModeStatic, Backends: []types.Backend{{AllocID: "alloc-1", IP: "10.0.0.1", Port: 1234}}, CreatedAt: now, UpdatedAt: now}
+			second := &types.Service{Name: "second", JobID: "job-2", SourceURL: "http://example.com/script", Mode: types.ServiceModeScript, Backends: []types.Backend{{AllocID: "alloc-2", IP: "10.0.0.2", Port: 4321}}, CreatedAt: now.Add(time.Second), UpdatedAt: now}
+
+			if err := s.SaveService(second); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := s.SaveService(first); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got, err := s.GetService("job-1")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got.Name != "first" || len(got.Backends) != 1 || got.Backends[0].Port != 1234 {
+				t.Errorf("unexpected service: %+v", got)
+			}
+
+			got.Backends[0].Port = 9999
+			again, _ := s.GetService("job-1")
+			if again.Backends[0].Port != 1234 {
+				t.Errorf("store returned shared backends, port was modified to %d", again.Backends[0].Port)
+			}
+
+			list, err := s.ListServices()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(list) != 2 || list[0].JobID != "job-1" || list[1].JobID != "job-2" {
+				t.Errorf("expected services ordered by creation date, got %+v", list)
+			}
+
+			if err := s.DeleteService("job-1"); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if _, err := s.GetService("job-1"); !errors.Is(err, types.ErrServiceNotFound) {
+				t.Errorf("expected ErrServiceNotFound, got %v", err)
+			}
+			if err := s.DeleteService("job-1"); !errors.Is(err, types.ErrServiceNotFound) {
+				t.Errorf("expected ErrServiceNotFound on second delete, got %v", err)
+			}
+		})
+	}
+}
+
+func TestFileStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatalf("failed to create file store: %v", err)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	service := &types.Service{Name: "persisted", Project: types.DefaultProject, JobID: "job-1", SourceURL: "http://example.com", Mode: types.ServiceModeScript, Backends: []types.Backend{{AllocID: "alloc-1", IP: "10.0.0.1", Port: 2000}}, CreatedAt: now, UpdatedAt: now}
+	if err := s.SaveService(service); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s.Close()
+
+	reloaded, err := NewFileStore(path)
+	if err != nil {
+		t.Fatalf("failed to reload file store: %v", err)
+	}
+
+	got, err := reloaded.GetService("job-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(got, service) {
+		t.Errorf("expected %+v after reload, got %+v", service, got)
+	}
+}
+
+func TestFileStoreMigratesToDefaultProject(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	legacy := `{"services":{"job-1":{"name":"legacy","job_id":"job-1"}},"api_keys":{"key-1":{"id":"key-1","name":"ci"}}}`
+	if err := os.WriteFile(path, []byte(legacy), 0o600); err != nil {
+		t.Fatalf("failed to write state: %v", err)
+	}
+
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatalf("failed to load file store: %v", err)
+	}
+
+	service, err := s.GetService("job-1")
+	if err != nil || service.Project != types.DefaultProject {
+		t.Fatalf("expected the service to move to the default project, got %+v, %v", service, err)
+	}
+
+	keys, err := s.ListAPIKeys()
+	if err != nil || len(keys) != 1 || keys[0].Project != types.DefaultProject {
+		t.Fatalf("expected the key to move to the default project, got %+v, %v", keys, err)
+	}
+}
+
+func TestAPIKeyStores(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	tests := []struct {
+		name     string
+		newStore func(t *testing.T) types.APIKeyStore
+	}{
+		{
+			name: "memory",
+			newStore: func(t *testing.T) types.APIKeyStore {
+				return NewMemoryStore()
+			},
+		},
+		{
+			name: "file",
+			newStore: func(t *testing.T) types.APIKeyStore {
+				s, err := NewFileStore(path)
+				if err != nil {
+					t.Fatalf("failed to create file store: %v", err)
+				}
+				return s
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.newStore(t)
+
+			now := time.Now().UTC().Truncate(time.Second)
+			first := &types.APIKey{ID: "key-1", Name: "first", Hash: "hash-1", CreatedAt: now}
+			second := &types.APIKey{ID: "key-2", Name: "second", Hash: "hash-2", CreatedAt: now.Add(time.Second)}
+
+			for _, key := range []*types.APIKey{second, first} {
+				if err := s.SaveAPIKey(key); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+
+			got, err := s.GetAPIKeyByHash("hash-2")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, second) {
+				t.Errorf("expected %+v, got %+v", second, got)
+			}
+
+			if _, err := s.GetAPIKeyByHash("unknown"); !errors.Is(err, types.ErrAPIKeyNotFound) {
+				t.Errorf("expected ErrAPIKeyNotFound, got %v", err)
+			}
+
+			list, err := s.ListAPIKeys()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(list) != 2 || list[0].ID != "key-1" || list[1].ID != "key-2" {
+				t.Errorf("expected keys ordered by creation date, got %+v", list)
+			}
+
+			if err := s.DeleteAPIKey("key-1"); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if _, err := s.GetAPIKeyByHash("hash-1"); !errors.Is(err, types.ErrAPIKeyNotFound) {
+				t.Errorf("expected ErrAPIKeyNotFound after delete, got %v", err)
+			}
+			if err := s.DeleteAPIKey("key-1"); !errors.Is(err, types.ErrAPIKeyNotFound) {
+				t.Errorf("expected ErrAPIKeyNotFound on second delete, got %v", err)
+			}
+		})
+	}
+
+	reloaded, err := NewFileStore(path)
+	if err != nil {
+		t.Fatalf("failed to reload file store: %v", err)
+	}
+	if _, err := reloaded.GetAPIKeyByHash("hash-2"); err != nil {
+		t.Errorf("expected the key to survive a reload, got %v", err)
+	}
+}
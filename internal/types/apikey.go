@@ -0,0 +1,26 @@
+package types
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrAPIKeyNotFound = errors.New("api key not found")
+
+// APIKey authenticates the callers of the API, the key itself is only known by its holder
+// and the store keeps its SHA-256 hash. A key only reaches the services of its project.
+type APIKey struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Project   string    `json:"project"`
+	Hash      string    `json:"hash"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// APIKeyStore persists the API keys next to the services
+type APIKeyStore interface {
+	GetAPIKeyByHash(hash string) (*APIKey, error)
+	ListAPIKeys() ([]*APIKey, error)
+	SaveAPIKey(key *APIKey) error
+	DeleteAPIKey(id string) error
+}
@@ -1,12 +1,229 @@
 package types
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
 type JobService interface {
-	GetJobPort(jobID string) (int, bool)
-	CreateJob(name string, targetURL string, isScript bool) (*CreateJobOutput, error)
+	GetJobBackends(jobID string) ([]Backend, bool)
+	ResolveSubdomain(project, label string) (string, bool)
+	CreateJob(input CreateJobInput) (*CreateJobOutput, error)
+	GetOperation(id string) (*Operation, error)
+	GetService(project, name string) (*ServiceOutput, error)
+	ListServices() ([]*ServiceOutput, error)
+	RestartJob(jobID string) error
+	ExtendService(project, name string, input ExtendServiceInput) (*ServiceOutput, error)
+	ScaleDown(jobID string) error
+	WakeJob(ctx context.Context, jobID string) ([]Backend, error)
 	PurgeJob(jobID string) error
 	Close() error
 }
 
+type CreateJobInput struct {
+	Name      string
+	TargetURL string
+	IsScript  bool
+
+	// Archive serves the files of a .tar.gz or .zip archive as a static site
+	Archive bool
+
+	// SPA serves the index.html of the archive for the unknown paths of a single page application
+	SPA bool
+
+	// ContentType is served instead of the detected type, empty detects it from the downloaded content
+	ContentType string
+
+	// Git clones a repository instead of downloading TargetURL, which then holds the URL of the repository
+	Git *GitSource
+
+	// SHA256 (hex) and Signature (base64 Ed25519, checked with the key of the server) must match
+	// the downloaded content, the init binary refuses to serve it otherwise
+	SHA256    string
+	Signature string
+
+	// Project groups the services, names are unique within a project. Empty is DefaultProject.
+	Project string
+
+	// Owner is the ID of the API key creating the service, empty when authentication is disabled
+	Owner string
+
+	// Async returns as soon as the operation is started instead of waiting for the service to run
+	Async bool
+
+	// Replicas is the number of instances of the service, zero uses the default of the server
+	Replicas int
+
+	// ExpiresAt is when the service is purged, the zero value keeps the current expiry or never expires
+	ExpiresAt time.Time
+
+	// Optional overrides of the job template, empty values use the defaults of the server.
+	// InstanceType picks named resources, Resources then overrides them field by field.
+	InstanceType string
+	Image        string
+	Region       string
+	Datacenters  []string
+	Resources    Resources
+}
+
+// Mode returns the mode matching the git source and the is_script and archive flags of the API
+func (i CreateJobInput) Mode() ServiceMode {
+	switch {
+	case i.Git != nil:
+		return ServiceModeGit
+	case i.IsScript:
+		return ServiceModeScript
+	case i.Archive:
+		return ServiceModeArchive
+	default:
+		return ServiceModeStatic
+	}
+}
+
+// ExtendServiceInput pushes back the expiry of a service, either by a TTL added to the
+// current expiry (or to now when the service does not expire) or to a fixed date
+type ExtendServiceInput struct {
+	TTL       time.Duration
+	ExpiresAt time.Time
+}
+
 type CreateJobOutput struct {
-	URL string
+	URL         string
+	OperationID string
+}
+
+const (
+	ServiceStatusPending  = "pending"
+	ServiceStatusRunning  = "running"
+	ServiceStatusFailed   = "failed"
+	ServiceStatusStopped  = "stopped"
+	ServiceStatusSleeping = "sleeping"
+	ServiceStatusUnknown  = "unknown"
+)
+
+type ServiceOutput struct {
+	Name        string
+	JobID       string
+	Status      string
+	URL         string
+	Mode        ServiceMode
+	SourceURL   string
+	ContentType string
+	SPA         bool
+	Git         *GitSource
+	SHA256      string
+	Signature   string
+	Project     string
+	Owner       string
+	Replicas    int
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+
+	// UpdatedAt is the last change of the service, such as an update, a wake or new backends
+	UpdatedAt time.Time
+}
+
+// Resources sizes the container of a service, zero values mean the default of the server
+type Resources struct {
+	CPU          int `json:"cpu"`           // MHz
+	MemoryMB     int `json:"memory_mb"`     // MB
+	NetworkMBits int `json:"network_mbits"` // Mbits
+}
+
+// JobSpec is the resolved placement and sizing of the job running a service
+type JobSpec struct {
+	InstanceType string    `json:"instance_type,omitempty"`
+	Image        string    `json:"image"`
+	Region       string    `json:"region"`
+	Datacenters  []string  `json:"datacenters"`
+	Resources    Resources `json:"resources"`
+	Replicas     int       `json:"replicas"`
+}
+
+// TotalResources returns the resources used by all the replicas of the job
+func (s JobSpec) TotalResources() Resources {
+	replicas := max(s.Replicas, 1)
+	return Resources{
+		CPU:          s.Resources.CPU * replicas,
+		MemoryMB:     s.Resources.MemoryMB * replicas,
+		NetworkMBits: s.Resources.NetworkMBits * replicas,
+	}
+}
+
+// Backend is a running instance of a service that the subdomain proxy can route to
+type Backend struct {
+	AllocID string `json:"alloc_id"`
+	IP      string `json:"ip"`
+	Port    int    `json:"port"`
+}
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// QuotaError is returned when a service would take the usage above a quota, it matches ErrQuotaExceeded
+type QuotaError struct {
+	// Resource is what goes over the quota: services, cpu or memory
+	Resource string
+	Usage    int
+	Limit    int
+
+	// Project is set when the quota of a project is exceeded rather than the global one
+	Project string
+}
+
+func (e *QuotaError) Error() string {
+	return ErrQuotaExceeded.Error() + ": " + e.Detail()
+}
+
+func (e *QuotaError) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
+
+// Detail describes the usage that goes over the quota, such as "1024 MB of memory out of 768"
+func (e *QuotaError) Detail() string {
+	var detail string
+	switch e.Resource {
+	case QuotaResourceCPU:
+		detail = fmt.Sprintf("%d MHz of cpu out of %d", e.Usage, e.Limit)
+	case QuotaResourceMemory:
+		detail = fmt.Sprintf("%d MB of memory out of %d", e.Usage, e.Limit)
+	default:
+		detail = fmt.Sprintf("%d %s out of %d", e.Usage, e.Resource, e.Limit)
+	}
+
+	if e.Project != "" {
+		detail += " in project " + e.Project
+	}
+	return detail
+}
+
+const (
+	QuotaResourceServices = "services"
+	QuotaResourceCPU      = "cpu"
+	QuotaResourceMemory   = "memory"
+)
+
+// ErrServiceNotSleeping is returned when waking a service that was not scaled to zero
+var ErrServiceNotSleeping = errors.New("service is not sleeping")
+
+// ErrServiceNameTaken is returned when creating a service whose subdomain is used by another
+// service of the project, such as "My App" and "my-app"
+var ErrServiceNameTaken = errors.New("service name is taken")
+
+// ErrOperationInProgress is returned by an async creation while another operation creates or updates
+// the same service
+var ErrOperationInProgress = errors.New("operation in progress")
+
+// ErrShuttingDown is returned when creating a service while the API shuts down
+var ErrShuttingDown = errors.New("shutting down")
+
+// ValidationError is returned when a request does not match what the server allows
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Field + " " + e.Message
 }
@@ -0,0 +1,36 @@
+package types
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrOperationNotFound = errors.New("operation not found")
+
+type OperationState string
+
+const (
+	OperationStatePending     OperationState = "pending"
+	OperationStateScheduling  OperationState = "scheduling"
+	OperationStateDownloading OperationState = "downloading"
+	OperationStateRunning     OperationState = "running"
+	OperationStateFailed      OperationState = "failed"
+)
+
+// Operation tracks the creation or the update of a service
+type Operation struct {
+	ID          string
+	ServiceName string
+	JobID       string
+	Project     string
+	Owner       string
+	State       OperationState
+	Reason      string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// Done reports whether the operation reached a final state
+func (o *Operation) Done() bool {
+	return o.State == OperationStateRunning || o.State == OperationStateFailed
+}
@@ -0,0 +1,17 @@
+package types
+
+import "regexp"
+
+// DefaultProject holds the services created without a project, such as when authentication is disabled
+const DefaultProject = "default"
+
+// projectPattern keeps project names usable as a DNS label and as a Nomad namespace
+var projectPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// ValidateProject returns a ValidationError when the name cannot be used as a project
+func ValidateProject(name string) error {
+	if !projectPattern.MatchString(name) {
+		return &ValidationError{Field: "project", Message: "must be lowercase letters, digits and dashes"}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package types
+
+import (
+	"errors"
+	"mime"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var ErrServiceNotFound = errors.New("service not found")
+
+type ServiceMode string
+
+const (
+	ServiceModeStatic  ServiceMode = "static"
+	ServiceModeScript  ServiceMode = "script"
+	ServiceModeArchive ServiceMode = "archive"
+	ServiceModeGit     ServiceMode = "git"
+)
+
+// GitSource is a git repository pinned to the commit its ref pointed to when the service was created
+type GitSource struct {
+	URL    string `json:"url"`
+	Ref    string `json:"ref,omitempty"`
+	Commit string `json:"commit"`
+
+	// Path is the directory of the repository that is served, empty serves the root
+	Path string `json:"path,omitempty"`
+
+	// Entrypoint is the script run for every request, relative to Path. Empty serves a static site.
+	Entrypoint string `json:"entrypoint,omitempty"`
+}
+
+// contentTypePattern keeps the content types to a form that is safe in the nginx configuration
+// and in the shell wrapper of the scripts
+var contentTypePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.+-]*/[a-z0-9][a-z0-9.+-]*(; charset=[a-z0-9._-]+)?$`)
+
+// NormalizeContentType lowercases a content type and only keeps its charset parameter
+func NormalizeContentType(value string) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(value)
+	if err != nil {
+		return "", err
+	}
+
+	normalized := mediaType
+	if charset := params["charset"]; charset != "" {
+		normalized += "; charset=" + strings.ToLower(charset)
+	}
+
+	if !contentTypePattern.MatchString(normalized) {
+		return "", errors.New("unsupported content type " + value)
+	}
+
+	return normalized, nil
+}
+
+// Service is the persisted record of a service created through the API
+type Service struct {
+	Name        string      `json:"name"`
+	JobID       string      `json:"job_id"`
+	SourceURL   string      `json:"source_url"`
+	Mode        ServiceMode `json:"mode"`
+	ContentType string      `json:"content_type,omitempty"`
+	SPA         bool        `json:"spa,omitempty"`
+	Git         *GitSource  `json:"git,omitempty"`
+	SHA256      string      `json:"sha256,omitempty"`
+	Signature   string      `json:"signature,omitempty"`
+	Project     string      `json:"project"`
+	Owner       string      `json:"owner,omitempty"`
+	Spec        JobSpec     `json:"spec"`
+	Backends    []Backend   `json:"backends"`
+	Sleeping    bool        `json:"sleeping,omitempty"`
+	CreatedAt   time.Time   `json:"created_at"`
+	UpdatedAt   time.Time   `json:"updated_at"`
+	ExpiresAt   time.Time   `json:"expires_at,omitzero"`
+}
+
+// ServiceStore persists services so that routing survives restarts of the API
+type ServiceStore interface {
+	GetService(jobID string) (*Service, error)
+	ListServices() ([]*Service, error)
+	SaveService(service *Service) error
+	DeleteService(jobID string) error
+	Close() error
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
 	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
@@ -10,16 +12,73 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/alexisvisco/koyebtests/internal/config"
+	"github.com/alexisvisco/koyebtests/internal/gitsource"
 	"github.com/alexisvisco/koyebtests/internal/handler"
+	"github.com/alexisvisco/koyebtests/internal/integrity"
+	"github.com/alexisvisco/koyebtests/internal/netguard"
 	"github.com/alexisvisco/koyebtests/internal/service"
+	"github.com/alexisvisco/koyebtests/internal/store"
+	"github.com/alexisvisco/koyebtests/internal/types"
 	"github.com/hashicorp/nomad/api"
 )
 
 var (
-	host    = "koyebtest.alexisvis.co"
-	apiHost = "api.koyebtest.alexisvis.co"
+	host         = "koyebtest.alexisvis.co"
+	apiHost      = "api.koyebtest.alexisvis.co"
+	stateBackend = "file"
+	stateFile    = "koyebtest-state.json"
+
+	reconcileInterval = 30 * time.Second
+	readyTimeout      = 2 * time.Minute
+	reapInterval      = time.Minute
+
+	orphanPolicy   = service.OrphanPolicyAdopt
+	shutdownPolicy = service.ShutdownPolicyDetach
+	drainTimeout   = 3 * time.Minute
+
+	configFile       = ""
+	sourcePolicyFile = ""
+	signatureKeyFile = ""
+
+	auth        = "api_key"
+	adminAPIKey = ""
+
+	orchestrator    = "nomad"
+	localInitBinary = "bin/init"
+	localWorkDir    = ""
+
+	localAllowPrivateSources = false
+
+	loadBalancing = handler.LoadBalancingRoundRobin
+
+	idleTimeout = time.Duration(0)
+	wakeTimeout = time.Minute
+	wakingPage  = false
 )
 
+const (
+	// maxIdleCheckInterval bounds how late an idle service is scaled to zero
+	maxIdleCheckInterval = time.Minute
+
+	// gitResolveTimeout bounds the lookup of the commit of a git source while creating a service
+	gitResolveTimeout = 30 * time.Second
+)
+
+// stateStore persists the services and the API keys
+type stateStore interface {
+	types.ServiceStore
+	types.APIKeyStore
+}
+
+// orchestratedJobService is a job service backed by an orchestrator that must be kept in sync with the store
+type orchestratedJobService interface {
+	types.JobService
+	Reconcile() error
+	RunReconciler(ctx context.Context, interval time.Duration)
+	RunReaper(ctx context.Context, interval time.Duration)
+}
+
 func main() {
 	logger := slog.With("component", "main")
 
@@ -31,31 +90,273 @@ func main() {
 		apiHost = os.Getenv("API_HOST")
 	}
 
-	config := api.DefaultConfig()
+	if os.Getenv("CONFIG_FILE") != "" {
+		configFile = os.Getenv("CONFIG_FILE")
+	}
 
-	nomadClient, err := api.NewClient(config)
+	cfg := config.Default()
+	if configFile != "" {
+		var err error
+		cfg, err = config.Load(configFile)
+		if err != nil {
+			logger.Error("unable to load config", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if os.Getenv("SOURCE_POLICY_FILE") != "" {
+		sourcePolicyFile = os.Getenv("SOURCE_POLICY_FILE")
+	}
+
+	var sourcePolicy *netguard.Policy
+	if sourcePolicyFile != "" {
+		var err error
+		sourcePolicy, err = netguard.LoadPolicy(sourcePolicyFile)
+		if err != nil {
+			logger.Error("unable to load source policy", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if os.Getenv("SIGNATURE_PUBLIC_KEY_FILE") != "" {
+		signatureKeyFile = os.Getenv("SIGNATURE_PUBLIC_KEY_FILE")
+	}
+
+	var signatureKey ed25519.PublicKey
+	if signatureKeyFile != "" {
+		var err error
+		signatureKey, err = integrity.LoadPublicKey(signatureKeyFile)
+		if err != nil {
+			logger.Error("unable to load signature public key", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if os.Getenv("STATE_BACKEND") != "" {
+		stateBackend = os.Getenv("STATE_BACKEND")
+	}
+
+	if os.Getenv("STATE_FILE") != "" {
+		stateFile = os.Getenv("STATE_FILE")
+	}
+
+	serviceStore, err := newServiceStore(stateBackend, stateFile)
 	if err != nil {
-		logger.Error("unable to create Nomad client", "error", err)
+		logger.Error("unable to open state store", "backend", stateBackend, "error", err)
 		os.Exit(1)
 	}
 
-	_, err = nomadClient.Agent().Self()
-	if err != nil {
-		logger.Error("unable to connect to Nomad", "error", err)
-	} else {
-		logger.Info("successfully connected to Nomad", "address", nomadClient.Address())
+	if os.Getenv("AUTH") != "" {
+		auth = os.Getenv("AUTH")
+	}
+
+	if os.Getenv("ADMIN_API_KEY") != "" {
+		adminAPIKey = os.Getenv("ADMIN_API_KEY")
+	}
+
+	switch auth {
+	case "api_key":
+		if adminAPIKey == "" {
+			logger.Warn("ADMIN_API_KEY is not set, no API key can be created")
+		}
+	case "none":
+		logger.Warn("authentication is disabled, anyone reaching the API can create services")
+	default:
+		logger.Error("unknown auth mode", "auth", auth)
+		os.Exit(1)
+	}
+
+	if os.Getenv("RECONCILE_INTERVAL") != "" {
+		reconcileInterval, err = time.ParseDuration(os.Getenv("RECONCILE_INTERVAL"))
+		if err != nil {
+			logger.Error("invalid RECONCILE_INTERVAL", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if os.Getenv("READY_TIMEOUT") != "" {
+		readyTimeout, err = time.ParseDuration(os.Getenv("READY_TIMEOUT"))
+		if err != nil {
+			logger.Error("invalid READY_TIMEOUT", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if os.Getenv("REAP_INTERVAL") != "" {
+		reapInterval, err = time.ParseDuration(os.Getenv("REAP_INTERVAL"))
+		if err != nil {
+			logger.Error("invalid REAP_INTERVAL", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if os.Getenv("ORPHAN_POLICY") != "" {
+		orphanPolicy = service.OrphanPolicy(os.Getenv("ORPHAN_POLICY"))
+	}
+
+	switch orphanPolicy {
+	case service.OrphanPolicyAdopt, service.OrphanPolicySweep:
+	default:
+		logger.Error("unknown orphan policy", "orphan_policy", orphanPolicy)
+		os.Exit(1)
+	}
+
+	if os.Getenv("SHUTDOWN_POLICY") != "" {
+		shutdownPolicy = service.ShutdownPolicy(os.Getenv("SHUTDOWN_POLICY"))
+	}
+
+	switch shutdownPolicy {
+	case service.ShutdownPolicyPurge, service.ShutdownPolicyDetach, service.ShutdownPolicyDrain:
+	default:
+		logger.Error("unknown shutdown policy", "shutdown_policy", shutdownPolicy)
+		os.Exit(1)
+	}
+
+	if os.Getenv("DRAIN_TIMEOUT") != "" {
+		drainTimeout, err = time.ParseDuration(os.Getenv("DRAIN_TIMEOUT"))
+		if err != nil {
+			logger.Error("invalid DRAIN_TIMEOUT", "error", err)
+			os.Exit(1)
+		}
 	}
 
-	jobService := service.NewNomadJobService(host, nomadClient)
+	if os.Getenv("ORCHESTRATOR") != "" {
+		orchestrator = os.Getenv("ORCHESTRATOR")
+	}
+
+	if os.Getenv("LOCAL_INIT_BINARY") != "" {
+		localInitBinary = os.Getenv("LOCAL_INIT_BINARY")
+	}
+
+	if os.Getenv("LOCAL_WORK_DIR") != "" {
+		localWorkDir = os.Getenv("LOCAL_WORK_DIR")
+	}
+
+	if os.Getenv("LOCAL_ALLOW_PRIVATE_SOURCES") != "" {
+		localAllowPrivateSources = os.Getenv("LOCAL_ALLOW_PRIVATE_SOURCES") == "true"
+	}
+
+	if os.Getenv("LOAD_BALANCING") != "" {
+		loadBalancing = handler.LoadBalancing(os.Getenv("LOAD_BALANCING"))
+	}
+
+	switch loadBalancing {
+	case handler.LoadBalancingRoundRobin, handler.LoadBalancingLeastConnections:
+	default:
+		logger.Error("unknown load balancing strategy", "load_balancing", loadBalancing)
+		os.Exit(1)
+	}
+
+	if os.Getenv("IDLE_TIMEOUT") != "" {
+		idleTimeout, err = time.ParseDuration(os.Getenv("IDLE_TIMEOUT"))
+		if err != nil {
+			logger.Error("invalid IDLE_TIMEOUT", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if os.Getenv("WAKE_TIMEOUT") != "" {
+		wakeTimeout, err = time.ParseDuration(os.Getenv("WAKE_TIMEOUT"))
+		if err != nil {
+			logger.Error("invalid WAKE_TIMEOUT", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if os.Getenv("WAKING_PAGE") != "" {
+		wakingPage = os.Getenv("WAKING_PAGE") == "true"
+	}
+
+	backgroundCtx, stopBackground := context.WithCancel(context.Background())
+
+	// The event loop outlives the other background tasks, draining creations wait for its readiness events
+	eventsCtx, stopEvents := context.WithCancel(context.Background())
+
+	var jobService orchestratedJobService
+	switch orchestrator {
+	case "nomad":
+		nomadJobService, err := newNomadJobService(logger, serviceStore, cfg, sourcePolicy, signatureKey)
+		if err != nil {
+			logger.Error("unable to create job service", "error", err)
+			os.Exit(1)
+		}
+
+		go nomadJobService.RunEventLoop(eventsCtx)
+		jobService = nomadJobService
+	case "local":
+		jobService, err = service.NewLocalJobService(service.LocalJobServiceParams{
+			Host:         host,
+			Store:        serviceStore,
+			InitBinary:   localInitBinary,
+			WorkDir:      localWorkDir,
+			ReadyTimeout: readyTimeout,
+			JobConfig:    &cfg.Job,
+			Quota:        cfg.Quota,
+			ProjectQuota: cfg.ProjectQuota,
+			SourcePolicy: sourcePolicy,
+			SignatureKey: signatureKey,
+
+			AllowPrivateSources: localAllowPrivateSources,
+
+			ShutdownPolicy: shutdownPolicy,
+			DrainTimeout:   drainTimeout,
+		})
+		if err != nil {
+			logger.Error("unable to create job service", "error", err)
+			os.Exit(1)
+		}
+	default:
+		logger.Error("unknown orchestrator", "orchestrator", orchestrator)
+		os.Exit(1)
+	}
+
+	logger.Info("using orchestrator", "orchestrator", orchestrator)
+
+	if err := jobService.Reconcile(); err != nil {
+		logger.Error("unable to reconcile jobs", "error", err)
+	}
+
+	go jobService.RunReconciler(backgroundCtx, reconcileInterval)
+	go jobService.RunReaper(backgroundCtx, reapInterval)
+
+	var idleScaler *handler.IdleScaler
+	if idleTimeout > 0 {
+		idleScaler = handler.NewIdleScaler(handler.IdleScalerParams{
+			JobService:  jobService,
+			IdleTimeout: idleTimeout,
+		})
+		go idleScaler.Run(backgroundCtx, min(idleTimeout, maxIdleCheckInterval))
+	}
+
+	http.HandleFunc("GET /services", handler.ListServices(jobService))
+	gitResolver := &gitsource.Resolver{Client: netguard.NewHTTPClient(gitResolveTimeout, sourcePolicy)}
+	http.HandleFunc("PUT /services/{name}", handler.CreateJob(jobService, &netguard.Validator{Policy: sourcePolicy}, gitResolver))
+	http.HandleFunc("GET /services/{name}", handler.GetService(jobService))
+	http.HandleFunc("DELETE /services/{name}", handler.DeleteService(jobService))
+	http.HandleFunc("POST /services/{name}/restart", handler.RestartService(jobService))
+	http.HandleFunc("POST /services/{name}/extend", handler.ExtendService(jobService))
+	http.HandleFunc("GET /operations/{id}", handler.GetOperation(jobService))
+
+	var api http.Handler = http.DefaultServeMux
+	if auth == "api_key" {
+		http.HandleFunc("POST /api-keys", handler.RequireAdmin(handler.CreateAPIKey(serviceStore)))
+		http.HandleFunc("GET /api-keys", handler.RequireAdmin(handler.ListAPIKeys(serviceStore)))
+		http.HandleFunc("DELETE /api-keys/{id}", handler.RequireAdmin(handler.DeleteAPIKey(serviceStore)))
+
+		api = handler.Authenticate(handler.AuthParams{Keys: serviceStore, AdminKey: adminAPIKey}, http.DefaultServeMux)
+	}
 
 	mainHandler := handler.Main(handler.MainParams{
-		Host:       host,
-		ApiHost:    apiHost,
-		JobService: jobService,
+		Host:          host,
+		ApiHost:       apiHost,
+		JobService:    jobService,
+		API:           api,
+		LoadBalancing: loadBalancing,
+		Idle:          idleScaler,
+		WakeTimeout:   wakeTimeout,
+		WakingPage:    wakingPage,
 	})
 
-	http.HandleFunc("PUT /services/{name}", handler.CreateJob(jobService))
-
 	server := &http.Server{
 		Addr:    ":80",
 		Handler: mainHandler,
@@ -67,7 +368,7 @@ func main() {
 	go func() {
 		logger.Info("server starting", "port", server.Addr)
 		logger.Info("API endpoint", "host", apiHost)
-		logger.Info("subdomain reverse proxy", "pattern", "*."+host, "target", "localhost")
+		logger.Info("subdomain reverse proxy", "pattern", "*."+host, "target", "allocations")
 
 		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			logger.Error("server error", "error", err)
@@ -76,20 +377,78 @@ func main() {
 	}()
 
 	<-stop
-	logger.Info("shutdown signal received")
+	logger.Info("shutdown signal received", "shutdown_policy", shutdownPolicy)
+
+	stopBackground()
+
+	// Closed while the server still runs so that new creations are answered with shutting_down
+	// and the sites keep being served while the in-flight creations drain
+	// A failing step is logged and the next ones still run, the requests in flight finish and the store is flushed
+	failed := false
+	if err := jobService.Close(); err != nil {
+		logger.Error("error closing jobs", "error", err)
+		failed = true
+	}
+
+	stopEvents()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	if err := server.Shutdown(ctx); err != nil {
 		logger.Error("server forced to shutdown", "error", err)
-		os.Exit(1)
+		failed = true
 	}
 
-	if err := jobService.Close(); err != nil {
-		logger.Error("error closing jobs", "error", err)
+	if err := serviceStore.Close(); err != nil {
+		logger.Error("error closing state store", "error", err)
+		failed = true
+	}
+
+	if failed {
 		os.Exit(1)
 	}
 
 	logger.Info("server exited gracefully")
 }
+
+func newNomadJobService(logger *slog.Logger, serviceStore types.ServiceStore, cfg config.Config, sourcePolicy *netguard.Policy, signatureKey ed25519.PublicKey) (*service.NomadJobService, error) {
+	nomadClient, err := api.NewClient(api.DefaultConfig())
+	if err != nil {
+		return nil, fmt.Errorf("unable to create Nomad client: %w", err)
+	}
+
+	_, err = nomadClient.Agent().Self()
+	if err != nil {
+		logger.Error("unable to connect to Nomad", "error", err)
+	} else {
+		logger.Info("successfully connected to Nomad", "address", nomadClient.Address())
+	}
+
+	return service.NewNomadJobService(service.NomadJobServiceParams{
+		Host:         host,
+		Client:       nomadClient,
+		Store:        serviceStore,
+		ReadyTimeout: readyTimeout,
+		JobConfig:    &cfg.Job,
+		Quota:        cfg.Quota,
+		ProjectQuota: cfg.ProjectQuota,
+		OrphanPolicy: orphanPolicy,
+		SourcePolicy: sourcePolicy,
+		SignatureKey: signatureKey,
+
+		ShutdownPolicy: shutdownPolicy,
+		DrainTimeout:   drainTimeout,
+	})
+}
+
+func newServiceStore(backend string, path string) (stateStore, error) {
+	switch backend {
+	case "file":
+		return store.NewFileStore(path)
+	case "memory":
+		return store.NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown state backend %q", backend)
+	}
+}
@@ -3,6 +3,8 @@
 package mocks
 
 import (
+	context "context"
+
 	types "github.com/alexisvisco/koyebtests/internal/types"
 	mock "github.com/stretchr/testify/mock"
 )
@@ -65,9 +67,9 @@ func (_c *JobService_Close_Call) RunAndReturn(run func() error) *JobService_Clos
 	return _c
 }
 
-// CreateJob provides a mock function with given fields: name, targetURL, isScript
-func (_m *JobService) CreateJob(name string, targetURL string, isScript bool) (*types.CreateJobOutput, error) {
-	ret := _m.Called(name, targetURL, isScript)
+// CreateJob provides a mock function with given fields: input
+func (_m *JobService) CreateJob(input types.CreateJobInput) (*types.CreateJobOutput, error) {
+	ret := _m.Called(input)
 
 	if len(ret) == 0 {
 		panic("no return value specified for CreateJob")
@@ -75,19 +77,19 @@ func (_m *JobService) CreateJob(name string, targetURL string, isScript bool) (*
 
 	var r0 *types.CreateJobOutput
 	var r1 error
-	if rf, ok := ret.Get(0).(func(string, string, bool) (*types.CreateJobOutput, error)); ok {
-		return rf(name, targetURL, isScript)
+	if rf, ok := ret.Get(0).(func(types.CreateJobInput) (*types.CreateJobOutput, error)); ok {
+		return rf(input)
 	}
-	if rf, ok := ret.Get(0).(func(string, string, bool) *types.CreateJobOutput); ok {
-		r0 = rf(name, targetURL, isScript)
+	if rf, ok := ret.Get(0).(func(types.CreateJobInput) *types.CreateJobOutput); ok {
+		r0 = rf(input)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).(*types.CreateJobOutput)
 		}
 	}
 
-	if rf, ok := ret.Get(1).(func(string, string, bool) error); ok {
-		r1 = rf(name, targetURL, isScript)
+	if rf, ok := ret.Get(1).(func(types.CreateJobInput) error); ok {
+		r1 = rf(input)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -101,16 +103,14 @@ type JobService_CreateJob_Call struct {
 }
 
 // CreateJob is a helper method to define mock.On call
-//   - name string
-//   - targetURL string
-//   - isScript bool
-func (_e *JobService_Expecter) CreateJob(name interface{}, targetURL interface{}, isScript interface{}) *JobService_CreateJob_Call {
-	return &JobService_CreateJob_Call{Call: _e.mock.On("CreateJob", name, targetURL, isScript)}
+//   - input types.CreateJobInput
+func (_e *JobService_Expecter) CreateJob(input interface{}) *JobService_CreateJob_Call {
+	return &JobService_CreateJob_Call{Call: _e.mock.On("CreateJob", input)}
 }
 
-func (_c *JobService_CreateJob_Call) Run(run func(name string, targetURL string, isScript bool)) *JobService_CreateJob_Call {
+func (_c *JobService_CreateJob_Call) Run(run func(input types.CreateJobInput)) *JobService_CreateJob_Call {
 	_c.Call.Run(func(args mock.Arguments) {
-		run(args[0].(string), args[1].(string), args[2].(bool))
+		run(args[0].(types.CreateJobInput))
 	})
 	return _c
 }
@@ -120,28 +120,90 @@ func (_c *JobService_CreateJob_Call) Return(_a0 *types.CreateJobOutput, _a1 erro
 	return _c
 }
 
-func (_c *JobService_CreateJob_Call) RunAndReturn(run func(string, string, bool) (*types.CreateJobOutput, error)) *JobService_CreateJob_Call {
+func (_c *JobService_CreateJob_Call) RunAndReturn(run func(types.CreateJobInput) (*types.CreateJobOutput, error)) *JobService_CreateJob_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// ExtendService provides a mock function with given fields: project, name, input
+func (_m *JobService) ExtendService(project string, name string, input types.ExtendServiceInput) (*types.ServiceOutput, error) {
+	ret := _m.Called(project, name, input)
+
+	if len(ret) == 0 {
+		panic("no return value specified for ExtendService")
+	}
+
+	var r0 *types.ServiceOutput
+	var r1 error
+	if rf, ok := ret.Get(0).(func(string, string, types.ExtendServiceInput) (*types.ServiceOutput, error)); ok {
+		return rf(project, name, input)
+	}
+	if rf, ok := ret.Get(0).(func(string, string, types.ExtendServiceInput) *types.ServiceOutput); ok {
+		r0 = rf(project, name, input)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*types.ServiceOutput)
+		}
+	}
+
+	if rf, ok := ret.Get(1).(func(string, string, types.ExtendServiceInput) error); ok {
+		r1 = rf(project, name, input)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// JobService_ExtendService_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'ExtendService'
+type JobService_ExtendService_Call struct {
+	*mock.Call
+}
+
+// ExtendService is a helper method to define mock.On call
+//   - project string
+//   - name string
+//   - input types.ExtendServiceInput
+func (_e *JobService_Expecter) ExtendService(project interface{}, name interface{}, input interface{}) *JobService_ExtendService_Call {
+	return &JobService_ExtendService_Call{Call: _e.mock.On("ExtendService", project, name, input)}
+}
+
+func (_c *JobService_ExtendService_Call) Run(run func(project string, name string, input types.ExtendServiceInput)) *JobService_ExtendService_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(string), args[1].(string), args[2].(types.ExtendServiceInput))
+	})
+	return _c
+}
+
+func (_c *JobService_ExtendService_Call) Return(_a0 *types.ServiceOutput, _a1 error) *JobService_ExtendService_Call {
+	_c.Call.Return(_a0, _a1)
+	return _c
+}
+
+func (_c *JobService_ExtendService_Call) RunAndReturn(run func(string, string, types.ExtendServiceInput) (*types.ServiceOutput, error)) *JobService_ExtendService_Call {
 	_c.Call.Return(run)
 	return _c
 }
 
-// GetJobPort provides a mock function with given fields: jobID
-func (_m *JobService) GetJobPort(jobID string) (int, bool) {
+// GetJobBackends provides a mock function with given fields: jobID
+func (_m *JobService) GetJobBackends(jobID string) ([]types.Backend, bool) {
 	ret := _m.Called(jobID)
 
 	if len(ret) == 0 {
-		panic("no return value specified for GetJobPort")
+		panic("no return value specified for GetJobBackends")
 	}
 
-	var r0 int
+	var r0 []types.Backend
 	var r1 bool
-	if rf, ok := ret.Get(0).(func(string) (int, bool)); ok {
+	if rf, ok := ret.Get(0).(func(string) ([]types.Backend, bool)); ok {
 		return rf(jobID)
 	}
-	if rf, ok := ret.Get(0).(func(string) int); ok {
+	if rf, ok := ret.Get(0).(func(string) []types.Backend); ok {
 		r0 = rf(jobID)
 	} else {
-		r0 = ret.Get(0).(int)
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]types.Backend)
+		}
 	}
 
 	if rf, ok := ret.Get(1).(func(string) bool); ok {
@@ -153,30 +215,204 @@ func (_m *JobService) GetJobPort(jobID string) (int, bool) {
 	return r0, r1
 }
 
-// JobService_GetJobPort_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'GetJobPort'
-type JobService_GetJobPort_Call struct {
+// JobService_GetJobBackends_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'GetJobBackends'
+type JobService_GetJobBackends_Call struct {
 	*mock.Call
 }
 
-// GetJobPort is a helper method to define mock.On call
+// GetJobBackends is a helper method to define mock.On call
 //   - jobID string
-func (_e *JobService_Expecter) GetJobPort(jobID interface{}) *JobService_GetJobPort_Call {
-	return &JobService_GetJobPort_Call{Call: _e.mock.On("GetJobPort", jobID)}
+func (_e *JobService_Expecter) GetJobBackends(jobID interface{}) *JobService_GetJobBackends_Call {
+	return &JobService_GetJobBackends_Call{Call: _e.mock.On("GetJobBackends", jobID)}
+}
+
+func (_c *JobService_GetJobBackends_Call) Run(run func(jobID string)) *JobService_GetJobBackends_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(string))
+	})
+	return _c
+}
+
+func (_c *JobService_GetJobBackends_Call) Return(_a0 []types.Backend, _a1 bool) *JobService_GetJobBackends_Call {
+	_c.Call.Return(_a0, _a1)
+	return _c
+}
+
+func (_c *JobService_GetJobBackends_Call) RunAndReturn(run func(string) ([]types.Backend, bool)) *JobService_GetJobBackends_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// GetOperation provides a mock function with given fields: id
+func (_m *JobService) GetOperation(id string) (*types.Operation, error) {
+	ret := _m.Called(id)
+
+	if len(ret) == 0 {
+		panic("no return value specified for GetOperation")
+	}
+
+	var r0 *types.Operation
+	var r1 error
+	if rf, ok := ret.Get(0).(func(string) (*types.Operation, error)); ok {
+		return rf(id)
+	}
+	if rf, ok := ret.Get(0).(func(string) *types.Operation); ok {
+		r0 = rf(id)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*types.Operation)
+		}
+	}
+
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(id)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// JobService_GetOperation_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'GetOperation'
+type JobService_GetOperation_Call struct {
+	*mock.Call
 }
 
-func (_c *JobService_GetJobPort_Call) Run(run func(jobID string)) *JobService_GetJobPort_Call {
+// GetOperation is a helper method to define mock.On call
+//   - id string
+func (_e *JobService_Expecter) GetOperation(id interface{}) *JobService_GetOperation_Call {
+	return &JobService_GetOperation_Call{Call: _e.mock.On("GetOperation", id)}
+}
+
+func (_c *JobService_GetOperation_Call) Run(run func(id string)) *JobService_GetOperation_Call {
 	_c.Call.Run(func(args mock.Arguments) {
 		run(args[0].(string))
 	})
 	return _c
 }
 
-func (_c *JobService_GetJobPort_Call) Return(_a0 int, _a1 bool) *JobService_GetJobPort_Call {
+func (_c *JobService_GetOperation_Call) Return(_a0 *types.Operation, _a1 error) *JobService_GetOperation_Call {
+	_c.Call.Return(_a0, _a1)
+	return _c
+}
+
+func (_c *JobService_GetOperation_Call) RunAndReturn(run func(string) (*types.Operation, error)) *JobService_GetOperation_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// GetService provides a mock function with given fields: project, name
+func (_m *JobService) GetService(project string, name string) (*types.ServiceOutput, error) {
+	ret := _m.Called(project, name)
+
+	if len(ret) == 0 {
+		panic("no return value specified for GetService")
+	}
+
+	var r0 *types.ServiceOutput
+	var r1 error
+	if rf, ok := ret.Get(0).(func(string, string) (*types.ServiceOutput, error)); ok {
+		return rf(project, name)
+	}
+	if rf, ok := ret.Get(0).(func(string, string) *types.ServiceOutput); ok {
+		r0 = rf(project, name)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*types.ServiceOutput)
+		}
+	}
+
+	if rf, ok := ret.Get(1).(func(string, string) error); ok {
+		r1 = rf(project, name)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// JobService_GetService_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'GetService'
+type JobService_GetService_Call struct {
+	*mock.Call
+}
+
+// GetService is a helper method to define mock.On call
+//   - project string
+//   - name string
+func (_e *JobService_Expecter) GetService(project interface{}, name interface{}) *JobService_GetService_Call {
+	return &JobService_GetService_Call{Call: _e.mock.On("GetService", project, name)}
+}
+
+func (_c *JobService_GetService_Call) Run(run func(project string, name string)) *JobService_GetService_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(string), args[1].(string))
+	})
+	return _c
+}
+
+func (_c *JobService_GetService_Call) Return(_a0 *types.ServiceOutput, _a1 error) *JobService_GetService_Call {
 	_c.Call.Return(_a0, _a1)
 	return _c
 }
 
-func (_c *JobService_GetJobPort_Call) RunAndReturn(run func(string) (int, bool)) *JobService_GetJobPort_Call {
+func (_c *JobService_GetService_Call) RunAndReturn(run func(string, string) (*types.ServiceOutput, error)) *JobService_GetService_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// ListServices provides a mock function with no fields
+func (_m *JobService) ListServices() ([]*types.ServiceOutput, error) {
+	ret := _m.Called()
+
+	if len(ret) == 0 {
+		panic("no return value specified for ListServices")
+	}
+
+	var r0 []*types.ServiceOutput
+	var r1 error
+	if rf, ok := ret.Get(0).(func() ([]*types.ServiceOutput, error)); ok {
+		return rf()
+	}
+	if rf, ok := ret.Get(0).(func() []*types.ServiceOutput); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]*types.ServiceOutput)
+		}
+	}
+
+	if rf, ok := ret.Get(1).(func() error); ok {
+		r1 = rf()
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// JobService_ListServices_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'ListServices'
+type JobService_ListServices_Call struct {
+	*mock.Call
+}
+
+// ListServices is a helper method to define mock.On call
+func (_e *JobService_Expecter) ListServices() *JobService_ListServices_Call {
+	return &JobService_ListServices_Call{Call: _e.mock.On("ListServices")}
+}
+
+func (_c *JobService_ListServices_Call) Run(run func()) *JobService_ListServices_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run()
+	})
+	return _c
+}
+
+func (_c *JobService_ListServices_Call) Return(_a0 []*types.ServiceOutput, _a1 error) *JobService_ListServices_Call {
+	_c.Call.Return(_a0, _a1)
+	return _c
+}
+
+func (_c *JobService_ListServices_Call) RunAndReturn(run func() ([]*types.ServiceOutput, error)) *JobService_ListServices_Call {
 	_c.Call.Return(run)
 	return _c
 }
@@ -227,6 +463,214 @@ func (_c *JobService_PurgeJob_Call) RunAndReturn(run func(string) error) *JobSer
 	return _c
 }
 
+// ResolveSubdomain provides a mock function with given fields: project, label
+func (_m *JobService) ResolveSubdomain(project string, label string) (string, bool) {
+	ret := _m.Called(project, label)
+
+	if len(ret) == 0 {
+		panic("no return value specified for ResolveSubdomain")
+	}
+
+	var r0 string
+	var r1 bool
+	if rf, ok := ret.Get(0).(func(string, string) (string, bool)); ok {
+		return rf(project, label)
+	}
+	if rf, ok := ret.Get(0).(func(string, string) string); ok {
+		r0 = rf(project, label)
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	if rf, ok := ret.Get(1).(func(string, string) bool); ok {
+		r1 = rf(project, label)
+	} else {
+		r1 = ret.Get(1).(bool)
+	}
+
+	return r0, r1
+}
+
+// JobService_ResolveSubdomain_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'ResolveSubdomain'
+type JobService_ResolveSubdomain_Call struct {
+	*mock.Call
+}
+
+// ResolveSubdomain is a helper method to define mock.On call
+//   - project string
+//   - label string
+func (_e *JobService_Expecter) ResolveSubdomain(project interface{}, label interface{}) *JobService_ResolveSubdomain_Call {
+	return &JobService_ResolveSubdomain_Call{Call: _e.mock.On("ResolveSubdomain", project, label)}
+}
+
+func (_c *JobService_ResolveSubdomain_Call) Run(run func(project string, label string)) *JobService_ResolveSubdomain_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(string), args[1].(string))
+	})
+	return _c
+}
+
+func (_c *JobService_ResolveSubdomain_Call) Return(_a0 string, _a1 bool) *JobService_ResolveSubdomain_Call {
+	_c.Call.Return(_a0, _a1)
+	return _c
+}
+
+func (_c *JobService_ResolveSubdomain_Call) RunAndReturn(run func(string, string) (string, bool)) *JobService_ResolveSubdomain_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// RestartJob provides a mock function with given fields: jobID
+func (_m *JobService) RestartJob(jobID string) error {
+	ret := _m.Called(jobID)
+
+	if len(ret) == 0 {
+		panic("no return value specified for RestartJob")
+	}
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string) error); ok {
+		r0 = rf(jobID)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// JobService_RestartJob_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'RestartJob'
+type JobService_RestartJob_Call struct {
+	*mock.Call
+}
+
+// RestartJob is a helper method to define mock.On call
+//   - jobID string
+func (_e *JobService_Expecter) RestartJob(jobID interface{}) *JobService_RestartJob_Call {
+	return &JobService_RestartJob_Call{Call: _e.mock.On("RestartJob", jobID)}
+}
+
+func (_c *JobService_RestartJob_Call) Run(run func(jobID string)) *JobService_RestartJob_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(string))
+	})
+	return _c
+}
+
+func (_c *JobService_RestartJob_Call) Return(_a0 error) *JobService_RestartJob_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *JobService_RestartJob_Call) RunAndReturn(run func(string) error) *JobService_RestartJob_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// ScaleDown provides a mock function with given fields: jobID
+func (_m *JobService) ScaleDown(jobID string) error {
+	ret := _m.Called(jobID)
+
+	if len(ret) == 0 {
+		panic("no return value specified for ScaleDown")
+	}
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string) error); ok {
+		r0 = rf(jobID)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// JobService_ScaleDown_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'ScaleDown'
+type JobService_ScaleDown_Call struct {
+	*mock.Call
+}
+
+// ScaleDown is a helper method to define mock.On call
+//   - jobID string
+func (_e *JobService_Expecter) ScaleDown(jobID interface{}) *JobService_ScaleDown_Call {
+	return &JobService_ScaleDown_Call{Call: _e.mock.On("ScaleDown", jobID)}
+}
+
+func (_c *JobService_ScaleDown_Call) Run(run func(jobID string)) *JobService_ScaleDown_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(string))
+	})
+	return _c
+}
+
+func (_c *JobService_ScaleDown_Call) Return(_a0 error) *JobService_ScaleDown_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *JobService_ScaleDown_Call) RunAndReturn(run func(string) error) *JobService_ScaleDown_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// WakeJob provides a mock function with given fields: ctx, jobID
+func (_m *JobService) WakeJob(ctx context.Context, jobID string) ([]types.Backend, error) {
+	ret := _m.Called(ctx, jobID)
+
+	if len(ret) == 0 {
+		panic("no return value specified for WakeJob")
+	}
+
+	var r0 []types.Backend
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context, string) ([]types.Backend, error)); ok {
+		return rf(ctx, jobID)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, string) []types.Backend); ok {
+		r0 = rf(ctx, jobID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]types.Backend)
+		}
+	}
+
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, jobID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// JobService_WakeJob_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'WakeJob'
+type JobService_WakeJob_Call struct {
+	*mock.Call
+}
+
+// WakeJob is a helper method to define mock.On call
+//   - ctx context.Context
+//   - jobID string
+func (_e *JobService_Expecter) WakeJob(ctx interface{}, jobID interface{}) *JobService_WakeJob_Call {
+	return &JobService_WakeJob_Call{Call: _e.mock.On("WakeJob", ctx, jobID)}
+}
+
+func (_c *JobService_WakeJob_Call) Run(run func(ctx context.Context, jobID string)) *JobService_WakeJob_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(context.Context), args[1].(string))
+	})
+	return _c
+}
+
+func (_c *JobService_WakeJob_Call) Return(_a0 []types.Backend, _a1 error) *JobService_WakeJob_Call {
+	_c.Call.Return(_a0, _a1)
+	return _c
+}
+
+func (_c *JobService_WakeJob_Call) RunAndReturn(run func(context.Context, string) ([]types.Backend, error)) *JobService_WakeJob_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
 // NewJobService creates a new instance of JobService. It also registers a testing interface on the mock and a cleanup function to assert the mocks expectations.
 // The first argument is typically a *testing.T value.
 func NewJobService(t interface {